@@ -2,16 +2,40 @@
 package accesslog
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var (
+	requests = metrics.NewCounter("metaphite_http_requests_total",
+		"HTTP requests served, by route and status code.", "path", "code")
+	duration = metrics.NewHistogram("metaphite_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route.", nil, "path")
 )
 
 // Handler wraps an existing http.Handler and logs any requests
 // routed along to the handler, in the following format:
 //
-// 	127.0.0.1 user-identifier frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
+// 	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /render?target=a.b HTTP/1.0" 200 2326 "-" "curl/8.0" 0.052 "a=0.041"
+//
+// That is the Combined Log Format, followed by the time taken to
+// serve the request, in seconds, and the time spent waiting for
+// each backend, as recorded with Upstream, or "-" if none were.
 //
 // Output is logged to the dest parameter. If dest is nil, the default
 // logger of the log package is used.
@@ -19,6 +43,121 @@ func Handler(existing http.Handler, dest Logger) http.Handler {
 	return handler{handler: existing, dest: dest}
 }
 
+// Options change the way requests are logged.
+type Options struct {
+	// If set, each request is logged as a structured record
+	// through Logger, with its fields and any annotations as
+	// attributes, instead of in the Common Log Format. The
+	// record's message is "request".
+	Logger *slog.Logger
+	// If Format is "json" and Logger is nil, each request is
+	// logged to dest as a JSON object on a line of its own,
+	// with the same fields as a structured record:
+	//
+	// 	{"time":"2024-05-01T12:00:00Z","level":"INFO","msg":"request","remote":"10.1.2.3","method":"GET",...}
+	//
+	// The default, "", is the Common Log Format.
+	Format string
+	// If greater than 1, only one in Sample successful requests
+	// is logged. Requests that fail, with a status of 400 or
+	// more, are always logged, and so are slow ones.
+	Sample int
+	// When sampling, requests that take longer than this are
+	// always logged. If zero, they are sampled like the rest.
+	SlowRequest time.Duration
+	// For requests from these networks, the client address is
+	// taken from the X-Forwarded-For header, or, failing that,
+	// the X-Real-IP header. X-Forwarded-For is read from right
+	// to left, skipping the addresses of trusted proxies.
+	TrustedProxies []*net.IPNet
+	// Log the client's port along with its address, as in
+	// "[2001:db8::1]:52114". The port of a forwarded client
+	// is not known.
+	LogPort bool
+	// Requests are counted in metrics under Route, such as
+	// the ServeMux pattern the handler is registered with,
+	// rather than their path, so that clients cannot create
+	// a series for every path they request. If empty, the
+	// pattern that matched the request is used, or "other".
+	Route string
+}
+
+// New is like Handler, with the given options.
+func New(existing http.Handler, dest Logger, opts Options) http.Handler {
+	h := handler{handler: existing, dest: dest, opts: opts, seen: new(uint64)}
+	if opts.Format == "json" && opts.Logger == nil {
+		h.opts.Logger = slog.New(slog.NewJSONHandler(lineWriter{h}, nil))
+	}
+	return h
+}
+
+// A lineWriter writes each line written to it to the access
+// log's destination.
+type lineWriter struct {
+	h handler
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w.h.logf("%s", bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
+
+type annotationKey struct{}
+
+type annotations struct {
+	mu       sync.Mutex
+	attrs    []slog.Attr
+	upstream []upstreamTime
+}
+
+type upstreamTime struct {
+	name string
+	d    time.Duration
+}
+
+func (a *annotations) list() []slog.Attr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.attrs
+}
+
+func (a *annotations) upstreams() []upstreamTime {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.upstream
+}
+
+// Annotate adds a field to the access log entry for r, such as
+// the backend a request was sent to. It has no effect on requests
+// that are not logged by a structured access log handler.
+func Annotate(r *http.Request, key string, value interface{}) {
+	if a, ok := r.Context().Value(annotationKey{}).(*annotations); ok {
+		a.mu.Lock()
+		a.attrs = append(a.attrs, slog.Any(key, value))
+		a.mu.Unlock()
+	}
+}
+
+// Upstream records that d was spent waiting for the backend name
+// while serving r. Times recorded for the same backend, such as
+// when a request is split across several of its servers, are
+// added together.
+func Upstream(r *http.Request, name string, d time.Duration) {
+	a, ok := r.Context().Value(annotationKey{}).(*annotations)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.upstream {
+		if a.upstream[i].name == name {
+			a.upstream[i].d += d
+			return
+		}
+	}
+	a.upstream = append(a.upstream, upstreamTime{name, d})
+}
+
 // Types implementing the Logger interface can be used as destinations
 // for access log messages. The Printf method must be safe for concurrent
 // use among multiple goroutines.
@@ -29,6 +168,82 @@ type Logger interface {
 type handler struct {
 	handler http.Handler
 	dest    Logger
+	opts    Options
+	seen    *uint64 // sampled requests
+}
+
+func trusted(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client returns the address of the client that made r, as
+// ClientAddr does, with its port if LogPort is set.
+func (h handler) client(r *http.Request) string {
+	peer, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// such as a unix socket, with no port
+		peer, port = r.RemoteAddr, ""
+	}
+	if peer == "" {
+		peer = "-"
+	}
+	if len(h.opts.TrustedProxies) == 0 || !trusted(h.opts.TrustedProxies, net.ParseIP(peer)) {
+		if h.opts.LogPort && port != "" {
+			return net.JoinHostPort(peer, port)
+		}
+		return peer
+	}
+	return ClientAddr(r, h.opts.TrustedProxies)
+}
+
+// ClientAddr returns the address of the client that made r. If
+// the peer is in one of the trusted networks, that is the
+// address it forwarded the request for, as described for
+// Options.TrustedProxies.
+func ClientAddr(r *http.Request, trustedProxies []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if len(trustedProxies) == 0 || !trusted(trustedProxies, net.ParseIP(peer)) {
+		return peer
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(s))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		if i == 0 || !trusted(trustedProxies, ip) {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// sampled reports whether a request that got the given status
+// and took d to serve should be logged.
+func (h handler) sampled(status int, d time.Duration) bool {
+	if h.opts.Sample <= 1 || status >= 400 {
+		return true
+	}
+	if h.opts.SlowRequest > 0 && d > h.opts.SlowRequest {
+		return true
+	}
+	return atomic.AddUint64(h.seen, 1)%uint64(h.opts.Sample) == 1
 }
 
 func (h handler) logf(format string, v ...interface{}) {
@@ -50,16 +265,70 @@ func (w *responseWriter) WriteHeader(status int) {
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
 	n, err := w.ResponseWriter.Write(b)
 	w.n += n
 	return n, err
 }
 
+// The methods below pass optional interfaces of the underlying
+// ResponseWriter through, so that wrapping a handler does not
+// change its behavior.
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("accesslog: connection cannot be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		// hide ReadFrom, so that io.Copy does not call it again
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := rf.ReadFrom(src)
+	w.n += int(n)
+	return n, err
+}
+
+func (w *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// ResponseWriter.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// From https://en.wikipedia.org/wiki/Common_Log_Format
 	//
 	// 127.0.0.1 user-identifier frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
-	const format = "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\""
+	const format = "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %.3f \"%s\""
 	const layout = "2/Jan/2006:15:04:05 -0700"
 
 	uri := r.URL.RequestURI()
@@ -73,13 +342,62 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	shim := responseWriter{ResponseWriter: w}
+	notes := new(annotations)
+	r = r.WithContext(context.WithValue(r.Context(), annotationKey{}, notes))
 
-	//start := time.Now()
+	start := time.Now()
 	h.handler.ServeHTTP(&shim, r)
 	end := time.Now()
+	if shim.status == 0 {
+		// nothing was written, which the server sends as an
+		// empty 200 response
+		shim.status = http.StatusOK
+	}
 
+	route := h.opts.Route
+	if route == "" {
+		route = r.Pattern
+	}
+	if route == "" {
+		route = "other"
+	}
+	requests.Inc(route, strconv.Itoa(shim.status))
+	duration.Observe(end.Sub(start).Seconds(), route)
+
+	if !h.sampled(shim.status, end.Sub(start)) {
+		return
+	}
+	upstream := notes.upstreams()
+	if h.opts.Logger != nil {
+		var timing []interface{}
+		for _, u := range upstream {
+			timing = append(timing, slog.Float64(u.name, u.d.Seconds()))
+		}
+		attrs := append([]slog.Attr{
+			slog.String("remote", h.client(r)),
+			slog.String("method", r.Method),
+			slog.String("uri", uri),
+			slog.String("proto", r.Proto),
+			slog.Int("status", shim.status),
+			slog.Int("bytes", shim.n),
+			slog.String("referer", referer),
+			slog.String("user_agent", userAgent),
+			slog.Float64("duration", end.Sub(start).Seconds()),
+			slog.Group("upstream", timing...),
+		}, notes.list()...)
+		h.opts.Logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		return
+	}
+	timing := "-"
+	if len(upstream) > 0 {
+		var list []string
+		for _, u := range upstream {
+			list = append(list, fmt.Sprintf("%s=%.3f", u.name, u.d.Seconds()))
+		}
+		timing = strings.Join(list, " ")
+	}
 	h.logf(format,
-		strings.Split(r.RemoteAddr, ":")[0],
+		h.client(r),
 		end.Format(layout),
 		r.Method,
 		uri,
@@ -87,5 +405,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		shim.status,
 		shim.n,
 		referer,
-		userAgent)
+		userAgent,
+		end.Sub(start).Seconds(),
+		timing)
 }
@@ -0,0 +1,259 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+func TestStructured(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Annotate(r, "backend", "prod")
+		Upstream(r, "prod", 10*time.Millisecond)
+		Upstream(r, "prod", 20*time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}), nil, Options{Logger: logger})
+
+	r := httptest.NewRequest("GET", "/render?target=prod.cpu", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%s: %v", buf.Bytes(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"msg":     "request",
+		"remote":  "10.1.2.3",
+		"uri":     "/render?target=prod.cpu",
+		"status":  float64(418),
+		"bytes":   float64(15),
+		"backend": "prod",
+	} {
+		if entry[k] != want {
+			t.Errorf("%s = %v, want %v", k, entry[k], want)
+		}
+	}
+	if _, ok := entry["duration"].(float64); !ok {
+		t.Errorf("no duration in %s", buf.Bytes())
+	}
+	upstream, _ := entry["upstream"].(map[string]interface{})
+	if upstream["prod"] != 0.03 {
+		t.Errorf("upstream = %v, want map[prod:0.03]", entry["upstream"])
+	}
+}
+
+type printer struct{ lines []string }
+
+func (p *printer) Printf(format string, v ...interface{}) {
+	p.lines = append(p.lines, fmt.Sprintf(format, v...))
+}
+
+func TestCommon(t *testing.T) {
+	var p printer
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upstream(r, "dev", 5*time.Millisecond)
+		Upstream(r, "prod", 12*time.Millisecond)
+		w.Write([]byte("ok"))
+	}), &p)
+
+	r := httptest.NewRequest("GET", "/render?target=sumSeries(dev.a,prod.b)", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(p.lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(p.lines))
+	}
+	line := p.lines[0]
+	if !strings.HasPrefix(line, "10.1.2.3 - - [") ||
+		!strings.Contains(line, `"GET /render?target=sumSeries(dev.a,prod.b) HTTP/1.1" 200 2 "-" "-" `) ||
+		!strings.HasSuffix(line, ` "dev=0.005 prod=0.012"`) {
+		t.Errorf("unexpected log line %s", line)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var p printer
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Annotate(r, "backend", "dev")
+		w.Write([]byte("ok"))
+	}), &p, Options{Format: "json"})
+
+	r := httptest.NewRequest("GET", "/render?target=dev.a", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(p.lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(p.lines))
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(p.lines[0]), &entry); err != nil {
+		t.Fatalf("%s: %v", p.lines[0], err)
+	}
+	if entry["uri"] != "/render?target=dev.a" || entry["backend"] != "dev" {
+		t.Errorf("unexpected entry %s", p.lines[0])
+	}
+}
+
+func TestSample(t *testing.T) {
+	var p printer
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/slow":
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}), &p, Options{Sample: 10, SlowRequest: 10 * time.Millisecond})
+
+	for _, path := range []string{"/ok", "/ok", "/fail", "/slow"} {
+		for i := 0; i < 10; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+	// 2 of 20 successful requests, 10 failed and 10 slow ones
+	if len(p.lines) != 22 {
+		t.Errorf("logged %d requests, want 22:\n%s", len(p.lines), strings.Join(p.lines, "\n"))
+	}
+}
+
+func TestClient(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	h := New(http.NotFoundHandler(), nil, Options{TrustedProxies: []*net.IPNet{lb}}).(handler)
+	tests := []struct {
+		peer, forwarded, realIP, want string
+	}{
+		{"192.0.2.1:4000", "198.51.100.7", "", "192.0.2.1"},
+		{"10.1.1.1:4000", "", "", "10.1.1.1"},
+		{"10.1.1.1:4000", "198.51.100.7", "", "198.51.100.7"},
+		{"10.1.1.1:4000", "203.0.113.9, 198.51.100.7, 10.2.2.2", "", "198.51.100.7"},
+		{"10.1.1.1:4000", "10.3.3.3, 10.2.2.2", "", "10.3.3.3"},
+		{"10.1.1.1:4000", "", "198.51.100.8", "198.51.100.8"},
+		{"10.1.1.1:4000", "bogus", "", "10.1.1.1"},
+		{"[2001:db8::1]:4000", "198.51.100.7", "", "2001:db8::1"},
+		{"10.1.1.1:4000", "2001:db8::2", "", "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := h.client(r); got != tt.want {
+			t.Errorf("peer %s, X-Forwarded-For %q, X-Real-IP %q: got %s, want %s",
+				tt.peer, tt.forwarded, tt.realIP, got, tt.want)
+		}
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	var p printer
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("ResponseWriter is not a Hijacker")
+		}
+		io.Copy(w, strings.NewReader("streamed"))
+		w.(http.Flusher).Flush()
+	}), &p)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Error("response was not flushed")
+	}
+	if rec.Body.String() != "streamed" {
+		t.Errorf("got body %q", rec.Body)
+	}
+	if len(p.lines) != 1 || !strings.Contains(p.lines[0], `" 200 8 "`) {
+		t.Errorf("unexpected log %q", p.lines)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := OpenFile(path, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Printf("first %d", 1)
+	f.Printf("second %d", 2)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second 2\n" {
+		t.Errorf("%s contains %q after rotation", path, data)
+	}
+	old, _ := filepath.Glob(path + ".*")
+	if len(old) != 1 {
+		t.Fatalf("found rotated files %q, want one", old)
+	}
+	if data, _ := ioutil.ReadFile(old[0]); string(data) != "first 1\n" {
+		t.Errorf("%s contains %q", old[0], data)
+	}
+}
+
+func TestLogPort(t *testing.T) {
+	h := New(http.NotFoundHandler(), nil, Options{LogPort: true}).(handler)
+	for peer, want := range map[string]string{
+		"192.0.2.1:4000":     "192.0.2.1:4000",
+		"[2001:db8::1]:4000": "[2001:db8::1]:4000",
+		"@":                  "@",
+		"":                   "-",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = peer
+		if got := h.client(r); got != want {
+			t.Errorf("peer %q: got %s, want %s", peer, got, want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var p printer
+	mux := http.NewServeMux()
+	empty := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("/admin/", New(empty, &p, Options{Route: "/admin/"}))
+	before := requests.Value("/admin/", "200")
+	for _, path := range []string{"/admin/status", "/admin/%ff", "/admin/" + strings.Repeat("x", 100)} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if n := requests.Value("/admin/", "200") - before; n != 3 {
+		t.Errorf("counted %v requests to /admin/ with status 200, expected 3", n)
+	}
+	var buf bytes.Buffer
+	if _, err := metrics.Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "/admin/status") || strings.Contains(buf.String(), `code="0"`) {
+		t.Errorf("metrics by path or without a status:\n%s", buf.String())
+	}
+}
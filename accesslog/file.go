@@ -0,0 +1,104 @@
+package accesslog
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A File is a Logger that appends each message to a file, on a
+// line of its own. Once the file grows past a maximum size, or
+// has been written to for longer than a maximum age, it is
+// renamed, with the time appended to its name, and a new file
+// is started. Old files are left for the operator to remove.
+type File struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenFile opens the file at path for appending access log
+// entries. If maxSize or maxAge are zero, the file is not
+// rotated by size or by age, respectively.
+func OpenFile(path string, maxSize int64, maxAge time.Duration) (*File, error) {
+	f := &File{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// rotate renames the current file and opens a new one. If the
+// file cannot be renamed, writing to it continues.
+func (f *File) rotate(now time.Time) error {
+	f.f.Close()
+	f.f = nil
+	err := os.Rename(f.path, f.path+"."+now.Format("20060102-150405"))
+	if err := f.open(); err != nil {
+		return err
+	}
+	return err
+}
+
+// Printf writes a message to the file, rotating it first if
+// necessary. Errors are logged with the log package.
+func (f *File) Printf(format string, v ...interface{}) {
+	line := fmt.Sprintf(format, v...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.f == nil {
+		// a previous rotation failed
+		if err := f.open(); err != nil {
+			return
+		}
+	}
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(line)) > f.maxSize ||
+		f.maxAge > 0 && now.Sub(f.opened) > f.maxAge) {
+		if err := f.rotate(now); err != nil {
+			log.Printf("rotate access log: %v", err)
+			if f.f == nil {
+				return
+			}
+		}
+	}
+	n, err := f.f.WriteString(line)
+	f.size += int64(n)
+	if err != nil {
+		log.Printf("write access log: %v", err)
+	}
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/droyo/metaphite/config"
+	"github.com/droyo/metaphite/metrics"
+)
+
+// pushMetrics sends metaphite's own metrics to the configured
+// carbon server at each interval, for as long as the process
+// runs. Failures are logged, and the metrics are sent again at
+// the next interval.
+func pushMetrics(c config.Carbon) {
+	prefix, interval := c.Prefix, c.Interval.Duration
+	if prefix == "" {
+		prefix = "metaphite"
+	}
+	if interval == 0 {
+		interval = time.Minute
+	}
+	for now := range time.Tick(interval) {
+		if err := pushOnce(c.Address, prefix, now); err != nil {
+			slog.Warn("push metrics failed", "address", c.Address, "err", err)
+		}
+	}
+}
+
+func pushOnce(addr, prefix string, now time.Time) error {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(now.Add(30 * time.Second))
+	if _, err := metrics.Default.WriteGraphite(conn, prefix, now); err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/droyo/metaphite/config"
+)
+
+// checkConfig implements the check subcommand, which validates a
+// config file and its backends, and exits with a non-zero status
+// if there are any problems.
+func checkConfig(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	file := fs.String("c", "", "configuration file")
+	probe := fs.Bool("probe", false, "send a render request to each backend")
+	timeout := fs.Duration("timeout", 10*time.Second, "time limit for lookups and probes")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: metaphite check -c config.json [-probe] [-timeout d]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *file == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.ParseFile(*file)
+	if err != nil {
+		fmt.Printf("%s: %s\n", *file, err)
+		os.Exit(1)
+	}
+	for _, w := range cfg.Warnings() {
+		fmt.Printf("%s: warning: %s\n", *file, w)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	failed := 0
+	for _, r := range cfg.Check(ctx, *probe) {
+		line := fmt.Sprintf("%s\t%s\t%s", r.Prefix, r.Kind, r.URL)
+		if len(r.Addrs) > 0 {
+			line += "\t" + strings.Join(r.Addrs, ",")
+		}
+		if r.Status != "" {
+			line += "\t" + r.Status
+		}
+		if r.Err != nil {
+			line += "\tFAIL: " + r.Err.Error()
+			failed++
+		} else {
+			line += "\tok"
+		}
+		fmt.Println(line)
+	}
+	if failed > 0 {
+		fmt.Printf("%s: %d backend(s) failed\n", *file, failed)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", *file)
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Access limits the client addresses that may use the render,
+// admin and metrics endpoints. Health checks are always
+// answered. In the config JSON,
+//
+// 	"access": {
+// 		"allow": ["10.20.0.0/16", "192.168.7.12"],
+// 		"deny": ["10.20.99.0/24"]
+// 	}
+//
+// Clients connected through a unix socket are not checked.
+type Access struct {
+	// Networks, in CIDR notation, or addresses that may make
+	// requests. If empty, all clients that are not denied may.
+	Allow []string
+	// Networks or addresses that may not make requests, even
+	// if they are allowed.
+	Deny []string
+}
+
+type accessList struct {
+	allow, deny []*net.IPNet
+}
+
+func (c *Config) setupAccess() error {
+	var err error
+	if c.access.allow, err = parseNets(c.Access.Allow); err != nil {
+		return fmt.Errorf("access: %v", err)
+	}
+	if c.access.deny, err = parseNets(c.Access.Deny); err != nil {
+		return fmt.Errorf("access: %v", err)
+	}
+	if c.trusted, err = parseNets(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trustedProxies: %v", err)
+	}
+	return nil
+}
+
+// TrustedNets returns the networks of the TrustedProxies.
+func (c *Config) TrustedNets() []*net.IPNet {
+	return c.trusted
+}
+
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitted checks the client address of r against the Access
+// setting. If it is not permitted, a 403 response is written
+// to w.
+func (c *Config) permitted(w http.ResponseWriter, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	if contains(c.access.deny, ip) || len(c.access.allow) > 0 && !contains(c.access.allow, ip) {
+		httperror(w, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// RestrictAccess wraps h so that it only serves the clients
+// permitted by the Access setting.
+func (c *Config) RestrictAccess(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.permitted(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccess(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{"access": {
+		"allow": ["10.20.0.0/16", "192.168.7.12", "fd00::/8"],
+		"deny": ["10.20.99.0/24"]
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, ok := range map[string]bool{
+		"10.20.1.1:5000":     true,
+		"10.20.99.1:5000":    false,
+		"192.168.7.12:5000":  true,
+		"192.168.7.13:5000":  false,
+		"[fd00::1]:5000":     true,
+		"[2001:db8::1]:5000": false,
+		"@":                  true, // unix socket
+	} {
+		r := httptest.NewRequest("GET", "/render?target=dev.cpu.load", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		if (w.Code != http.StatusForbidden) != ok {
+			t.Errorf("%s: status %d", addr, w.Code)
+		}
+	}
+	if _, err := Parse(strings.NewReader(`{"access": {"deny": ["10.0.0.0/33"]}}`)); err == nil {
+		t.Error("accepted an invalid network")
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/droyo/metaphite/version"
+)
+
+// Admin returns an http.Handler for the administrative endpoints
+// under /admin/. Requests must carry the configured AdminToken
+// as a bearer token. If no AdminToken is configured, the admin
+// endpoints are disabled.
+//
+// 	GET /admin/status
+// 		Reports the configured mappings and the
+// 		observed state of each backend.
+// 	GET /admin/mappings
+// 	GET /admin/mappings/{prefix}
+// 		Reports the current mappings.
+// 	PUT /admin/mappings/{prefix}
+// 		Maps prefix to the backend in the request body,
+// 		a JSON string with its URL or a Mapping object.
+// 	DELETE /admin/mappings/{prefix}
+// 		Removes the mapping for prefix.
+// 	GET /admin/loglevel
+// 	GET /admin/loglevel/{prefix}
+// 		Reports log level overrides.
+// 	PUT /admin/loglevel/{prefix}
+// 		Sets the log level for requests to the backend
+// 		for prefix; the body is a JSON string.
+// 	DELETE /admin/loglevel/{prefix}
+// 		Removes the log level override for prefix.
+// 	GET /admin/stats
+// 		Reports the number of requests, errors, bytes
+// 		and latency of each server of each backend.
+// 	GET /admin/usage
+// 		Reports the use each client made of the render
+// 		endpoint within the quota window, and its quotas.
+// 	GET /admin/state
+// 		Reports the health of each backend, as saved
+// 		in the StateFile. Peers read it.
+// 	GET /admin/version
+// 		Reports the version, commit and build date of
+// 		metaphite.
+//
+// If PersistMappings is set, changes to the mappings are
+// written back to the config file.
+func (c *Config) Admin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/status", c.adminStatus)
+	mux.HandleFunc("/admin/mappings", c.adminMappings)
+	mux.HandleFunc("/admin/mappings/", c.adminMappings)
+	mux.HandleFunc("/admin/loglevel", c.adminLogLevel)
+	mux.HandleFunc("/admin/loglevel/", c.adminLogLevel)
+	mux.HandleFunc("/admin/stats", c.adminStats)
+	mux.HandleFunc("/admin/usage", c.adminUsage)
+	mux.HandleFunc("/admin/state", c.adminState)
+	mux.HandleFunc("/admin/version", adminVersion)
+	return c.authorizeAdmin(mux)
+}
+
+func (c *Config) authorizeAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.AdminToken == "" {
+			notfound(w)
+			return
+		}
+		const scheme = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, scheme) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(c.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metaphite"`)
+			httperror(w, http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func adminVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		badmethod(w)
+		return
+	}
+	writeJSON(w, version.Get())
+}
+
+func (c *Config) adminState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		badmethod(w)
+		return
+	}
+	writeJSON(w, c.healthState())
+}
+
+func (c *Config) adminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		badmethod(w)
+		return
+	}
+	writeJSON(w, struct {
+		Mappings map[string]BackendStatus
+	}{c.Status()})
+}
+
+func (c *Config) adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		badmethod(w)
+		return
+	}
+	writeJSON(w, struct {
+		Mappings map[string]map[string]ServerStats
+	}{c.Stats()})
+}
+
+func (c *Config) adminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		badmethod(w)
+		return
+	}
+	writeJSON(w, struct {
+		Window  Duration
+		Clients map[string]Usage
+	}{c.Quota.Window, c.Usage()})
+}
+
+// Status reports the observed state of the backend for
+// each configured prefix.
+func (c *Config) Status() map[string]BackendStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string]BackendStatus, len(c.proxy))
+	for pfx, b := range c.proxy {
+		st := b.state.status(c.SlowStart.Duration)
+		st.URL = b.url.String()
+		result[pfx] = st
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("write response", "err", err)
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminStatus(t *testing.T) {
+	c := newCluster(t, testData, `"adminToken": "secret"`)
+	defer c.Close()
+	admin := httptest.NewServer(c.config.Admin())
+	defer admin.Close()
+	get := func(method, token string) (int, map[string]BackendStatus) {
+		req, _ := http.NewRequest(method, admin.URL+"/admin/status", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		var status struct{ Mappings map[string]BackendStatus }
+		if rsp.StatusCode == 200 {
+			if err := json.NewDecoder(rsp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode, status.Mappings
+	}
+	if code, _ := get("GET", ""); code != 401 {
+		t.Errorf("without a token: got status %d, expected 401", code)
+	}
+	if code, _ := get("GET", "wrong"); code != 401 {
+		t.Errorf("with the wrong token: got status %d, expected 401", code)
+	}
+	if code, _ := get("POST", "secret"); code != 405 {
+		t.Errorf("POST: got status %d, expected 405", code)
+	}
+
+	c.backends["dev"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		c.get(t, "/render?format=json&target=dev.cpu.load")
+	}
+	entered, release := make(chan bool), make(chan bool)
+	c.backends["prod"].seen = func(*http.Request) {
+		entered <- true
+		<-release
+	}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		rsp, err := http.Get(c.URL + "/render?format=json&target=prod.cpu.load")
+		if err == nil {
+			rsp.Body.Close()
+		}
+	}()
+	<-entered
+
+	code, status := get("GET", "secret")
+	if code != 200 {
+		t.Fatalf("got status %d, expected 200", code)
+	}
+	dev, prod := status["dev"], status["prod"]
+	if len(status) != 2 {
+		t.Errorf("got status of %d mappings, expected 2", len(status))
+	}
+	if dev.URL != c.backends["dev"].URL+"/" || prod.URL != c.backends["prod"].URL+"/" {
+		t.Errorf("got URLs %s and %s, expected the mapped backends", dev.URL, prod.URL)
+	}
+	if dev.Healthy || dev.Requests != maxFailures || dev.ErrorRate != 1 || dev.LastError == "" || dev.LastFail == nil {
+		t.Errorf("failing backend: got %+v", dev)
+	}
+	if !prod.Healthy || prod.InFlight != 1 || prod.ErrorRate != 0 || prod.LastFail != nil {
+		t.Errorf("backend with a request in flight: got %+v", prod)
+	}
+	close(release)
+	<-done
+	if _, status := get("GET", "secret"); status["prod"].InFlight != 0 || status["prod"].Requests != 1 {
+		t.Errorf("after the request: got %+v", status["prod"])
+	}
+
+	cfg, err := Parse(strings.NewReader(`{"mappings": {"dev": "http://dev/"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	cfg.Admin().ServeHTTP(rec, httptest.NewRequest("GET", "/admin/status", nil))
+	if rec.Code != 404 {
+		t.Errorf("without an adminToken: got status %d, expected 404", rec.Code)
+	}
+}
@@ -0,0 +1,317 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/droyo/metaphite/accesslog"
+	"github.com/droyo/metaphite/metrics"
+	"github.com/droyo/metaphite/query"
+)
+
+var auditDropped = metrics.NewCounter("metaphite_audit_dropped_total",
+	"Audit log entries that could not be delivered.")
+
+// Audit records who made each render request, and what was
+// requested, separately from the access log. Each entry is a JSON
+// object:
+//
+// 	{
+// 		"time": "2024-05-01T12:00:00.123Z",
+// 		"principal": "grafana",
+// 		"address": "10.20.1.7",
+// 		"targets": ["sumSeries(prod.cpu.*)"],
+// 		"normalized": ["sumSeries(prod.cpu.*)"],
+// 		"backends": ["prod"],
+// 		"status": 200,
+// 		"bytes": 5120,
+// 		"duration": 0.012
+// 	}
+//
+// The principal is the user name or client certificate the
+// request was authenticated with, or, for a bearer token, "token:"
+// followed by the start of its SHA-256 hash. The normalized targets
+// are the parsed targets, after any hooks. Requests that are
+// rejected are recorded too, with whatever was known about them.
+//
+// None of these settings can be changed by reloading the config.
+type Audit struct {
+	// Path of a file to append entries to, one per line. It is
+	// rotated when it grows larger than MaxSize megabytes, or
+	// older than MaxAge, if they are set, as the access log is.
+	File    string
+	MaxSize int
+	MaxAge  Duration
+	// URL to POST entries to, in batches of lines, with the
+	// content type application/x-ndjson. Entries that cannot be
+	// delivered after a few attempts are dropped.
+	URL string
+}
+
+// An auditSink is where audit log entries are written.
+type auditSink interface {
+	write(entry []byte)
+	close() error
+}
+
+func (c *Config) setupAudit() error {
+	a := c.Audit
+	if a.File != "" && a.URL != "" {
+		return errors.New("audit: only one of file and url may be set")
+	}
+	switch {
+	case a.File != "":
+		f, err := accesslog.OpenFile(a.File, int64(a.MaxSize)<<20, a.MaxAge.Duration)
+		if err != nil {
+			return fmt.Errorf("audit: %v", err)
+		}
+		c.audit = auditFile{f}
+	case a.URL != "":
+		u, err := url.Parse(a.URL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("audit: invalid url %q", a.URL)
+		}
+		c.audit = newAuditPoster(a.URL, &http.Client{Transport: c.transport(), Timeout: time.Minute})
+	}
+	return nil
+}
+
+type auditFile struct {
+	*accesslog.File
+}
+
+func (f auditFile) write(entry []byte) { f.Printf("%s", entry) }
+func (f auditFile) close() error       { return f.Close() }
+
+// Limits on the entries waiting to be posted, and on the entries
+// posted at once.
+const (
+	auditQueue = 10000
+	auditBatch = 500
+)
+
+// An auditPoster posts audit log entries to a URL, in the
+// background.
+type auditPoster struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newAuditPoster(url string, client *http.Client) *auditPoster {
+	p := &auditPoster{
+		url:    url,
+		client: client,
+		queue:  make(chan []byte, auditQueue),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *auditPoster) write(entry []byte) {
+	select {
+	case p.queue <- entry:
+	default:
+		auditDropped.Inc()
+	}
+}
+
+// close posts the entries that are waiting, and stops p.
+func (p *auditPoster) close() error {
+	close(p.queue)
+	<-p.done
+	return nil
+}
+
+// run posts the entries in the queue, gathering those that arrive
+// within a second of each other into a batch.
+func (p *auditPoster) run() {
+	defer close(p.done)
+	var batch bytes.Buffer
+	var n int
+	flush := func() {
+		if n > 0 {
+			p.post(batch.Bytes(), n)
+		}
+		batch.Reset()
+		n = 0
+	}
+	timer := time.NewTimer(time.Second)
+	for {
+		select {
+		case entry, ok := <-p.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch.Write(entry)
+			batch.WriteByte('\n')
+			if n++; n >= auditBatch {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(time.Second)
+		}
+	}
+}
+
+func (p *auditPoster) post(body []byte, entries int) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var rsp *http.Response
+		rsp, err = p.client.Post(p.url, "application/x-ndjson", bytes.NewReader(body))
+		if err == nil {
+			rsp.Body.Close()
+			if rsp.StatusCode/100 == 2 {
+				return
+			}
+			err = errors.New(rsp.Status)
+		}
+	}
+	slog.Warn("audit log entries dropped", "url", p.url, "entries", entries, "err", err)
+	auditDropped.Add(float64(entries))
+}
+
+// An auditEntry is what is known about a render request, as it is
+// served.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal,omitempty"`
+	Address    string    `json:"address"`
+	Targets    []string  `json:"targets"`
+	Normalized []string  `json:"normalized"`
+	Backends   []string  `json:"backends"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Duration   float64   `json:"duration"`
+}
+
+// startAudit starts the audit log entry for r. The entry is nil if
+// there is no audit log.
+func (c *Config) startAudit(r *http.Request) *auditEntry {
+	if c.audit == nil {
+		return nil
+	}
+	e := &auditEntry{Time: time.Now(), Targets: []string{}, Normalized: []string{}, Backends: []string{}}
+	e.Address, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if e.Address == "" {
+		e.Address = r.RemoteAddr
+	}
+	return e
+}
+
+// wrap returns w, set up to record the response.
+func (e *auditEntry) wrap(w http.ResponseWriter) http.ResponseWriter {
+	return &auditWriter{w, e}
+}
+
+// authenticated records the credentials r was authenticated with.
+func (e *auditEntry) authenticated(c *Config, r *http.Request) {
+	if e == nil {
+		return
+	}
+	e.Principal = c.principal(r)
+}
+
+// routed records the queries of a request, and the backends they
+// are routed to, as returned by backendKeys.
+func (e *auditEntry) routed(queries []*query.Query, keys map[string]bool) {
+	if e == nil {
+		return
+	}
+	for _, q := range queries {
+		e.Normalized = append(e.Normalized, q.String())
+	}
+	prefixes := make(map[string]bool)
+	for k := range keys {
+		prefixes[strings.SplitN(k, "#", 2)[0]] = true
+	}
+	for pfx := range prefixes {
+		e.Backends = append(e.Backends, pfx)
+	}
+	sort.Strings(e.Backends)
+}
+
+// routedTo records that a request is sent to the backend for
+// prefix, such as the DefaultBackend.
+func (e *auditEntry) routedTo(prefix string) {
+	if e == nil || prefix == "" {
+		return
+	}
+	for _, pfx := range e.Backends {
+		if pfx == prefix {
+			return
+		}
+	}
+	e.Backends = append(e.Backends, prefix)
+}
+
+// finishAudit writes the entry for r to the audit log.
+func (c *Config) finishAudit(e *auditEntry, r *http.Request) {
+	if r.Form != nil {
+		e.Targets = append(e.Targets, r.Form["target"]...)
+	}
+	e.Duration = time.Since(e.Time).Seconds()
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("encode audit log entry", "err", err)
+		return
+	}
+	c.audit.write(b)
+}
+
+// CloseAudit writes the audit log entries that are waiting to be
+// delivered. The audit log is shared by the Configs loaded by a
+// Reloader; it must not be used afterwards.
+func (c *Config) CloseAudit() error {
+	if c.audit == nil {
+		return nil
+	}
+	return c.audit.close()
+}
+
+// An auditWriter records the status and size of a response.
+type auditWriter struct {
+	http.ResponseWriter
+	e *auditEntry
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.e.Status == 0 {
+		w.e.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.e.Status == 0 {
+		w.e.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.e.Bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// ResponseWriter.
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
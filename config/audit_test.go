@@ -0,0 +1,65 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	c := newCluster(t, testData, `"audit": {"file": "`+path+`"}, "auth": {"tokens": ["secret"]}`)
+	defer c.Close()
+
+	render := func(target string) {
+		req, _ := http.NewRequest("GET", c.URL+"/render?format=json&target="+url.QueryEscape(target), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+	}
+	render("sumSeries(prod.cpu.load,dev.cpu.*)")
+	render("prod.cpu.load)")
+
+	var entries []auditEntry
+	for deadline := time.Now().Add(5 * time.Second); len(entries) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := ioutil.ReadFile(path)
+		entries = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var e auditEntry
+			if json.Unmarshal([]byte(line), &e) == nil {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit log entries, expected 2", len(entries))
+	}
+	e := entries[0]
+	if e.Principal != "token:"+fmt.Sprintf("%x", sha256.Sum256([]byte("secret")))[:12] || e.Address != "127.0.0.1" {
+		t.Errorf("entry for %q at %s", e.Principal, e.Address)
+	}
+	if want := []string{"sumSeries(prod.cpu.load,dev.cpu.*)"}; !reflect.DeepEqual(e.Targets, want) {
+		t.Errorf("targets %q, want %q", e.Targets, want)
+	}
+	if want := []string{"sumSeries(prod.cpu.load, dev.cpu.*)"}; !reflect.DeepEqual(e.Normalized, want) {
+		t.Errorf("normalized targets %q, want %q", e.Normalized, want)
+	}
+	if want := []string{"dev", "prod"}; !reflect.DeepEqual(e.Backends, want) || e.Status != 200 || e.Bytes == 0 {
+		t.Errorf("sent to %q, status %d, %d bytes", e.Backends, e.Status, e.Bytes)
+	}
+	if e := entries[1]; e.Status != 400 || len(e.Targets) != 1 || len(e.Normalized) != 0 {
+		t.Errorf("invalid target recorded as %+v", e)
+	}
+}
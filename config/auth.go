@@ -0,0 +1,148 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth lists the credentials accepted on the render and metrics
+// endpoints. If it is empty, no credentials are required. The
+// health and admin endpoints are not affected. In the config JSON,
+//
+// 	"auth": {
+// 		"users": {
+// 			"grafana": "$2a$10$4v9QpC5AxoVjsC7IpISEY.HA4Iya9acXEQhB/c/Pu9eyDg.lsFCry"
+// 		},
+// 		"tokens": ["7b2c8a07e5d94b1b"]
+// 	}
+//
+// Hashes can be generated with htpasswd -nB, HashPassword, or the
+// hash-password subcommand. The credentials are for metaphite only, and are
+// removed from requests before they are proxied to a backend.
+type Auth struct {
+	// Maps from user name to the bcrypt hash of the user's
+	// password, for HTTP basic authentication.
+	Users map[string]string
+	// Bearer tokens.
+	Tokens []string
+}
+
+// An authCache remembers passwords that have been checked, so
+// that bcrypt, which is slow by design, does not run for every
+// request. Only a hash of each password is kept.
+type authCache struct {
+	mu   sync.Mutex
+	good map[string][sha256.Size]byte // user -> hash of password
+}
+
+func (a Auth) enabled() bool {
+	return len(a.Users) > 0 || len(a.Tokens) > 0
+}
+
+func (a Auth) validate() error {
+	for user, hash := range a.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("auth: password hash for %q: %v", user, err)
+		}
+	}
+	return nil
+}
+
+// HashPassword returns a bcrypt hash of password, to list in
+// Auth.Users.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// authenticate checks the credentials in r. If they are missing
+// or wrong, a 401 response is written to w.
+func (c *Config) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if !c.Auth.enabled() || c.checkToken(r) || c.checkPassword(r) {
+		return true
+	}
+	if len(c.Auth.Users) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="metaphite"`)
+	}
+	if len(c.Auth.Tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="metaphite"`)
+	}
+	httperror(w, http.StatusUnauthorized)
+	return false
+}
+
+// principal returns the identity an authenticated request was
+// made with: the user name, "token:" and the first 12 hex digits
+// of the SHA-256 hash of the bearer token, or the common name of
+// the client certificate. It is empty if there is none.
+func (c *Config) principal(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && len(c.Auth.Users) > 0 {
+		return user
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && len(c.Auth.Tokens) > 0 {
+		sum := sha256.Sum256([]byte(auth[len("Bearer "):]))
+		return "token:" + hex.EncodeToString(sum[:6])
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ""
+}
+
+func (c *Config) checkToken(r *http.Request) bool {
+	const scheme = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, scheme) {
+		return false
+	}
+	ok := 0
+	for _, token := range c.Auth.Tokens {
+		ok |= subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(token))
+	}
+	return ok == 1
+}
+
+func (c *Config) checkPassword(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := c.Auth.Users[user]
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	c.auth.mu.Lock()
+	good, ok := c.auth.good[user]
+	c.auth.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(sum[:], good[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	c.auth.mu.Lock()
+	if c.auth.good == nil {
+		c.auth.good = make(map[string][sha256.Size]byte)
+	}
+	c.auth.good[user] = sum
+	c.auth.mu.Unlock()
+	return true
+}
+
+// RequireAuth wraps h so that requests to it must carry the
+// credentials listed in the Auth setting.
+func (c *Config) RequireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.authenticate(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// Authorization asks an external service whether each render
+// request may be made, so that, for example, each team can only
+// query its own prefixes. In the config JSON,
+//
+// 	"authorization": {
+// 		"url": "http://localhost:8181/metaphite",
+// 		"headers": ["X-Grafana-User"]
+// 	}
+//
+// The service is sent a POST request with a JSON body describing
+// the client and the metrics it requested:
+//
+// 	{
+// 		"user": "grafana",
+// 		"address": "10.20.1.7",
+// 		"headers": {"X-Grafana-User": "alice"},
+// 		"prefixes": ["prod"],
+// 		"metrics": ["prod.cpu.*"],
+// 		"targets": ["sumSeries(prod.cpu.*)"]
+// 	}
+//
+// The user is the name given for basic authentication, if any.
+// A 2xx response allows the request, and a 403 response denies it
+// with status 403, and the response body as the reason. If the
+// service fails, or answers with any other status, the request
+// is refused with status 503.
+type Authorization struct {
+	// URL of the service. If empty, requests are not
+	// authorized.
+	URL string
+	// Request headers to send to the service, which identify the
+	// client, such as a user name set by Grafana.
+	Headers []string
+	// How long to wait for the service. The default is 5s.
+	Timeout Duration
+}
+
+const defaultAuthorizationTimeout = 5 * time.Second
+
+// Limit on the reason given for denying a request.
+const maxDenyReason = 4 << 10
+
+// authzRequest is the body of a request to the authorization
+// service.
+type authzRequest struct {
+	User     string            `json:"user,omitempty"`
+	Address  string            `json:"address"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Prefixes []string          `json:"prefixes"`
+	Metrics  []string          `json:"metrics"`
+	Targets  []string          `json:"targets"`
+}
+
+func (c *Config) setupAuthorization() error {
+	a := c.Authorization
+	if a.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(a.URL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("authorization: invalid url %q", a.URL)
+	}
+	timeout := a.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultAuthorizationTimeout
+	}
+	c.authz = &http.Client{Transport: c.transport(), Timeout: timeout}
+	return nil
+}
+
+// authorize asks the authorization service whether r, for
+// queries, may be made. If not, a response is written to w.
+func (c *Config) authorize(w http.ResponseWriter, r *http.Request, queries []*query.Query) bool {
+	if c.authz == nil {
+		return true
+	}
+	req := authzRequest{Prefixes: []string{}, Metrics: []string{}, Targets: []string{}}
+	req.User, _, _ = r.BasicAuth()
+	req.Address, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if req.Address == "" {
+		req.Address = r.RemoteAddr
+	}
+	for _, h := range c.Authorization.Headers {
+		if v := r.Header.Get(h); v != "" {
+			if req.Headers == nil {
+				req.Headers = make(map[string]string)
+			}
+			req.Headers[h] = v
+		}
+	}
+	prefixes := make(map[string]bool)
+	for _, q := range queries {
+		req.Targets = append(req.Targets, q.String())
+		for _, m := range q.Metrics() {
+			req.Metrics = append(req.Metrics, string(*m))
+			pfx, _ := m.Split()
+			prefixes[string(pfx)] = true
+		}
+	}
+	for pfx := range prefixes {
+		req.Prefixes = append(req.Prefixes, pfx)
+	}
+	sort.Strings(req.Prefixes)
+
+	allowed, reason, err := c.checkAuthorization(r, req)
+	switch {
+	case err != nil:
+		slog.Warn("authorization failed", "err", err)
+		unavailable(w)
+		return false
+	case !allowed:
+		w.WriteHeader(http.StatusForbidden)
+		if reason == "" {
+			reason = http.StatusText(http.StatusForbidden)
+		}
+		fmt.Fprint(w, reason)
+		return false
+	}
+	return true
+}
+
+// checkAuthorization sends req to the authorization service, and
+// returns its decision.
+func (c *Config) checkAuthorization(r *http.Request, req authzRequest) (allowed bool, reason string, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, "", err
+	}
+	hr, err := http.NewRequest("POST", c.Authorization.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	hr = hr.WithContext(r.Context())
+	hr.Header.Set("Content-Type", "application/json")
+	rsp, err := c.authz.Do(hr)
+	if err != nil {
+		return false, "", err
+	}
+	defer rsp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, maxDenyReason))
+	switch {
+	case rsp.StatusCode/100 == 2:
+		return true, "", nil
+	case rsp.StatusCode == http.StatusForbidden:
+		return false, string(bytes.TrimSpace(msg)), nil
+	}
+	return false, "", fmt.Errorf("%s: %s", c.Authorization.URL, rsp.Status)
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuthorization(t *testing.T) {
+	var mu sync.Mutex
+	var last authzRequest
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mu.Lock()
+		last = req
+		mu.Unlock()
+		switch team := req.Headers["X-Team"]; {
+		case team == "broken":
+			http.Error(w, "policy error", 500)
+		case len(req.Prefixes) != 1 || req.Prefixes[0] != team:
+			http.Error(w, team+" may not query "+strings.Join(req.Prefixes, ", "), 403)
+		}
+	}))
+	defer authz.Close()
+	c := newCluster(t, testData, `"authorization": {"url": "`+authz.URL+`", "headers": ["X-Team"]}`)
+	defer c.Close()
+
+	render := func(team, target string) (int, string) {
+		req, _ := http.NewRequest("GET", c.URL+"/render?format=json&target="+url.QueryEscape(target), nil)
+		req.Header.Set("X-Team", team)
+		req.SetBasicAuth("grafana", "")
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+	if code, body := render("dev", "sumSeries(dev.cpu.*)"); code != 200 {
+		t.Errorf("dev querying dev: %d %s", code, body)
+	}
+	mu.Lock()
+	want := authzRequest{
+		User:     "grafana",
+		Address:  "127.0.0.1",
+		Headers:  map[string]string{"X-Team": "dev"},
+		Prefixes: []string{"dev"},
+		Metrics:  []string{"dev.cpu.*"},
+		Targets:  []string{"sumSeries(dev.cpu.*)"},
+	}
+	if !reflect.DeepEqual(last, want) {
+		t.Errorf("authorization request %+v, want %+v", last, want)
+	}
+	mu.Unlock()
+	if code, body := render("dev", "prod.cpu.load"); code != 403 || body != "dev may not query prod" {
+		t.Errorf("dev querying prod: %d %s", code, body)
+	}
+	if code, body := render("broken", "prod.cpu.load"); code != 503 {
+		t.Errorf("failed authorization: %d %s", code, body)
+	}
+}
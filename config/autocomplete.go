@@ -0,0 +1,226 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/droyo/metaphite/multi"
+)
+
+// Results of tag autocompletion are limited to this many entries
+// unless the request asks for fewer.
+const defaultAutoCompleteLimit = 100
+
+// AutoComplete returns an http.Handler for the tag autocompletion
+// endpoints of the graphite API, which Grafana's query builder
+// uses for tagged series:
+//
+// 	GET /tags/autoComplete/tags?tagPrefix=...&expr=...&limit=...
+// 		Lists tag names.
+// 	GET /tags/autoComplete/values?tag=...&valuePrefix=...&expr=...&limit=...
+// 		Lists the values of a tag.
+//
+// Requests are sent to every backend, and their results merged,
+// unless an expr selects a backend with the RouteTag. The
+// RouteTag itself is offered as a tag, with the configured
+// prefixes as its values.
+func (c *Config) AutoComplete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.permitted(w, r) || !c.authenticate(w, r) || !c.allow(w, r) {
+			return
+		}
+		if r.Method != "GET" && r.Method != "POST" {
+			badmethod(w)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			badrequest(w)
+			return
+		}
+		var kind, prefix string
+		switch r.URL.Path {
+		case "/tags/autoComplete/tags":
+			kind, prefix = "tags", r.Form.Get("tagPrefix")
+		case "/tags/autoComplete/values":
+			kind, prefix = "values", r.Form.Get("valuePrefix")
+			if r.Form.Get("tag") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "tag is required")
+				return
+			}
+		default:
+			notfound(w)
+			return
+		}
+		limit := defaultAutoCompleteLimit
+		if s := r.Form.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "invalid limit %q", s)
+				return
+			}
+			if n < limit {
+				limit = n
+			}
+		}
+
+		form := make(url.Values, len(r.Form))
+		for k, v := range r.Form {
+			form[k] = v
+		}
+		form.Set("limit", strconv.Itoa(limit))
+		backends, routed := c.autoCompleteBackends(form)
+
+		var result []string
+		if c.RouteTag != "" && !routed {
+			if kind == "tags" && strings.HasPrefix(c.RouteTag, prefix) {
+				result = append(result, c.RouteTag)
+			}
+			if kind == "values" && form.Get("tag") == c.RouteTag {
+				for _, b := range backends {
+					if strings.HasPrefix(b.prefix, prefix) {
+						result = append(result, b.prefix)
+					}
+				}
+				writeStrings(w, limitStrings(mergeStrings(result), limit))
+				return
+			}
+		}
+		found, ok := c.fanOutAutoComplete(r, form, backends)
+		if !ok {
+			httperror(w, http.StatusBadGateway)
+			return
+		}
+		writeStrings(w, limitStrings(mergeStrings(append(result, found...)), limit))
+	})
+}
+
+// autoCompleteBackends returns the backends to ask. If an expr in
+// form selects a backend with the RouteTag, it is the only one,
+// and the expr is removed from form, as the backend's series do
+// not have the tag.
+func (c *Config) autoCompleteBackends(form url.Values) (list []backend, routed bool) {
+	if c.RouteTag != "" {
+		exprs := form["expr"]
+		for i, e := range exprs {
+			v := strings.TrimPrefix(e, c.RouteTag+"=")
+			if v == e || strings.HasPrefix(v, "~") {
+				continue
+			}
+			form["expr"] = append(exprs[:i:i], exprs[i+1:]...)
+			if b, ok := c.backend(v); ok {
+				return []backend{b}, true
+			}
+			return nil, true
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, b := range c.proxy {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].prefix < list[j].prefix })
+	return list, false
+}
+
+// fanOutAutoComplete sends the autocomplete request r, with the
+// given form, to each backend, and merges their responses as the
+// autoComplete MergeStrategy decides. It returns false if the
+// request fails.
+func (c *Config) fanOutAutoComplete(r *http.Request, form url.Values, backends []backend) ([]string, bool) {
+	if len(backends) == 0 {
+		return nil, true
+	}
+	req, err := http.NewRequest("GET", r.URL.Path, nil)
+	if err != nil {
+		slog.Error("autocomplete", "err", err)
+		return nil, false
+	}
+	req = req.WithContext(r.Context())
+
+	// tags may be on any node of a hash ring
+	var servers []backend
+	for _, b := range backends {
+		if b.ring == nil {
+			servers = append(servers, b)
+			continue
+		}
+		for i := range b.ring.nodes {
+			servers = append(servers, b.node(i))
+		}
+	}
+	backends = servers
+
+	targets := make([]multi.Target, len(backends))
+	index := make(map[*url.URL]int, len(backends))
+	for i, b := range backends {
+		u := *b.pick()
+		index[&u] = i
+		// each backend has its own client, with its own settings
+		targets[i] = multi.Target{URL: &u, Query: form, Client: b.client}
+	}
+	found := make([][]string, len(backends))
+	results := make([]MergeResult, len(backends))
+	for rsp := range multi.ProxyContext(r.Context(), nil, req, targets) {
+		i := index[rsp.Target.URL]
+		err := multi.DecodeArray(rsp, func(elem json.RawMessage) error {
+			var s string
+			if err := json.Unmarshal(elem, &s); err != nil {
+				slog.Warn("backend error", "backend", backends[i].prefix, "err", err)
+				return nil
+			}
+			found[i] = append(found[i], s)
+			return nil
+		})
+		if err != nil {
+			slog.Warn("backend error", "backend", backends[i].prefix, "err", err)
+		}
+		results[i] = MergeResult{Backend: backends[i].prefix, Err: err}
+	}
+	keep, err := merge(c.mergeTags, results)
+	if err != nil {
+		slog.Warn("autocomplete", "err", err)
+		return nil, false
+	}
+	var result []string
+	for i := range backends {
+		if keep[i] {
+			result = append(result, found[i]...)
+		}
+	}
+	return result, true
+}
+
+// writeStrings writes list as compact JSON, as graphite does.
+func writeStrings(w http.ResponseWriter, list []string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		slog.Debug("write response", "err", err)
+	}
+}
+
+// mergeStrings sorts list and removes duplicates.
+func mergeStrings(list []string) []string {
+	sort.Strings(list)
+	result := []string{}
+	for i, s := range list {
+		if i == 0 || s != list[i-1] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func limitStrings(list []string, limit int) []string {
+	if len(list) > limit {
+		return list[:limit]
+	}
+	return list
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAutoComplete(t *testing.T) {
+	tagServer := func(tags, values []string, exprs *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			*exprs = append(*exprs, r.Form["expr"]...)
+			filter := func(list []string, prefix string) []string {
+				result := []string{}
+				for _, s := range list {
+					if strings.HasPrefix(s, prefix) {
+						result = append(result, s)
+					}
+				}
+				return result
+			}
+			switch r.URL.Path {
+			case "/tags/autoComplete/tags":
+				json.NewEncoder(w).Encode(filter(tags, r.Form.Get("tagPrefix")))
+			case "/tags/autoComplete/values":
+				json.NewEncoder(w).Encode(filter(values, r.Form.Get("valuePrefix")))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+	var prodExprs, devExprs []string
+	prod := tagServer([]string{"dc", "host", "name"}, []string{"web1", "web2"}, &prodExprs)
+	defer prod.Close()
+	dev := tagServer([]string{"env", "host", "name"}, []string{"dev1", "web1"}, &devExprs)
+	defer dev.Close()
+
+	cfg, err := Parse(strings.NewReader(fmt.Sprintf(`{
+		"mappings": {"prod": %q, "dev": %q},
+		"routeTag": "cluster"
+	}`, prod.URL, dev.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(cfg.AutoComplete())
+	defer srv.Close()
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/tags/autoComplete/tags", `["cluster","dc","env","host","name"]`},
+		{"/tags/autoComplete/tags?tagPrefix=h", `["host"]`},
+		{"/tags/autoComplete/tags?limit=2", `["cluster","dc"]`},
+		{"/tags/autoComplete/values?tag=host", `["dev1","web1","web2"]`},
+		{"/tags/autoComplete/values?tag=cluster", `["dev","prod"]`},
+		{"/tags/autoComplete/values?tag=cluster&valuePrefix=p", `["prod"]`},
+		{"/tags/autoComplete/values?tag=host&expr=cluster%3Dprod&expr=name%3Dcpu", `["web1","web2"]`},
+	}
+	for _, tt := range tests {
+		rsp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if got := strings.TrimSpace(string(body)); rsp.StatusCode != 200 || got != tt.want {
+			t.Errorf("%s: got %d %s, want %s", tt.path, rsp.StatusCode, got, tt.want)
+		}
+	}
+	if !reflect.DeepEqual(prodExprs, []string{"name=cpu"}) || len(devExprs) != 0 {
+		t.Errorf("backends got exprs %q and %q, expected only prod to get name=cpu", prodExprs, devExprs)
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setCacheControl sets the Cache-Control header of a response
+// that metaphite produced itself. For a response merged from
+// several backend responses, backend holds their Cache-Control
+// headers, which are combined conservatively. If they cannot be
+// combined, c.CacheControl is used.
+func (c *Config) setCacheControl(w http.ResponseWriter, backend []string) {
+	cc := mergeCacheControl(backend)
+	if cc == "" {
+		cc = c.CacheControl
+	}
+	if cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+}
+
+// mergeCacheControl combines Cache-Control headers so that the
+// result allows no more caching than any one of them. The result
+// is empty if any header is missing, because nothing is known
+// about the response it came with.
+func mergeCacheControl(headers []string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	var (
+		private, public = false, true
+		maxAge          = -1
+	)
+	for _, h := range headers {
+		if h == "" {
+			return ""
+		}
+		age := -1
+		var isPublic bool
+		for _, d := range strings.Split(h, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			name, val := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, val = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			switch name {
+			case "no-store":
+				return "no-store"
+			case "no-cache":
+				return "no-cache"
+			case "private":
+				private = true
+			case "public":
+				isPublic = true
+			case "max-age":
+				if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+					age = n
+				}
+			}
+		}
+		if age < 0 {
+			// caching is up to heuristics
+			return ""
+		}
+		if maxAge < 0 || age < maxAge {
+			maxAge = age
+		}
+		public = public && isPublic
+	}
+	cc := "max-age=" + strconv.Itoa(maxAge)
+	if private {
+		cc = "private, " + cc
+	} else if public {
+		cc = "public, " + cc
+	}
+	return cc
+}
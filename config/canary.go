@@ -0,0 +1,243 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var (
+	canaryCompared = metrics.NewCounter("metaphite_canary_comparisons_total",
+		"Render responses compared against a canary backend.", "backend")
+	canaryMismatched = metrics.NewCounter("metaphite_canary_mismatches_total",
+		"Differences found between primary and canary responses, by kind.", "backend", "kind")
+)
+
+// Responses larger than this are not compared.
+const maxCanaryBody = 8 << 20
+
+// A canary is a second backend that receives a copy of every
+// JSON render request sent to a primary backend. Its responses
+// are compared to the primary's, and any differences are logged
+// and counted. Clients only ever see the primary's response.
+type canary struct {
+	prefix string
+	url    *url.URL
+	client *http.Client
+}
+
+func (c *Config) setupCanaries() error {
+	c.canaries = make(map[string]*canary)
+	for pfx, v := range c.Canaries {
+		if _, ok := c.proxy[pfx]; !ok {
+			return fmt.Errorf("canary for unknown prefix %q", pfx)
+		}
+		u, err := backendURL(v)
+		if err != nil {
+			return fmt.Errorf("canary for %q: %v", pfx, err)
+		}
+		c.canaries[pfx] = &canary{
+			prefix: pfx,
+			url:    u,
+			client: &http.Client{
+				Transport: c.transport(),
+				Timeout:   time.Minute,
+			},
+		}
+	}
+	return nil
+}
+
+// fetch runs a render query against the canary, sending the
+// response body on the returned channel, or nil on failure.
+func (cn *canary) fetch(form url.Values) <-chan []byte {
+	ch := make(chan []byte, 1)
+	u := *cn.url
+	u.Path = path.Join(u.Path, "/render")
+	u.RawQuery = form.Encode()
+	go func() {
+		var body []byte
+		defer func() { ch <- body }()
+		rsp, err := cn.client.Get(u.String())
+		if err != nil {
+			slog.Warn("canary error", "backend", cn.prefix, "err", err)
+			canaryMismatched.Inc(cn.prefix, "error")
+			return
+		}
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxCanaryBody+1))
+		if err != nil || rsp.StatusCode != http.StatusOK {
+			slog.Warn("canary error", "backend", cn.prefix, "status", rsp.Status, "err", err)
+			canaryMismatched.Inc(cn.prefix, "error")
+			return
+		}
+		if len(data) <= maxCanaryBody {
+			body = data
+		}
+	}()
+	return ch
+}
+
+// compare wraps serve, which writes the primary response, so that
+// the response is compared with the canary's answer to form.
+func (cn *canary) compare(form url.Values, tolerance float64, serve func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := cn.fetch(form)
+		tee := &teeWriter{ResponseWriter: w}
+		serve(tee, r)
+		go func() {
+			secondary := <-result
+			if secondary == nil || tee.overflow || tee.status != http.StatusOK {
+				return
+			}
+			primary := tee.buf.Bytes()
+			if tee.Header().Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(primary))
+				if err != nil {
+					return
+				}
+				if primary, err = ioutil.ReadAll(zr); err != nil {
+					return
+				}
+			}
+			for _, d := range diffRender(primary, secondary, tolerance) {
+				canaryMismatched.Inc(cn.prefix, d.kind)
+				slog.Warn("canary mismatch", "backend", cn.prefix, "query", form["target"], "diff", d.msg)
+			}
+			// counted last, so that a comparison is only seen
+			// with its differences
+			canaryCompared.Inc(cn.prefix)
+		}()
+	}
+}
+
+// A teeWriter keeps a copy of the response it writes, up to
+// maxCanaryBody bytes.
+type teeWriter struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (t *teeWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	if !t.overflow {
+		if t.buf.Len()+len(p) > maxCanaryBody {
+			t.overflow = true
+			t.buf.Reset()
+		} else {
+			t.buf.Write(p)
+		}
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+type renderSeries struct {
+	Target     string
+	Datapoints [][2]*float64
+}
+
+type difference struct {
+	kind, msg string
+}
+
+// diffRender compares two graphite JSON render responses. Values
+// are considered equal if their relative difference is no more
+// than tolerance.
+func diffRender(primary, secondary []byte, tolerance float64) []difference {
+	var a, b []renderSeries
+	if err := json.Unmarshal(primary, &a); err != nil {
+		return []difference{{"decode", "primary: " + err.Error()}}
+	}
+	if err := json.Unmarshal(secondary, &b); err != nil {
+		return []difference{{"decode", "canary: " + err.Error()}}
+	}
+	index := func(list []renderSeries) map[string]renderSeries {
+		m := make(map[string]renderSeries, len(list))
+		for _, s := range list {
+			m[s.Target] = s
+		}
+		return m
+	}
+	am, bm := index(a), index(b)
+
+	var diffs []difference
+	var names []string
+	for name := range am {
+		names = append(names, name)
+	}
+	for name := range bm {
+		if _, ok := am[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		x, inA := am[name]
+		y, inB := bm[name]
+		switch {
+		case !inB:
+			diffs = append(diffs, difference{"targets", fmt.Sprintf("%q missing from canary", name)})
+			continue
+		case !inA:
+			diffs = append(diffs, difference{"targets", fmt.Sprintf("%q only in canary", name)})
+			continue
+		case len(x.Datapoints) != len(y.Datapoints):
+			diffs = append(diffs, difference{"datapoints", fmt.Sprintf("%q has %d datapoints, canary has %d",
+				name, len(x.Datapoints), len(y.Datapoints))})
+			continue
+		}
+		for i := range x.Datapoints {
+			p, q := x.Datapoints[i], y.Datapoints[i]
+			if !sameValue(p[0], q[0], tolerance) || !sameValue(p[1], q[1], 0) {
+				diffs = append(diffs, difference{"values", fmt.Sprintf("%q datapoint %d is %s, canary has %s",
+					name, i, formatPoint(p), formatPoint(q))})
+				break
+			}
+		}
+	}
+	return diffs
+}
+
+func sameValue(x, y *float64, tolerance float64) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	if *x == *y {
+		return true
+	}
+	scale := math.Max(math.Abs(*x), math.Abs(*y))
+	return math.Abs(*x-*y) <= tolerance*scale
+}
+
+func formatPoint(p [2]*float64) string {
+	s := func(f *float64) string {
+		if f == nil {
+			return "null"
+		}
+		return fmt.Sprint(*f)
+	}
+	return "[" + s(p[0]) + ", " + s(p[1]) + "]"
+}
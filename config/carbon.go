@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// Carbon configures pushing metaphite's own metrics, the ones
+// served at /debug/metrics, to a carbon server. In the config
+// JSON,
+//
+// 	"carbon": {
+// 		"address": "graphite.example.net:2003",
+// 		"prefix": "metaphite.web1",
+// 		"interval": "1m"
+// 	}
+type Carbon struct {
+	// The host:port of a carbon plaintext listener. If empty,
+	// metrics are not pushed.
+	Address string
+	// Prepended to the name of each metric. The default is
+	// "metaphite".
+	Prefix string
+	// How often to push metrics. The default is a minute.
+	Interval Duration
+}
+
+func validCarbon(c Carbon) error {
+	if c.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("carbon: %v", err)
+	}
+	if c.Interval.Duration < 0 {
+		return fmt.Errorf("carbon: interval %s is negative", c.Interval)
+	}
+	return nil
+}
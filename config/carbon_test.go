@@ -0,0 +1,36 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCarbonRoute(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{
+		"mappings": {
+			"prod": {"url": "http://prod/", "carbon": "prod-carbon:2003"},
+			"raw": {"url": "http://raw/", "carbon": "raw-carbon:2003", "stripPrefix": false},
+			"dev": "http://dev/"
+		},
+		"rewrites": [{"pattern": "^production\\.", "replacement": "prod."}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, addr, newName string
+	}{
+		{"prod.cpu.load", "prod-carbon:2003", "cpu.load"},
+		{"production.cpu.load", "prod-carbon:2003", "cpu.load"},
+		{"raw.cpu.load", "raw-carbon:2003", "raw.cpu.load"},
+		{"dev.cpu.load", "", ""},
+		{"unknown.cpu.load", "", ""},
+		{"prod", "", ""},
+	}
+	for _, tt := range tests {
+		addr, name, ok := cfg.CarbonRoute(tt.name)
+		if addr != tt.addr || name != tt.newName || ok != (tt.addr != "") {
+			t.Errorf("CarbonRoute(%q) = %q, %q, %v, want %q, %q", tt.name, addr, name, ok, tt.addr, tt.newName)
+		}
+	}
+}
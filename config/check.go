@@ -0,0 +1,148 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+)
+
+// A CheckResult is the outcome of checking one backend URL.
+type CheckResult struct {
+	Prefix string
+	// "mapping", "shard" or "canary".
+	Kind string
+	URL  string
+	// The addresses the URL's host name resolved to.
+	Addrs []string
+	// The status of the probe request, if one was made.
+	Status string
+	Err    error
+}
+
+// Check resolves the host name of every backend URL in the
+// config, including those of time shards and canaries. If probe
+// is true, it also makes a render request to each of them for a
+// metric that is not expected to exist, which a working graphite
+// server answers with an empty result. The results are sorted by
+// prefix.
+func (c *Config) Check(ctx context.Context, probe bool) []CheckResult {
+	type target struct {
+		CheckResult
+		u      *url.URL
+		client *http.Client
+	}
+	var targets []target
+	add := func(kind string, b backend) {
+		urls := b.urls
+		if b.discovery != nil {
+			// the servers of an SRV URL are looked up now
+			var err error
+			if urls, err = b.discovery.find(ctx, false); err != nil {
+				targets = append(targets, target{CheckResult{Prefix: b.prefix, Kind: kind, URL: b.url.String(), Err: err}, nil, nil})
+			}
+		}
+		for _, u := range urls {
+			targets = append(targets, target{CheckResult{Prefix: b.prefix, Kind: kind, URL: u.String()}, u, b.client})
+		}
+	}
+	var mapped []backend
+	c.mu.RLock()
+	for _, b := range c.proxy {
+		mapped = append(mapped, b)
+	}
+	c.mu.RUnlock()
+	for _, b := range mapped {
+		add("mapping", b)
+	}
+	for _, list := range c.shards {
+		for _, s := range list {
+			add("shard", s.backend)
+		}
+	}
+	for pfx, cn := range c.canaries {
+		targets = append(targets, target{CheckResult{Prefix: pfx, Kind: "canary", URL: cn.url.String()}, cn.url, cn.client})
+	}
+
+	results := make([]CheckResult, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t := targets[i]
+			if t.u == nil {
+				results[i] = t.CheckResult
+				return
+			}
+			t.Addrs, t.Err = c.resolve(ctx, t.u.Hostname())
+			if t.Err == nil && probe {
+				t.Status, t.Err = probeRender(ctx, t.client, t.u)
+			}
+			results[i] = t.CheckResult
+		}(i)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Prefix != b.Prefix {
+			return a.Prefix < b.Prefix
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.URL < b.URL
+	})
+	return results
+}
+
+// resolve looks up host the way connections to backends do.
+func (c *Config) resolve(ctx context.Context, host string) ([]string, error) {
+	if ip, ok := c.Hosts[host]; ok {
+		return []string{ip}, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	resolver := c.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return resolver.LookupHost(ctx, host)
+}
+
+// probeRequest returns a render request, to the graphite server
+// at u, for a metric that is not expected to exist.
+func probeRequest(ctx context.Context, u *url.URL) (*http.Request, error) {
+	probe := *u
+	probe.Path = path.Join(u.Path, "/render")
+	probe.RawQuery = url.Values{
+		"target": {"metaphite.check"},
+		"format": {"json"},
+		"from":   {"-1min"},
+	}.Encode()
+	return http.NewRequestWithContext(ctx, "GET", probe.String(), nil)
+}
+
+func probeRender(ctx context.Context, client *http.Client, u *url.URL) (string, error) {
+	req, err := probeRequest(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return rsp.Status, fmt.Errorf("probe failed: %s", rsp.Status)
+	}
+	return rsp.Status, nil
+}
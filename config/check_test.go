@@ -0,0 +1,50 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	good := newFakeGraphite(nil)
+	defer good.Close()
+	bad := newFakeGraphite(nil)
+	bad.fail = true
+	defer bad.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cfg, err := Parse(strings.NewReader(`{
+		"mappings": {
+			"good": "` + good.URL + `/",
+			"bad": "` + bad.URL + `/",
+			"gone": "http://graphite.example.net:` + closed.URL[strings.LastIndex(closed.URL, ":")+1:] + `/"
+		},
+		"hosts": {"graphite.example.net": "127.0.0.1"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := cfg.Check(ctx, true)
+	if len(results) != 3 {
+		t.Fatalf("got %d results, expected 3", len(results))
+	}
+	for _, r := range results {
+		if (r.Err == nil) != (r.Prefix == "good") {
+			t.Errorf("%s: %s: unexpected result %v", r.Prefix, r.URL, r.Err)
+		}
+		if r.Prefix == "gone" && !reflect.DeepEqual(r.Addrs, []string{"127.0.0.1"}) {
+			t.Errorf("gone: resolved to %q, expected hosts override", r.Addrs)
+		}
+	}
+	if results[0].Prefix != "bad" || results[0].Status != "502 Bad Gateway" {
+		t.Errorf("bad: got %+v", results[0])
+	}
+}
@@ -0,0 +1,1339 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/droyo/metaphite/query"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A fakeGraphite is a graphite server with a fixed set of series.
+// It answers /render queries for plain metric names and globs
+// in the json and csv formats. Functions are not evaluated.
+type fakeGraphite struct {
+	series map[string][][2]float64 // metric -> [value, timestamp]
+	fail   bool                    // answer every request with a 502
+	broken bool                    // answer every request with a 500, as for a bad query
+	header http.Header             // added to every response
+	seen   func(*http.Request)     // if not nil, called with every request
+	*httptest.Server
+}
+
+func newFakeGraphite(series map[string][][2]float64) *fakeGraphite {
+	g := &fakeGraphite{series: series}
+	g.Server = httptest.NewServer(g)
+	return g
+}
+
+func (g *fakeGraphite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.seen != nil {
+		g.seen(r)
+	}
+	if g.fail {
+		http.Error(w, "backend failure", http.StatusBadGateway)
+		return
+	}
+	if g.broken {
+		http.Error(w, "cannot evaluate query", 500)
+		return
+	}
+	for k, v := range g.header {
+		w.Header()[k] = v
+	}
+	if r.URL.Path != "/render" {
+		http.NotFound(w, r)
+		return
+	}
+	r.ParseForm()
+	if r.Method == "POST" && isJSON(r) {
+		if err := parseJSONForm(r); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	type result struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	var results []result
+	for _, target := range r.Form["target"] {
+		var names []string
+		for name := range g.series {
+			if query.Metric(target).Match(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			results = append(results, result{name, window(g.series[name], r.Form)})
+		}
+	}
+	switch r.Form.Get("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		if results == nil {
+			results = []result{}
+		}
+		json.NewEncoder(w).Encode(results)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		for _, res := range results {
+			for _, p := range res.Datapoints {
+				fmt.Fprintf(w, "%s,%v,%v\n", res.Target, p[1], p[0])
+			}
+		}
+	default:
+		http.Error(w, "unsupported format", 400)
+	}
+}
+
+// window selects the datapoints within the from and until
+// parameters of a request, if they are given as epoch seconds.
+func window(points [][2]float64, form url.Values) [][2]float64 {
+	from, err := strconv.ParseFloat(form.Get("from"), 64)
+	if err != nil {
+		return points
+	}
+	until, err := strconv.ParseFloat(form.Get("until"), 64)
+	if err != nil {
+		return points
+	}
+	result := [][2]float64{}
+	for _, p := range points {
+		if p[1] >= from && p[1] <= until {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// A cluster is a metaphite instance in front of several
+// fake graphite servers.
+type cluster struct {
+	backends map[string]*fakeGraphite
+	config   *Config
+	*httptest.Server
+}
+
+// newCluster starts a fake graphite server for each prefix in
+// data, and a metaphite server mapping each prefix to its
+// backend. The extra string, if not empty, is spliced into
+// the config JSON.
+func newCluster(t *testing.T, data map[string]map[string][][2]float64, extra string) *cluster {
+	c := &cluster{backends: make(map[string]*fakeGraphite)}
+	for pfx, series := range data {
+		c.backends[pfx] = newFakeGraphite(series)
+	}
+	c.config = c.parse(t, extra)
+	c.Server = httptest.NewServer(c.config)
+	return c
+}
+
+// parse parses a config mapping each prefix to its backend, with
+// the extra string spliced in.
+func (c *cluster) parse(t *testing.T, extra string) *Config {
+	mappings := make(map[string]string)
+	for pfx, g := range c.backends {
+		mappings[pfx] = g.URL + "/"
+	}
+	m, err := json.Marshal(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := `{"mappings": ` + string(m)
+	if extra != "" {
+		js += ", " + extra
+	}
+	js += "}"
+	cfg, err := Parse(strings.NewReader(js))
+	if err != nil {
+		t.Fatalf("parse %s: %s", js, err)
+	}
+	return cfg
+}
+
+func (c *cluster) Close() {
+	c.Server.Close()
+	for _, g := range c.backends {
+		g.Close()
+	}
+}
+
+func (c *cluster) get(t *testing.T, path string) (int, string) {
+	rsp, err := http.Get(c.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.StatusCode, string(body)
+}
+
+var testData = map[string]map[string][][2]float64{
+	"dev": {
+		"cpu.load":  {{1, 100}, {2, 160}},
+		"cpu.user":  {{10, 100}, {20, 160}},
+		"mem.total": {{512, 100}},
+	},
+	"prod": {
+		"cpu.load": {{5, 100}, {6, 160}},
+		"disk.io":  {{7, 100}},
+	},
+}
+
+func TestCluster(t *testing.T) {
+	c := newCluster(t, testData, `"rewrites": [{"pattern": "^production\\.", "replacement": "prod."}]`)
+	defer c.Close()
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		body   string
+	}{
+		{
+			name:   "dev prefix",
+			query:  url.Values{"target": {"dev.cpu.load"}, "format": {"json"}},
+			status: 200,
+			body:   `[{"target":"cpu.load","datapoints":[[1,100],[2,160]]}]` + "\n",
+		},
+		{
+			name:   "prod prefix",
+			query:  url.Values{"target": {"prod.cpu.load"}, "format": {"json"}},
+			status: 200,
+			body:   `[{"target":"cpu.load","datapoints":[[5,100],[6,160]]}]` + "\n",
+		},
+		{
+			name:   "glob",
+			query:  url.Values{"target": {"dev.cpu.*"}, "format": {"json"}},
+			status: 200,
+			body: `[{"target":"cpu.load","datapoints":[[1,100],[2,160]]},` +
+				`{"target":"cpu.user","datapoints":[[10,100],[20,160]]}]` + "\n",
+		},
+		{
+			name:   "multiple targets",
+			query:  url.Values{"target": {"dev.mem.total", "dev.cpu.load"}, "format": {"csv"}},
+			status: 200,
+			body:   "mem.total,100,512\ncpu.load,100,1\ncpu.load,160,2\n",
+		},
+		{
+			name:   "rewrite",
+			query:  url.Values{"target": {"production.disk.io"}, "format": {"json"}},
+			status: 200,
+			body:   `[{"target":"disk.io","datapoints":[[7,100]]}]` + "\n",
+		},
+		{
+			name:   "no matches",
+			query:  url.Values{"target": {"prod.nonexistent"}, "format": {"json"}},
+			status: 200,
+			body:   "[]\n",
+		},
+		{
+			name:   "unknown prefix",
+			query:  url.Values{"target": {"qa.cpu.load"}, "format": {"json"}},
+			status: 404,
+			body:   "Not Found\n",
+		},
+		{
+			name:   "invalid target",
+			query:  url.Values{"target": {"dev.cpu.load)"}},
+			status: 400,
+			body:   `Invalid query "dev.cpu.load)": syntax error in ")" at column 12`,
+		},
+	}
+	empty := renderEmpty.Value("prod")
+	for _, tt := range tests {
+		status, body := c.get(t, "/render?"+tt.query.Encode())
+		if status != tt.status || body != tt.body {
+			t.Errorf("%s: got %d %q, expected %d %q",
+				tt.name, status, body, tt.status, tt.body)
+		}
+	}
+	if n := renderEmpty.Value("prod") - empty; n != 1 {
+		t.Errorf("counted %v empty responses from prod, expected 1", n)
+	}
+}
+
+func TestClusterUnknownPrefix(t *testing.T) {
+	c := newCluster(t, testData, `"unknownPrefix": "empty"`)
+	defer c.Close()
+
+	tests := []struct {
+		format string
+		status int
+		body   string
+	}{
+		{"json", 200, "[]"},
+		{"csv", 200, ""},
+		{"png", 404, "Not Found\n"},
+	}
+	for _, tt := range tests {
+		status, body := c.get(t, "/render?target=qa.cpu.load&format="+tt.format)
+		if status != tt.status || body != tt.body {
+			t.Errorf("format %s: got %d %q, expected %d %q",
+				tt.format, status, body, tt.status, tt.body)
+		}
+	}
+}
+
+func TestClusterFailure(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+
+	c.backends["prod"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		if status, _ := c.get(t, "/render?format=json&target=prod.cpu.load"); status != 502 {
+			t.Errorf("request %d to failing backend: got status %d, expected 502", i, status)
+		}
+	}
+	if status, _ := c.get(t, "/render?format=json&target=prod.cpu.load"); status != 503 {
+		t.Errorf("request to unhealthy backend: got status %d, expected 503", status)
+	}
+	if status, _ := c.get(t, "/render?format=json&target=dev.cpu.load"); status != 200 {
+		t.Errorf("request to healthy backend: got status %d, expected 200", status)
+	}
+}
+
+// Only failures of the backend itself make it unhealthy: not
+// errors in the query, nor clients that go away.
+func TestClusterFailureIgnored(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+
+	c.backends["prod"].broken = true
+	for i := 0; i < 2*maxFailures; i++ {
+		if status, _ := c.get(t, "/render?format=json&target=prod.cpu.load"); status != 500 {
+			t.Errorf("bad query %d: got status %d, expected 500", i, status)
+		}
+	}
+	if !c.config.proxy["prod"].state.healthy() {
+		t.Error("backend is unhealthy after errors in queries")
+	}
+
+	// a dashboard panel that is closed before it has loaded
+	var hang atomic.Bool
+	hang.Store(true)
+	c.backends["dev"].seen = func(r *http.Request) {
+		if hang.Load() {
+			<-r.Context().Done()
+		}
+	}
+	for i := 0; i < 2*maxFailures; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		r, _ := http.NewRequestWithContext(ctx, "GET", c.URL+"/render?format=json&target=dev.cpu.load", nil)
+		if rsp, err := http.DefaultClient.Do(r); err == nil {
+			rsp.Body.Close()
+			t.Errorf("canceled request %d: got status %d", i, rsp.StatusCode)
+		}
+		cancel()
+	}
+	hang.Store(false)
+	// the server notices the client has gone away asynchronously
+	time.Sleep(50 * time.Millisecond)
+	if !c.config.proxy["dev"].state.healthy() {
+		t.Error("backend is unhealthy after requests canceled by the client")
+	}
+	if ok, reason := c.config.Ready(); !ok {
+		t.Errorf("not ready: %s", reason)
+	}
+	if status, _ := c.get(t, "/render?format=json&target=dev.cpu.load"); status != 200 {
+		t.Errorf("request after cancellations: got status %d, expected 200", status)
+	}
+}
+
+func TestClusterPost(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+
+	form := url.Values{"target": {"prod.disk.io"}, "format": {"csv"}}
+	rsp, err := http.PostForm(c.URL+"/render", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	body, _ := ioutil.ReadAll(rsp.Body)
+	if want := "disk.io,100,7\n"; string(body) != want {
+		t.Errorf("got %q, expected %q", body, want)
+	}
+}
+
+func TestClusterPostJSON(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"target": ["prod.disk.io"], "format": "csv"}`, 200, "disk.io,100,7\n"},
+		{`{"target": "dev.mem.total", "format": "csv", "maxDataPoints": 100}`, 200, "mem.total,100,512\n"},
+		{`{"target": [{"refId": "A"}]}`, 400, `parameter "target": unsupported value map[refId:A]`},
+		{`["dev.mem.total"]`, 400, ""},
+	}
+	for _, tt := range tests {
+		rsp, err := http.Post(c.URL+"/render", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != tt.status || (tt.want != "" && string(body) != tt.want) {
+			t.Errorf("%s: got %d %q, expected %d %q", tt.body, rsp.StatusCode, body, tt.status, tt.want)
+		}
+	}
+}
+
+func TestClusterCanary(t *testing.T) {
+	canary := newFakeGraphite(map[string][][2]float64{
+		"cpu.load": {{5, 100}, {6.0000001, 160}},
+		"disk.io":  {{8, 100}},
+		"disk.new": {{1, 100}},
+	})
+	defer canary.Close()
+	c := newCluster(t, testData, `"canaryTolerance": 1e-6, "canaries": {"prod": "`+canary.URL+`/"}`)
+	defer c.Close()
+
+	before := func(kind string) float64 { return canaryMismatched.Value("prod", kind) }
+	values, targets := before("values"), before("targets")
+	compared := canaryCompared.Value("prod")
+
+	status, body := c.get(t, "/render?format=json&target=prod.cpu.load")
+	if want := `[{"target":"cpu.load","datapoints":[[5,100],[6,160]]}]` + "\n"; status != 200 || body != want {
+		t.Errorf("got %d %q, expected primary response %q", status, body, want)
+	}
+	c.get(t, "/render?format=json&target=prod.disk.*")
+
+	deadline := time.Now().Add(time.Second)
+	for canaryCompared.Value("prod") < compared+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := canaryCompared.Value("prod") - compared; n != 2 {
+		t.Fatalf("compared %v responses, expected 2", n)
+	}
+	if n := before("values") - values; n != 1 {
+		t.Errorf("found %v value differences, expected 1", n)
+	}
+	if n := before("targets") - targets; n != 1 {
+		t.Errorf("found %v target differences, expected 1", n)
+	}
+}
+
+func TestClusterTimeShards(t *testing.T) {
+	old := newFakeGraphite(map[string][][2]float64{
+		"cpu.load": {{1, 100}, {2, 200}, {3, 300}},
+		"cpu.old":  {{4, 100}},
+	})
+	defer old.Close()
+	recent := newFakeGraphite(map[string][][2]float64{
+		"cpu.load": {{30, 300}, {40, 400}},
+	})
+	defer recent.Close()
+	c := newCluster(t, testData, `"timeShards": {"prod": [
+		{"url": "`+recent.URL+`/", "from": "250"},
+		{"url": "`+old.URL+`/", "until": "250"}
+	]}`)
+	defer c.Close()
+
+	tests := []struct {
+		query string
+		body  string
+	}{
+		{
+			"format=json&target=prod.cpu.*&from=0&until=1000",
+			`[{"target":"cpu.load","datapoints":[[1,100],[2,200],[30,300],[40,400]]},` +
+				`{"target":"cpu.old","datapoints":[[4,100]]}]` + "\n",
+		},
+		{
+			"format=json&target=prod.cpu.load&from=0&until=150",
+			`[{"target":"cpu.load","datapoints":[[1,100]]}]` + "\n",
+		},
+		{
+			"format=csv&target=prod.cpu.load&from=0&until=1000",
+			"cpu.load,300,30\ncpu.load,400,40\n",
+		},
+	}
+	for _, tt := range tests {
+		status, body := c.get(t, "/render?"+tt.query)
+		if status != 200 || body != tt.body {
+			t.Errorf("%s: got %d %q, expected %q", tt.query, status, body, tt.body)
+		}
+	}
+
+	// stitched requests go through each shard's own transport,
+	// and are admitted and counted in flight like any other
+	shards := c.config.shards["prod"]
+	var inflight int64
+	old.seen = func(*http.Request) { inflight = atomic.LoadInt64(&shards[1].state.inflight) }
+	c.get(t, "/render?"+tests[0].query)
+	if inflight != 1 {
+		t.Errorf("stitched request: %d requests in flight to the shard, expected 1", inflight)
+	}
+	// each shard was also sent one of the tests unstitched
+	for _, sh := range shards {
+		if st := sh.stats.snapshot()[sh.url.Scheme+"://"+sh.url.Host]; st.Requests != 3 {
+			t.Errorf("shard %s: %d requests in its stats, expected 3", sh.url, st.Requests)
+		}
+	}
+	state := shards[1].state
+	state.mu.Lock()
+	state.failures = maxFailures
+	state.lastProbe = time.Now()
+	state.mu.Unlock()
+	if status, body := c.get(t, "/render?"+tests[0].query); status != 503 {
+		t.Errorf("unhealthy shard: got %d %q, expected 503", status, body)
+	}
+}
+
+func TestClusterEvaluate(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+
+	tests := []struct {
+		query  url.Values
+		status int
+		body   string
+	}{
+		{
+			url.Values{"target": {"sumSeries(dev.cpu.load, prod.cpu.load)"}, "format": {"json"}},
+			200,
+			`[{"target":"sumSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[6,100],[8,160]]}]` + "\n",
+		},
+		{
+			url.Values{"target": {"maxSeries(dev.cpu.*, prod.cpu.load)", "prod.disk.io"}, "format": {"json"}},
+			200,
+			`[{"target":"maxSeries(dev.cpu.*,prod.cpu.load)","datapoints":[[10,100],[20,160]]},` +
+				`{"target":"disk.io","datapoints":[[7,100]]}]` + "\n",
+		},
+		{
+			url.Values{"target": {"averageSeries(dev.cpu.load, prod.cpu.load)", "dev.mem.total"}, "format": {"json"}},
+			200,
+			`[{"target":"averageSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[3,100],[4,160]]},` +
+				`{"target":"mem.total","datapoints":[[512,100]]}]` + "\n",
+		},
+		{
+			url.Values{"target": {"sumSeries(dev.cpu.load, prod.cpu.load)"}, "format": {"csv"}},
+			400,
+			"Targets spanning several backends are only supported with format=json",
+		},
+		{
+			url.Values{"target": {"diffSeries(dev.cpu.load, prod.cpu.load)"}, "format": {"json"}},
+			400,
+			`Cannot evaluate "diffSeries(dev.cpu.load, prod.cpu.load)": its metrics span several backends`,
+		},
+	}
+	for _, tt := range tests {
+		status, body := c.get(t, "/render?"+tt.query.Encode())
+		if status != tt.status || body != tt.body {
+			t.Errorf("%s: got %d %q, expected %d %q",
+				tt.query["target"], status, body, tt.status, tt.body)
+		}
+	}
+
+	path := "/render?format=json&target=sumSeries(dev.cpu.load,prod.cpu.load)"
+	rsp, err := http.Get(c.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	etag := rsp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on evaluated response")
+	}
+	req, _ := http.NewRequest("GET", c.URL+path, nil)
+	req.Header.Set("If-None-Match", etag)
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional request: got status %d, expected 304", rsp.StatusCode)
+	}
+}
+
+func TestClusterTraces(t *testing.T) {
+	old := newFakeGraphite(map[string][][2]float64{"cpu.load": {{1, 100}}})
+	defer old.Close()
+	recent := newFakeGraphite(map[string][][2]float64{"cpu.load": {{2, 300}}})
+	defer recent.Close()
+	c := newCluster(t, testData, `"logLevels": {"prod": "debug"},
+		"rewrites": [{"pattern": "^production\\.", "replacement": "prod."}],
+		"timeShards": {"prod": [
+			{"url": "`+old.URL+`/", "until": "250"},
+			{"url": "`+recent.URL+`/", "from": "250"}
+		]}`)
+	defer c.Close()
+
+	tests := []struct {
+		name, query string
+		want        []routeTrace
+	}{
+		{
+			"evaluated",
+			"target=sumSeries(dev.cpu.load,production.cpu.load)",
+			[]routeTrace{{
+				Target:   "production.cpu.load",
+				Rewrites: []appliedRewrite{{`^production\.`, "production.cpu.load", "prod.cpu.load"}},
+				Backend:  "prod",
+				Final:    "cpu.load",
+			}},
+		},
+		{
+			"stitched",
+			"target=production.cpu.load&from=0&until=1000",
+			[]routeTrace{{
+				Target:   "production.cpu.load",
+				Rewrites: []appliedRewrite{{`^production\.`, "production.cpu.load", "prod.cpu.load"}},
+				Backend:  "prod",
+				Final:    "cpu.load",
+			}},
+		},
+		{
+			"not debugged",
+			"target=dev.cpu.load&from=0&until=1000",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		stitched := renderStitched.Value("prod")
+		rsp, err := http.Get(c.URL + "/render?format=json&" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if tt.name == "stitched" && renderStitched.Value("prod") == stitched {
+			t.Errorf("%s: request was not stitched", tt.name)
+		}
+		var traces []routeTrace
+		for _, h := range rsp.Header.Values("X-Metaphite-Trace") {
+			var trace routeTrace
+			if err := json.Unmarshal([]byte(h), &trace); err != nil {
+				t.Errorf("%s: bad trace header %q: %v", tt.name, h, err)
+			}
+			traces = append(traces, trace)
+		}
+		if !reflect.DeepEqual(traces, tt.want) {
+			t.Errorf("%s: got traces %+v, expected %+v", tt.name, traces, tt.want)
+		}
+	}
+}
+
+func TestClusterEvaluateNonFinite(t *testing.T) {
+	c := newCluster(t, map[string]map[string][][2]float64{
+		"dev":  {"big": {{1e308, 100}, {1, 160}}},
+		"prod": {"big": {{1e308, 100}, {2, 160}}},
+	}, "")
+	defer c.Close()
+	status, body := c.get(t, "/render?format=json&target=sumSeries(dev.big,prod.big)")
+	want := `[{"target":"sumSeries(dev.big,prod.big)","datapoints":[[null,100],[3,160]]}]` + "\n"
+	if status != 200 || body != want {
+		t.Errorf("got %d %q, expected %q", status, body, want)
+	}
+}
+
+func TestClusterOutput(t *testing.T) {
+	old := newFakeGraphite(map[string][][2]float64{"a": {{1.23456, 100}}})
+	defer old.Close()
+	recent := newFakeGraphite(map[string][][2]float64{"a": {{2, 300}}})
+	defer recent.Close()
+	c := newCluster(t, map[string]map[string][][2]float64{
+		"dev":  {"a": {{1.3, 100}, {2.5, 160}, {1e308, 220}}},
+		"prod": {"a": {{2, 100}, {2, 160}, {1e308, 220}}},
+	}, `"output": {"precision": 3, "trimZeros": true, "null": "0"},
+		"timeShards": {"prod": [
+			{"url": "`+old.URL+`/", "until": "250"},
+			{"url": "`+recent.URL+`/", "from": "250"}
+		]}`)
+	defer c.Close()
+
+	tests := []struct {
+		query, body string
+	}{
+		{
+			"target=sumSeries(dev.a,prod.a)",
+			`[{"target":"sumSeries(dev.a,prod.a)","datapoints":[[3.3,100],[4.5,160],[0,220]]}]` + "\n",
+		},
+		{
+			"target=prod.a&from=0&until=1000",
+			`[{"target":"a","datapoints":[[1.235,100],[2,300]]}]` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		if status, body := c.get(t, "/render?format=json&"+tt.query); status != 200 || body != tt.body {
+			t.Errorf("%s: got %d %q, expected %q", tt.query, status, body, tt.body)
+		}
+	}
+
+	for _, output := range []string{`{"precision": 18}`, `{"null": "nil"}`} {
+		if _, err := Parse(strings.NewReader(`{"output": ` + output + `}`)); err == nil {
+			t.Errorf("output %s accepted", output)
+		}
+	}
+}
+
+func TestClusterStringArgs(t *testing.T) {
+	c := newCluster(t, testData, `"debug": true, "rewrites": [{"pattern": "^production\\.", "replacement": "prod."}]`)
+	defer c.Close()
+
+	tests := []struct {
+		target, final string
+	}{
+		{
+			`useSeriesAbove(prod.reqs.*, 10, "prod.reqs", 'production.time')`,
+			`useSeriesAbove(reqs.*, 10, "reqs", 'time')`,
+		},
+		{
+			`useSeriesAbove(prod.reqs.*, 10, "reqs", "time")`,
+			`useSeriesAbove(reqs.*, 10, "reqs", "time")`,
+		},
+		{
+			`template(prod.cpu.load, "prod.worker1")`,
+			`template(cpu.load, "worker1")`,
+		},
+		{
+			`alias(prod.cpu.load, "prod.cpu")`,
+			`alias(cpu.load, "prod.cpu")`,
+		},
+	}
+	for _, tt := range tests {
+		rsp, err := http.Get(c.URL + "/render?format=json&target=" + url.QueryEscape(tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		var trace routeTrace
+		if err := json.Unmarshal([]byte(rsp.Header.Get("X-Metaphite-Trace")), &trace); err != nil {
+			t.Errorf("%s: bad trace header: %v", tt.target, err)
+		} else if trace.Final != tt.final {
+			t.Errorf("%s: routed as %s, expected %s", tt.target, trace.Final, tt.final)
+		}
+	}
+}
+
+func TestClusterReady(t *testing.T) {
+	c := newCluster(t, testData, `"readyQuorum": 1`)
+	defer c.Close()
+	ready := httptest.NewServer(c.config.Readiness())
+	defer ready.Close()
+	check := func(want int) {
+		rsp, err := http.Get(ready.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != want {
+			t.Errorf("readiness check: got status %d, expected %d", rsp.StatusCode, want)
+		}
+	}
+	check(200)
+	c.backends["prod"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		c.get(t, "/render?format=json&target=prod.cpu.load")
+	}
+	check(503)
+}
+
+// Readiness recovers when a backend does, without any render
+// requests, and a fresh instance whose backends are down is not
+// ready.
+func TestClusterReadyRecovery(t *testing.T) {
+	c := newCluster(t, testData, `"readyQuorum": 1`)
+	defer c.Close()
+	c.backends["prod"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		c.get(t, "/render?format=json&target=prod.cpu.load")
+	}
+	if ok, _ := c.config.Ready(); ok {
+		t.Fatal("ready with a failing backend")
+	}
+	var checks atomic.Int32
+	c.backends["prod"].seen = func(r *http.Request) { checks.Add(1) }
+	if ok, _ := c.config.Ready(); ok || checks.Load() != 0 {
+		t.Errorf("backend checked %d times within the probe interval", checks.Load())
+	}
+
+	c.backends["prod"].fail = false
+	state := c.config.proxy["prod"].state
+	state.mu.Lock()
+	state.lastProbe = time.Now().Add(-probeInterval)
+	state.mu.Unlock()
+	if ok, reason := c.config.Ready(); !ok {
+		t.Errorf("not ready after the backend recovered: %s", reason)
+	}
+	if checks.Load() != 1 {
+		t.Errorf("backend checked %d times, expected 1", checks.Load())
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	cfg, err := Parse(strings.NewReader(`{"mappings": {"dev": "` + down.URL + `/"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cfg.Ready(); ok {
+		t.Error("fresh instance ready with its only backend down")
+	}
+}
+
+// A recovered backend is sent a growing fraction of requests over
+// the slow start window, starting from a tenth.
+func TestClusterSlowStart(t *testing.T) {
+	c := newCluster(t, testData, `"slowStart": "1h"`)
+	defer c.Close()
+	path := "/render?format=json&target=prod.cpu.load"
+	c.backends["prod"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		c.get(t, path)
+	}
+	c.backends["prod"].fail = false
+	state := c.config.proxy["prod"].state
+	state.mu.Lock()
+	state.lastProbe = time.Now().Add(-probeInterval)
+	state.mu.Unlock()
+	if status, body := c.get(t, path); status != 200 {
+		t.Fatalf("probe of recovered backend: got %d %q", status, body)
+	}
+
+	count := func(n int) (admitted int) {
+		for i := 0; i < n; i++ {
+			status, body := c.get(t, path)
+			switch status {
+			case 200:
+				admitted++
+			case 503:
+			default:
+				t.Fatalf("got %d %q, expected 200 or 503", status, body)
+			}
+		}
+		return admitted
+	}
+	rejected := renderRejected.Value("slowstart")
+	if n := count(200); n == 0 || n > 100 {
+		t.Errorf("%d of 200 requests admitted at the start of the slow start window", n)
+	}
+	if renderRejected.Value("slowstart") == rejected {
+		t.Error("rejected requests not counted")
+	}
+
+	state.mu.Lock()
+	state.recovered = time.Now().Add(-time.Hour)
+	state.mu.Unlock()
+	if n := count(20); n != 20 {
+		t.Errorf("%d of 20 requests admitted after the slow start window", n)
+	}
+}
+
+func TestClusterReadyBackends(t *testing.T) {
+	c := newCluster(t, testData, fmt.Sprintf(`"readyBackends": %d`, len(testData)))
+	defer c.Close()
+	if ok, reason := c.config.Ready(); !ok {
+		t.Fatalf("not ready: %s", reason)
+	}
+	c.backends["prod"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		c.get(t, "/render?format=json&target=prod.cpu.load")
+	}
+	if ok, _ := c.config.Ready(); ok {
+		t.Errorf("ready with %d backends required and one failing", len(testData))
+	}
+	if _, err := Parse(strings.NewReader(`{"readyBackends": -1}`)); err == nil {
+		t.Error("accepted a negative readyBackends")
+	}
+}
+
+func TestClusterHosts(t *testing.T) {
+	g := newFakeGraphite(testData["dev"])
+	defer g.Close()
+	u, err := url.Parse(g.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := `{
+		"mappings": {"dev": "http://graphite.invalid:` + u.Port() + `/"},
+		"hosts": {"graphite.invalid": "127.0.0.1"}
+	}`
+	cfg, err := Parse(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(cfg)
+	defer srv.Close()
+	c := &cluster{Server: srv, config: cfg}
+
+	status, body := c.get(t, "/render?format=json&target=dev.mem.total")
+	if want := `[{"target":"mem.total","datapoints":[[512,100]]}]` + "\n"; status != 200 || body != want {
+		t.Errorf("got %d %q, expected %q", status, body, want)
+	}
+	if _, err := Parse(strings.NewReader(`{"hosts": {"graphite": "localhost"}}`)); err == nil {
+		t.Error("host override to a name was accepted")
+	}
+}
+
+func TestClusterDefaultBackend(t *testing.T) {
+	c := newCluster(t, testData, `"defaultBackend": "prod"`)
+	defer c.Close()
+
+	tests := []struct {
+		query   string
+		backend string
+	}{
+		{"target=constantLine(100)", "prod"},
+		{"target=constantLine(100)&target=dev.cpu.load", "dev"},
+		{"target=dev.cpu.load&target=constantLine(100)", "dev"},
+	}
+	for _, tt := range tests {
+		before := backendRequests.Value(tt.backend)
+		if status, body := c.get(t, "/render?format=json&"+tt.query); status != 200 {
+			t.Errorf("%s: got %d %q", tt.query, status, body)
+		}
+		if n := backendRequests.Value(tt.backend) - before; n != 1 {
+			t.Errorf("%s: sent %v requests to %s, expected 1", tt.query, n, tt.backend)
+		}
+	}
+	if _, err := Parse(strings.NewReader(`{"defaultBackend": "qa"}`)); err == nil {
+		t.Error("unmapped default backend was accepted")
+	}
+}
+
+func TestClusterCacheControl(t *testing.T) {
+	c := newCluster(t, testData, `"cacheControl": "max-age=5", "unknownPrefix": "empty"`)
+	defer c.Close()
+
+	tests := []struct {
+		dev, prod string
+		path      string
+		want      string
+	}{
+		{"public, max-age=60", "public, max-age=30", "/render?format=json&target=sumSeries(dev.cpu.load,prod.cpu.load)", "public, max-age=30"},
+		{"max-age=60", "private, max-age=90", "/render?format=json&target=sumSeries(dev.cpu.load,prod.cpu.load)", "private, max-age=60"},
+		{"max-age=60", "no-store", "/render?format=json&target=sumSeries(dev.cpu.load,prod.cpu.load)", "no-store"},
+		{"max-age=60", "", "/render?format=json&target=sumSeries(dev.cpu.load,prod.cpu.load)", "max-age=5"},
+		{"max-age=60", "", "/render?format=json&target=dev.cpu.load", "max-age=60"},
+		{"", "", "/render?format=json&target=qa.cpu.load", "max-age=5"},
+	}
+	for _, tt := range tests {
+		c.backends["dev"].header = http.Header{"Cache-Control": {tt.dev}}
+		c.backends["prod"].header = http.Header{"Cache-Control": {tt.prod}}
+		rsp, err := http.Get(c.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if cc := rsp.Header.Get("Cache-Control"); cc != tt.want {
+			t.Errorf("%q, %q: got Cache-Control %q, expected %q", tt.dev, tt.prod, cc, tt.want)
+		}
+	}
+}
+
+func TestClusterTemplateVariables(t *testing.T) {
+	tests := []struct {
+		extra  string
+		target string
+		status int
+		body   string
+	}{
+		{
+			"", "$env.cpu.load", 400,
+			`Invalid query "$env.cpu.load": syntax error in "" at column 1`,
+		},
+		{
+			`"templateVariables": "reject"`, "[[env]].cpu.load", 400,
+			`Invalid query "[[env]].cpu.load": unexpanded template variable in "[[env]].cpu.load"`,
+		},
+		{
+			`"templateVariables": "default", "defaultBackend": "prod"`, "${env}.cpu.load", 200,
+			`[{"target":"cpu.load","datapoints":[[5,100],[6,160]]}]` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		c := newCluster(t, testData, tt.extra)
+		q := url.Values{"format": {"json"}, "target": {tt.target}}
+		status, body := c.get(t, "/render?"+q.Encode())
+		if status != tt.status || body != tt.body {
+			t.Errorf("%s with %s: got %d %q, expected %d %q",
+				tt.target, tt.extra, status, body, tt.status, tt.body)
+		}
+		c.Close()
+	}
+	if _, err := Parse(strings.NewReader(`{"templateVariables": "default"}`)); err == nil {
+		t.Error("templateVariables without a defaultBackend was accepted")
+	}
+}
+
+func TestClusterRouteTag(t *testing.T) {
+	c := newCluster(t, testData, `"debug": true, "routeTag": "env"`)
+	defer c.Close()
+
+	tests := []struct {
+		target, backend, final string
+	}{
+		{"seriesByTag('name=cpu.load', 'env=prod')", "prod", "seriesByTag('name=cpu.load')"},
+		{"seriesByTag('env=dev')", "dev", "seriesByTag('env=dev')"},
+		{"aliasByTags(seriesByTag('env=prod', 'dc=east'), 'dc')", "prod", "aliasByTags(seriesByTag('dc=east'), 'dc')"},
+	}
+	for _, tt := range tests {
+		before := backendRequests.Value(tt.backend)
+		rsp, err := http.Get(c.URL + "/render?format=json&target=" + url.QueryEscape(tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if n := backendRequests.Value(tt.backend) - before; n != 1 {
+			t.Errorf("%s: sent %v requests to %s, expected 1", tt.target, n, tt.backend)
+		}
+		var trace routeTrace
+		json.Unmarshal([]byte(rsp.Header.Get("X-Metaphite-Trace")), &trace)
+		if trace.Final != tt.final {
+			t.Errorf("%s: routed as %s, expected %s", tt.target, trace.Final, tt.final)
+		}
+	}
+}
+
+func TestClusterValidateFunctions(t *testing.T) {
+	c := newCluster(t, testData, `"validateFunctions": true`)
+	defer c.Close()
+
+	before := backendRequests.Value("dev")
+	q := url.Values{"format": {"json"}, "target": {"aliasByNod(dev.cpu.load, 1)"}}
+	status, body := c.get(t, "/render?"+q.Encode())
+	want := `Invalid query "aliasByNod(dev.cpu.load, 1)": aliasByNod: unknown function, did you mean aliasByNode?`
+	if status != 400 || body != want {
+		t.Errorf("got %d %q, expected 400 %q", status, body, want)
+	}
+	if n := backendRequests.Value("dev") - before; n != 0 {
+		t.Errorf("sent %v invalid requests to backend", n)
+	}
+}
+
+func TestClusterMaxQueryCost(t *testing.T) {
+	c := newCluster(t, testData, `"maxQueryCost": 10`)
+	defer c.Close()
+
+	if status, body := c.get(t, "/render?format=json&target=dev.cpu.*"); status != 200 {
+		t.Errorf("cheap query: got %d %q", status, body)
+	}
+	status, body := c.get(t, "/render?format=json&target=dev.*.*")
+	want := `Invalid query "dev.*.*": query too expensive (cost 17, limit 10)`
+	if status != 400 || body != want {
+		t.Errorf("expensive query: got %d %q, expected 400 %q", status, body, want)
+	}
+}
+
+func TestClusterMappingObject(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	// serve wraps a fake graphite server, counting its requests.
+	// If check returns an error status for the nth request, it
+	// is sent instead.
+	serve := func(name string, g *fakeGraphite, check func(r *http.Request, n int) int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			n := hits[name]
+			mu.Unlock()
+			if check != nil {
+				if code := check(r, n); code != 0 {
+					httperror(w, code)
+					return
+				}
+			}
+			g.ServeHTTP(w, r)
+		}))
+	}
+	dev := newFakeGraphite(testData["dev"])
+	defer dev.Close()
+	prod := newFakeGraphite(map[string][][2]float64{"prod.cpu.load": {{1, 100}}})
+	defer prod.Close()
+
+	auth := serve("auth", dev, func(r *http.Request, n int) int {
+		if user, pass, _ := r.BasicAuth(); user != "u" || pass != "p" || r.Header.Get("X-Org") != "2" {
+			return http.StatusUnauthorized
+		}
+		return 0
+	})
+	defer auth.Close()
+	prod1 := serve("prod1", prod, nil)
+	defer prod1.Close()
+	prod2 := serve("prod2", prod, nil)
+	defer prod2.Close()
+	flaky := serve("flaky", dev, func(r *http.Request, n int) int {
+		if n == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+	defer flaky.Close()
+
+	cfg, err := Parse(strings.NewReader(`{"mappings": {
+		"dev": {"url": "` + auth.URL + `/", "username": "u", "password": "p",
+			"headers": {"X-Org": "2"}},
+		"prod": {"urls": ["` + prod1.URL + `/", "` + prod2.URL + `/"], "stripPrefix": false},
+		"qa": {"url": "` + flaky.URL + `/", "retries": 1}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cluster{config: cfg, Server: httptest.NewServer(cfg)}
+	defer c.Server.Close()
+
+	for _, target := range []string{"dev.cpu.load", "prod.cpu.load", "prod.cpu.load", "qa.cpu.load"} {
+		code, body := c.get(t, "/render?format=json&target="+target)
+		if code != 200 || !strings.Contains(body, "cpu.load") {
+			t.Errorf("%s: %d %s", target, code, body)
+		}
+	}
+	mu.Lock()
+	if hits["prod1"] != 1 || hits["prod2"] != 1 {
+		t.Errorf("requests to prod were not spread: %v", hits)
+	}
+	if hits["flaky"] != 2 {
+		t.Errorf("qa was not retried: %v", hits)
+	}
+	mu.Unlock()
+
+	// the admin API hides secrets, and a simple mapping stays a string
+	data, err := json.Marshal(map[string]Mapping{
+		"a": {URL: "http://a/"},
+		"b": cfg.Mappings["dev"].redacted(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"http://a/","b":{"url":"` + auth.URL + `/","username":"u","password":"REDACTED","headers":{"X-Org":"2"}}}`
+	if string(data) != want {
+		t.Errorf("marshalled mappings = %s, expected %s", data, want)
+	}
+}
+
+func TestClusterAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as written by htpasswd -B
+	htpasswd := "$2y$" + string(hash[4:])
+	c := newCluster(t, testData, `"auth": {
+		"users": {"grafana": "`+string(hash)+`", "nagios": "`+htpasswd+`"},
+		"tokens": ["t0k3n"]
+	}`)
+	defer c.Close()
+	forwarded := make(chan string, 10)
+	c.backends["dev"].seen = func(r *http.Request) { forwarded <- r.Header.Get("Authorization") }
+
+	tests := []struct {
+		name string
+		set  func(r *http.Request)
+		code int
+	}{
+		{"none", func(r *http.Request) {}, 401},
+		{"password", func(r *http.Request) { r.SetBasicAuth("grafana", "secret") }, 200},
+		{"password again", func(r *http.Request) { r.SetBasicAuth("grafana", "secret") }, 200},
+		{"htpasswd hash", func(r *http.Request) { r.SetBasicAuth("nagios", "secret") }, 200},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("grafana", "guess") }, 401},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("mallory", "secret") }, 401},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3n") }, 200},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3") }, 401},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest("GET", c.URL+"/render?format=json&target=dev.cpu.load", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.set(r)
+		rsp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != tt.code {
+			t.Errorf("%s: status %d, expected %d", tt.name, rsp.StatusCode, tt.code)
+		}
+		if rsp.StatusCode == 401 && len(rsp.Header["Www-Authenticate"]) != 2 {
+			t.Errorf("%s: WWW-Authenticate = %q", tt.name, rsp.Header["Www-Authenticate"])
+		}
+		if rsp.StatusCode == 200 {
+			if auth := <-forwarded; auth != "" {
+				t.Errorf("%s: backend was sent Authorization %q", tt.name, auth)
+			}
+		}
+	}
+
+	for _, hash := range []string{
+		"plaintext",
+		"$2y$05$dzZd7YxcgXJEXpqk6XPxuO",
+		"$2y$99$dzZd7YxcgXJEXpqk6XPxuOqzz/prxlM.I6w84sqh88khEJVmJvxKC",
+	} {
+		if _, err := Parse(strings.NewReader(`{"auth": {"users": {"a": "` + hash + `"}}}`)); err == nil {
+			t.Errorf("accepted password hash %q", hash)
+		}
+	}
+}
+
+func TestClusterDebugDump(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	c := newCluster(t, testData, `"logLevels": {"prod": "debug"}`)
+	defer c.Close()
+
+	for _, target := range []string{"prod.disk.io", "dev.mem.total"} {
+		status, body := c.get(t, "/render?format=csv&target="+target)
+		if status != 200 || !strings.HasSuffix(body, ",100,7\n") && !strings.HasSuffix(body, ",100,512\n") {
+			t.Errorf("%s: got %d %q", target, status, body)
+		}
+	}
+	log := buf.String()
+	for _, want := range []string{
+		`msg="backend request" backend=prod`,
+		`msg="backend response" backend=prod`,
+		`disk.io,100,7`,
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log does not contain %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "backend=dev") {
+		t.Errorf("request to dev was dumped:\n%s", log)
+	}
+}
+
+func TestClusterStats(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+
+	c.get(t, "/render?format=json&target=prod.cpu.load")
+	c.get(t, "/render?format=json&target=sumSeries(prod.disk.io,dev.mem.total)")
+	c.backends["dev"].fail = true
+	c.get(t, "/render?format=json&target=dev.cpu.load")
+
+	stats := c.config.Stats()
+	prod := stats["prod"][c.backends["prod"].URL]
+	dev := stats["dev"][c.backends["dev"].URL]
+	if prod.Requests != 2 || prod.Errors != 0 || prod.BytesReceived == 0 {
+		t.Errorf("prod: got %+v, expected 2 requests, no errors", prod)
+	}
+	if dev.Requests != 2 || dev.Errors != 1 {
+		t.Errorf("dev: got %+v, expected 2 requests, 1 error", dev)
+	}
+	var n int64
+	for _, count := range prod.Latency.Counts {
+		n += count
+	}
+	if n != prod.Requests {
+		t.Errorf("prod: latency histogram has %d observations, expected %d", n, prod.Requests)
+	}
+}
+
+func TestClusterDefaults(t *testing.T) {
+	c := newCluster(t, testData, `"defaults": {"dev": {"xFilesFactor": 0.5, "consolidateBy": "max"}}`)
+	defer c.Close()
+	var mu sync.Mutex
+	var seen url.Values
+	c.backends["dev"].seen = func(r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		seen = r.Form
+		mu.Unlock()
+	}
+	for _, tt := range []struct {
+		query, target, xff string
+	}{
+		{
+			"target=dev.cpu.load",
+			`aliasSub(consolidateBy(cpu.load, 'max'), '^consolidateBy[(](.*),.max.[)]$', '\1')`,
+			"0.5",
+		},
+		{
+			"target=alias(dev.cpu.*,'cpu')&xFilesFactor=0.1",
+			`aliasSub(consolidateBy(alias(cpu.*, 'cpu'), 'max'), '^consolidateBy[(](.*),.max.[)]$', '\1')`,
+			"0.1",
+		},
+		{
+			"target=consolidateBy(dev.cpu.load,'min')",
+			`consolidateBy(cpu.load, 'min')`,
+			"0.5",
+		},
+		{
+			"target=sumSeries(consolidateBy(dev.cpu.*,'sum'))",
+			`sumSeries(consolidateBy(cpu.*, 'sum'))`,
+			"0.5",
+		},
+	} {
+		c.get(t, "/render?format=json&"+tt.query)
+		mu.Lock()
+		target, xff := seen.Get("target"), seen.Get("xFilesFactor")
+		mu.Unlock()
+		if target != tt.target || xff != tt.xff {
+			t.Errorf("%s: backend got target %s, xFilesFactor %q; expected %s, %q",
+				tt.query, target, xff, tt.target, tt.xff)
+		}
+	}
+}
+
+func TestClusterPeers(t *testing.T) {
+	a := newCluster(t, testData, `"adminToken": "secret"`)
+	defer a.Close()
+	admin := httptest.NewServer(a.config.Admin())
+	defer admin.Close()
+	b := a.parse(t, `"adminToken": "secret", "peers": ["`+admin.URL+`/"]`)
+	if _, err := Parse(strings.NewReader(`{"peers": ["` + admin.URL + `/"]}`)); err == nil {
+		t.Error("peers without an adminToken accepted")
+	}
+	b.peers.interval = time.Millisecond
+	unhealthy := func(cfg *Config) bool {
+		be, _ := cfg.backend("dev")
+		return !be.state.healthy()
+	}
+	// asks a's peers until cond holds
+	wait := func(what string, cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: not shared by peer", what)
+			}
+			b.askPeers()
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	a.backends["dev"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		a.get(t, "/render?format=json&target=dev.cpu.load")
+	}
+	if !unhealthy(a.config) {
+		t.Fatal("dev is healthy after failing")
+	}
+	wait("failure", func() bool { return unhealthy(b) })
+	if be, _ := b.backend("prod"); !be.state.healthy() {
+		t.Error("prod is unhealthy after dev failed")
+	}
+
+	// b probes dev as soon as a sees it recover
+	be, _ := a.config.backend("dev")
+	be.state.record(nil)
+	wait("recovery", func() bool {
+		be, _ := b.backend("dev")
+		return be.state.probe()
+	})
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var renderCoalesced = metrics.NewCounter("metaphite_render_coalesced_total",
+	"Render requests answered with the response to an identical concurrent request.")
+
+// maxCoalescedBody is the size of the largest response that is
+// shared between identical requests.
+const maxCoalescedBody = 8 << 20
+
+var errCoalescedSize = errors.New("response too large to share")
+
+// A recorder is an http.ResponseWriter that buffers a response
+// so that it can be replayed to several clients.
+type recorder struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool // the body was larger than maxCoalescedBody
+}
+
+func (r *recorder) Header() http.Header { return r.header }
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.body.Len()+len(p) > maxCoalescedBody {
+		r.overflow = true
+		return 0, errCoalescedSize
+	}
+	return r.body.Write(p)
+}
+
+func (r *recorder) replay(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	if r.status != 0 {
+		w.WriteHeader(r.status)
+	}
+	w.Write(r.body.Bytes())
+}
+
+type flight struct {
+	done    chan struct{}
+	rsp     recorder
+	aborted bool // serving the request panicked with http.ErrAbortHandler
+	cancel  context.CancelFunc
+	waiters int // guarded by flightGroup.mu
+}
+
+// A flightGroup runs one request for each distinct key at a
+// time. Identical requests that arrive while a request is in
+// flight wait for it to finish, and receive a copy of its
+// response.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do answers r with serve, or, if a request with the same key is
+// in flight, with a copy of its response. The request is served
+// in the background, with a context that is only canceled when
+// every request waiting for it has gone, so that the first
+// client to leave does not fail the others. Responses larger
+// than maxCoalescedBody are not shared; each waiting request is
+// then served on its own.
+func (g *flightGroup) do(key string, w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, joined := g.flights[key]
+	if !joined {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		f = &flight{
+			done:   make(chan struct{}),
+			rsp:    recorder{header: make(http.Header)},
+			cancel: cancel,
+		}
+		g.flights[key] = f
+		go g.serve(key, f, r.WithContext(ctx), serve)
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		g.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			g.forget(key, f)
+		}
+		g.mu.Unlock()
+		return
+	}
+	switch {
+	case f.rsp.overflow:
+		serve(w, r)
+	case f.aborted:
+		panic(http.ErrAbortHandler)
+	default:
+		if joined {
+			renderCoalesced.Inc()
+		}
+		f.rsp.replay(w)
+	}
+}
+
+// serve records the response to r in f.
+func (g *flightGroup) serve(key string, f *flight, r *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	defer func() {
+		v := recover()
+		f.aborted = v != nil
+		f.cancel()
+		g.mu.Lock()
+		g.forget(key, f)
+		g.mu.Unlock()
+		close(f.done)
+		// a reverse proxy aborts when it cannot copy a response
+		if v != nil && v != http.ErrAbortHandler {
+			panic(v)
+		}
+	}()
+	serve(&f.rsp, r)
+}
+
+// forget removes f from g, so that later requests with its key
+// are not answered with its response. g.mu is held.
+func (g *flightGroup) forget(key string, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
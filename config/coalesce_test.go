@@ -0,0 +1,173 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	var (
+		g       flightGroup
+		calls   int32
+		release = make(chan struct{})
+	)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-release:
+			w.Write([]byte("response"))
+		case <-r.Context().Done():
+		}
+	}
+	waiters := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			g.mu.Lock()
+			f := g.flights["key"]
+			ok := f != nil && f.waiters == n
+			g.mu.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d requests are not waiting", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	request := func() (*httptest.ResponseRecorder, context.CancelFunc, chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequest("GET", "/render", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			g.do("key", w, r, serve)
+			close(done)
+		}()
+		return w, cancel, done
+	}
+
+	_, cancelFirst, firstDone := request()
+	waiters(1)
+	second, cancelSecond, secondDone := request()
+	defer cancelSecond()
+	waiters(2)
+	third, cancelThird, thirdDone := request()
+	waiters(3)
+
+	// the requests that leave do not wait for the response,
+	// nor fail the one that stays
+	cancelFirst()
+	cancelThird()
+	<-firstDone
+	<-thirdDone
+	waiters(1)
+	close(release)
+	<-secondDone
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("served %d requests, expected 1", n)
+	}
+	if body := second.Body.String(); body != "response" {
+		t.Errorf("got %q after the first request left, expected the response", body)
+	}
+	if third.Body.Len() != 0 {
+		t.Errorf("request that left got %q", third.Body.String())
+	}
+
+	// when every request has left, the shared one is canceled
+	canceled := make(chan struct{})
+	serve = func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	}
+	_, cancelLast, lastDone := request()
+	waiters(1)
+	cancelLast()
+	<-lastDone
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("shared request not canceled after every client left")
+	}
+}
+
+func TestCoalesceLargeResponse(t *testing.T) {
+	var (
+		g     flightGroup
+		calls int32
+	)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		for i := 0; i <= maxCoalescedBody/1024; i++ {
+			if _, err := w.Write(make([]byte, 1024)); err != nil {
+				return
+			}
+		}
+	}
+	w := httptest.NewRecorder()
+	g.do("key", w, httptest.NewRequest("GET", "/render", nil), serve)
+	if w.Body.Len() <= maxCoalescedBody {
+		t.Errorf("got %d bytes, expected the whole response", w.Body.Len())
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("served %d times, expected once shared and once on its own", n)
+	}
+}
+
+func TestClusterCoalesceCredentials(t *testing.T) {
+	c := newCluster(t, testData, `"Coalesce": true`)
+	defer c.Close()
+	var (
+		mu   sync.Mutex
+		auth []string
+		wait = make(chan struct{})
+	)
+	c.backends["dev"].seen = func(r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		<-wait
+	}
+	var wg sync.WaitGroup
+	for _, user := range []string{"alice", "bob"} {
+		req, err := http.NewRequest("GET", c.URL+"/render?target=dev.cpu.load&format=json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, "password")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rsp.Body.Close()
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(auth)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(wait)
+			t.Fatalf("backend saw %d requests from different users, expected 2", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(wait)
+	wg.Wait()
+	if auth[0] == auth[1] {
+		t.Errorf("requests from different users have the same credentials %q", auth[0])
+	}
+}
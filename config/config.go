@@ -20,30 +20,220 @@ package config
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/droyo/metaphite/accesslog"
 	"github.com/droyo/metaphite/certs"
+	"github.com/droyo/metaphite/eval"
 	"github.com/droyo/metaphite/query"
+	"github.com/droyo/metaphite/ratelimit"
 )
 
 type backend struct {
-	url *url.URL
+	prefix      string
+	url         *url.URL   // the first of urls, or the SRV URL
+	urls        []*url.URL // used in turn
+	discovery   *discovery // used instead of urls, if set
+	ring        *hashRing  // spreads metrics over other backends
+	turn        *uint32    // accessed atomically
+	stripPrefix bool
+	local       map[string]bool   // functions evaluated by metaphite
+	carbon      string            // host:port, for the relay
+	limit       *ratelimit.Bucket // rejects excess requests
+	outbound    *ratelimit.Bucket // delays excess requests
+	state       *backendState
+	stats       *backendStats
+	client      *http.Client // for requests not made by the proxy
 	*httputil.ReverseProxy
 }
 
+func (c *Config) newBackend(prefix string, m Mapping) (backend, error) {
+	if m.HashRing != nil {
+		return c.newRingBackend(prefix, m)
+	}
+	var urls []*url.URL
+	var found *discovery
+	var local http.RoundTripper
+	var err error
+	switch {
+	case m.Whisper != "":
+		if m.URL != "" || len(m.URLs) > 0 || m.Kubernetes != nil || m.Consul != nil {
+			return backend{}, errors.New("whisper cannot be combined with url, urls, kubernetes or consul")
+		}
+		var u *url.URL
+		if u, local, err = whisperBackend(m.Whisper); err != nil {
+			return backend{}, err
+		}
+		urls = []*url.URL{u}
+	case m.Kubernetes != nil:
+		if m.URL != "" || len(m.URLs) > 0 {
+			return backend{}, errors.New("kubernetes cannot be combined with url or urls")
+		}
+		if found, err = c.kubernetesDiscovery(*m.Kubernetes, m.Refresh.Duration); err != nil {
+			return backend{}, err
+		}
+		urls = []*url.URL{found.url}
+	case m.Consul != nil:
+		if m.URL != "" || len(m.URLs) > 0 || m.Kubernetes != nil {
+			return backend{}, errors.New("consul cannot be combined with url, urls or kubernetes")
+		}
+		if found, err = c.consulDiscovery(*m.Consul, m.Refresh.Duration); err != nil {
+			return backend{}, err
+		}
+		urls = []*url.URL{found.url}
+	case isSRV(m.URL):
+		if len(m.URLs) > 0 {
+			return backend{}, fmt.Errorf("SRV URL %s cannot be combined with urls", m.URL)
+		}
+		if found, err = c.srvDiscovery(m.URL, m.Refresh.Duration); err != nil {
+			return backend{}, err
+		}
+		urls = []*url.URL{found.url}
+	default:
+		if urls, err = m.urls(); err != nil {
+			return backend{}, err
+		}
+	}
+	transport, err := c.mappingTransport(m)
+	if err != nil {
+		return backend{}, err
+	}
+	if err := m.validHedge(); err != nil {
+		return backend{}, err
+	}
+	if local != nil {
+		transport = local
+	}
+	if m.Carbon != "" {
+		if _, _, err := net.SplitHostPort(m.Carbon); err != nil {
+			return backend{}, fmt.Errorf("carbon: %v", err)
+		}
+	}
+	localFuncs := make(map[string]bool, len(m.LocalFunctions))
+	for _, name := range m.LocalFunctions {
+		if name != "*" && !eval.Supported(name) {
+			return backend{}, fmt.Errorf("localFunctions: %s cannot be evaluated by metaphite", name)
+		}
+		localFuncs[name] = true
+	}
+	if m.Whisper != "" && len(localFuncs) == 0 {
+		localFuncs["*"] = true
+	}
+	stats := newBackendStats()
+	transport = timedTransport{prefix, stats, dumpTransport{prefix, c.debugFor, transport}}
+	if found != nil {
+		transport = discoveryTransport{found, transport}
+	}
+	b := backend{
+		prefix:       prefix,
+		ReverseProxy: new(httputil.ReverseProxy),
+		url:          urls[0],
+		turn:         new(uint32),
+		discovery:    found,
+		stripPrefix:  m.stripPrefix(),
+		local:        localFuncs,
+		carbon:       m.Carbon,
+		state:        new(backendState),
+		stats:        stats,
+		client:       &http.Client{Transport: transport},
+	}
+	if found != nil {
+		b.Director = func(r *http.Request) {
+			u := b.pick()
+			httputil.NewSingleHostReverseProxy(u).Director(r)
+			r.Host = u.Host
+		}
+	} else {
+		b.urls = urls
+		directors := make([]func(*http.Request), len(urls))
+		for i, u := range urls {
+			directors[i] = httputil.NewSingleHostReverseProxy(u).Director
+		}
+		b.Director = func(r *http.Request) {
+			i := b.next(len(urls))
+			directors[i](r)
+			r.Host = urls[i].Host
+		}
+	}
+	if c.Auth.enabled() {
+		director := b.Director
+		b.Director = func(r *http.Request) {
+			director(r)
+			// the client's credentials are for metaphite; the
+			// backend's, if any, are set by its transport
+			r.Header.Del("Authorization")
+		}
+	}
+	if m.HedgeAfter.Duration > 0 {
+		transport = hedgedTransport{
+			prefix:       prefix,
+			after:        m.HedgeAfter.Duration,
+			quantile:     m.HedgeQuantile,
+			stats:        stats,
+			targets:      b.targets,
+			RoundTripper: transport,
+		}
+		b.client.Transport = transport
+	}
+	b.ModifyResponse = countEmpty(prefix)
+	b.ErrorHandler = proxyError(prefix)
+	if c.StateFile != "" {
+		b.state.onChange = func() { go c.saveState() }
+	}
+	b.Transport = instrumentedTransport{
+		prefix:       prefix,
+		state:        b.state,
+		RoundTripper: transport,
+	}
+	return b, nil
+}
+
+// next returns the index, among n URLs, of the URL to send the
+// next request to.
+func (b backend) next(n int) int {
+	if n < 2 {
+		return 0
+	}
+	return int(atomic.AddUint32(b.turn, 1) % uint32(n))
+}
+
+// targets returns the URLs of the backend's servers, which for an
+// SRV URL may be none.
+func (b backend) targets() []*url.URL {
+	if b.discovery != nil {
+		return b.discovery.get()
+	}
+	return b.urls
+}
+
+// pick returns the URL to send the next request to.
+func (b backend) pick() *url.URL {
+	urls := b.targets()
+	if len(urls) == 0 {
+		return b.discovery.none()
+	}
+	return urls[b.next(len(urls))]
+}
+
 // A Config contains the necessary information for running
 // a metaphite server. Most importantly, it contains the
 // mappings of metrics prefixes to backend servers. In the
 // config JSON, the value of the "mappings" key must be
-// an object of prefix -> URL pairs.
+// an object of prefix -> URL pairs. In place of a URL, an
+// object with more settings may be given; see Mapping.
 type Config struct {
 	// Do not validate HTTPS certs
 	InsecureHTTPS bool
@@ -51,14 +241,207 @@ type Config struct {
 	CACertDir string
 	// file to load CA certs from
 	CACert string
-	// The address to listen on, if not specified on the command line.
+	// The address to listen on, if not specified on the command
+	// line and there are no Listeners. See Listener.Address.
 	Address string
-	// Maps from metrics prefix to backend URL.
-	Mappings map[string]string
-	// Dump proxied requests
+	// Permissions of the unix socket at Address, in octal.
+	SocketMode string
+	// Addresses to listen on, and the endpoints served on each.
+	Listeners []Listener
+	// If set, an address to serve the pprof profiles and expvar
+	// variables on, in addition to the other listeners. This is
+	// short for a listener that serves only "debug".
+	DebugAddress string
+	// Limits on the time the HTTP server takes to read a
+	// request or its headers, to write a response, and to wait
+	// for the next request on an idle connection. See
+	// http.Server. ReadHeaderTimeout defaults to 10 seconds and
+	// IdleTimeout to 2 minutes; the others are unlimited.
+	ReadTimeout, ReadHeaderTimeout, WriteTimeout, IdleTimeout Duration
+	// How long to wait for requests in flight to finish when
+	// shutting down. The default is 20 seconds.
+	DrainTimeout Duration
+	// Maps from metrics prefix to backend. See Mapping.
+	Mappings map[string]Mapping
+	// Log the requests sent to backends, and their responses,
+	// with bodies truncated to 4KiB. Use LogLevels to do so for
+	// some backends only.
 	Debug bool
+	// Rules for rewriting metric names before routing.
+	Rewrites []Rewrite
+	// Limits on the rate of incoming requests.
+	RateLimit RateLimits
+	// Bearer token required for the admin endpoints.
+	AdminToken string
+	// Write mappings changed through the admin API back
+	// to the config file.
+	PersistMappings bool
+	// The least severe log messages that are written: "debug",
+	// "info" (the default), "warn" or "error".
+	LogLevel string
+	// Per-mapping log levels, "info" or "debug".
+	LogLevels map[string]string
+	// "text" (the default) for plain log messages and access
+	// logs in the Common Log Format, or "json" to write both as
+	// JSON objects, one per line. It cannot be changed by
+	// reloading the config.
+	LogFormat string
+	// "common" for access logs in the Common Log Format, or
+	// "json" for JSON objects, regardless of LogFormat. By
+	// default, access logs follow LogFormat. It cannot be
+	// changed by reloading the config.
+	AccessLogFormat string
+	// Only log one in this many successful requests in the
+	// access log. Failed requests are always logged, and so
+	// are requests slower than AccessLogSlowRequest. Neither
+	// can be changed by reloading the config.
+	AccessLogSample      int
+	AccessLogSlowRequest Duration
+	// Where to write the access log: "stderr" (the default),
+	// "syslog", or the path of a file. A file is rotated when
+	// it grows larger than AccessLogMaxSize megabytes, or older
+	// than AccessLogMaxAge, if they are set, by renaming it with
+	// the time appended. None of these can be changed by
+	// reloading the config.
+	AccessLog        string
+	AccessLogMaxSize int
+	AccessLogMaxAge  Duration
+	// After a backend recovers, ramp up traffic to it
+	// over this period.
+	SlowStart Duration
+	// File to save backend health in, so that it survives
+	// restarts.
+	StateFile string
+	// URLs of other metaphite instances serving the same
+	// backends, which share what they observe of the health
+	// of the backends. They must have the same AdminToken.
+	Peers []string
+	// Share responses between identical concurrent requests
+	// with the same credentials. Responses larger than 8MB
+	// are not shared.
+	Coalesce bool
+	// How to answer requests for unknown prefixes: "notfound"
+	// (the default) for a 404, or "empty" for an empty result.
+	UnknownPrefix string
+	// Maps from metrics prefix to the URL of a canary backend,
+	// whose responses to JSON render requests are compared with
+	// the primary backend's.
+	Canaries map[string]string
+	// The largest relative difference between primary and canary
+	// values that is not reported.
+	CanaryTolerance float64
+	// How values are written in the json render output that
+	// metaphite produces itself.
+	Output Output
+	// How the responses of several backends to one request are
+	// merged, for each endpoint.
+	Merge Merge
+	// Maps from metrics prefix to default render parameters.
+	Defaults map[string]RenderDefaults
+	// Maps from metrics prefix to backends holding its data
+	// for different periods of time.
+	TimeShards map[string][]TimeShard
+	// The fraction of backends that must be healthy for the
+	// readiness check to pass. By default, one is enough.
+	ReadyQuorum float64
+	// The number of backends that must be healthy for the
+	// readiness check to pass, if greater than ReadyQuorum
+	// requires.
+	ReadyBackends int
+	// The prefix of the backend that receives targets with no
+	// metrics in them, such as constantLine(100), when there are
+	// no other targets in the request to route it by.
+	DefaultBackend string
+	// Cache-Control header for responses produced by metaphite,
+	// rather than a single backend, when the backends involved
+	// do not agree on one.
+	CacheControl string
+	// Reject targets that call unknown graphite functions, or
+	// give them the wrong arguments, instead of sending them to
+	// a backend.
+	ValidateFunctions bool
+	// Reject targets whose estimated cost, as computed by
+	// query.Query.Cost, is greater than this. Zero means no limit.
+	MaxQueryCost int
+	// If set, seriesByTag queries with a filter of the form
+	// 'tag=value' for this tag are routed to the backend with the
+	// prefix value. The filter is removed from the query.
+	RouteTag string
+	// How to handle unexpanded Grafana template variables, such
+	// as $env, in targets. By default they are a syntax error.
+	// With "reject", the error names the variable. With
+	// "default", metrics whose prefix is a variable are routed
+	// to DefaultBackend.
+	TemplateVariables string
+	// Address of a DNS server for resolving backend host names.
+	Resolver string
+	// Maps from backend host name to IP address, bypassing DNS.
+	Hosts map[string]string
+	// Glob pattern of files with more mappings, such as
+	// "conf.d/*.json", relative to the config file.
+	Include string
+	// HTTPS and client certificate settings for the listener.
+	TLS ServerTLS
+	// Credentials required for render requests and metrics.
+	Auth Auth
+	// Client networks that may, or may not, make requests.
+	Access Access
+	// An external service that decides which render requests
+	// may be made.
+	Authorization Authorization
+	// How much each client may use the render endpoint.
+	Quota Quota
+	// Where to record who made each render request.
+	Audit Audit
+	// URL paths to answer with a 404, such as "/admin/". A path
+	// ending in a slash disables everything under it.
+	DisabledPaths []string
+	// Networks, in CIDR notation, or addresses of load balancers
+	// and proxies in front of metaphite. For requests from them,
+	// the access log records the client address given in the
+	// X-Forwarded-For or X-Real-IP header. It cannot be changed
+	// by reloading the config.
+	TrustedProxies []string
+	// Log the client's port, as well as its address, in the
+	// access log. It cannot be changed by reloading the config.
+	AccessLogPort bool
+	// Where to push metaphite's own metrics. It cannot be
+	// changed by reloading the config.
+	Carbon Carbon
+	// Relay metrics written to metaphite to the backends'
+	// carbon servers.
+	Relay Relay
+	// Where to watch for mappings in etcd. It cannot be changed
+	// by reloading the config.
+	Etcd Etcd
 
-	proxy map[string]backend
+	path        string              // config file, if any
+	included    map[string]string   // prefix -> file it is mapped in
+	dynamic     map[string]*Mapping // from etcd -> mapping it replaced
+	hooks       []Hook
+	warnings    []string
+	mu          sync.RWMutex
+	updateMu    sync.Mutex // serializes changes to the mappings
+	saveMu      sync.Mutex // serializes writes to StateFile
+	auth        authCache
+	authz       *http.Client // for Authorization
+	access      accessList
+	trusted     []*net.IPNet // TrustedProxies
+	flights     flightGroup
+	canaries    map[string]*canary
+	shards      map[string][]shard
+	proxy       map[string]backend
+	tlsconfig   *tls.Config // for requests to backends
+	serverTLS   *tls.Config // for the listener
+	dialer      *net.Dialer
+	globalLimit *ratelimit.Bucket
+	clientLimit *ratelimit.Set
+	quotas      *quotas
+	audit       auditSink
+	peers       *peers
+	format      eval.Format   // of Output
+	mergeRender MergeStrategy // of Merge
+	mergeTags   MergeStrategy // of Merge, for autocomplete
 }
 
 // ParseFile opens the config file at path and calls Parse
@@ -68,22 +451,42 @@ func ParseFile(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return Parse(file)
+	defer file.Close()
+	return parse(file, path)
 }
 
 // Parse parses the config data from r and
-// parses its content into a *Config value.
+// parses its content into a *Config value. Unknown keys and
+// invalid settings are errors; all of them are reported in
+// the returned error.
 func Parse(r io.Reader) (*Config, error) {
+	return parse(r, "")
+}
+
+func parse(r io.Reader, path string) (*Config, error) {
 	var pool certs.Pool
 	tlsconfig := new(tls.Config)
 	cfg := Config{
-		Mappings: make(map[string]string),
-		proxy:    make(map[string]backend),
+		Mappings:  make(map[string]Mapping),
+		LogLevels: make(map[string]string),
+		proxy:     make(map[string]backend),
+		tlsconfig: tlsconfig,
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, jsonPosition(data, err)
 	}
-	d := json.NewDecoder(r)
-	if err := d.Decode(&cfg); err != nil {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
 		return nil, err
 	}
+	// Everything that can be checked is, so that all the
+	// problems in the file are reported together.
+	errs := configErrors(unknownKeys("", raw, reflect.TypeOf(&cfg)))
+	cfg.path = path
 	if cfg.InsecureHTTPS {
 		tlsconfig.InsecureSkipVerify = true
 	}
@@ -96,16 +499,76 @@ func Parse(r io.Reader) (*Config, error) {
 	if pool != nil {
 		tlsconfig.RootCAs = pool.CertPool()
 	}
+	if err := cfg.setupDialer(); err != nil {
+		return nil, append(errs, err)
+	}
+	errs.add(cfg.setupServerTLS())
+	errs.add(cfg.Auth.validate())
+	errs.add(cfg.setupAccess())
+	errs.add(cfg.validListeners())
+	errs.add(validDisabledPaths(cfg.DisabledPaths))
+	errs.add(validUnknownPrefix(cfg.UnknownPrefix))
+	errs.add(validReadiness(cfg.ReadyQuorum, cfg.ReadyBackends))
+	if cfg.Mappings == nil {
+		cfg.Mappings = make(map[string]Mapping)
+	}
+	if cfg.LogLevels == nil {
+		cfg.LogLevels = make(map[string]string)
+	}
+	errs.add(cfg.loadIncludes())
+	for pfx, d := range cfg.Defaults {
+		if err := d.validate(); err != nil {
+			errs.add(fmt.Errorf("defaults for %q: %v", pfx, err))
+		}
+	}
+	for _, level := range cfg.LogLevels {
+		errs.add(validLevel(level))
+	}
+	errs.add(validLogFormat(cfg.LogFormat))
+	errs.add(validAccessLogFormat(cfg.AccessLogFormat))
+	errs.add(validSampling(cfg.AccessLogSample, cfg.AccessLogSlowRequest.Duration))
+	errs.add(validRotation(cfg.AccessLogMaxSize, cfg.AccessLogMaxAge.Duration))
+	errs.add(validCarbon(cfg.Carbon))
+	errs.add(validRelay(cfg.Relay))
+	errs.add(validEtcd(cfg.Etcd))
+	errs.add(validLogLevel(cfg.LogLevel))
+	for i := range cfg.Rewrites {
+		errs.add(cfg.Rewrites[i].compile())
+	}
+	mapped := len(errs)
+	errs = append(errs, cfg.validPrefixes()...)
 	for k, v := range cfg.Mappings {
-		if u, err := url.Parse(v); err != nil {
+		b, err := cfg.newBackend(k, v)
+		if err != nil {
+			errs.add(fmt.Errorf("mapping for %q: %v", k, err))
+			continue
+		}
+		cfg.proxy[k] = b
+	}
+	// The remaining checks refer to mappings, and would only
+	// repeat the errors above if some of them are missing.
+	if len(errs) > mapped {
+		return nil, errs
+	}
+	if _, ok := cfg.proxy[cfg.DefaultBackend]; cfg.DefaultBackend != "" && !ok {
+		errs.add(fmt.Errorf("defaultBackend %q is not mapped", cfg.DefaultBackend))
+	}
+	errs.add(cfg.validTemplateVariables())
+	errs.add(cfg.setupRateLimits())
+	errs.add(cfg.setupCanaries())
+	errs.add(cfg.setupAuthorization())
+	errs.add(cfg.setupQuotas())
+	errs.add(cfg.setupAudit())
+	errs.add(cfg.setupShards())
+	errs.add(cfg.setupPeers())
+	errs.add(cfg.setupOutput())
+	errs.add(cfg.setupMerge())
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	if cfg.StateFile != "" {
+		if err := cfg.loadState(); err != nil {
 			return nil, err
-		} else {
-			b := backend{
-				ReverseProxy: httputil.NewSingleHostReverseProxy(u),
-				url:          u,
-			}
-			b.Transport = &http.Transport{TLSClientConfig: tlsconfig}
-			cfg.proxy[k] = b
 		}
 	}
 	return &cfg, nil
@@ -125,23 +588,70 @@ func unavailable(w http.ResponseWriter) { httperror(w, 503) }
 // graphite server based on its content. If the query contains
 // metrics that map one (and only one) of the prefixes in
 // a configuration, ServeHTTP will strip the prefix and proxy
-// the request to the appropriate backend server.
+// the request to the appropriate backend server. JSON requests
+// whose metrics span several backends are answered by combining
+// the responses of each backend.
 func (c *Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/render" {
 		notfound(w)
 		return
 	}
+	c.askPeers()
+
+	audit := c.startAudit(r)
+	if audit != nil {
+		defer func() { c.finishAudit(audit, r) }()
+		w = audit.wrap(w)
+	}
+
+	if !c.permitted(w, r) {
+		renderRejected.Inc("access")
+		return
+	}
+
+	if !c.authenticate(w, r) {
+		renderRejected.Inc("auth")
+		return
+	}
+	audit.authenticated(c, r)
+
+	if !c.allow(w, r) {
+		renderRejected.Inc("ratelimit")
+		return
+	}
+
+	acct, ok := c.admit(w, r)
+	if !ok {
+		renderRejected.Inc("quota")
+		return
+	}
+	if acct != nil {
+		defer acct.finish()
+		w, r = acct.wrap(w, r)
+	}
 
 	if err := r.ParseForm(); err != nil {
-		log.Println(err)
+		slog.Debug("invalid render request", "err", err)
 		badrequest(w)
 		return
 	}
+	jsonBody := r.Method == "POST" && isJSON(r)
+	if jsonBody {
+		if err := parseJSONForm(r); err != nil {
+			renderRejected.Inc("parse")
+			w.WriteHeader(400)
+			fmt.Fprint(w, err)
+			return
+		}
+	}
 
 	targets := r.Form["target"]
+	renderTargets.Observe(float64(len(targets)))
+	accesslog.Annotate(r, "query", targets)
 	queries := make([]*query.Query, 0, len(targets))
 	for _, target := range targets {
-		if q, err := query.Parse(target); err != nil {
+		if q, err := c.parse(target); err != nil {
+			renderRejected.Inc("parse")
 			w.WriteHeader(400)
 			fmt.Fprintf(w, "Invalid query %q: %v", target, err)
 			return
@@ -149,7 +659,29 @@ func (c *Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			queries = append(queries, q)
 		}
 	}
-	form, server := c.proxyTargets(queries)
+	queries, err := c.queryHooks(r, queries)
+	if err != nil {
+		renderRejected.Inc("hook")
+		w.WriteHeader(403)
+		fmt.Fprint(w, err)
+		return
+	}
+	if !c.authorize(w, r, queries) {
+		renderRejected.Inc("authorization")
+		return
+	}
+	if rw := c.resultHooks(r); rw != nil {
+		defer c.writeResult(w, r, rw)
+		w = rw
+	}
+	keys := c.backendKeys(queries)
+	audit.routed(queries, keys)
+	if len(keys) > 1 || r.Form.Get("format") == "json" && c.evaluatesLocally(queries) {
+		c.evaluate(w, r, queries)
+		return
+	}
+	form, server, traces := c.proxyTargets(queries)
+	audit.routedTo(server.prefix)
 	for k, v := range r.Form {
 		if k != "target" {
 			form[k] = v
@@ -157,51 +689,154 @@ func (c *Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if server.ReverseProxy == nil {
-		log.Printf("no backend for %q", queries)
-		badrequest(w)
+		if c.Debug {
+			slog.Info("no backend", "query", fmt.Sprint(queries))
+		}
+		c.unknownPrefix(w, r.Form.Get("format"))
+		return
+	}
+
+	c.applyFormDefaults(form, server.prefix)
+	accesslog.Annotate(r, "backend", server.prefix)
+
+	if server.limit != nil {
+		if ok, wait := server.limit.Take(); !ok {
+			renderRejected.Inc("ratelimit")
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
+	if server.ring != nil {
+		server = server.ringNode(keys)
+	}
+
+	if c.debugFor(server.prefix) {
+		c.writeTraces(w, traces)
+	}
+
+	if windows := c.pickShards(server.prefix, form); len(windows) > 1 && form.Get("format") == "json" {
+		c.stitch(w, r, form, windows)
+		return
+	} else if len(windows) > 0 {
+		// the newest shard has the most relevant data
+		server = windows[len(windows)-1].backend
+	}
+
+	if ok, reason := server.state.admit(c.SlowStart.Duration); !ok {
+		renderRejected.Inc(reason)
+		w.Header().Set("Retry-After", "1")
+		unavailable(w)
 		return
 	}
 
 	switch r.Method {
 	case "GET":
 		r.URL.RawQuery = form.Encode()
-		r.Host = server.url.Host
-		if c.Debug {
-			if dmp, err := httputil.DumpRequest(r, false); err == nil {
-				log.Printf("%s", dmp)
-			}
-		}
 	case "POST":
 		s := form.Encode()
+		if jsonBody {
+			b, err := encodeJSONForm(form)
+			if err != nil {
+				slog.Error("encode JSON form", "err", err)
+				httperror(w, 500)
+				return
+			}
+			s = string(b)
+		}
 		r.ContentLength = int64(len(s))
 		r.Body = ioutil.NopCloser(
 			strings.NewReader(s))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(s)), nil
+		}
+	}
+	if err := server.wait(r.Context()); err != nil {
+		renderRejected.Inc("canceled")
+		return
+	}
+	server.state.begin()
+	defer server.state.end()
+	serve := server.ServeHTTP
+	if cn := c.canaries[server.prefix]; cn != nil && form.Get("format") == "json" {
+		serve = cn.compare(form, c.CanaryTolerance, serve)
+	}
+	if c.Coalesce {
+		// form contains the rewritten targets and any
+		// time range, so it identifies the response, and
+		// the credentials identify who may see it.
+		key := strings.Join([]string{
+			server.prefix,
+			r.Method,
+			r.Header.Get("Accept-Encoding"),
+			r.Header.Get("Authorization"),
+			r.Header.Get("Cookie"),
+			form.Encode(),
+		}, "\x00")
+		c.flights.do(key, w, r, serve)
+	} else {
+		serve(w, r)
 	}
-	server.ServeHTTP(w, r)
 }
 
-func (c *Config) proxyTargets(queries []*query.Query) (url.Values, backend) {
+func (c *Config) proxyTargets(queries []*query.Query) (url.Values, backend, []routeTrace) {
 	var server backend
 	var targets []string
+	var traces []routeTrace
+	metricless := true
 	for _, q := range queries {
-		tgt, srv := c.route(q)
+		trace := routeTrace{Target: q.String()}
+		tgt, srv, rw := c.route(q)
 		targets = append(targets, tgt)
-		server = srv
+		// targets without metrics follow the others
+		if len(q.Metrics()) > 0 || srv.ReverseProxy != nil {
+			server = srv
+			metricless = false
+		}
+		trace.Rewrites = rw
+		trace.Backend = srv.prefix
+		trace.Final = tgt
+		traces = append(traces, trace)
+	}
+	if metricless && c.DefaultBackend != "" {
+		server, _ = c.backend(c.DefaultBackend)
+		for i := range traces {
+			traces[i].Backend = server.prefix
+		}
 	}
-	return url.Values{"target": targets}, server
+	return url.Values{"target": targets}, server, traces
 }
 
-func (c *Config) route(q *query.Query) (target string, server backend) {
+func (c *Config) route(q *query.Query) (target string, server backend, rewrites []appliedRewrite) {
 	for _, m := range q.Metrics() {
+		rewrites = append(rewrites, c.rewrite(m)...)
 		pfx, rest := m.Split()
-		if c.Debug {
-			log.Printf("%q -> %q, %q", *m, pfx, rest)
+		if c.debugFor(string(pfx)) {
+			slog.Info("route", "metric", string(*m), "prefix", string(pfx), "rest", string(rest))
 		}
-		s, ok := c.proxy[string(pfx)]
+		s, ok := c.prefixBackend(pfx)
 		if ok {
 			server = s
+			if !s.stripPrefix {
+				continue
+			}
 		}
 		*m = rest
 	}
-	return q.String(), server
+	for _, t := range q.TagQueries() {
+		if s, i, ok := c.tagBackend(t); ok {
+			server = s
+			// the backend's series do not have the tag
+			if len(t.Filters) > 1 {
+				t.Filters = append(t.Filters[:i], t.Filters[i+1:]...)
+			}
+		}
+	}
+	strip := server.prefix
+	if !server.stripPrefix {
+		strip = ""
+	}
+	rewrites = append(rewrites, c.rewriteStringArgs(q, strip)...)
+	c.applyDefaults(q, server.prefix)
+	return q.String(), server, rewrites
 }
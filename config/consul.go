@@ -0,0 +1,174 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Consul selects the instances of a service in the Consul catalog
+// that are a backend's servers. Only instances whose health checks
+// all pass are used. For example:
+//
+// 	"prod": {
+// 		"consul": {
+// 			"service": "graphite-api",
+// 			"tag": "prod"
+// 		}
+// 	}
+//
+// While the backend is in use, metaphite watches the service with
+// blocking queries, so that changes are seen as they happen.
+type Consul struct {
+	// Address of the Consul agent, as a URL or host:port. The
+	// default is $CONSUL_HTTP_ADDR, or 127.0.0.1:8500.
+	Address string `json:"address,omitempty"`
+	// ACL token. The default is $CONSUL_HTTP_TOKEN.
+	Token string `json:"token,omitempty"`
+	// Name of the service.
+	Service string `json:"service"`
+	// Only use instances with this tag.
+	Tag string `json:"tag,omitempty"`
+	// Datacenter of the service. The default is the agent's.
+	Datacenter string `json:"datacenter,omitempty"`
+	// "http", the default, or "https".
+	Scheme string `json:"scheme,omitempty"`
+	// Path of the graphite API on the servers.
+	Path string `json:"path,omitempty"`
+}
+
+// consulDiscovery prepares the lookup of the instances of the
+// service selected by cs.
+func (c *Config) consulDiscovery(cs Consul, refresh time.Duration) (*discovery, error) {
+	if cs.Service == "" {
+		return nil, errors.New("consul: service is required")
+	}
+	scheme := cs.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("consul: invalid scheme %q", cs.Scheme)
+	}
+	if cs.Address == "" {
+		cs.Address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if cs.Address == "" {
+		cs.Address = "127.0.0.1:8500"
+	}
+	if !strings.Contains(cs.Address, "://") {
+		cs.Address = "http://" + cs.Address
+	}
+	agent, err := url.Parse(cs.Address)
+	if err != nil || agent.Host == "" {
+		return nil, fmt.Errorf("consul: invalid address %q", cs.Address)
+	}
+	if cs.Token == "" {
+		cs.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+
+	q := url.Values{"passing": {"1"}}
+	if cs.Tag != "" {
+		q.Set("tag", cs.Tag)
+	}
+	if cs.Datacenter != "" {
+		q.Set("dc", cs.Datacenter)
+	}
+	u := &url.URL{Scheme: "consul", Host: agent.Host, Path: "/" + cs.Service, RawQuery: q.Encode()}
+	d := newDiscovery(u, scheme, cs.Path, refresh)
+	w := &consulWatch{
+		url:    *agent.JoinPath("/v1/health/service", cs.Service),
+		query:  q,
+		token:  cs.Token,
+		client: &http.Client{Transport: c.transport()},
+	}
+	d.lookup = func(ctx context.Context, watch bool) ([]*url.URL, error) {
+		return w.instances(ctx, d, watch)
+	}
+	return d, nil
+}
+
+// A consulWatch queries the health of a service.
+type consulWatch struct {
+	url    url.URL
+	query  url.Values
+	token  string
+	client *http.Client
+	index  atomic.Uint64 // of the last response
+}
+
+// consulEntry is the part of an entry of Consul's service health
+// response that is needed to find a server.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// instances returns the URLs of the healthy instances of the
+// service. If watch is true, it is a blocking query, which returns
+// when they change, or after the discovery's refresh interval.
+func (w *consulWatch) instances(ctx context.Context, d *discovery, watch bool) ([]*url.URL, error) {
+	u := w.url
+	q := make(url.Values, len(w.query)+2)
+	for k, v := range w.query {
+		q[k] = v
+	}
+	if index := w.index.Load(); watch && index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", d.refresh.String())
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if w.token != "" {
+		req.Header.Set("X-Consul-Token", w.token)
+	}
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: %s", rsp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(rsp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("consul: %v", err)
+	}
+	// an index that goes backwards must not be waited on
+	index, _ := strconv.ParseUint(rsp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < w.index.Load() {
+		index = 0
+	}
+	w.index.Store(index)
+
+	var urls []*url.URL
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		if addr == "" || e.Service.Port == 0 {
+			continue
+		}
+		urls = append(urls, d.server(net.JoinHostPort(addr, strconv.Itoa(e.Service.Port))))
+	}
+	return urls, nil
+}
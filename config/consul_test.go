@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsul(t *testing.T) {
+	a, b := newFakeGraphite(nil), newFakeGraphite(nil)
+	defer a.Close()
+	defer b.Close()
+	var mu sync.Mutex
+	index, current := 1, a
+	var watched bool
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/health/service/graphite-api" || q.Get("passing") != "1" ||
+			q.Get("tag") != "prod" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "unexpected request "+r.URL.String(), 403)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if q.Get("index") != "" {
+			watched = true
+		}
+		u, _ := url.Parse(current.URL)
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		fmt.Fprintf(w, `[{"Node": {"Address": %q}, "Service": {"Address": "", "Port": %s}}]`, u.Hostname(), u.Port())
+	}))
+	defer agent.Close()
+
+	c := newCluster(t, nil, `"mappings": {"prod": {
+		"consul": {"address": "`+agent.URL+`", "token": "secret", "service": "graphite-api", "tag": "prod"},
+		"refresh": "1ms"
+	}}`)
+	defer c.Close()
+	if code, body := c.get(t, "/render?format=json&target=prod.cpu"); code != 200 {
+		t.Fatalf("got %d %s", code, body)
+	}
+	if n := c.config.Stats()["prod"][a.URL].Requests; n != 1 {
+		t.Errorf("%s got %d requests, expected 1", a.URL, n)
+	}
+
+	mu.Lock()
+	index, current = 2, b
+	mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.config.Stats()["prod"][b.URL].Requests == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests were not sent to the new instance")
+		}
+		c.get(t, "/render?format=json&target=prod.cpu")
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !watched {
+		t.Error("refreshes were not blocking queries")
+	}
+}
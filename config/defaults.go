@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// RenderDefaults are added to render requests sent to a
+// backend, when the client has not chosen its own. In the
+// config JSON,
+//
+// 	"defaults": {
+// 		"staging": {"xFilesFactor": 0.5, "consolidateBy": "max"}
+// 	}
+//
+// A default consolidation function is applied by wrapping each
+// target with metrics that does not call consolidateBy in a call
+// to it. As graphite includes the call in the names of the
+// resulting series, the target is also wrapped in a call to
+// aliasSub that removes it, so that the names are unchanged:
+//
+// 	aliasSub(consolidateBy(prod.cpu.*, 'max'), '^consolidateBy[(](.*),.max.[)]$', '\1')
+type RenderDefaults struct {
+	XFilesFactor  *float64
+	ConsolidateBy string
+}
+
+func (d RenderDefaults) validate() error {
+	if x := d.XFilesFactor; x != nil && (*x < 0 || *x > 1) {
+		return fmt.Errorf("xFilesFactor %v out of range [0,1]", *x)
+	}
+	switch d.ConsolidateBy {
+	case "", "sum", "average", "avg", "min", "max", "first", "last":
+		return nil
+	}
+	return fmt.Errorf("unknown consolidation function %q", d.ConsolidateBy)
+}
+
+// applyDefaults adds the default consolidation function for the
+// backend with the given prefix to q, unless q chooses its own.
+func (c *Config) applyDefaults(q *query.Query, prefix string) {
+	d, ok := c.Defaults[prefix]
+	if !ok || d.ConsolidateBy == "" || callsFunc(q.Expr, "consolidateBy") {
+		return
+	}
+	if len(q.Metrics()) == 0 && len(q.TagQueries()) == 0 {
+		// nothing to consolidate
+		return
+	}
+	fn := query.Value("'" + d.ConsolidateBy + "'")
+	search := query.Value("'^consolidateBy[(](.*),." + d.ConsolidateBy + ".[)]$'")
+	replace := query.Value(`'\1'`)
+	q.Expr = &query.Func{
+		Name: "aliasSub",
+		Args: []query.Expr{
+			&query.Func{Name: "consolidateBy", Args: []query.Expr{q.Expr, &fn}},
+			&search,
+			&replace,
+		},
+	}
+}
+
+// applyFormDefaults adds the default render parameters for the
+// backend with the given prefix to form.
+func (c *Config) applyFormDefaults(form url.Values, prefix string) {
+	d, ok := c.Defaults[prefix]
+	if !ok {
+		return
+	}
+	if d.XFilesFactor != nil && form.Get("xFilesFactor") == "" {
+		form.Set("xFilesFactor", strconv.FormatFloat(*d.XFilesFactor, 'g', -1, 64))
+	}
+}
+
+// callsFunc returns true if the expression e contains a call
+// to the named function.
+func callsFunc(e query.Expr, name string) bool {
+	var found bool
+	query.Walk(e, func(e query.Expr) bool {
+		if f, ok := e.(*query.Func); ok && f.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func validDisabledPaths(paths []string) error {
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("disabledPaths: %q does not start with /", p)
+		}
+	}
+	return nil
+}
+
+// disabled reports whether path is one of the DisabledPaths, or
+// under one that ends in a slash.
+func (c *Config) disabled(path string) bool {
+	for _, d := range c.DisabledPaths {
+		if path == d || strings.HasSuffix(d, "/") && strings.HasPrefix(path, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeEnabled wraps h so that requests for the DisabledPaths
+// are answered with a 404 instead of reaching h.
+func (c *Config) ServeEnabled(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.disabled(r.URL.Path) {
+			notfound(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
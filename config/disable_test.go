@@ -0,0 +1,32 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDisabledPaths(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{"disabledPaths": ["/render", "/admin/"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := cfg.ServeEnabled(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, code := range map[string]int{
+		"/render":         404,
+		"/render/x":       200,
+		"/admin/mappings": 404,
+		"/admin":          200,
+		"/readyz":         200,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("%s: status %d, expected %d", path, w.Code, code)
+		}
+	}
+	if _, err := Parse(strings.NewReader(`{"disabledPaths": ["render"]}`)); err == nil {
+		t.Error("accepted a relative path")
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the servers of a discovered backend are looked up
+// again, unless the mapping says otherwise.
+const defaultRefresh = 30 * time.Second
+
+// A discovery is the set of servers of a backend that are found
+// at run time, through DNS, Kubernetes or Consul, rather than
+// listed in the config. They are looked up when first used, and
+// again, in the background, when used after refresh has passed,
+// so that the lookups of a replaced config stop along with its
+// requests.
+type discovery struct {
+	url     *url.URL // identifies the backend, as configured
+	scheme  string   // of the servers
+	path    string   // of the servers
+	refresh time.Duration
+	// If watch is true, lookup may wait up to refresh for the
+	// servers to change, if it can be told when they do.
+	lookup func(ctx context.Context, watch bool) ([]*url.URL, error)
+
+	mu         sync.Mutex
+	urls       []*url.URL
+	updated    time.Time
+	refreshing bool
+}
+
+func newDiscovery(u *url.URL, scheme, path string, refresh time.Duration) *discovery {
+	if refresh <= 0 {
+		refresh = defaultRefresh
+	}
+	return &discovery{url: u, scheme: scheme, path: path, refresh: refresh}
+}
+
+// get returns the current servers, looking them up first if they
+// have not been yet.
+func (d *discovery) get() []*url.URL {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.updated.IsZero() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		d.set(d.find(ctx, false))
+	} else if !d.refreshing && time.Since(d.updated) > d.refresh {
+		d.refreshing = true
+		go d.update()
+	}
+	return d.urls
+}
+
+func (d *discovery) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), d.refresh+10*time.Second)
+	defer cancel()
+	urls, err := d.find(ctx, true)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.set(urls, err)
+	d.refreshing = false
+}
+
+// find looks up the servers, and returns their URLs in a stable
+// order.
+func (d *discovery) find(ctx context.Context, watch bool) ([]*url.URL, error) {
+	urls, err := d.lookup(ctx, watch)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i].Host < urls[j].Host })
+	return urls, nil
+}
+
+// set replaces the servers with the result of a lookup. After an
+// error, the previous servers are kept until the next lookup.
+func (d *discovery) set(urls []*url.URL, err error) {
+	d.updated = time.Now()
+	if err != nil {
+		slog.Warn("backend discovery failed", "backend", d.url.String(), "err", err)
+		return
+	}
+	if !sameURLs(urls, d.urls) {
+		slog.Info("backend servers changed", "backend", d.url.String(), "servers", len(urls))
+	}
+	d.urls = urls
+}
+
+// server returns the URL of the server at host.
+func (d *discovery) server(host string) *url.URL {
+	return &url.URL{Scheme: d.scheme, Host: host, Path: d.path}
+}
+
+func sameURLs(a, b []*url.URL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// none is the URL requests are sent to when no servers are known;
+// discoveryTransport fails them.
+func (d *discovery) none() *url.URL {
+	return d.server("")
+}
+
+// A discoveryTransport fails requests for a backend that has no
+// servers, with a clearer error than the one for a missing host.
+type discoveryTransport struct {
+	*discovery
+	http.RoundTripper
+}
+
+func (t discoveryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == "" {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, fmt.Errorf("no servers found for %s", t.url)
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
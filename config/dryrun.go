@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// A Route describes where a render target, or part of one, would
+// be sent.
+type Route struct {
+	// The target, or the part of it that is sent to one backend
+	// when metaphite evaluates the rest.
+	Target string
+	// The rewrite rules applied to metric names in Target, as
+	// "rule: from -> to".
+	Rewrites []string
+	// The prefix of the backend, or "" if there is none.
+	Backend string
+	// The URLs the target may be sent to. There are several if
+	// the backend has several URLs, which are used in turn, or
+	// if the request is split across time shards.
+	URLs []string
+	// The target as it is sent to the backend.
+	Upstream string
+}
+
+// Routes reports how the render request with the given form
+// would be routed, without sending it. Evaluated is true if the
+// targets span several backends, so that metaphite would send
+// parts of them to each backend and combine the results itself.
+func (c *Config) Routes(form url.Values) (routes []Route, evaluated bool, err error) {
+	targets := form["target"]
+	if len(targets) == 0 {
+		return nil, false, errors.New("no targets")
+	}
+	var queries []*query.Query
+	for _, target := range targets {
+		q, err := c.parse(target)
+		if err != nil {
+			return nil, false, fmt.Errorf("Invalid query %q: %v", target, err)
+		}
+		queries = append(queries, q)
+	}
+	keys := c.backendKeys(queries)
+	if len(keys) > 1 {
+		ev := c.evaluator()
+		_, byExpr, err := c.leaves(ev, queries)
+		if err != nil {
+			return nil, true, err
+		}
+		// include the leaves with an unknown prefix, in order
+		for _, q := range queries {
+			for _, e := range ev.Leaves(q) {
+				l := byExpr[e]
+				urls := l.server.targets()
+				if l.nodes != nil {
+					urls = nil
+					for _, n := range l.nodes {
+						urls = append(urls, n.url)
+					}
+				}
+				routes = append(routes, Route{
+					Target:   exprString(l.expr),
+					Rewrites: rewriteStrings(l.rewrites),
+					Backend:  l.server.prefix,
+					URLs:     urlStrings(urls),
+					Upstream: l.target,
+				})
+			}
+		}
+		return routes, true, nil
+	}
+
+	_, server, traces := c.proxyTargets(queries)
+	if server.ring != nil {
+		server = server.ringNode(keys)
+	}
+	urls := server.targets()
+	if windows := c.pickShards(server.prefix, form); len(windows) > 1 && form.Get("format") == "json" {
+		urls = nil
+		for _, w := range windows {
+			urls = append(urls, w.url)
+		}
+	} else if len(windows) > 0 {
+		urls = windows[len(windows)-1].urls
+	}
+	for _, t := range traces {
+		routes = append(routes, Route{
+			Target:   t.Target,
+			Rewrites: rewriteStrings(t.Rewrites),
+			Backend:  server.prefix,
+			URLs:     urlStrings(urls),
+			Upstream: t.Final,
+		})
+	}
+	return routes, false, nil
+}
+
+func rewriteStrings(list []appliedRewrite) []string {
+	var result []string
+	for _, rw := range list {
+		result = append(result, fmt.Sprintf("%s: %s -> %s", rw.Rule, rw.From, rw.To))
+	}
+	return result
+}
+
+func urlStrings(list []*url.URL) []string {
+	var result []string
+	for _, u := range list {
+		result = append(result, u.String())
+	}
+	return result
+}
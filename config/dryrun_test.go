@@ -0,0 +1,52 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{
+		"mappings": {
+			"prod": {"urls": ["http://graphite-1/", "http://graphite-2/"]},
+			"dev": "http://dev-graphite/"
+		},
+		"rewrites": [{"pattern": "^stage\\.(.*)", "replacement": "dev.$1"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, evaluated, err := cfg.Routes(url.Values{"target": {"sumSeries(stage.cpu.*)"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Route{{
+		Target:   "sumSeries(stage.cpu.*)",
+		Rewrites: []string{`^stage\.(.*): stage.cpu.* -> dev.cpu.*`},
+		Backend:  "dev",
+		URLs:     []string{"http://dev-graphite/"},
+		Upstream: "sumSeries(cpu.*)",
+	}}
+	if evaluated || !reflect.DeepEqual(routes, want) {
+		t.Errorf("got %+v, %v\nwant %+v", routes, evaluated, want)
+	}
+
+	routes, evaluated, err = cfg.Routes(url.Values{"target": {"sumSeries(prod.a, dev.b)"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !evaluated || len(routes) != 2 {
+		t.Fatalf("got %+v, %v; expected two evaluated parts", routes, evaluated)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Backend < routes[j].Backend })
+	if routes[1].Backend != "prod" || routes[1].Upstream != "a" || len(routes[1].URLs) != 2 {
+		t.Errorf("unexpected route %+v", routes[1])
+	}
+
+	if _, _, err := cfg.Routes(url.Values{"target": {"sumSeries(prod.a"}}); err == nil {
+		t.Error("accepted an invalid target")
+	}
+}
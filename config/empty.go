@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var (
+	renderUnknownPrefix = metrics.NewCounter("metaphite_render_unknown_prefix_total",
+		"Render requests whose targets matched no configured prefix.")
+	renderEmpty = metrics.NewCounter("metaphite_render_empty_total",
+		"Successful render responses from each backend that contained no series.", "backend")
+)
+
+// Values for Config.UnknownPrefix
+const (
+	unknownNotFound = "notfound"
+	unknownEmpty    = "empty"
+)
+
+func validUnknownPrefix(v string) error {
+	switch v {
+	case "", unknownNotFound, unknownEmpty:
+		return nil
+	}
+	return fmt.Errorf("invalid unknownPrefix %q, must be %q or %q",
+		v, unknownNotFound, unknownEmpty)
+}
+
+// unknownPrefix answers a render request that could not be
+// routed to any backend, according to c.UnknownPrefix. An
+// empty result can only be produced for the data formats;
+// requests for images get a 404 regardless.
+func (c *Config) unknownPrefix(w http.ResponseWriter, format string) {
+	renderUnknownPrefix.Inc()
+	if c.UnknownPrefix == unknownEmpty {
+		c.setCacheControl(w, nil)
+		switch format {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, "[]")
+			return
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			return
+		case "raw":
+			w.Header().Set("Content-Type", "text/plain")
+			return
+		}
+	}
+	notfound(w)
+}
+
+// countEmpty arranges for successful responses from a backend
+// with no series in them to be counted.
+func countEmpty(prefix string) func(*http.Response) error {
+	return func(rsp *http.Response) error {
+		if rsp.StatusCode == http.StatusOK {
+			rsp.Body = &emptyDetector{
+				ReadCloser: rsp.Body,
+				prefix:     prefix,
+				gzip:       rsp.Header.Get("Content-Encoding") == "gzip",
+			}
+		}
+		return nil
+	}
+}
+
+// A gzipped body larger than this is not empty.
+const maxEmptyGzip = 512
+
+// An emptyDetector watches a response body as it is read, and
+// counts it as empty if it contains nothing but whitespace and,
+// optionally, an empty JSON array. A gzipped body is decoded
+// first.
+type emptyDetector struct {
+	io.ReadCloser
+	prefix   string
+	gzip     bool
+	raw      []byte // of a gzipped body, up to maxEmptyGzip+1 bytes
+	seen     []byte // non-space bytes, up to 3
+	eof      bool
+	reported bool
+}
+
+func (d *emptyDetector) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if d.gzip {
+		if len(d.raw) <= maxEmptyGzip {
+			d.raw = append(d.raw, p[:n]...)
+		}
+	} else {
+		d.scan(p[:n])
+	}
+	if err == io.EOF {
+		d.eof = true
+	}
+	return n, err
+}
+
+// scan adds the first non-space bytes of p to d.seen.
+func (d *emptyDetector) scan(p []byte) {
+	for _, b := range p {
+		if len(d.seen) > 2 {
+			return
+		}
+		if !bytes.ContainsRune([]byte(" \t\r\n"), rune(b)) {
+			d.seen = append(d.seen, b)
+		}
+	}
+}
+
+func (d *emptyDetector) Close() error {
+	if d.eof && !d.reported {
+		d.reported = true
+		if d.empty() {
+			renderEmpty.Inc(d.prefix)
+		}
+	}
+	return d.ReadCloser.Close()
+}
+
+func (d *emptyDetector) empty() bool {
+	if d.gzip && len(d.raw) > 0 {
+		if len(d.raw) > maxEmptyGzip {
+			return false
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(d.raw))
+		if err != nil {
+			return false
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(zr, maxEmptyGzip+1))
+		if err != nil || len(body) > maxEmptyGzip {
+			return false
+		}
+		d.scan(body)
+	}
+	s := string(d.seen)
+	return s == "" || s == "[]"
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCountEmpty(t *testing.T) {
+	compress := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	for _, tt := range []struct {
+		encoding string
+		body     []byte
+		empty    bool
+	}{
+		{"", []byte(" [ ]\n"), true},
+		{"", []byte(`[{"target":"cpu.load","datapoints":[]}]`), false},
+		{"gzip", compress("[]"), true},
+		{"gzip", compress(" \n"), true},
+		{"gzip", nil, true},
+		{"gzip", compress(`[{"target":"cpu.load","datapoints":[[1,100]]}]`), false},
+		{"gzip", compress("[" + strings.Repeat(" ", 4096) + "1]"), false},
+	} {
+		before := renderEmpty.Value("test")
+		rsp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Encoding": {tt.encoding}},
+			Body:       ioutil.NopCloser(bytes.NewReader(tt.body)),
+		}
+		countEmpty("test")(rsp)
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if empty := renderEmpty.Value("test") > before; empty != tt.empty {
+			t.Errorf("%q body %q counted as empty: %v, expected %v", tt.encoding, tt.body, empty, tt.empty)
+		}
+	}
+}
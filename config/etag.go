@@ -0,0 +1,36 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// writeTagged writes a response that metaphite produced itself,
+// such as one merged from several backends, with a strong ETag
+// computed over its body. If the request's If-None-Match header
+// matches the ETag, a 304 is written instead.
+func writeTagged(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if noneMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// noneMatch returns true if the If-None-Match header value h
+// matches etag. Weak comparison is used, as RFC 7232 requires.
+func noneMatch(h, etag string) bool {
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Etcd configures a routing table kept in etcd, which is shared
+// by every metaphite server watching it. In the config JSON,
+//
+// 	"etcd": {
+// 		"endpoints": ["http://etcd-1:2379", "http://etcd-2:2379"],
+// 		"prefix": "/metaphite/mappings/",
+// 		"username": "metaphite",
+// 		"password": "secret"
+// 	}
+//
+// Each key under the prefix maps the metrics prefix that follows
+// it, and its value is a mapping, as in the config file: a JSON
+// string with a URL, or an object. For example,
+//
+// 	etcdctl put /metaphite/mappings/prod '"http://graphite-prod/"'
+//
+// The keys are watched, and changes apply as they are made. They
+// replace the mappings of the config file for the same prefix, and
+// are not written to it with PersistMappings. Invalid mappings are
+// logged and ignored.
+type Etcd struct {
+	// URLs of the etcd servers' client API, version 3.4 or
+	// later. If empty, etcd is not used.
+	Endpoints []string
+	// Key prefix of the mappings. The default is
+	// "/metaphite/mappings/".
+	Prefix string
+	// Credentials, if etcd has authentication enabled.
+	Username, Password string
+}
+
+const defaultEtcdPrefix = "/metaphite/mappings/"
+
+func validEtcd(e Etcd) error {
+	for _, s := range e.Endpoints {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("etcd: invalid endpoint %q", s)
+		}
+	}
+	return nil
+}
+
+// WatchEtcd keeps the mappings from etcd, as configured when the
+// Reloader was created, in the current Config and each one loaded
+// after it. It runs until ctx is done, reconnecting to the next
+// endpoint when a request fails.
+func (rl *Reloader) WatchEtcd(ctx context.Context) error {
+	e := rl.Config().Etcd
+	if e.Prefix == "" {
+		e.Prefix = defaultEtcdPrefix
+	}
+	w := &etcdWatch{Etcd: e, ctx: ctx, client: &http.Client{Transport: rl.Config().transport()}}
+	var backoff time.Duration
+	for i := 0; ; i++ {
+		w.endpoint = strings.TrimSuffix(e.Endpoints[i%len(e.Endpoints)], "/")
+		rev, err := w.sync(rl)
+		if err == nil {
+			backoff = 0
+			err = w.watch(rl, rev+1)
+		}
+		if backoff == 0 {
+			backoff = 100 * time.Millisecond
+		} else if backoff *= 2; backoff > maxEtcdBackoff {
+			backoff = maxEtcdBackoff
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Warn("etcd watch failed", "endpoint", w.endpoint, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+const maxEtcdBackoff = 30 * time.Second
+
+// setDynamic replaces the mappings that do not come from the
+// config file, and applies them to the current Config.
+func (rl *Reloader) setDynamic(mappings map[string]Mapping) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	cfg := rl.Config()
+	for pfx := range rl.dynamic {
+		if _, ok := mappings[pfx]; !ok {
+			cfg.deleteDynamic(pfx)
+		}
+	}
+	for pfx, m := range mappings {
+		if prev, ok := rl.dynamic[pfx]; ok && reflect.DeepEqual(prev, m) {
+			continue
+		}
+		if err := cfg.putDynamic(pfx, m); err != nil {
+			slog.Warn("invalid mapping from etcd", "prefix", pfx, "err", err)
+			delete(mappings, pfx)
+		}
+	}
+	rl.dynamic = mappings
+}
+
+// updateDynamic changes a single mapping that does not come from
+// the config file. A nil m removes it.
+func (rl *Reloader) updateDynamic(prefix string, m *Mapping) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if m == nil {
+		delete(rl.dynamic, prefix)
+		rl.Config().deleteDynamic(prefix)
+		return
+	}
+	if err := rl.Config().putDynamic(prefix, *m); err != nil {
+		slog.Warn("invalid mapping from etcd", "prefix", prefix, "err", err)
+		return
+	}
+	if rl.dynamic == nil {
+		rl.dynamic = make(map[string]Mapping)
+	}
+	rl.dynamic[prefix] = *m
+}
+
+// An etcdWatch reads mappings through the JSON gateway of etcd's
+// v3 API.
+type etcdWatch struct {
+	Etcd
+	ctx      context.Context
+	endpoint string
+	client   *http.Client
+	token    string
+}
+
+type etcdKeyValue struct {
+	Key, Value []byte // base64 in JSON
+}
+
+type etcdHeader struct {
+	Revision int64 `json:",string"`
+}
+
+// post sends a request to the API, and decodes the response into
+// v, unless v is nil, in which case the response is returned for
+// the caller to read.
+func (w *etcdWatch) post(path string, req, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", w.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(w.ctx)
+	r.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		r.Header.Set("Authorization", w.token)
+	}
+	rsp, err := w.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, rsp.Status)
+	}
+	if v == nil {
+		return rsp, nil
+	}
+	defer rsp.Body.Close()
+	if err := json.NewDecoder(rsp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rsp, nil
+}
+
+// authenticate gets a token for the credentials, if there are any.
+func (w *etcdWatch) authenticate() error {
+	w.token = ""
+	if w.Username == "" {
+		return nil
+	}
+	var rsp struct{ Token string }
+	req := map[string]string{"name": w.Username, "password": w.Password}
+	if _, err := w.post("/v3/auth/authenticate", req, &rsp); err != nil {
+		return err
+	}
+	w.token = rsp.Token
+	return nil
+}
+
+// keyRange returns the range of keys under the prefix.
+func (w *etcdWatch) keyRange() map[string]interface{} {
+	end := []byte(w.Prefix)
+	end[len(end)-1]++
+	return map[string]interface{}{"key": []byte(w.Prefix), "range_end": end}
+}
+
+// sync reads all the mappings, and returns the revision they were
+// read at.
+func (w *etcdWatch) sync(rl *Reloader) (int64, error) {
+	if err := w.authenticate(); err != nil {
+		return 0, err
+	}
+	var rsp struct {
+		Header etcdHeader
+		Kvs    []etcdKeyValue
+	}
+	if _, err := w.post("/v3/kv/range", w.keyRange(), &rsp); err != nil {
+		return 0, err
+	}
+	mappings := make(map[string]Mapping, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		pfx, m, err := w.mapping(kv)
+		if err != nil {
+			slog.Warn("invalid mapping from etcd", "key", string(kv.Key), "err", err)
+			continue
+		}
+		mappings[pfx] = m
+	}
+	rl.setDynamic(mappings)
+	return rsp.Header.Revision, nil
+}
+
+func (w *etcdWatch) mapping(kv etcdKeyValue) (string, Mapping, error) {
+	var m Mapping
+	err := json.Unmarshal(kv.Value, &m)
+	return strings.TrimPrefix(string(kv.Key), w.Prefix), m, err
+}
+
+// watch applies the changes made to the mappings from revision rev
+// on. It returns when the watch fails.
+func (w *etcdWatch) watch(rl *Reloader, rev int64) error {
+	req := w.keyRange()
+	req["start_revision"] = strconv.FormatInt(rev, 10)
+	req["progress_notify"] = true
+	rsp, err := w.post("/v3/watch", map[string]interface{}{"create_request": req}, nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	dec := json.NewDecoder(rsp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled        bool
+				CancelReason    string `json:"cancel_reason"`
+				CompactRevision int64  `json:"compact_revision,string"`
+				Events          []struct {
+					Type string // PUT, the default, is left out
+					Kv   etcdKeyValue
+				}
+			}
+			Error *struct{ Message string }
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if r := msg.Result; r.Canceled || r.CompactRevision > 0 {
+			return fmt.Errorf("watch canceled at revision %d: %s", r.CompactRevision, r.CancelReason)
+		}
+		for _, ev := range msg.Result.Events {
+			pfx, m, err := w.mapping(ev.Kv)
+			switch {
+			case ev.Type == "DELETE":
+				rl.updateDynamic(pfx, nil)
+			case err != nil:
+				slog.Warn("invalid mapping from etcd", "key", string(ev.Kv.Key), "err", err)
+			default:
+				rl.updateDynamic(pfx, &m)
+			}
+		}
+	}
+}
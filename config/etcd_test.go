@@ -0,0 +1,123 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEtcd(t *testing.T) {
+	dev := newFakeGraphite(testData["dev"])
+	defer dev.Close()
+	prod := newFakeGraphite(testData["prod"])
+	defer prod.Close()
+
+	type kv struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value,omitempty"`
+	}
+	mapping := func(pfx, u string) kv {
+		return kv{[]byte("/metaphite/mappings/" + pfx), []byte(`"` + u + `/"`)}
+	}
+	events := make(chan string)
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"header": map[string]string{"revision": "5"},
+				"kvs":    []kv{mapping("prod", prod.URL)},
+			})
+		case "/v3/watch":
+			var create struct {
+				StartRevision string `json:"start_revision"`
+			}
+			json.Unmarshal(req["create_request"], &create)
+			if create.StartRevision != "6" {
+				http.Error(w, "unexpected start revision "+create.StartRevision, 400)
+				return
+			}
+			fmt.Fprintln(w, `{"result": {"created": true}}`)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case ev := <-events:
+					fmt.Fprintln(w, ev)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer etcd.Close()
+
+	dir, err := ioutil.TempDir("", "metaphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	js := `{"mappings": {"dev": "` + dev.URL + `/"}, "etcd": {"endpoints": ["` + etcd.URL + `"]}}`
+	if err := ioutil.WriteFile(path, []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- rl.WatchEtcd(ctx) }()
+
+	mapped := func(pfx string) string {
+		rl.Config().mu.RLock()
+		defer rl.Config().mu.RUnlock()
+		return rl.Config().Mappings[pfx].URL
+	}
+	waitFor := func(pfx, u string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for mapped(pfx) != u {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is mapped to %q, expected %q", pfx, mapped(pfx), u)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("prod", prod.URL+"/")
+
+	event := func(typ string, v kv) string {
+		b, _ := json.Marshal(map[string]interface{}{"type": typ, "kv": v})
+		return `{"result": {"events": [` + string(b) + `]}}`
+	}
+	events <- event("", mapping("dev", prod.URL))
+	waitFor("dev", prod.URL+"/")
+	if err := rl.Config().SetMapping("dev", dev.URL+"/"); err == nil {
+		t.Error("mapping from etcd was changed through the admin API")
+	}
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if mapped("dev") != prod.URL+"/" || mapped("prod") != prod.URL+"/" {
+		t.Errorf("mappings from etcd were lost on reload")
+	}
+	events <- event("DELETE", kv{Key: []byte("/metaphite/mappings/dev")})
+	waitFor("dev", dev.URL+"/")
+	events <- event("DELETE", kv{Key: []byte("/metaphite/mappings/prod")})
+	waitFor("prod", "")
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("WatchEtcd returned %v, expected context.Canceled", err)
+	}
+}
@@ -0,0 +1,342 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/droyo/metaphite/accesslog"
+	"github.com/droyo/metaphite/eval"
+	"github.com/droyo/metaphite/metrics"
+	"github.com/droyo/metaphite/multi"
+	"github.com/droyo/metaphite/query"
+)
+
+var renderEvaluated = metrics.NewCounter("metaphite_render_evaluated_total",
+	"Render requests whose targets spanned several backends, or used functions their backends lack, evaluated by metaphite.")
+
+// exprString produces the string representation of a
+// subexpression of a query.
+func exprString(e query.Expr) string {
+	return (&query.Query{Expr: e}).String()
+}
+
+// copyExpr returns a copy of a subexpression of a query, which
+// may be routed without modifying the query.
+func copyExpr(e query.Expr) *query.Query {
+	return query.Rewrite(&query.Query{Expr: e}, func(e query.Expr) query.Expr { return e })
+}
+
+// routeMetrics calls fn with each metric or tag query in e, and
+// the backend it would be routed to, without the prefix if the
+// backend strips it. A tag query is passed as the metric "*".
+// e is not modified.
+func (c *Config) routeMetrics(e query.Expr, add func(backend, query.Metric)) {
+	query.Walk(e, func(e query.Expr) bool {
+		switch v := e.(type) {
+		case *query.Metric:
+			m := *v
+			c.rewrite(&m)
+			pfx, rest := m.Split()
+			if b, ok := c.prefixBackend(pfx); ok {
+				if b.stripPrefix {
+					add(b, rest)
+				} else {
+					add(b, m)
+				}
+			}
+		case *query.SeriesByTag:
+			if b, _, ok := c.tagBackend(v); ok {
+				add(b, "*")
+			}
+		}
+		return true
+	})
+}
+
+// backendsOf returns the prefixes of the backends that the
+// metrics in e would be routed to. For a backend with a hash
+// ring, it returns the ringKey of each node that may hold the
+// metrics instead. e is not modified.
+func (c *Config) backendsOf(e query.Expr) map[string]bool {
+	result := make(map[string]bool)
+	c.routeMetrics(e, func(b backend, m query.Metric) {
+		if b.ring == nil {
+			result[b.prefix] = true
+			return
+		}
+		for _, i := range b.ring.nodesFor(m) {
+			result[ringKey(b.prefix, i)] = true
+		}
+	})
+	return result
+}
+
+// unsupported returns true if any of the backends the metrics in
+// f's arguments are routed to lists f in its LocalFunctions.
+func (c *Config) unsupported(f *query.Func) bool {
+	var found bool
+	c.routeMetrics(f, func(b backend, _ query.Metric) {
+		found = found || b.local[f.Name] || b.local["*"]
+	})
+	return found
+}
+
+// evaluatesLocally returns true if any of the function calls in
+// queries must be evaluated by metaphite.
+func (c *Config) evaluatesLocally(queries []*query.Query) bool {
+	local := c.evaluator().Local
+	for _, q := range queries {
+		found := false
+		query.Walk(q, func(e query.Expr) bool {
+			if f, ok := e.(*query.Func); ok && local(f) {
+				found = true
+			}
+			return !found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// backendKeys returns the backends the metrics in a request are
+// routed to, as backendsOf does. If there is more than one, the
+// request must be evaluated.
+func (c *Config) backendKeys(queries []*query.Query) map[string]bool {
+	seen := make(map[string]bool)
+	for _, q := range queries {
+		for k := range c.backendsOf(q) {
+			seen[k] = true
+		}
+	}
+	return seen
+}
+
+// A leaf is a part of a target that is sent to a single backend,
+// or to the nodes of its hash ring.
+type leaf struct {
+	expr     query.Expr
+	target   string // with the prefix stripped
+	server   backend
+	nodes    []backend // of server's hash ring
+	rewrites []appliedRewrite
+	series   []eval.Series
+}
+
+// evaluator evaluates the functions whose arguments span
+// several backends, or whose backends do not support them.
+func (c *Config) evaluator() eval.Evaluator {
+	return eval.Evaluator{
+		Local: func(f *query.Func) bool {
+			return eval.Supported(f.Name) && (len(c.backendsOf(f)) > 1 || c.unsupported(f))
+		},
+	}
+}
+
+// leaves splits queries into the parts that are sent to a single
+// backend, and routes them. Leaves with an unknown prefix are
+// in byExpr, but not in the returned list.
+func (c *Config) leaves(ev eval.Evaluator, queries []*query.Query) ([]*leaf, map[query.Expr]*leaf, error) {
+	var leaves []*leaf
+	byExpr := make(map[query.Expr]*leaf)
+	for _, q := range queries {
+		for _, e := range ev.Leaves(q) {
+			keys := c.backendsOf(e)
+			prefixes := make(map[string]bool)
+			for k := range keys {
+				prefixes[strings.SplitN(k, "#", 2)[0]] = true
+			}
+			if len(prefixes) > 1 {
+				return nil, nil, fmt.Errorf("Cannot evaluate %q: its metrics span several backends", exprString(e))
+			}
+			l := new(leaf)
+			l.expr = e
+			l.target, l.server, l.rewrites = c.route(copyExpr(e))
+			if l.server.ring != nil {
+				for i := range l.server.ring.nodes {
+					if keys[ringKey(l.server.prefix, i)] {
+						l.nodes = append(l.nodes, l.server.node(i))
+					}
+				}
+			}
+			byExpr[e] = l
+			if l.server.ReverseProxy != nil {
+				leaves = append(leaves, l)
+			}
+		}
+	}
+	return leaves, byExpr, nil
+}
+
+// evaluate answers a json render request whose targets refer to
+// metrics on several backends, or call functions listed in the
+// LocalFunctions of their backends. Calls to the functions
+// supported by the eval package whose arguments span several
+// backends, or that their backends lack, are evaluated locally;
+// everything else is sent to the backends.
+// Time shards are not consulted; each backend's mapping is used.
+// Parts of a target with an unknown prefix produce no series.
+func (c *Config) evaluate(w http.ResponseWriter, r *http.Request, queries []*query.Query) {
+	if r.Form.Get("format") != "json" {
+		renderRejected.Inc("evaluate")
+		w.WriteHeader(400)
+		fmt.Fprint(w, "Targets spanning several backends are only supported with format=json")
+		return
+	}
+	ev := c.evaluator()
+	leaves, byExpr, err := c.leaves(ev, queries)
+	if err != nil {
+		renderRejected.Inc("evaluate")
+		w.WriteHeader(400)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	var traces []routeTrace
+	for _, l := range leaves {
+		if c.debugFor(l.server.prefix) {
+			traces = append(traces, routeTrace{
+				Target:   exprString(l.expr),
+				Rewrites: l.rewrites,
+				Backend:  l.server.prefix,
+				Final:    l.target,
+			})
+		}
+	}
+	c.writeTraces(w, traces)
+
+	var backends []string
+	// a leaf is fetched from each node of a hash ring it spans
+	type part struct {
+		l      *leaf
+		server backend
+	}
+	var parts []part
+	for _, l := range leaves {
+		backends = append(backends, l.server.prefix)
+		if l.nodes == nil {
+			parts = append(parts, part{l, l.server})
+		}
+		for _, n := range l.nodes {
+			parts = append(parts, part{l, n})
+		}
+	}
+	accesslog.Annotate(r, "backend", backends)
+
+	req, err := http.NewRequest("GET", "/render", nil)
+	if err != nil {
+		slog.Error("evaluate", "err", err)
+		httperror(w, 500)
+		return
+	}
+	req = req.WithContext(r.Context())
+
+	targets := make([]multi.Target, len(parts))
+	byURL := make(map[*url.URL]int, len(parts))
+	for i, p := range parts {
+		if p.server.limit != nil {
+			if ok, wait := p.server.limit.Take(); !ok {
+				renderRejected.Inc("ratelimit")
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+		if ok, reason := p.server.state.admit(c.SlowStart.Duration); !ok {
+			renderRejected.Inc(reason)
+			w.Header().Set("Retry-After", "1")
+			unavailable(w)
+			return
+		}
+		if err := p.server.wait(r.Context()); err != nil {
+			renderRejected.Inc("canceled")
+			return
+		}
+		form := make(url.Values, len(r.Form))
+		for k, v := range r.Form {
+			if k != "target" {
+				form[k] = v
+			}
+		}
+		form.Set("target", p.l.target)
+		c.applyFormDefaults(form, p.server.prefix)
+
+		// each part gets its own URL, to identify its response
+		u := *p.server.pick()
+		targets[i] = multi.Target{URL: &u, Query: form, Client: p.server.client}
+		byURL[&u] = i
+		p.server.state.begin()
+		defer p.server.state.end()
+	}
+
+	results := make([]MergeResult, len(parts))
+	series := make([][]eval.Series, len(parts))
+	cacheControl := make([]string, len(parts))
+	// each backend has its own client, with its own settings
+	for rsp := range multi.ProxyContext(r.Context(), nil, req, targets) {
+		i := byURL[rsp.Target.URL]
+		p := parts[i]
+		p.server.state.observe(r.Context(), rsp.Response, rsp.Err)
+		err := rsp.Err
+		if err == nil {
+			cacheControl[i] = rsp.Header.Get("Cache-Control")
+			err = multi.DecodeArray(rsp, func(elem json.RawMessage) error {
+				var s eval.Series
+				if err := json.Unmarshal(elem, &s); err != nil {
+					return err
+				}
+				series[i] = append(series[i], s)
+				return nil
+			})
+		}
+		if err != nil {
+			slog.Warn("backend error", "backend", p.server.prefix, "err", err)
+		}
+		results[i] = MergeResult{Backend: p.server.prefix, Err: err}
+	}
+	keep, err := merge(c.mergeRender, results)
+	if err != nil {
+		slog.Warn("evaluate", "err", err)
+		httperror(w, http.StatusBadGateway)
+		return
+	}
+	var merged []string
+	for i, p := range parts {
+		if keep[i] {
+			p.l.series = append(p.l.series, series[i]...)
+			merged = append(merged, cacheControl[i])
+		}
+	}
+	cacheControl = merged
+
+	fetch := func(e query.Expr) ([]eval.Series, error) {
+		if l := byExpr[e]; l != nil {
+			return l.series, nil
+		}
+		return nil, fmt.Errorf("no data for %q", exprString(e))
+	}
+	result := []eval.Series{}
+	for _, q := range queries {
+		series, err := ev.Eval(q, fetch)
+		if err != nil {
+			renderRejected.Inc("evaluate")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Cannot evaluate %q: %v", q, err)
+			return
+		}
+		result = append(result, series...)
+	}
+	renderEvaluated.Inc()
+	body, err := c.format.Marshal(result)
+	if err != nil {
+		slog.Error("evaluate", "err", err)
+		httperror(w, 500)
+		return
+	}
+	c.setCacheControl(w, cacheControl)
+	writeTagged(w, r, "application/json", append(body, '\n'))
+}
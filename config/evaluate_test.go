@@ -0,0 +1,84 @@
+package config
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/droyo/metaphite/query"
+)
+
+func TestLocalFunctions(t *testing.T) {
+	g := newFakeGraphite(testData["dev"])
+	defer g.Close()
+	js := `{"mappings": {"dev": {"url": "` + g.URL + `/", "localFunctions": ["scale", "aliasByNode"]}}}`
+	cfg, err := Parse(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(cfg)
+	defer srv.Close()
+	c := &cluster{config: cfg, Server: srv}
+
+	tests := []struct {
+		target string
+		body   string
+	}{
+		{"scale(dev.cpu.load, 2)", `[{"target":"scale(cpu.load,2)","datapoints":[[2,100],[4,160]]}]` + "\n"},
+		{"aliasByNode(scale(dev.cpu.*, 0.5), -1)", `[{"target":"load","datapoints":[[0.5,100],[1,160]]},` +
+			`{"target":"user","datapoints":[[5,100],[10,160]]}]` + "\n"},
+		// not listed, so sent to the backend, which does not evaluate it
+		{"offset(dev.cpu.load, 1)", "[]\n"},
+	}
+	for _, tt := range tests {
+		code, body := c.get(t, "/render?format=json&target="+url.QueryEscape(tt.target))
+		if code != 200 || body != tt.body {
+			t.Errorf("%s: got %d %q, expected %q", tt.target, code, body, tt.body)
+		}
+	}
+
+	js = `{"mappings": {"dev": {"url": "` + g.URL + `/", "localFunctions": ["holtWintersForecast"]}}}`
+	if _, err := Parse(strings.NewReader(js)); err == nil || !strings.Contains(err.Error(), "holtWintersForecast") {
+		t.Errorf("function metaphite cannot evaluate was accepted: %v", err)
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	js := `{
+		"mappings": {"dev": "http://dev/", "prod": "http://prod/"},
+		"rewrites": [{"pattern": "^production\\.", "replacement": "prod."}]
+	}`
+	cfg, err := Parse(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "sumSeries(production.cpu.load, scale(dev.cpu.*, 2), seriesByTag('name=x'))"
+	q, err := cfg.parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []*query.Query{q}
+	if !cfg.evaluatesLocally(queries) {
+		t.Errorf("%s is not evaluated", target)
+	}
+	if keys := cfg.backendKeys(queries); len(keys) != 2 || !keys["dev"] || !keys["prod"] {
+		t.Errorf("%s is routed to %v, expected dev and prod", target, keys)
+	}
+	leaves, _, err := cfg.leaves(cfg.evaluator(), queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range leaves {
+		got = append(got, l.server.prefix+" "+l.target)
+	}
+	if want := []string{"prod cpu.load", "dev scale(cpu.*, 2)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got leaves %q, expected %q", got, want)
+	}
+	// routing works on copies
+	if s := q.String(); s != target {
+		t.Errorf("query changed to %s", s)
+	}
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// A HashRing spreads the metrics of a prefix across several
+// graphite servers, each with its own carbon, as carbon's
+// consistent-hashing relay does. In the config JSON,
+//
+// 	"prod": {
+// 		"hashRing": {
+// 			"nodes": [
+// 				{"url": "http://graphite-1/", "carbon": "10.0.0.1:2004:a"},
+// 				{"url": "http://graphite-2/", "carbon": "10.0.0.2:2004:a"}
+// 			]
+// 		}
+// 	}
+//
+// The nodes must be listed with the same addresses and instances
+// as the carbon-relay's DESTINATIONS, so that metrics are placed
+// alike; their order does not matter. A render request for metrics
+// that are all on one node is sent to it. Otherwise, the request
+// must use the json format, and is sent to each node holding some
+// of the metrics: wildcards may match metrics on any node. Series
+// are combined by the functions metaphite can evaluate; other
+// functions are applied by each node to its own series, which is
+// only right for functions of single series, such as scale or
+// aliasByNode.
+//
+// The relay forwards each metric under the prefix to the carbon
+// of its node.
+type HashRing struct {
+	Nodes []HashNode `json:"nodes"`
+	// "carbon_ch", the default, or "fnv1a_ch", as carbon's
+	// ROUTER_HASH_TYPE.
+	HashType string `json:"hashType,omitempty"`
+}
+
+// A HashNode is a graphite server, and the carbon daemon that
+// receives its metrics.
+type HashNode struct {
+	URL string `json:"url"`
+	// As in carbon's DESTINATIONS: host:port, or
+	// host:port:instance. The host and instance place the node
+	// on the ring, and the relay sends metrics to host:port.
+	Carbon string `json:"carbon"`
+}
+
+// Positions of each node on the ring, as in carbon.
+const ringReplicas = 100
+
+type hashRing struct {
+	fnv1a     bool
+	positions []ringPosition // sorted
+	nodes     []backend
+	carbon    []string // host:port of each node
+}
+
+type ringPosition struct {
+	pos  int
+	node int
+}
+
+// newHashRing places the nodes of h on a ring, as carbon's
+// ConsistentHashRing does.
+func newHashRing(h HashRing) (*hashRing, error) {
+	r := &hashRing{}
+	switch h.HashType {
+	case "", "carbon_ch":
+	case "fnv1a_ch":
+		r.fnv1a = true
+	default:
+		return nil, fmt.Errorf("hashRing: invalid hashType %q", h.HashType)
+	}
+	if len(h.Nodes) == 0 {
+		return nil, errors.New("hashRing: no nodes")
+	}
+	taken := make(map[int]bool)
+	for i, n := range h.Nodes {
+		host, port, instance, err := carbonDestination(n.Carbon)
+		if err != nil {
+			return nil, fmt.Errorf("hashRing: %v", err)
+		}
+		r.carbon = append(r.carbon, net.JoinHostPort(host, port))
+		// the node's key is the python tuple (host, instance)
+		key := "('" + host + "', None)"
+		if instance != "" {
+			key = "('" + host + "', '" + instance + "')"
+		}
+		for j := 0; j < ringReplicas; j++ {
+			var pos int
+			if r.fnv1a {
+				pos = r.position(strconv.Itoa(j) + "-" + pyStr(instance))
+			} else {
+				pos = r.position(key + ":" + strconv.Itoa(j))
+			}
+			for taken[pos] {
+				pos++
+			}
+			taken[pos] = true
+			r.positions = append(r.positions, ringPosition{pos, i})
+		}
+	}
+	sort.Slice(r.positions, func(i, j int) bool { return r.positions[i].pos < r.positions[j].pos })
+	return r, nil
+}
+
+// pyStr formats s as python's "%s" would, with None for empty.
+func pyStr(s string) string {
+	if s == "" {
+		return "None"
+	}
+	return s
+}
+
+// carbonDestination parses a destination in carbon's format.
+func carbonDestination(s string) (host, port, instance string, err error) {
+	// an IPv6 host is in brackets
+	rest := s
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return "", "", "", fmt.Errorf("invalid carbon destination %q", s)
+		}
+		host, rest = s[1:i], strings.TrimPrefix(s[i+1:], ":")
+	} else if i := strings.Index(s, ":"); i >= 0 {
+		host, rest = s[:i], s[i+1:]
+	}
+	parts := strings.SplitN(rest, ":", 2)
+	port = parts[0]
+	if len(parts) > 1 {
+		instance = parts[1]
+	}
+	if host == "" || port == "" {
+		return "", "", "", fmt.Errorf("invalid carbon destination %q", s)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", "", fmt.Errorf("invalid carbon destination %q", s)
+	}
+	return host, port, instance, nil
+}
+
+func (r *hashRing) position(key string) int {
+	if r.fnv1a {
+		h := uint32(0x811c9dc5)
+		for _, c := range key {
+			h ^= uint32(c)
+			h *= 0x01000193
+		}
+		return int(h>>16 ^ h&0xffff)
+	}
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// node returns the index of the node that holds the named metric.
+func (r *hashRing) node(name string) int {
+	pos := r.position(name)
+	i := sort.Search(len(r.positions), func(i int) bool { return r.positions[i].pos >= pos })
+	return r.positions[i%len(r.positions)].node
+}
+
+// nodesFor returns the nodes that may hold metrics matching m,
+// which is the name the nodes know them by.
+func (r *hashRing) nodesFor(m query.Metric) []int {
+	if !m.HasGlob() && !m.HasVariables() {
+		return []int{r.node(string(m))}
+	}
+	all := make([]int, len(r.nodes))
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// newRingBackend creates the backend for a mapping with a hash
+// ring. It sends requests that are not for particular metrics to
+// the nodes in turn. Each node has a backend of its own, with the
+// settings of the mapping.
+func (c *Config) newRingBackend(prefix string, m Mapping) (backend, error) {
+	if m.URL != "" || len(m.URLs) > 0 || m.Kubernetes != nil || m.Consul != nil || m.Whisper != "" || m.Carbon != "" {
+		return backend{}, errors.New("hashRing cannot be combined with url, urls, kubernetes, consul, whisper or carbon")
+	}
+	if m.HedgeAfter.Duration != 0 {
+		return backend{}, errors.New("hashRing cannot be combined with hedgeAfter; its nodes are not replicas")
+	}
+	ring, err := newHashRing(*m.HashRing)
+	if err != nil {
+		return backend{}, err
+	}
+	base := m
+	base.HashRing = nil
+	all := base
+	for _, n := range m.HashRing.Nodes {
+		nm := base
+		nm.URL = n.URL
+		b, err := c.newBackend(prefix, nm)
+		if err != nil {
+			return backend{}, err
+		}
+		ring.nodes = append(ring.nodes, b)
+		all.URLs = append(all.URLs, n.URL)
+	}
+	b, err := c.newBackend(prefix, all)
+	if err != nil {
+		return backend{}, err
+	}
+	b.ring = ring
+	return b, nil
+}
+
+// node returns the backend of the i'th node of b's hash ring,
+// which is subject to b's rate limits.
+func (b backend) node(i int) backend {
+	n := b.ring.nodes[i]
+	n.limit, n.outbound = b.limit, b.outbound
+	return n
+}
+
+// ringKey identifies a node of a hash ring in the results of
+// backendsOf.
+func ringKey(prefix string, node int) string {
+	return prefix + "#" + strconv.Itoa(node)
+}
+
+// ringNode returns the node of b's hash ring that is the only one
+// in keys, as returned by backendKeys, or b itself if there is no
+// such node.
+func (b backend) ringNode(keys map[string]bool) backend {
+	if len(keys) != 1 {
+		return b
+	}
+	for i := range b.ring.nodes {
+		if keys[ringKey(b.prefix, i)] {
+			return b.node(i)
+		}
+	}
+	return b
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	// placements computed with carbon's ConsistentHashRing
+	fixtures := []struct {
+		ring HashRing
+		want map[string]int
+	}{
+		{
+			HashRing{Nodes: []HashNode{{Carbon: "10.0.0.1:2003"}, {Carbon: "10.0.0.2:2003"}, {Carbon: "10.0.0.3:2004:a"}}},
+			map[string]int{"cpu.load": 1, "disk.io": 2, "net.eth0.rx": 0, "servers.web1.cpu": 1, "carbon.agents.x.metricsReceived": 0},
+		},
+		{
+			HashRing{HashType: "fnv1a_ch", Nodes: []HashNode{{Carbon: "10.0.0.1:2003:a"}, {Carbon: "10.0.0.2:2003:b"}, {Carbon: "10.0.0.3:2003:c"}}},
+			map[string]int{"cpu.load": 1, "a": 0, "servers.web1.cpu": 1, "servers.web2.cpu": 2},
+		},
+	}
+	for _, f := range fixtures {
+		r, err := newHashRing(f.ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range f.want {
+			if got := r.node(name); got != want {
+				t.Errorf("%s: %s is on node %d, expected %d", f.ring.HashType, name, got, want)
+			}
+		}
+	}
+
+	ring := HashRing{Nodes: []HashNode{{Carbon: "10.0.0.1:2003:a"}, {Carbon: "10.0.0.2:2003:b"}}}
+	r, err := newHashRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []*fakeGraphite{newFakeGraphite(map[string][][2]float64{}), newFakeGraphite(map[string][][2]float64{})}
+	for _, g := range nodes {
+		defer g.Close()
+	}
+	placed := make(map[int]bool)
+	for name, points := range testData["prod"] {
+		i := r.node(name)
+		nodes[i].series[name] = points
+		placed[i] = true
+	}
+	if len(placed) != 2 {
+		t.Fatal("test data is all on one node")
+	}
+	for i := range ring.Nodes {
+		ring.Nodes[i].URL = nodes[i].URL + "/"
+	}
+	js, _ := json.Marshal(map[string]Mapping{"prod": {HashRing: &ring}})
+	c := newCluster(t, nil, `"mappings": `+string(js))
+	defer c.Close()
+
+	for name := range testData["prod"] {
+		node := r.node(name)
+		other := nodes[1-node].URL
+		before := c.config.Stats()["prod"][other].Requests
+		code, body := c.get(t, "/render?format=json&target=prod."+name)
+		if code != 200 || !strings.Contains(body, name) {
+			t.Fatalf("render %s: %d %s", name, code, body)
+		}
+		if c.config.Stats()["prod"][other].Requests != before {
+			t.Errorf("%s was sent to the wrong node", name)
+		}
+		addr, newName, ok := c.config.CarbonRoute("prod." + name)
+		if want := []string{"10.0.0.1:2003", "10.0.0.2:2003"}[node]; !ok || addr != want || newName != name {
+			t.Errorf("CarbonRoute(prod.%s) = %q, %q, %v, want %q", name, addr, newName, ok, want)
+		}
+	}
+
+	code, body := c.get(t, "/render?format=json&target=prod.*.*")
+	var series []renderJSON
+	if err := json.Unmarshal([]byte(body), &series); code != 200 || err != nil {
+		t.Fatalf("render prod.*.*: %d %s", code, body)
+	}
+	if len(series) != len(testData["prod"]) {
+		t.Errorf("got %d series from all nodes, expected %d", len(series), len(testData["prod"]))
+	}
+	code, body = c.get(t, "/render?format=json&target=sumSeries(prod.*.*)")
+	if err := json.Unmarshal([]byte(body), &series); code != 200 || err != nil || len(series) != 1 {
+		t.Errorf("sumSeries over all nodes: %d %s", code, body)
+	}
+}
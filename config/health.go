@@ -0,0 +1,224 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A backend is considered unhealthy after this many
+	// consecutive failed requests, and healthy again after
+	// the next successful one.
+	maxFailures = 3
+	// While a backend is unhealthy, requests fail immediately,
+	// except for one request per probeInterval, which is let
+	// through to test whether the backend has recovered.
+	probeInterval = 5 * time.Second
+	// Error rates are computed over this many recent requests.
+	historySize = 100
+)
+
+// backendState tracks the health of a backend, as observed
+// through the requests proxied to it.
+type backendState struct {
+	inflight int64 // accessed atomically
+
+	mu          sync.Mutex
+	succeeded   bool // a request has succeeded
+	failures    int  // consecutive
+	history     [historySize]bool
+	next, n     int // position and fill of history
+	lastError   string
+	lastFail    time.Time
+	recovered   time.Time // last transition from unhealthy to healthy
+	lastSuccess time.Time
+	lastProbe   time.Time
+
+	// called after the backend becomes healthy or unhealthy
+	onChange func()
+}
+
+func (s *backendState) begin() { atomic.AddInt64(&s.inflight, 1) }
+func (s *backendState) end()   { atomic.AddInt64(&s.inflight, -1) }
+
+// record records the outcome of a request to the backend. A nil
+// error indicates success.
+func (s *backendState) record(err error) {
+	wasHealthy, isHealthy := s.update(err)
+	if wasHealthy != isHealthy && s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// observe records the outcome of a request to the backend, made
+// with ctx, as record does. Only errors reaching the backend, and
+// gateway errors, count as failures: other responses, such as a
+// 500 for a query graphite cannot evaluate, show the backend is
+// up. Requests that were canceled, such as when the client went
+// away, are not recorded at all.
+func (s *backendState) observe(ctx context.Context, rsp *http.Response, err error) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil {
+		switch rsp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			err = errors.New(rsp.Status)
+		}
+	}
+	s.record(err)
+}
+
+func (s *backendState) update(err error) (wasHealthy, isHealthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wasHealthy = s.failures < maxFailures
+	s.history[s.next] = err != nil
+	s.next = (s.next + 1) % historySize
+	if s.n < historySize {
+		s.n++
+	}
+	if err == nil {
+		if !wasHealthy {
+			s.recovered = time.Now()
+		}
+		s.succeeded = true
+		s.failures = 0
+		s.lastSuccess = time.Now()
+	} else {
+		s.failures++
+		s.lastError = err.Error()
+		s.lastFail = time.Now()
+		if s.failures == maxFailures {
+			s.lastProbe = s.lastFail
+		}
+	}
+	return wasHealthy, s.failures < maxFailures
+}
+
+// admit decides whether to send a request to a backend. Requests
+// to unhealthy backends are not admitted, except for periodic
+// probes. For the duration of the slow start window after a
+// backend recovers, only a fraction of requests are admitted,
+// increasing linearly from minAdmit to 1. If a request is not
+// admitted, admit returns a short reason.
+func (s *backendState) admit(window time.Duration) (ok bool, reason string) {
+	const minAdmit = 0.1
+	if !s.probe() {
+		return false, "unhealthy"
+	}
+	p := s.ramp(window)
+	if p >= 1 {
+		return true, ""
+	}
+	if p < minAdmit {
+		p = minAdmit
+	}
+	if rand.Float64() < p {
+		return true, ""
+	}
+	return false, "slowstart"
+}
+
+// probe returns true if the backend is healthy, or if it is time
+// to send a request to an unhealthy backend to see if it has
+// recovered.
+func (s *backendState) probe() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures < maxFailures {
+		return true
+	}
+	if now := time.Now(); now.Sub(s.lastProbe) >= probeInterval {
+		s.lastProbe = now
+		return true
+	}
+	return false
+}
+
+// ramp returns the fraction of the slow start window that has
+// passed since the backend last recovered.
+func (s *backendState) ramp(window time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if window <= 0 || s.recovered.IsZero() || s.failures >= maxFailures {
+		return 1
+	}
+	return float64(time.Since(s.recovered)) / float64(window)
+}
+
+func (s *backendState) healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures < maxFailures
+}
+
+// known returns true if the backend is known to be healthy: a
+// request to it has succeeded, and it is healthy.
+func (s *backendState) known() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.succeeded && s.failures < maxFailures
+}
+
+// needsCheck returns true if it is time to send a health check to
+// the backend: when no request to it has succeeded yet, or it is
+// unhealthy, at most once per probeInterval.
+func (s *backendState) needsCheck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.succeeded && s.failures < maxFailures {
+		return false
+	}
+	if now := time.Now(); now.Sub(s.lastProbe) >= probeInterval {
+		s.lastProbe = now
+		return true
+	}
+	return false
+}
+
+// A BackendStatus describes the observed state of a backend.
+type BackendStatus struct {
+	URL       string
+	Healthy   bool
+	SlowStart bool // true while recovering
+	InFlight  int64
+	Requests  int        // number of recent requests
+	ErrorRate float64    // fraction of recent requests that failed
+	LastError string     `json:",omitempty"`
+	LastFail  *time.Time `json:",omitempty"`
+}
+
+func (s *backendState) status(window time.Duration) BackendStatus {
+	slow := s.ramp(window) < 1
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failed int
+	for _, v := range s.history[:s.n] {
+		if v {
+			failed++
+		}
+	}
+	st := BackendStatus{
+		Healthy:   s.failures < maxFailures,
+		SlowStart: slow,
+		InFlight:  atomic.LoadInt64(&s.inflight),
+		Requests:  s.n,
+		LastError: s.lastError,
+	}
+	if !s.lastFail.IsZero() {
+		t := s.lastFail
+		st.LastFail = &t
+	}
+	if s.n > 0 {
+		st.ErrorRate = float64(failed) / float64(s.n)
+	}
+	return st
+}
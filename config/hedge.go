@@ -0,0 +1,171 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var backendHedged = metrics.NewCounter("metaphite_backend_hedged_total",
+	"Requests to each backend that were sent to a second server, because the first was slow.", "backend")
+
+// Requests a backend must have been sent before the quantile of
+// their latency is used to decide when to hedge.
+const minHedgeSamples = 100
+
+func (m Mapping) validHedge() error {
+	switch {
+	case m.HedgeAfter.Duration < 0:
+		return fmt.Errorf("invalid hedgeAfter %s", m.HedgeAfter)
+	case m.HedgeQuantile < 0 || m.HedgeQuantile >= 1:
+		return fmt.Errorf("hedgeQuantile %g is not between 0 and 1", m.HedgeQuantile)
+	case m.HedgeQuantile > 0 && m.HedgeAfter.Duration == 0:
+		return errors.New("hedgeQuantile requires hedgeAfter")
+	}
+	return nil
+}
+
+// A hedgedTransport sends a request to a second server of a
+// backend if the first has not answered within a delay, and uses
+// whichever response arrives first. The other request is canceled.
+type hedgedTransport struct {
+	prefix   string
+	after    time.Duration
+	quantile float64
+	stats    *backendStats
+	targets  func() []*url.URL
+	http.RoundTripper
+}
+
+// delay returns how long to wait for the first server before
+// sending the request to another.
+func (t hedgedTransport) delay() time.Duration {
+	if t.quantile > 0 {
+		if d, ok := t.stats.quantile(t.quantile); ok && d > t.after {
+			return d
+		}
+	}
+	return t.after
+}
+
+// other returns the URL of a server other than the one r is
+// sent to, if there is one.
+func (t hedgedTransport) other(r *http.Request) *url.URL {
+	for _, u := range t.targets() {
+		if u.Scheme != r.URL.Scheme || u.Host != r.URL.Host {
+			return u
+		}
+	}
+	return nil
+}
+
+func (t hedgedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil || t.other(r) == nil {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	type result struct {
+		rsp *http.Response
+		err error
+		i   int // of the request
+	}
+	results := make(chan result, 2)
+	var cancels []context.CancelFunc
+	send := func(r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			rsp, err := t.RoundTripper.RoundTrip(r.WithContext(ctx))
+			results <- result{rsp, err, i}
+		}()
+	}
+	send(r)
+	pending := 1
+	timer := time.NewTimer(t.delay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			hr, err := hedgeRequest(r, t.other(r))
+			if err != nil {
+				continue
+			}
+			backendHedged.Inc(t.prefix)
+			send(hr)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				cancels[res.i]()
+				continue
+			}
+			if pending > 0 {
+				// cancel the slower request, and discard its
+				// response
+				cancels[1-res.i]()
+				go func() {
+					if loser := <-results; loser.err == nil {
+						loser.rsp.Body.Close()
+					}
+				}()
+			}
+			if res.err != nil {
+				cancels[res.i]()
+				return nil, res.err
+			}
+			res.rsp.Body = cancelBody{res.rsp.Body, cancels[res.i]}
+			return res.rsp, nil
+		}
+	}
+}
+
+// hedgeRequest returns a copy of r to be sent to the server at u.
+func hedgeRequest(r *http.Request, u *url.URL) (*http.Request, error) {
+	if u == nil {
+		return nil, errors.New("no other server")
+	}
+	hr := r.Clone(r.Context())
+	hr.URL.Scheme, hr.URL.Host, hr.Host = u.Scheme, u.Host, u.Host
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		hr.Body = body
+	}
+	return hr, nil
+}
+
+// quantile estimates the qth quantile of the latency of the
+// requests made to the backend, as the upper bound of the
+// histogram bucket it falls in. It returns false if too few
+// requests have been made, or the quantile is beyond the largest
+// bucket.
+func (s *backendStats) quantile(q float64) (time.Duration, bool) {
+	counts := make([]int64, len(latencyBuckets)+1)
+	var total int64
+	s.mu.Lock()
+	for _, st := range s.servers {
+		for i, n := range st.Latency.Counts {
+			counts[i] += n
+			total += n
+		}
+	}
+	s.mu.Unlock()
+	if total < minHedgeSamples {
+		return 0, false
+	}
+	rank := int64(q * float64(total))
+	var seen int64
+	for i, n := range counts[:len(latencyBuckets)] {
+		if seen += n; seen > rank {
+			return time.Duration(latencyBuckets[i] * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
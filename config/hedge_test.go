@@ -0,0 +1,79 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHedge(t *testing.T) {
+	fast := newFakeGraphite(testData["prod"])
+	defer fast.Close()
+	canceled := make(chan bool, 10)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			http.Error(w, "too slow", 504)
+		}
+	}))
+	defer slow.Close()
+	js := `{"mappings": {"prod": {"urls": ["` + slow.URL + `/", "` + fast.URL + `/"], "hedgeAfter": "20ms"}}}`
+	cfg, err := Parse(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(cfg)
+	defer srv.Close()
+	c := &cluster{config: cfg, Server: srv}
+
+	hedged := backendHedged.Value("prod")
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		code, body := c.get(t, "/render?format=json&target=prod.cpu.load")
+		if code != 200 || !strings.Contains(body, `"cpu.load"`) {
+			t.Errorf("render %d: %d %s", i, code, body)
+		}
+	}
+	rsp, err := http.PostForm(srv.URL+"/render", url.Values{"format": {"json"}, "target": {"prod.cpu.load"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 || !strings.Contains(string(body), `"cpu.load"`) {
+		t.Errorf("render POST: %d %s", rsp.StatusCode, body)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("slow server was waited for: %s", d)
+	}
+	if n := backendHedged.Value("prod") - hedged; n < 2 {
+		t.Errorf("%v requests hedged, expected at least 2", n)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("request to the slow server was not canceled")
+	}
+
+	stats := newBackendStats()
+	if _, ok := stats.quantile(0.95); ok {
+		t.Error("quantile of no requests")
+	}
+	for i := 0; i < 100; i++ {
+		stats.server("http://a").Latency.observe(float64(i) / 1000)
+	}
+	if d, ok := stats.quantile(0.95); !ok || d != 100*time.Millisecond {
+		t.Errorf("95th percentile of 0-99ms is %s", d)
+	}
+
+	js = `{"mappings": {"prod": {"urls": ["` + fast.URL + `/"], "hedgeQuantile": 0.95}}}`
+	if _, err := Parse(strings.NewReader(js)); err == nil {
+		t.Error("hedgeQuantile without hedgeAfter was accepted")
+	}
+}
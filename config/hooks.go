@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/droyo/metaphite/eval"
+	"github.com/droyo/metaphite/query"
+)
+
+// A Hook changes how render requests are handled, for programs
+// that serve a Config of their own. For example, a hook may limit
+// the metrics each team can query, or remove series from the
+// responses. Hooks are called in the order they were added.
+type Hook struct {
+	// Query, if set, is called with the parsed targets of a
+	// render request before they are routed, and returns the
+	// targets to route, which it may have changed in place.
+	// An error rejects the request with status 403, and the
+	// error as the body.
+	Query func(r *http.Request, queries []*query.Query) ([]*query.Query, error)
+	// Result, if set, is called with the series of a successful
+	// render request with format=json before they are encoded,
+	// whether they come from one backend or were merged from
+	// several, and returns the series to send. Responses in
+	// other formats are sent unchanged.
+	Result func(r *http.Request, series []eval.Series) []eval.Series
+}
+
+// AddHook adds h after the hooks already added to c. It must not
+// be called while c is serving requests.
+func (c *Config) AddHook(h Hook) {
+	c.hooks = append(c.hooks, h)
+}
+
+// AddHook adds h to the current Config, and to each one loaded
+// after it. It must be called before the Reloader serves requests.
+func (rl *Reloader) AddHook(h Hook) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.hooks = append(rl.hooks, h)
+	rl.Config().AddHook(h)
+}
+
+// queryHooks passes queries through each Query hook.
+func (c *Config) queryHooks(r *http.Request, queries []*query.Query) ([]*query.Query, error) {
+	for _, h := range c.hooks {
+		if h.Query == nil {
+			continue
+		}
+		var err error
+		if queries, err = h.Query(r, queries); err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
+
+// resultHooks returns a writer that holds the response to r, so
+// that the Result hooks can change it before writeResult sends it
+// to w. If there are no Result hooks for r, it returns nil.
+func (c *Config) resultHooks(r *http.Request) *resultWriter {
+	if r.Form.Get("format") != "json" {
+		return nil
+	}
+	for _, h := range c.hooks {
+		if h.Result != nil {
+			rw := &resultWriter{header: make(http.Header), noneMatch: r.Header.Get("If-None-Match")}
+			// the response is decoded, and tagged when
+			// written, so it must be complete and plain
+			r.Header.Del("If-None-Match")
+			r.Header.Del("Accept-Encoding")
+			return rw
+		}
+	}
+	return nil
+}
+
+// writeResult writes the response held by rw to w, after passing
+// its series through each Result hook.
+func (c *Config) writeResult(w http.ResponseWriter, r *http.Request, rw *resultWriter) {
+	for k, v := range rw.header {
+		w.Header()[k] = v
+	}
+	switch rw.status {
+	case 0:
+		return
+	case http.StatusOK:
+	default:
+		w.WriteHeader(rw.status)
+		w.Write(rw.buf.Bytes())
+		return
+	}
+	var series []eval.Series
+	if err := json.Unmarshal(rw.buf.Bytes(), &series); err != nil {
+		slog.Warn("invalid render response", "query", r.Form["target"], "err", err)
+		httperror(w, http.StatusBadGateway)
+		return
+	}
+	for _, h := range c.hooks {
+		if h.Result != nil {
+			series = h.Result(r, series)
+		}
+	}
+	if series == nil {
+		series = []eval.Series{}
+	}
+	body, err := json.Marshal(series)
+	if err != nil {
+		slog.Error("encode render response", "err", err)
+		httperror(w, 500)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	r.Header.Set("If-None-Match", rw.noneMatch)
+	writeTagged(w, r, "application/json", append(body, '\n'))
+}
+
+// A resultWriter holds a response until the Result hooks have
+// seen it.
+type resultWriter struct {
+	header    http.Header
+	status    int
+	buf       bytes.Buffer
+	noneMatch string // of the request
+}
+
+func (rw *resultWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *resultWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *resultWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.buf.Write(p)
+}
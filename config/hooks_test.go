@@ -0,0 +1,69 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/droyo/metaphite/eval"
+	"github.com/droyo/metaphite/query"
+)
+
+func TestHooks(t *testing.T) {
+	c := newCluster(t, testData, "")
+	defer c.Close()
+	var order []string
+	c.config.AddHook(Hook{
+		Query: func(r *http.Request, queries []*query.Query) ([]*query.Query, error) {
+			order = append(order, "query")
+			team := r.Form.Get("team")
+			for _, q := range queries {
+				for _, m := range q.Metrics() {
+					if pfx, _ := m.Split(); team != "" && string(pfx) != team {
+						return nil, fmt.Errorf("%s may not query %s", team, *m)
+					}
+				}
+			}
+			return queries, nil
+		},
+	})
+	c.config.AddHook(Hook{
+		Result: func(r *http.Request, series []eval.Series) []eval.Series {
+			order = append(order, "result")
+			var kept []eval.Series
+			for _, s := range series {
+				if !strings.Contains(s.Target, "mem") {
+					kept = append(kept, s)
+				}
+			}
+			return kept
+		},
+	})
+
+	code, body := c.get(t, "/render?format=json&team=dev&target=prod.cpu.load")
+	if code != 403 || !strings.Contains(body, "dev may not query prod.cpu.load") {
+		t.Errorf("query outside the team's prefix: %d %s", code, body)
+	}
+	order = nil
+	code, body = c.get(t, "/render?format=json&team=dev&target=dev.*.*")
+	var series []renderJSON
+	if err := json.Unmarshal([]byte(body), &series); code != 200 || err != nil || len(series) != 2 {
+		t.Errorf("render dev.*.* without mem: %d %s", code, body)
+	}
+	if !reflect.DeepEqual(order, []string{"query", "result"}) {
+		t.Errorf("hooks called in order %v", order)
+	}
+	// merged from several backends
+	code, body = c.get(t, "/render?format=json&target=prod.cpu.load&target=dev.mem.total")
+	if err := json.Unmarshal([]byte(body), &series); code != 200 || err != nil || len(series) != 1 {
+		t.Errorf("render from prod and dev without mem: %d %s", code, body)
+	}
+	// other formats are unchanged
+	code, body = c.get(t, "/render?format=csv&target=dev.mem.total")
+	if code != 200 || !strings.Contains(body, "mem.total") {
+		t.Errorf("render csv: %d %s", code, body)
+	}
+}
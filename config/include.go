@@ -0,0 +1,54 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+)
+
+// loadIncludes merges the mappings in the files matching the
+// Include pattern into c.Mappings. Each file holds a JSON object
+// with a "mappings" key, like the config file; other keys are
+// ignored. A prefix may only be mapped once across all files.
+func (c *Config) loadIncludes() error {
+	c.included = make(map[string]string)
+	if c.Include == "" {
+		return nil
+	}
+	pattern := c.Include
+	if !filepath.IsAbs(pattern) && c.path != "" {
+		pattern = filepath.Join(filepath.Dir(c.path), pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("include %q: %v", c.Include, err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var inc struct{ Mappings map[string]Mapping }
+		if err := json.Unmarshal(data, &inc); err != nil {
+			return fmt.Errorf("%s: %v", file, jsonPosition(data, err))
+		}
+		var raw struct{ Mappings interface{} }
+		json.Unmarshal(data, &raw)
+		if errs := unknownKeys("mappings", raw.Mappings, reflect.TypeOf(inc.Mappings)); len(errs) > 0 {
+			return fmt.Errorf("%s: %v", file, configErrors(errs))
+		}
+		for pfx, u := range inc.Mappings {
+			if prev, ok := c.included[pfx]; ok {
+				return fmt.Errorf("%s: prefix %q is already mapped in %s", file, pfx, prev)
+			}
+			if _, ok := c.Mappings[pfx]; ok {
+				return fmt.Errorf("%s: prefix %q is already mapped in the config file", file, pfx)
+			}
+			c.Mappings[pfx] = u
+			c.included[pfx] = file
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metaphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, js string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(js), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "config.json")
+	write("config.json", `{
+		"mappings": {"dev": "http://dev/"},
+		"include": "conf.d/*.json",
+		"persistMappings": true
+	}`)
+	write("conf.d/prod.json", `{"mappings": {"prod": "http://prod/"}}`)
+	write("conf.d/qa.json", `{"mappings": {"qa": "http://qa/", "stage": "http://stage/"}}`)
+
+	cfg, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Mapping{
+		"dev":   {URL: "http://dev/"},
+		"prod":  {URL: "http://prod/"},
+		"qa":    {URL: "http://qa/"},
+		"stage": {URL: "http://stage/"},
+	}
+	if !reflect.DeepEqual(cfg.Mappings, want) {
+		t.Errorf("mappings = %v, expected %v", cfg.Mappings, want)
+	}
+
+	// changes are saved to the config file, without the
+	// included mappings
+	if err := cfg.SetMapping("test", "http://test/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetMapping("prod", "http://prod2/"); err == nil {
+		t.Error("changed a mapping from an included file")
+	}
+	if cfg, err = ParseFile(path); err != nil {
+		t.Fatalf("reparse after SetMapping: %v", err)
+	}
+	if cfg.Mappings["test"].URL != "http://test/" || cfg.Mappings["prod"].URL != "http://prod/" {
+		t.Errorf("mappings after SetMapping = %v", cfg.Mappings)
+	}
+
+	// a change that cannot be saved is not made
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("config.json", `not json`)
+	if err := cfg.SetMapping("test", "http://test2/"); err == nil {
+		t.Error("changed a mapping that could not be saved")
+	}
+	if err := cfg.SetMapping("new", "http://new/"); err == nil {
+		t.Error("added a mapping that could not be saved")
+	}
+	if _, err := cfg.DeleteMapping("dev"); err == nil {
+		t.Error("deleted a mapping that could not be saved")
+	}
+	if cfg.Mappings["test"].URL != "http://test/" || cfg.Mappings["dev"].URL != "http://dev/" {
+		t.Errorf("mappings after failed changes = %v", cfg.Mappings)
+	}
+	for _, pfx := range []string{"test", "dev", "new"} {
+		if _, ok := cfg.backend(pfx); ok != (pfx != "new") {
+			t.Errorf("backend for %s after failed changes: %v", pfx, ok)
+		}
+	}
+	write("config.json", string(saved))
+
+	write("conf.d/dup.json", `{"mappings": {"prod": "http://other/"}}`)
+	if _, err := ParseFile(path); err == nil || !strings.Contains(err.Error(), "already mapped") {
+		t.Errorf("duplicate prefix: error = %v", err)
+	}
+}
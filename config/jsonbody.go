@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxJSONBody limits the size of JSON render request bodies.
+const maxJSONBody = 10 << 20
+
+// isJSON returns true if r has a JSON body.
+func isJSON(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// parseJSONForm reads the parameters of a render request from
+// a JSON body, as sent by newer versions of Grafana, and adds
+// them to r.Form. The body is a JSON object whose values are
+// strings, numbers, booleans, or lists of them:
+//
+// 	{"target": ["dev.cpu.load"], "from": "-1h", "maxDataPoints": 100}
+func parseJSONForm(r *http.Request) error {
+	var body map[string]interface{}
+	d := json.NewDecoder(io.LimitReader(r.Body, maxJSONBody))
+	d.UseNumber()
+	if err := d.Decode(&body); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if r.Form == nil {
+		r.Form = make(url.Values)
+	}
+	for k, v := range body {
+		list, ok := v.([]interface{})
+		if !ok {
+			list = []interface{}{v}
+		}
+		for _, x := range list {
+			s, err := jsonParam(x)
+			if err != nil {
+				return fmt.Errorf("parameter %q: %v", k, err)
+			}
+			r.Form.Add(k, s)
+		}
+	}
+	return nil
+}
+
+func jsonParam(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// encodeJSONForm encodes form as a JSON body, in the format
+// read by parseJSONForm. Targets are always sent as a list.
+func encodeJSONForm(form url.Values) ([]byte, error) {
+	body := make(map[string]interface{}, len(form))
+	for k, v := range form {
+		if len(v) == 1 && k != "target" {
+			body[k] = v[0]
+		} else {
+			body[k] = v
+		}
+	}
+	return json.Marshal(body)
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/droyo/metaphite/certs"
+)
+
+// Kubernetes selects the EndpointSlices of a backend's servers. The
+// ready endpoints of the slices are sent requests in turn. For
+// example, to use the pods of the graphite-api service:
+//
+// 	"prod": {
+// 		"kubernetes": {
+// 			"namespace": "monitoring",
+// 			"selector": "kubernetes.io/service-name=graphite-api",
+// 			"port": "http"
+// 		},
+// 		"refresh": "10s"
+// 	}
+//
+// metaphite must run in the cluster, with a service account that
+// may list EndpointSlices in the namespace.
+type Kubernetes struct {
+	// Namespace of the EndpointSlices. The default is the
+	// namespace metaphite runs in.
+	Namespace string `json:"namespace,omitempty"`
+	// Label selector for the EndpointSlices.
+	Selector string `json:"selector"`
+	// Name of the port to send requests to. The default is the
+	// first port of each slice.
+	Port string `json:"port,omitempty"`
+	// "http", the default, or "https".
+	Scheme string `json:"scheme,omitempty"`
+	// Path of the graphite API on the servers.
+	Path string `json:"path,omitempty"`
+}
+
+// The files of the service account of a pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// A kubeClient makes requests to the Kubernetes API.
+type kubeClient struct {
+	server    string // https://host:port
+	namespace string // of the pod
+	token     func() (string, error)
+	client    *http.Client
+}
+
+// inCluster returns a client for the API server of the cluster
+// metaphite runs in. It is a variable so that tests can replace it.
+var inCluster = func() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	pool := certs.FromFile(path.Join(serviceAccountDir, "ca.crt"))
+	if len(pool) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", path.Join(serviceAccountDir, "ca.crt"))
+	}
+	namespace, err := ioutil.ReadFile(path.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	return &kubeClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		// the token is rotated, so it is read for every request
+		token: func() (string, error) {
+			b, err := ioutil.ReadFile(path.Join(serviceAccountDir, "token"))
+			return strings.TrimSpace(string(b)), err
+		},
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool.CertPool()},
+			},
+		},
+	}, nil
+}
+
+// kubernetesDiscovery prepares the lookup of the servers selected
+// by k.
+func (c *Config) kubernetesDiscovery(k Kubernetes, refresh time.Duration) (*discovery, error) {
+	if k.Selector == "" {
+		return nil, errors.New("kubernetes: selector is required")
+	}
+	scheme := k.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("kubernetes: invalid scheme %q", k.Scheme)
+	}
+	kc, err := inCluster()
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	if k.Namespace == "" {
+		k.Namespace = kc.namespace
+	}
+	u := &url.URL{
+		Scheme:   "kubernetes",
+		Host:     k.Namespace,
+		RawQuery: url.Values{"labelSelector": {k.Selector}}.Encode(),
+	}
+	d := newDiscovery(u, scheme, k.Path, refresh)
+	d.lookup = func(ctx context.Context, _ bool) ([]*url.URL, error) {
+		return kc.endpoints(ctx, d, k)
+	}
+	return d, nil
+}
+
+// endpointSliceList is the part of a list of discovery.k8s.io/v1
+// EndpointSlices that is needed to find servers.
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Addresses  []string
+			Conditions struct {
+				Ready *bool
+			}
+		}
+		Ports []struct {
+			Name *string
+			Port *int32
+		}
+	}
+}
+
+// endpoints lists the EndpointSlices selected by k, and returns
+// the URLs of their ready endpoints.
+func (kc *kubeClient) endpoints(ctx context.Context, d *discovery, k Kubernetes) ([]*url.URL, error) {
+	u := kc.server + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(k.Namespace) +
+		"/endpointslices?" + url.Values{"labelSelector": {k.Selector}}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if kc.token != nil {
+		token, err := kc.token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list endpointslices: %s", rsp.Status)
+	}
+	var list endpointSliceList
+	if err := json.NewDecoder(rsp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("list endpointslices: %v", err)
+	}
+
+	var urls []*url.URL
+	seen := make(map[string]bool)
+	for _, slice := range list.Items {
+		port := -1
+		for _, p := range slice.Ports {
+			if p.Port != nil && (k.Port == "" || p.Name != nil && *p.Name == k.Port) {
+				port = int(*p.Port)
+				break
+			}
+		}
+		if port < 0 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// a missing condition means the endpoint is ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready || len(ep.Addresses) == 0 {
+				continue
+			}
+			host := net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port))
+			if !seen[host] {
+				seen[host] = true
+				urls = append(urls, d.server(host))
+			}
+		}
+	}
+	return urls, nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKubernetes(t *testing.T) {
+	g := newFakeGraphite(nil)
+	defer g.Close()
+	u, _ := url.Parse(g.URL)
+	var mu sync.Mutex
+	ready := true
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/monitoring/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=graphite-api" ||
+			r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unexpected request "+r.URL.String(), 403)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `{"items": [{
+			"addressType": "IPv4",
+			"endpoints": [
+				{"addresses": [%q], "conditions": {"ready": %v}},
+				{"addresses": ["10.0.0.2"], "conditions": {"ready": false}}
+			],
+			"ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": %s}]
+		}]}`, u.Hostname(), ready, u.Port())
+	}))
+	defer api.Close()
+	defer func(f func() (*kubeClient, error)) { inCluster = f }(inCluster)
+	inCluster = func() (*kubeClient, error) {
+		return &kubeClient{
+			server:    api.URL,
+			namespace: "monitoring",
+			token:     func() (string, error) { return "secret", nil },
+			client:    api.Client(),
+		}, nil
+	}
+
+	c := newCluster(t, nil, `"mappings": {"prod": {
+		"kubernetes": {"selector": "kubernetes.io/service-name=graphite-api", "port": "http"},
+		"refresh": "1ms"
+	}}`)
+	defer c.Close()
+	if code, body := c.get(t, "/render?format=json&target=prod.cpu"); code != 200 {
+		t.Fatalf("got %d %s", code, body)
+	}
+	if n := c.config.Stats()["prod"][g.URL].Requests; n != 1 {
+		t.Errorf("ready endpoint got %d requests, expected 1", n)
+	}
+
+	mu.Lock()
+	ready = false
+	mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, _ := c.get(t, "/render?format=json&target=prod.cpu")
+		if code == http.StatusBadGateway {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %d after the endpoint became unready", code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := Parse(strings.NewReader(`{"mappings": {"prod": {"kubernetes": {"port": "http"}}}}`)); err == nil {
+		t.Error("kubernetes mapping without a selector was accepted")
+	}
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The endpoints that a Listener can serve.
+const (
+	EndpointRender  = "render"  // /render and /tags/autoComplete/
+	EndpointAdmin   = "admin"   // /admin/
+	EndpointMetrics = "metrics" // /debug/metrics
+	EndpointHealth  = "health"  // /livez, /healthz and /readyz
+	EndpointDebug   = "debug"   // /debug/pprof/ and /debug/vars
+)
+
+// A Listener is an address to accept connections on, and the
+// endpoints to serve there. In the config JSON,
+//
+// 	"listeners": [
+// 		{"address": ":443", "tls": true, "serve": ["render", "health"]},
+// 		{"address": "127.0.0.1:8081", "serve": ["admin", "metrics"]},
+// 		{"address": "unix:///run/metaphite.sock", "socketMode": "0660"}
+// 	]
+type Listener struct {
+	// A TCP address, or the path of a unix socket in the
+	// form unix:///path/to/socket.
+	Address string
+	// Permissions of a unix socket, in octal.
+	SocketMode string
+	// The endpoints to serve; all but debug if empty.
+	Serve []string
+	// Serve HTTPS, with the settings in the TLS field of the
+	// Config.
+	TLS bool
+}
+
+// Serves returns true if l serves endpoint. The debug endpoint
+// must be asked for by name.
+func (l Listener) Serves(endpoint string) bool {
+	if len(l.Serve) == 0 {
+		return endpoint != EndpointDebug
+	}
+	for _, e := range l.Serve {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validListeners() error {
+	if _, err := (Listener{Address: c.Address, SocketMode: c.SocketMode}).socketMode(); err != nil {
+		return err
+	}
+	for _, d := range []Duration{c.ReadTimeout, c.ReadHeaderTimeout, c.WriteTimeout, c.IdleTimeout, c.DrainTimeout} {
+		if d.Duration < 0 {
+			return fmt.Errorf("negative server timeout %s", d)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if l.Address == "" {
+			return errors.New("listener without an address")
+		}
+		if seen[l.Address] {
+			return fmt.Errorf("more than one listener on %s", l.Address)
+		}
+		seen[l.Address] = true
+		if _, err := l.socketMode(); err != nil {
+			return fmt.Errorf("listener %s: %v", l.Address, err)
+		}
+		if l.TLS && c.serverTLS == nil {
+			return fmt.Errorf("listener %s: tls requires a cert and key", l.Address)
+		}
+		for _, e := range l.Serve {
+			switch e {
+			case EndpointRender, EndpointAdmin, EndpointMetrics, EndpointHealth, EndpointDebug:
+			default:
+				return fmt.Errorf("listener %s: unknown endpoint %q", l.Address, e)
+			}
+		}
+	}
+	if seen[c.DebugAddress] {
+		return fmt.Errorf("debugAddress %s is also a listener", c.DebugAddress)
+	}
+	return nil
+}
+
+const unixScheme = "unix://"
+
+func (l Listener) socketMode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(l.Address, unixScheme) {
+		return 0, errors.New("socketMode is only for unix sockets")
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socketMode %q", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Listen opens the address of l. A unix socket left behind by
+// an earlier process is removed first.
+func (l Listener) Listen() (net.Listener, error) {
+	if !strings.HasPrefix(l.Address, unixScheme) {
+		return net.Listen("tcp", l.Address)
+	}
+	mode, err := l.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimPrefix(l.Address, unixScheme)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Default server timeouts.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// Server returns an HTTP server for h, with the timeouts set in c.
+func (c *Config) Server(h http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           h,
+		ReadTimeout:       c.ReadTimeout.Duration,
+		ReadHeaderTimeout: c.ReadHeaderTimeout.Duration,
+		WriteTimeout:      c.WriteTimeout.Duration,
+		IdleTimeout:       c.IdleTimeout.Duration,
+	}
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = defaultIdleTimeout
+	}
+	return srv
+}
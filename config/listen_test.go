@@ -0,0 +1,93 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListeners(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{"listeners": [
+		{"address": ":8080", "serve": ["render", "health"]},
+		{"address": "127.0.0.1:8081"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := cfg.Listeners
+	if !l[0].Serves(EndpointRender) || l[0].Serves(EndpointAdmin) || !l[1].Serves(EndpointAdmin) || l[1].Serves(EndpointDebug) {
+		t.Errorf("unexpected endpoints in %+v", l)
+	}
+	for _, js := range []string{
+		`{"listeners": [{"address": ":8080", "serve": ["pprof"]}]}`,
+		`{"listeners": [{"address": ":8080"}, {"address": ":8080"}]}`,
+		`{"listeners": [{"address": ":8080", "tls": true}]}`,
+		`{"listeners": [{"serve": ["render"]}]}`,
+		`{"listeners": [{"address": ":8080"}], "debugAddress": ":8080"}`,
+		`{"listeners": [{"address": ":8080", "socketMode": "0660"}]}`,
+		`{"listeners": [{"address": "unix:///tmp/sock", "socketMode": "rw"}]}`,
+		`{"address": "unix:///tmp/sock", "socketMode": "01777"}`,
+		`{"writeTimeout": "-1s"}`,
+	} {
+		if _, err := Parse(strings.NewReader(js)); err == nil {
+			t.Errorf("accepted %s", js)
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{"readTimeout": "5s", "writeTimeout": 60}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := cfg.Server(http.NotFoundHandler())
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != time.Minute {
+		t.Errorf("got read/write timeouts %s/%s, want 5s/1m", srv.ReadTimeout, srv.WriteTimeout)
+	}
+	if srv.ReadHeaderTimeout != defaultReadHeaderTimeout || srv.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("defaults not applied: %s/%s", srv.ReadHeaderTimeout, srv.IdleTimeout)
+	}
+	if _, err := Parse(strings.NewReader(`{"drainTimeout": "-1s"}`)); err == nil {
+		t.Error("negative drainTimeout accepted")
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metaphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metaphite.sock")
+	l := Listener{Address: "unix://" + path, SocketMode: "0660"}
+	for i := 0; i < 2; i++ {
+		ln, err := l.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0660 {
+			t.Errorf("socket has mode %v, want 0660", fi.Mode().Perm())
+		}
+		// Leave the socket behind, as a crashed process would.
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		ln.Close()
+	}
+	if err := ioutil.WriteFile(path+".txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l.Address = "unix://" + path + ".txt"
+	if _, err := l.Listen(); err == nil {
+		t.Error("replaced a regular file with a socket")
+	}
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// Log levels that may be set for individual mappings. At the
+// "debug" level, requests to the backend, and the responses, are
+// logged in detail, as if the Debug option were set for that
+// backend alone.
+const (
+	levelInfo  = "info"
+	levelDebug = "debug"
+)
+
+func validLevel(level string) error {
+	switch level {
+	case levelInfo, levelDebug:
+		return nil
+	}
+	return fmt.Errorf("invalid log level %q", level)
+}
+
+func validLogLevel(level string) error {
+	switch level {
+	case "", "debug", "info", "warn", "error":
+		return nil
+	}
+	return fmt.Errorf("invalid log level %q", level)
+}
+
+// proxyError answers a request that could not be proxied to the
+// backend for prefix, as httputil.ReverseProxy does by default.
+// Requests canceled by the client are only logged at the debug
+// level.
+func proxyError(prefix string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		level := slog.LevelWarn
+		if errors.Is(err, context.Canceled) {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "proxy error", "backend", prefix, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// Response bodies longer than this are truncated in dumps.
+const maxDumpBody = 4096
+
+// A dumpTransport logs the requests to a backend, and their
+// responses, while debug logging is enabled for it.
+type dumpTransport struct {
+	prefix string
+	debug  func(prefix string) bool
+	http.RoundTripper
+}
+
+func (t dumpTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.debug(t.prefix) {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	if dump, err := httputil.DumpRequestOut(r, true); err == nil {
+		slog.Info("backend request", "backend", t.prefix, "dump", string(dump))
+	}
+	rsp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil {
+		slog.Info("backend response", "backend", t.prefix, "err", err)
+		return nil, err
+	}
+	dump, err := httputil.DumpResponse(rsp, false)
+	if err != nil {
+		return rsp, nil
+	}
+	body := make([]byte, maxDumpBody+1)
+	n, _ := io.ReadFull(rsp.Body, body)
+	rsp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body[:n]), rsp.Body), rsp.Body}
+	if n > maxDumpBody {
+		n = maxDumpBody
+		defer slog.Info("backend response", "backend", t.prefix, "dump", string(dump)+string(body[:n])+"...")
+	} else {
+		defer slog.Info("backend response", "backend", t.prefix, "dump", string(dump)+string(body[:n]))
+	}
+	return rsp, nil
+}
+
+func validLogFormat(format string) error {
+	switch format {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q", format)
+}
+
+func validAccessLogFormat(format string) error {
+	switch format {
+	case "", "common", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid access log format %q", format)
+}
+
+func validSampling(sample int, slow time.Duration) error {
+	if sample < 0 {
+		return fmt.Errorf("accessLogSample %d is negative", sample)
+	}
+	if slow < 0 {
+		return fmt.Errorf("accessLogSlowRequest %s is negative", slow)
+	}
+	return nil
+}
+
+func validRotation(maxSize int, maxAge time.Duration) error {
+	if maxSize < 0 {
+		return fmt.Errorf("accessLogMaxSize %d is negative", maxSize)
+	}
+	if maxAge < 0 {
+		return fmt.Errorf("accessLogMaxAge %s is negative", maxAge)
+	}
+	return nil
+}
+
+// debugFor returns true if debug logging is enabled for
+// the backend with the given prefix.
+func (c *Config) debugFor(prefix string) bool {
+	if c.Debug {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.LogLevels[prefix] == levelDebug
+}
+
+// SetLogLevel overrides the log level for a mapping. An empty
+// level removes the override.
+func (c *Config) SetLogLevel(prefix, level string) error {
+	if level != "" {
+		if err := validLevel(level); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if level == "" {
+		delete(c.LogLevels, prefix)
+	} else {
+		c.LogLevels[prefix] = level
+	}
+	return nil
+}
+
+// adminLogLevel handles /admin/loglevel and /admin/loglevel/{prefix}.
+func (c *Config) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/admin/loglevel")
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	switch r.Method {
+	case "GET":
+		// copied, so that the lock is not held while a slow
+		// client reads the response
+		c.mu.RLock()
+		levels := make(map[string]string, len(c.LogLevels))
+		for pfx, level := range c.LogLevels {
+			levels[pfx] = level
+		}
+		c.mu.RUnlock()
+		if prefix == "" {
+			writeJSON(w, levels)
+		} else if level, ok := levels[prefix]; ok {
+			writeJSON(w, level)
+		} else {
+			writeJSON(w, levelInfo)
+		}
+	case "PUT":
+		var level string
+		if prefix == "" {
+			badmethod(w)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&level); err != nil {
+			http.Error(w, "body must be a JSON string containing a log level", 400)
+			return
+		}
+		if err := c.SetLogLevel(prefix, level); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if prefix == "" {
+			badmethod(w)
+			return
+		}
+		c.SetLogLevel(prefix, "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		badmethod(w)
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	c := newCluster(t, testData, `"adminToken": "secret"`)
+	defer c.Close()
+	admin := httptest.NewServer(c.config.Admin())
+	defer admin.Close()
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		b, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, strings.Join(strings.Fields(string(b)), "")
+	}
+	// reports whether a request to dev is dumped
+	dumped := func() bool {
+		buf.Reset()
+		if status, body := c.get(t, "/render?format=csv&target=dev.mem.total"); status != 200 {
+			t.Fatalf("render: got %d %q", status, body)
+		}
+		return strings.Contains(buf.String(), `msg="backend request" backend=dev`)
+	}
+
+	if dumped() {
+		t.Error("request dumped without a log level override")
+	}
+	tests := []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"PUT", "/admin/loglevel/dev", `"debug"`, 204, ""},
+		{"GET", "/admin/loglevel", "", 200, `{"dev":"debug"}`},
+		{"GET", "/admin/loglevel/dev", "", 200, `"debug"`},
+		{"GET", "/admin/loglevel/prod", "", 200, `"info"`},
+		{"PUT", "/admin/loglevel/prod", `"verbose"`, 400, `invalidloglevel"verbose"`},
+		{"PUT", "/admin/loglevel/prod", `debug`, 400, ""},
+		{"PUT", "/admin/loglevel", `"debug"`, 405, ""},
+	}
+	for _, tt := range tests {
+		status, body := do(tt.method, tt.path, tt.body)
+		if status != tt.status || tt.want != "" && body != tt.want {
+			t.Errorf("%s %s %s: got %d %s, expected %d %s",
+				tt.method, tt.path, tt.body, status, body, tt.status, tt.want)
+		}
+	}
+	if !dumped() {
+		t.Error("request not dumped after setting the debug level")
+	}
+	if c.config.debugFor("prod") {
+		t.Error("debug level set for prod by a rejected request")
+	}
+	if status, _ := do("DELETE", "/admin/loglevel/dev", ""); status != 204 {
+		t.Errorf("DELETE: got status %d, expected 204", status)
+	}
+	if dumped() {
+		t.Error("request dumped after removing the override")
+	}
+	if _, body := do("GET", "/admin/loglevel", ""); body != "{}" {
+		t.Errorf("after DELETE: got overrides %s", body)
+	}
+}
+
+func TestProxyErrorLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	c := newCluster(t, testData, "")
+	defer c.Close()
+	c.backends["prod"].Close()
+	if status, body := c.get(t, "/render?format=csv&target=prod.cpu.load"); status != 502 {
+		t.Errorf("backend down: got %d %q, expected 502", status, body)
+	}
+	if log := buf.String(); !strings.Contains(log, `level=WARN msg="proxy error" backend=prod`) {
+		t.Errorf("proxy error not logged as a warning:\n%s", log)
+	}
+
+	buf.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	proxyError("dev")(rec, httptest.NewRequest("GET", "/render", nil).WithContext(ctx), ctx.Err())
+	if rec.Code != 502 {
+		t.Errorf("canceled request: got status %d, expected 502", rec.Code)
+	}
+	if log := buf.String(); !strings.Contains(log, `level=DEBUG msg="proxy error" backend=dev`) {
+		t.Errorf("canceled request not logged at the debug level:\n%s", log)
+	}
+
+	for _, level := range []string{"debug", "info", "warn", "error"} {
+		if _, err := Parse(strings.NewReader(`{"logLevel": "` + level + `"}`)); err != nil {
+			t.Errorf("logLevel %q: %v", level, err)
+		}
+	}
+	if _, err := Parse(strings.NewReader(`{"logLevel": "verbose"}`)); err == nil {
+		t.Error("invalid logLevel accepted")
+	}
+}
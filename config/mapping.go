@@ -0,0 +1,344 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+
+	"github.com/droyo/metaphite/certs"
+)
+
+// A Mapping describes the backend for a metrics prefix. In the
+// config JSON, a mapping is either the URL of the backend, or an
+// object with more settings:
+//
+// 	"mappings": {
+// 		"dev": "http://dev-graphite/",
+// 		"prod": {
+// 			"urls": ["http://graphite-1/", "http://graphite-2/"],
+// 			"timeout": "30s",
+// 			"retries": 1,
+// 			"username": "metaphite",
+// 			"password": "secret",
+// 			"headers": {"X-Grafana-Org-Id": "2"},
+// 			"caCert": "/etc/ssl/prod-ca.pem",
+// 			"stripPrefix": false,
+// 			"carbon": "graphite-1:2003"
+// 		},
+// 		"scaled": "srv://_graphite._tcp.prod.example.net"
+// 	}
+//
+// A URL with the srv:// scheme names the DNS SRV records of the
+// backend's servers, which are sent requests in turn over http,
+// or over https if the scheme is srv+https://. The records are
+// looked up again every Refresh, while the backend is in use.
+// Servers may also be found through the Kubernetes API or the
+// Consul catalog; see the Kubernetes and Consul types.
+//
+// A backend that lacks some render functions, such as one that
+// only implements part of graphite's API, may list them in
+// LocalFunctions. Metaphite fetches the arguments of calls to
+// them from the backend, and computes their results itself, for
+// requests with format=json.
+type Mapping struct {
+	// Backend URL.
+	URL string
+	// URLs of several equivalent backends, which are sent
+	// requests in turn. Used instead of URL.
+	URLs []string
+	// The EndpointSlices of the backend's servers, which are
+	// used instead of URL.
+	Kubernetes *Kubernetes
+	// The Consul service of the backend's servers, which are
+	// used instead of URL.
+	Consul *Consul
+	// Servers that each hold some of the metrics, used instead
+	// of URL.
+	HashRing *HashRing
+	// Directory of whisper files, as written by carbon, to serve
+	// the metrics from, instead of URL. Render functions are
+	// evaluated by metaphite; see LocalFunctions.
+	Whisper string
+	// How often to look up the servers of an srv:// URL, or of
+	// Kubernetes, and the longest a Consul watch waits. The
+	// default is 30s.
+	Refresh Duration
+	// Limit on the time a request to the backend may take.
+	Timeout Duration
+	// Number of times to retry a request that fails without
+	// a response, or with a 502, 503 or 504 status. Requests
+	// with a body that cannot be sent again are not retried.
+	Retries int
+	// If a request to one of several URLs has not been answered
+	// after this long, send it to another as well, and use
+	// whichever response comes first. The slower request is
+	// canceled. Zero, the default, never does.
+	HedgeAfter Duration
+	// Wait instead for this quantile of the latency of the
+	// backend's requests, such as 0.95, once it has been sent
+	// enough of them, if it is longer than HedgeAfter.
+	HedgeQuantile float64
+	// Credentials for HTTP basic authentication.
+	Username, Password string
+	// Sent in the Authorization header, instead of basic
+	// authentication credentials.
+	BearerToken string
+	// Extra headers for requests to the backend.
+	Headers map[string]string
+	// Do not validate the backend's HTTPS cert.
+	InsecureHTTPS bool
+	// File to load CA certs from, instead of the global ones.
+	CACert string
+	// Files with a certificate and key to present to the
+	// backend.
+	ClientCert, ClientKey string
+	// Remove the prefix from metric names before sending
+	// them to the backend. The default is true.
+	StripPrefix *bool
+	// The host:port of the backend's carbon plaintext listener,
+	// to which the relay forwards metrics under the prefix.
+	Carbon string
+	// Render functions the backend does not support, which are
+	// evaluated by metaphite. Only functions metaphite can
+	// evaluate may be listed; "*" stands for all of them, and is
+	// the default for Whisper.
+	LocalFunctions []string
+}
+
+// mappingJSON is the object form of a Mapping, for marshalling.
+type mappingJSON struct {
+	URL            string            `json:"url,omitempty"`
+	URLs           []string          `json:"urls,omitempty"`
+	Kubernetes     *Kubernetes       `json:"kubernetes,omitempty"`
+	Consul         *Consul           `json:"consul,omitempty"`
+	HashRing       *HashRing         `json:"hashRing,omitempty"`
+	Whisper        string            `json:"whisper,omitempty"`
+	Refresh        *Duration         `json:"refresh,omitempty"`
+	Timeout        *Duration         `json:"timeout,omitempty"`
+	Retries        int               `json:"retries,omitempty"`
+	HedgeAfter     *Duration         `json:"hedgeAfter,omitempty"`
+	HedgeQuantile  float64           `json:"hedgeQuantile,omitempty"`
+	Username       string            `json:"username,omitempty"`
+	Password       string            `json:"password,omitempty"`
+	BearerToken    string            `json:"bearerToken,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	InsecureHTTPS  bool              `json:"insecureHTTPS,omitempty"`
+	CACert         string            `json:"caCert,omitempty"`
+	ClientCert     string            `json:"clientCert,omitempty"`
+	ClientKey      string            `json:"clientKey,omitempty"`
+	StripPrefix    *bool             `json:"stripPrefix,omitempty"`
+	Carbon         string            `json:"carbon,omitempty"`
+	LocalFunctions []string          `json:"localFunctions,omitempty"`
+}
+
+func (m *Mapping) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '"' {
+		*m = Mapping{}
+		return json.Unmarshal(data, &m.URL)
+	}
+	if len(data) == 0 || data[0] != '{' {
+		return fmt.Errorf("mapping must be a URL or an object, not %s", data)
+	}
+	type plain Mapping
+	var v plain
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*m = Mapping(v)
+	return nil
+}
+
+// MarshalJSON produces the URL alone if no other settings are
+// used, so that config files written with PersistMappings keep
+// their simple form.
+func (m Mapping) MarshalJSON() ([]byte, error) {
+	v := mappingJSON{
+		URL:            m.URL,
+		URLs:           m.URLs,
+		Kubernetes:     m.Kubernetes,
+		Consul:         m.Consul,
+		HashRing:       m.HashRing,
+		Whisper:        m.Whisper,
+		Retries:        m.Retries,
+		HedgeQuantile:  m.HedgeQuantile,
+		Username:       m.Username,
+		Password:       m.Password,
+		BearerToken:    m.BearerToken,
+		Headers:        m.Headers,
+		InsecureHTTPS:  m.InsecureHTTPS,
+		CACert:         m.CACert,
+		ClientCert:     m.ClientCert,
+		ClientKey:      m.ClientKey,
+		StripPrefix:    m.StripPrefix,
+		Carbon:         m.Carbon,
+		LocalFunctions: m.LocalFunctions,
+	}
+	if m.Timeout.Duration != 0 {
+		v.Timeout = &m.Timeout
+	}
+	if m.Refresh.Duration != 0 {
+		v.Refresh = &m.Refresh
+	}
+	if m.HedgeAfter.Duration != 0 {
+		v.HedgeAfter = &m.HedgeAfter
+	}
+	if reflect.DeepEqual(v, mappingJSON{URL: m.URL}) {
+		return json.Marshal(m.URL)
+	}
+	return json.Marshal(v)
+}
+
+// redacted returns a copy of m without its secrets, for display.
+func (m Mapping) redacted() Mapping {
+	if m.Password != "" {
+		m.Password = "REDACTED"
+	}
+	if m.BearerToken != "" {
+		m.BearerToken = "REDACTED"
+	}
+	return m
+}
+
+// urls parses the backend URLs of m.
+func (m Mapping) urls() ([]*url.URL, error) {
+	list := m.URLs
+	if m.URL != "" {
+		list = append([]string{m.URL}, list...)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no backend URL")
+	}
+	result := make([]*url.URL, 0, len(list))
+	for _, s := range list {
+		u, err := backendURL(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+// backendURL parses the URL of a graphite server.
+func backendURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid backend URL %q", s)
+	}
+	return u, nil
+}
+
+func (m Mapping) stripPrefix() bool {
+	return m.StripPrefix == nil || *m.StripPrefix
+}
+
+// mappingTransport returns the transport for requests to the
+// backend described by m.
+func (c *Config) mappingTransport(m Mapping) (http.RoundTripper, error) {
+	t := c.transport()
+	if m.InsecureHTTPS || m.CACert != "" || m.ClientCert != "" || m.ClientKey != "" {
+		tlsconfig := c.tlsconfig.Clone()
+		if m.InsecureHTTPS {
+			tlsconfig.InsecureSkipVerify = true
+		}
+		if m.CACert != "" {
+			pool := certs.FromFile(m.CACert)
+			if len(pool) == 0 {
+				return nil, fmt.Errorf("no certificates in %s", m.CACert)
+			}
+			tlsconfig.RootCAs = pool.CertPool()
+		}
+		if m.ClientCert != "" || m.ClientKey != "" {
+			cert, err := tls.LoadX509KeyPair(m.ClientCert, m.ClientKey)
+			if err != nil {
+				return nil, err
+			}
+			tlsconfig.Certificates = []tls.Certificate{cert}
+		}
+		t.TLSClientConfig = tlsconfig
+	}
+	if m.Timeout.Duration == 0 && m.Retries == 0 && m.Headers == nil &&
+		m.Username == "" && m.Password == "" && m.BearerToken == "" {
+		return t, nil
+	}
+	return mappedTransport{Mapping: m, RoundTripper: t}, nil
+}
+
+// A mappedTransport applies the request settings of a Mapping.
+type mappedTransport struct {
+	Mapping
+	http.RoundTripper
+}
+
+func (t mappedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if t.Timeout.Duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout.Duration)
+	}
+	r = r.Clone(ctx)
+	for k, v := range t.Headers {
+		r.Header.Set(k, v)
+	}
+	if t.BearerToken != "" {
+		r.Header.Set("Authorization", "Bearer "+t.BearerToken)
+	} else if t.Username != "" || t.Password != "" {
+		r.SetBasicAuth(t.Username, t.Password)
+	}
+	for try := 0; ; try++ {
+		rsp, err := t.RoundTripper.RoundTrip(r)
+		if try < t.Retries && ctx.Err() == nil && retryable(r, rsp, err) {
+			if err == nil {
+				rsp.Body.Close()
+			}
+			if r.GetBody != nil {
+				if r.Body, err = r.GetBody(); err != nil {
+					cancel()
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		rsp.Body = cancelBody{rsp.Body, cancel}
+		return rsp, nil
+	}
+}
+
+func retryable(r *http.Request, rsp *http.Response, err error) bool {
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch rsp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// A cancelBody releases the context of a request when the body
+// of its response is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
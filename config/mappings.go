@@ -0,0 +1,297 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backend returns the backend for a metrics prefix.
+func (c *Config) backend(prefix string) (backend, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	b, ok := c.proxy[prefix]
+	return b, ok
+}
+
+// SetMapping adds or replaces the mapping for a metrics prefix.
+// Requests in flight to a replaced backend are not interrupted.
+func (c *Config) SetMapping(prefix, rawurl string) error {
+	return c.PutMapping(prefix, Mapping{URL: rawurl})
+}
+
+// PutMapping is like SetMapping, but takes a Mapping with any
+// of its settings. If PersistMappings is set and the mapping
+// cannot be saved, it is not changed.
+func (c *Config) PutMapping(prefix string, m Mapping) error {
+	b, err := c.mappingBackend(prefix, m)
+	if err != nil {
+		return err
+	}
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.mu.RLock()
+	err = c.persistable(prefix)
+	own := c.ownMappings()
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	own[prefix] = m
+	if err := c.persist(own); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.Mappings[prefix] = m
+	c.proxy[prefix] = b
+	c.mu.Unlock()
+	return nil
+}
+
+// mappingBackend creates the backend for a mapping added at run
+// time.
+func (c *Config) mappingBackend(prefix string, m Mapping) (backend, error) {
+	if err := validPrefix(prefix); err != nil {
+		return backend{}, err
+	}
+	if strings.Contains(prefix, ".") {
+		return backend{}, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	b, err := c.newBackend(prefix, m)
+	if err != nil {
+		return backend{}, err
+	}
+	if l, ok := c.RateLimit.Prefix[prefix]; ok {
+		b.limit = l.bucket()
+	}
+	b.outbound = c.RateLimit.Outbound[prefix].bucket()
+	return b, nil
+}
+
+// putDynamic is like PutMapping, for a mapping from etcd, which
+// is not persisted. The mapping of the config file it replaces,
+// if any, is restored by deleteDynamic.
+func (c *Config) putDynamic(prefix string, m Mapping) error {
+	b, err := c.mappingBackend(prefix, m)
+	if err != nil {
+		return err
+	}
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dynamic == nil {
+		c.dynamic = make(map[string]*Mapping)
+	}
+	if _, ok := c.dynamic[prefix]; !ok {
+		if prev, ok := c.Mappings[prefix]; ok {
+			c.dynamic[prefix] = &prev
+		} else {
+			c.dynamic[prefix] = nil
+		}
+	}
+	c.Mappings[prefix] = m
+	c.proxy[prefix] = b
+	return nil
+}
+
+// deleteDynamic removes a mapping added by putDynamic.
+func (c *Config) deleteDynamic(prefix string) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.mu.RLock()
+	prev, ok := c.dynamic[prefix]
+	c.mu.RUnlock()
+	if !ok {
+		return
+	}
+	var (
+		b   backend
+		err error
+	)
+	if prev != nil {
+		b, err = c.mappingBackend(prefix, *prev)
+		if err != nil {
+			slog.Error("restore mapping", "prefix", prefix, "err", err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dynamic, prefix)
+	delete(c.Mappings, prefix)
+	delete(c.proxy, prefix)
+	if prev != nil && err == nil {
+		c.Mappings[prefix] = *prev
+		c.proxy[prefix] = b
+	}
+}
+
+// DeleteMapping removes the mapping for a metrics prefix. It
+// returns false if there was no such mapping. If PersistMappings
+// is set and the removal cannot be saved, the mapping is kept.
+func (c *Config) DeleteMapping(prefix string) (bool, error) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.mu.RLock()
+	_, ok := c.proxy[prefix]
+	err := c.persistable(prefix)
+	own := c.ownMappings()
+	c.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	delete(own, prefix)
+	if err := c.persist(own); err != nil {
+		return true, err
+	}
+	c.mu.Lock()
+	delete(c.Mappings, prefix)
+	delete(c.proxy, prefix)
+	c.mu.Unlock()
+	return true, nil
+}
+
+// persistable returns an error if a change to the mapping for
+// prefix cannot be saved, because the mapping is in an included
+// file. c.mu must be held.
+func (c *Config) persistable(prefix string) error {
+	if _, ok := c.dynamic[prefix]; ok {
+		return fmt.Errorf("prefix %q is mapped in etcd", prefix)
+	}
+	if file, ok := c.included[prefix]; ok && c.PersistMappings {
+		return fmt.Errorf("prefix %q is mapped in %s, which is not updated", prefix, file)
+	}
+	return nil
+}
+
+// ownMappings returns a copy of the mappings that belong in the
+// config file: those not from included files, and not from etcd,
+// which for the latter are those they replaced. c.mu must be held.
+func (c *Config) ownMappings() map[string]Mapping {
+	own := make(map[string]Mapping, len(c.Mappings))
+	for pfx, u := range c.Mappings {
+		if prev, ok := c.dynamic[pfx]; ok {
+			if prev == nil {
+				continue
+			}
+			u = *prev
+		}
+		if _, ok := c.included[pfx]; !ok {
+			own[pfx] = u
+		}
+	}
+	return own
+}
+
+// persist writes own, from ownMappings, back to the config file
+// as its mappings, if PersistMappings is set. All other contents
+// of the file are preserved, though not their formatting. The
+// file is written without c.mu, so that requests are not held up;
+// c.updateMu must be held instead.
+func (c *Config) persist(own map[string]Mapping) error {
+	if !c.PersistMappings || c.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	mappings, err := json.Marshal(own)
+	if err != nil {
+		return err
+	}
+	key := "mappings"
+	for k := range doc {
+		if strings.EqualFold(k, key) {
+			key = k
+		}
+	}
+	doc[key] = mappings
+	if data, err = json.MarshalIndent(doc, "", "\t"); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that a failed
+	// write does not leave a truncated config behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".metaphite")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// adminMappings handles /admin/mappings and /admin/mappings/{prefix}.
+func (c *Config) adminMappings(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/admin/mappings")
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	switch r.Method {
+	case "GET":
+		// copied, so that the lock is not held while a slow
+		// client reads the response
+		c.mu.RLock()
+		result := make(map[string]Mapping, len(c.Mappings))
+		for pfx, m := range c.Mappings {
+			if prefix == "" || pfx == prefix {
+				result[pfx] = m.redacted()
+			}
+		}
+		c.mu.RUnlock()
+		if prefix == "" {
+			writeJSON(w, result)
+		} else if m, ok := result[prefix]; ok {
+			writeJSON(w, m)
+		} else {
+			notfound(w)
+		}
+	case "PUT":
+		var m Mapping
+		if prefix == "" {
+			badmethod(w)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "body must be a JSON string containing a URL, or a mapping object", 400)
+			return
+		}
+		if err := c.PutMapping(prefix, m); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if prefix == "" {
+			badmethod(w)
+			return
+		}
+		if ok, err := c.DeleteMapping(prefix); err != nil {
+			http.Error(w, err.Error(), 500)
+		} else if !ok {
+			notfound(w)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		badmethod(w)
+	}
+}
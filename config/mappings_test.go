@@ -0,0 +1,73 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A blockedWriter is a ResponseWriter for a client that does not
+// read its response until released.
+type blockedWriter struct {
+	*httptest.ResponseRecorder
+	writing chan bool
+	release chan bool
+}
+
+func (w blockedWriter) Write(p []byte) (int, error) {
+	w.writing <- true
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestAdminMappings(t *testing.T) {
+	c := newCluster(t, testData, `"adminToken": "secret"`)
+	defer c.Close()
+
+	w := blockedWriter{httptest.NewRecorder(), make(chan bool), make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		c.config.adminMappings(w, httptest.NewRequest("GET", "/admin/mappings", nil))
+		close(done)
+	}()
+	<-w.writing
+
+	// a change to the mappings, and requests routed after it, do
+	// not wait for the slow client
+	changed := make(chan error, 1)
+	go func() { changed <- c.config.SetMapping("stage", "http://stage/") }()
+	select {
+	case err := <-changed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetMapping blocked by a slow admin client")
+	}
+	if _, ok := c.config.backend("stage"); !ok {
+		t.Error("mapping not added")
+	}
+	close(w.release)
+	<-done
+
+	var got map[string]Mapping
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["dev"].URL != c.backends["dev"].URL+"/" {
+		t.Errorf("got mappings %v, expected those before the change", got)
+	}
+
+	rec := httptest.NewRecorder()
+	c.config.adminMappings(rec, httptest.NewRequest("GET", "/admin/mappings/stage", nil))
+	if body := strings.TrimSpace(rec.Body.String()); rec.Code != 200 || body != `"http://stage/"` {
+		t.Errorf("GET /admin/mappings/stage: got %d %s", rec.Code, body)
+	}
+	rec = httptest.NewRecorder()
+	c.config.adminMappings(rec, httptest.NewRequest("GET", "/admin/mappings/qa", nil))
+	if rec.Code != 404 {
+		t.Errorf("GET /admin/mappings/qa: got status %d, expected 404", rec.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Merge selects, for each endpoint, the MergeStrategy that decides
+// how the responses of several backends to one request are
+// merged, by its name in MergeStrategies. In the config JSON,
+//
+// 	"merge": {"render": "partial", "autoComplete": "quorum"}
+//
+// By default, a render request fails if any backend fails, and
+// an autocomplete request fails only if all of them do.
+type Merge struct {
+	// Render requests with functions evaluated by metaphite, and
+	// those stitched together from time shards.
+	Render string
+	// Tag autocomplete requests.
+	AutoComplete string
+}
+
+// A MergeResult is the outcome of one of the requests sent to
+// several backends to answer a request.
+type MergeResult struct {
+	Backend string // prefix of the backend
+	Err     error  // nil if its response was received
+}
+
+// A MergeStrategy decides which of the responses of several
+// backends to one request are merged into its response. Merge is
+// given the results of the requests, in the order they were sent,
+// and returns the indexes of those whose responses are merged, or
+// an error if the request fails. Failed results must not be
+// merged.
+type MergeStrategy interface {
+	Merge(results []MergeResult) ([]int, error)
+}
+
+// A MergeFunc is a function used as a MergeStrategy.
+type MergeFunc func(results []MergeResult) ([]int, error)
+
+func (f MergeFunc) Merge(results []MergeResult) ([]int, error) { return f(results) }
+
+// MergeStrategies are the strategies that may be named in Merge.
+// Programs using this package may add their own before parsing
+// a config.
+//
+// 	all      every response is merged; any failure fails the request
+// 	partial  the responses received are merged, if there are any
+// 	quorum   the responses received are merged, if more than half
+// 	         of the backends answered
+var MergeStrategies = map[string]MergeStrategy{
+	"all":     MergeFunc(mergeAll),
+	"partial": MergeFunc(mergePartial),
+	"quorum":  MergeFunc(mergeQuorum),
+}
+
+var errMergeFailed = errors.New("no backend answered")
+
+func mergeAll(results []MergeResult) ([]int, error) {
+	for _, r := range results {
+		if r.Err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Backend, r.Err)
+		}
+	}
+	return answered(results), nil
+}
+
+func mergePartial(results []MergeResult) ([]int, error) {
+	list := answered(results)
+	if len(list) == 0 && len(results) > 0 {
+		return nil, errMergeFailed
+	}
+	return list, nil
+}
+
+func mergeQuorum(results []MergeResult) ([]int, error) {
+	list := answered(results)
+	if 2*len(list) <= len(results) {
+		return nil, fmt.Errorf("%d of %d backends answered", len(list), len(results))
+	}
+	return list, nil
+}
+
+// answered returns the indexes of the results that did not fail.
+func answered(results []MergeResult) []int {
+	var list []int
+	for i, r := range results {
+		if r.Err == nil {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+func (c *Config) setupMerge() error {
+	render, err := mergeStrategy(c.Merge.Render, "all")
+	if err != nil {
+		return fmt.Errorf("merge: render: %v", err)
+	}
+	autoComplete, err := mergeStrategy(c.Merge.AutoComplete, "partial")
+	if err != nil {
+		return fmt.Errorf("merge: autoComplete: %v", err)
+	}
+	c.mergeRender, c.mergeTags = render, autoComplete
+	return nil
+}
+
+func mergeStrategy(name, def string) (MergeStrategy, error) {
+	if name == "" {
+		name = def
+	}
+	if s, ok := MergeStrategies[name]; ok {
+		return s, nil
+	}
+	var names []string
+	for k := range MergeStrategies {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown strategy %q, want one of %s", name, strings.Join(names, ", "))
+}
+
+// merge applies s to results. It returns, for each result,
+// whether its response is merged, or the error of s.
+func merge(s MergeStrategy, results []MergeResult) ([]bool, error) {
+	list, err := s.Merge(results)
+	if err != nil {
+		return nil, err
+	}
+	keep := make([]bool, len(results))
+	for _, i := range list {
+		if i < 0 || i >= len(results) || results[i].Err != nil {
+			return nil, fmt.Errorf("merge strategy chose result %d, which failed or does not exist", i)
+		}
+		keep[i] = true
+	}
+	return keep, nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	MergeStrategies["prefer-primary"] = MergeFunc(func(results []MergeResult) ([]int, error) {
+		for i, r := range results {
+			if r.Err == nil {
+				return []int{i}, nil
+			}
+		}
+		return nil, errors.New("no backend answered")
+	})
+	defer delete(MergeStrategies, "prefer-primary")
+
+	path := "/render?format=json&target=sumSeries(dev.cpu.load,prod.cpu.load)"
+	tests := []struct {
+		strategy string
+		fail     bool
+		status   int
+		body     string
+	}{
+		{"", false, 200, `[{"target":"sumSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[6,100],[8,160]]}]` + "\n"},
+		{"", true, 502, "Bad Gateway\n"},
+		{"all", true, 502, "Bad Gateway\n"},
+		{"partial", true, 200, `[{"target":"sumSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[5,100],[6,160]]}]` + "\n"},
+		{"quorum", false, 200, `[{"target":"sumSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[6,100],[8,160]]}]` + "\n"},
+		{"quorum", true, 502, "Bad Gateway\n"},
+		{"prefer-primary", false, 200, `[{"target":"sumSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[1,100],[2,160]]}]` + "\n"},
+		{"prefer-primary", true, 200, `[{"target":"sumSeries(dev.cpu.load,prod.cpu.load)","datapoints":[[5,100],[6,160]]}]` + "\n"},
+	}
+	for _, tt := range tests {
+		c := newCluster(t, testData, fmt.Sprintf(`"merge": {"render": %q}`, tt.strategy))
+		c.backends["dev"].fail = tt.fail
+		status, body := c.get(t, path)
+		if status != tt.status || body != tt.body {
+			t.Errorf("%q, dev failing %v: got %d %q, expected %d %q",
+				tt.strategy, tt.fail, status, body, tt.status, tt.body)
+		}
+		c.Close()
+	}
+
+	tagServer := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, `["host"]`)
+		}))
+	}
+	up, down := tagServer(200), tagServer(502)
+	defer up.Close()
+	defer down.Close()
+	for _, tt := range []struct {
+		strategy string
+		status   int
+	}{{"", 200}, {"partial", 200}, {"all", 502}, {"quorum", 502}} {
+		cfg, err := Parse(strings.NewReader(fmt.Sprintf(`{
+			"mappings": {"prod": %q, "dev": %q},
+			"merge": {"autoComplete": %q}
+		}`, up.URL, down.URL, tt.strategy)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		cfg.AutoComplete().ServeHTTP(rec, httptest.NewRequest("GET", "/tags/autoComplete/tags", nil))
+		if rec.Code != tt.status {
+			t.Errorf("autocomplete with %q: got %d %s, expected %d", tt.strategy, rec.Code, rec.Body, tt.status)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader(`{"merge": {"render": "majority"}}`)); err == nil {
+		t.Error("unknown merge strategy accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/droyo/metaphite/accesslog"
+	"github.com/droyo/metaphite/metrics"
+)
+
+var (
+	backendRequests = metrics.NewCounter("metaphite_backend_requests_total",
+		"Requests proxied to each backend.", "backend")
+	backendErrors = metrics.NewCounter("metaphite_backend_errors_total",
+		"Requests to each backend that failed or returned a 5xx status.", "backend")
+	backendLatency = metrics.NewHistogram("metaphite_backend_latency_seconds",
+		"Time until response headers are received from each backend.", nil, "backend")
+	backendDelay = metrics.NewHistogram("metaphite_backend_delay_seconds",
+		"Time requests to each backend were delayed by outbound rate limits.", nil, "backend")
+	renderTargets = metrics.NewHistogram("metaphite_render_targets",
+		"Number of targets in each render request.", []float64{1, 2, 4, 8, 16, 32, 64})
+	renderRejected = metrics.NewCounter("metaphite_render_rejected_total",
+		"Render requests that were not proxied, by reason.", "reason")
+)
+
+// An instrumentedTransport records statistics about the
+// requests made to a backend.
+type instrumentedTransport struct {
+	prefix string
+	state  *backendState
+	http.RoundTripper
+}
+
+// A timedTransport records the time spent waiting for a backend
+// in the access log entry of the request being served, and the
+// request in the backend's statistics.
+type timedTransport struct {
+	prefix string
+	stats  *backendStats
+	http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	rsp, err := t.RoundTripper.RoundTrip(r)
+	d := time.Since(start)
+	accesslog.Upstream(r, t.prefix, d)
+	countFanOut(r.Context())
+	t.stats.record(r, rsp, err, d)
+	if err == nil {
+		rsp.Body = countingBody{rsp.Body, r.URL.Scheme + "://" + r.URL.Host, t.stats}
+	}
+	return rsp, err
+}
+
+func (t instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	rsp, err := t.RoundTripper.RoundTrip(r)
+	backendRequests.Inc(t.prefix)
+	backendLatency.Observe(time.Since(start).Seconds(), t.prefix)
+	t.state.observe(r.Context(), rsp, err)
+	if r.Context().Err() == nil && (err != nil || rsp.StatusCode >= 500) {
+		backendErrors.Inc(t.prefix)
+	}
+	return rsp, err
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/droyo/metaphite/eval"
+)
+
+// Output is how metaphite writes the values of the series it
+// produces itself, in json render output: those of functions it
+// evaluates, and those stitched together from time shards.
+// Responses passed on from a single backend are not changed. In
+// the config JSON,
+//
+// 	"output": {"precision": 3, "trimZeros": true, "null": "0"}
+//
+// Values are never written in exponent notation.
+type Output struct {
+	// Digits after the decimal point. By default, as many as
+	// are needed to represent each value exactly.
+	Precision *int
+	// Remove zeros at the end of the digits after the decimal
+	// point, and the point if no digits are left.
+	TrimZeros bool
+	// The JSON written for missing values, and for values that
+	// are not finite, instead of null.
+	Null string
+}
+
+func (c *Config) setupOutput() error {
+	o := c.Output
+	c.format = eval.DefaultFormat
+	if p := o.Precision; p != nil {
+		if *p < 0 || *p > 17 {
+			return fmt.Errorf("output: precision %d out of range [0,17]", *p)
+		}
+		c.format.Precision = *p
+	}
+	if o.Null != "" && !json.Valid([]byte(o.Null)) {
+		return fmt.Errorf("output: null %q is not JSON", o.Null)
+	}
+	c.format.TrimZeros = o.TrimZeros
+	c.format.Null = o.Null
+	return nil
+}
+
+// reformat writes the values of list, from backends, in the
+// Output format. In the default format they are kept as they
+// are, so that they are reproduced exactly.
+func (c *Config) reformat(list []renderJSON) {
+	if c.format == eval.DefaultFormat {
+		return
+	}
+	for _, s := range list {
+		for _, point := range s.Datapoints {
+			if len(point) == 0 {
+				continue
+			}
+			var v *float64
+			if err := json.Unmarshal(point[0], &v); err != nil {
+				continue
+			}
+			point[0] = c.format.AppendValue(nil, v)
+		}
+	}
+}
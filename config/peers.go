@@ -0,0 +1,146 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// peers are the other metaphite instances serving the same
+// backends, listed in Config.Peers. Each instance asks its peers,
+// at most once per interval, for the health of the backends, as
+// reported by GET /admin/state, so that a backend one instance
+// finds down is avoided by all of them, rather than each sending
+// it maxFailures requests first, and one that an instance finds
+// recovered is probed by the others straight away. Peers are
+// asked when requests are served, so that a replaced config stops
+// asking along with its requests.
+type peers struct {
+	urls     []*url.URL // of /admin/state
+	token    string     // AdminToken
+	client   *http.Client
+	interval time.Duration
+
+	mu     sync.Mutex
+	asked  time.Time
+	asking bool
+}
+
+func (c *Config) setupPeers() error {
+	if len(c.Peers) == 0 {
+		return nil
+	}
+	if c.AdminToken == "" {
+		return fmt.Errorf("peers: adminToken is required")
+	}
+	p := &peers{
+		token:    c.AdminToken,
+		client:   &http.Client{Transport: c.transport(), Timeout: healthCheckTimeout},
+		interval: probeInterval,
+	}
+	for _, s := range c.Peers {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("peers: invalid url %q", s)
+		}
+		p.urls = append(p.urls, u.ResolveReference(&url.URL{Path: "admin/state"}))
+	}
+	c.peers = p
+	return nil
+}
+
+// askPeers asks the peers for the health of the backends, in the
+// background, if they have not been asked within the interval.
+func (c *Config) askPeers() {
+	p := c.peers
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.asking || time.Since(p.asked) < p.interval {
+		return
+	}
+	p.asking = true
+	go func() {
+		for _, u := range p.urls {
+			state, err := p.ask(u)
+			if err != nil {
+				slog.Warn("ask peer for backend health", "peer", u.Host, "err", err)
+				continue
+			}
+			c.share(u.Host, state)
+		}
+		p.mu.Lock()
+		p.asked = time.Now()
+		p.asking = false
+		p.mu.Unlock()
+	}()
+}
+
+func (p *peers) ask(u *url.URL) (map[string]savedState, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", rsp.Status)
+	}
+	var state map[string]savedState
+	if err := json.NewDecoder(rsp.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// share updates the health of the backends with what a peer
+// has observed of them. Backends whose URL differs on the peer
+// are left alone.
+func (c *Config) share(peer string, state map[string]savedState) {
+	for pfx, v := range state {
+		b, ok := c.backend(pfx)
+		if !ok || b.url.String() != v.URL {
+			continue
+		}
+		if b.state.share(v) {
+			slog.Info("backend health shared by peer", "backend", pfx, "peer", peer, "failures", v.Failures)
+		}
+	}
+}
+
+// share updates the health of the backend with what a peer has
+// observed of it. A failure the peer saw after the last success
+// seen here makes the backend unhealthy here too. A recovery the
+// peer saw after the last failure seen here makes the backend due
+// for a probe. It returns true if the backend's state changed.
+func (s *backendState) share(v savedState) bool {
+	s.mu.Lock()
+	healthy := s.failures < maxFailures
+	down := healthy && v.Failures >= maxFailures && v.LastFail.After(s.lastSuccess)
+	up := !healthy && v.Failures < maxFailures && v.Recovered.After(s.lastFail)
+	if down {
+		s.failures = maxFailures
+		s.lastError = v.LastError
+		s.lastFail = v.LastFail
+		s.lastProbe = time.Now()
+	}
+	if up {
+		s.lastProbe = time.Time{}
+	}
+	s.mu.Unlock()
+	if down && s.onChange != nil {
+		s.onChange()
+	}
+	return down || up
+}
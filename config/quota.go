@@ -0,0 +1,291 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/droyo/metaphite/accesslog"
+)
+
+// Quota accounts for the use each client makes of the render
+// endpoint over a sliding window, and limits it. Clients are
+// identified by what they authenticated with: a user name, a
+// bearer token, as "token:" and the first 12 hex digits of its
+// SHA-256 hash, or the common name of a client certificate.
+// Others are identified by their address, which, for requests
+// from the TrustedProxies, is the address forwarded by the proxy. A request by a client that has used up any of
+// its quotas is rejected with a 429 status code. In the config
+// JSON,
+//
+// 	"quota": {
+// 		"window": "1h",
+// 		"default": {"queries": 5000, "fanOut": 20000},
+// 		"clients": {
+// 			"reports": {"queries": 50000, "bytes": 10000000000}
+// 		}
+// 	}
+//
+// The usage of each client is reported by the admin API. It is
+// kept when the config is reloaded, unless the window changes.
+type Quota struct {
+	// Length of the sliding window. If zero, usage is not
+	// accounted for, and there are no quotas.
+	Window Duration
+	// Quotas of each client not listed in Clients.
+	Default QuotaLimit
+	// Quotas of particular clients, by identity or address.
+	Clients map[string]QuotaLimit
+}
+
+// A QuotaLimit is the use a client may make of the render endpoint
+// within the window. Zero is no limit.
+type QuotaLimit struct {
+	// Render requests.
+	Queries int64
+	// Requests sent to backends for those render requests.
+	FanOut int64
+	// Bytes of responses.
+	Bytes int64
+}
+
+// Usage is the use a client made of the render endpoint within the
+// quota window.
+type Usage struct {
+	Queries int64
+	FanOut  int64
+	Bytes   int64
+	// The client's quotas.
+	Limit QuotaLimit
+}
+
+// The window is divided into this many intervals, whose usage
+// is forgotten together.
+const quotaIntervals = 60
+
+// quotas keeps the usage of each client.
+type quotas struct {
+	Quota
+	width   time.Duration // of each interval
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+	swept   int64 // interval of the last sweep
+}
+
+// clientUsage is a ring of the usage in the intervals of the
+// window. Interval i, counted from the zero time, is at index
+// i%quotaIntervals.
+type clientUsage struct {
+	interval [quotaIntervals]int64
+	usage    [quotaIntervals]QuotaLimit
+}
+
+// An account is the use made by a render request, as it is served.
+type account struct {
+	q      *quotas
+	client string
+	fanOut atomic.Int64
+	bytes  int64
+}
+
+type accountKey struct{}
+
+func (c *Config) setupQuotas() error {
+	q := c.Quota
+	if q.Window.Duration < 0 {
+		return fmt.Errorf("quota: invalid window %s", q.Window)
+	}
+	if q.Window.Duration == 0 {
+		if q.Default != (QuotaLimit{}) || len(q.Clients) > 0 {
+			return fmt.Errorf("quota: window is required")
+		}
+		return nil
+	}
+	c.quotas = &quotas{
+		Quota:   q,
+		width:   q.Window.Duration / quotaIntervals,
+		clients: make(map[string]*clientUsage),
+	}
+	if c.quotas.width <= 0 {
+		return fmt.Errorf("quota: window %s is too short", q.Window)
+	}
+	return nil
+}
+
+// clientID identifies the client that made r.
+func (c *Config) clientID(r *http.Request) string {
+	if id := c.principal(r); id != "" {
+		return id
+	}
+	return accesslog.ClientAddr(r, c.trusted)
+}
+
+// carry returns q with the limits of next, so that the usage of
+// each client is kept when the config is reloaded. If the window
+// changed, it returns next, and usage starts afresh.
+func (q *quotas) carry(next *quotas) *quotas {
+	if next.Window != q.Window {
+		return next
+	}
+	q.mu.Lock()
+	q.Default, q.Clients = next.Default, next.Clients
+	q.mu.Unlock()
+	return q
+}
+
+func (q *quotas) limit(client string) QuotaLimit {
+	if l, ok := q.Clients[client]; ok {
+		return l
+	}
+	return q.Default
+}
+
+// admit checks the quotas of the client that made r, and starts
+// accounting for r's use. If the client is over quota, a 429
+// response is written to w. The account is nil if there are no
+// quotas.
+func (c *Config) admit(w http.ResponseWriter, r *http.Request) (*account, bool) {
+	q := c.quotas
+	if q == nil {
+		return nil, true
+	}
+	client := c.clientID(r)
+	now := q.now()
+	q.mu.Lock()
+	u, l := q.usage(client, now), q.limit(client)
+	if l.Queries > 0 && u.Queries >= l.Queries || l.FanOut > 0 && u.FanOut >= l.FanOut || l.Bytes > 0 && u.Bytes >= l.Bytes {
+		wait := q.reset(client, now)
+		q.mu.Unlock()
+		tooManyRequests(w, wait)
+		return nil, false
+	}
+	q.add(client, now, QuotaLimit{Queries: 1})
+	q.mu.Unlock()
+	return &account{q: q, client: client}, true
+}
+
+// wrap returns w and r, set up to count the use made by r.
+func (a *account) wrap(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	return &accountWriter{w, a}, r.WithContext(context.WithValue(r.Context(), accountKey{}, a))
+}
+
+// finish adds the use made by a request to its client's usage.
+func (a *account) finish() {
+	a.q.mu.Lock()
+	a.q.add(a.client, a.q.now(), QuotaLimit{FanOut: a.fanOut.Load(), Bytes: a.bytes})
+	a.q.mu.Unlock()
+}
+
+// countFanOut counts a request to a backend made for the render
+// request whose context is ctx.
+func countFanOut(ctx context.Context) {
+	if a, ok := ctx.Value(accountKey{}).(*account); ok {
+		a.fanOut.Add(1)
+	}
+}
+
+func (q *quotas) now() int64 {
+	return time.Now().UnixNano() / int64(q.width)
+}
+
+// usage returns the usage of client within the window ending in
+// interval now.
+func (q *quotas) usage(client string, now int64) QuotaLimit {
+	var sum QuotaLimit
+	cu := q.clients[client]
+	if cu == nil {
+		return sum
+	}
+	for i, n := range cu.interval {
+		if n > now-quotaIntervals {
+			sum.Queries += cu.usage[i].Queries
+			sum.FanOut += cu.usage[i].FanOut
+			sum.Bytes += cu.usage[i].Bytes
+		}
+	}
+	return sum
+}
+
+// reset returns how long it is until the oldest use made by client
+// within the window is forgotten.
+func (q *quotas) reset(client string, now int64) time.Duration {
+	oldest := now
+	if cu := q.clients[client]; cu != nil {
+		for _, n := range cu.interval {
+			if n > now-quotaIntervals && n < oldest {
+				oldest = n
+			}
+		}
+	}
+	end := time.Unix(0, (oldest+quotaIntervals)*int64(q.width))
+	return time.Until(end)
+}
+
+// add adds use to the usage of client in interval now, and forgets
+// clients that have made no use of the window.
+func (q *quotas) add(client string, now int64, use QuotaLimit) {
+	cu := q.clients[client]
+	if cu == nil {
+		cu = new(clientUsage)
+		q.clients[client] = cu
+	}
+	i := now % quotaIntervals
+	if cu.interval[i] != now {
+		cu.interval[i], cu.usage[i] = now, QuotaLimit{}
+	}
+	cu.usage[i].Queries += use.Queries
+	cu.usage[i].FanOut += use.FanOut
+	cu.usage[i].Bytes += use.Bytes
+
+	if now-q.swept < quotaIntervals {
+		return
+	}
+	q.swept = now
+	for name := range q.clients {
+		if q.usage(name, now) == (QuotaLimit{}) {
+			delete(q.clients, name)
+		}
+	}
+}
+
+// Usage reports the use each client made of the render endpoint
+// within the quota window, if there is one.
+func (c *Config) Usage() map[string]Usage {
+	result := make(map[string]Usage)
+	q := c.quotas
+	if q == nil {
+		return result
+	}
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for name := range q.clients {
+		u := q.usage(name, now)
+		if u == (QuotaLimit{}) {
+			continue
+		}
+		result[name] = Usage{Queries: u.Queries, FanOut: u.FanOut, Bytes: u.Bytes, Limit: q.limit(name)}
+	}
+	return result
+}
+
+// An accountWriter counts the bytes of a response.
+type accountWriter struct {
+	http.ResponseWriter
+	a *account
+}
+
+func (w *accountWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.a.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// ResponseWriter.
+func (w *accountWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	c := newCluster(t, testData, `"quota": {"window": "1h", "default": {"queries": 3}, "clients": {"10.0.0.1": {}}}`)
+	defer c.Close()
+
+	if code, body := c.get(t, "/render?format=json&target=prod.cpu.load"); code != 200 {
+		t.Fatalf("render prod.cpu.load: %d %s", code, body)
+	}
+	// fetched from both backends
+	if code, body := c.get(t, "/render?format=json&target=sumSeries(prod.cpu.load,dev.cpu.load)"); code != 200 {
+		t.Fatalf("render from prod and dev: %d %s", code, body)
+	}
+	u := c.config.Usage()["127.0.0.1"]
+	if u.Queries != 2 || u.FanOut != 3 || u.Bytes == 0 || u.Limit.Queries != 3 {
+		t.Errorf("usage %+v, expected 2 queries and fan-out of 3", u)
+	}
+	if code, body := c.get(t, "/render?format=json&target=dev.cpu.load"); code != 200 {
+		t.Fatalf("render dev.cpu.load: %d %s", code, body)
+	}
+	rsp, err := http.Get(c.URL + "/render?format=json&target=dev.cpu.load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 429 || rsp.Header.Get("Retry-After") == "" {
+		t.Errorf("over quota: %s, Retry-After %q", rsp.Status, rsp.Header.Get("Retry-After"))
+	}
+	if u := c.config.Usage()["127.0.0.1"]; u.Queries != 3 {
+		t.Errorf("%d queries counted, expected 3; rejected requests are not counted", u.Queries)
+	}
+}
+
+func TestQuotaClients(t *testing.T) {
+	c := newCluster(t, testData, `"quota": {"window": "1h"}, "trustedProxies": ["127.0.0.1"]`)
+	defer c.Close()
+	req, _ := http.NewRequest("GET", c.URL+"/render?format=json&target=dev.cpu.load", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.5")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if u := c.config.Usage()["10.0.0.5"]; u.Queries != 1 {
+		t.Errorf("usage %+v of forwarded client, expected 1 query: %v", u, c.config.Usage())
+	}
+
+	cfg := c.parse(t, `"quota": {"window": "1h"}, "trustedProxies": ["127.0.0.1"], "auth": {"tokens": ["secret"]}`)
+	sum := sha256.Sum256([]byte("secret"))
+	for _, tt := range []struct {
+		remote, forwarded, auth, want string
+	}{
+		{"127.0.0.1:5000", "", "", "127.0.0.1"},
+		{"127.0.0.1:5000", "10.0.0.5", "", "10.0.0.5"},
+		{"192.0.2.1:5000", "10.0.0.5", "", "192.0.2.1"},
+		{"127.0.0.1:5000", "10.0.0.5", "Bearer secret", fmt.Sprintf("token:%x", sum[:6])},
+	} {
+		r := httptest.NewRequest("GET", "/render", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if got := cfg.clientID(r); got != tt.want {
+			t.Errorf("client of request from %s for %q with %q is %q, expected %q",
+				tt.remote, tt.forwarded, tt.auth, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaReload(t *testing.T) {
+	dev := newFakeGraphite(testData["dev"])
+	defer dev.Close()
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(quota string) {
+		js := `{"mappings": {"dev": "` + dev.URL + `/"}, "quota": ` + quota + `}`
+		if err := ioutil.WriteFile(path, []byte(js), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"window": "1h", "default": {"queries": 5}}`)
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rl)
+	defer srv.Close()
+	c := &cluster{Server: srv}
+	if code, body := c.get(t, "/render?format=json&target=dev.cpu.load"); code != 200 {
+		t.Fatalf("render dev.cpu.load: %d %s", code, body)
+	}
+
+	write(`{"window": "1h", "default": {"queries": 1}}`)
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if u := rl.Config().Usage()["127.0.0.1"]; u.Queries != 1 || u.Limit.Queries != 1 {
+		t.Errorf("usage %+v after reload, expected 1 query of 1", u)
+	}
+	if code, _ := c.get(t, "/render?format=json&target=dev.cpu.load"); code != 429 {
+		t.Errorf("got %d over the quota after reload, expected 429", code)
+	}
+
+	write(`{"window": "2h", "default": {"queries": 1}}`)
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if u := rl.Config().Usage(); len(u) != 0 {
+		t.Errorf("usage %+v kept after the window changed", u)
+	}
+}
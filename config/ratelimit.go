@@ -0,0 +1,127 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/droyo/metaphite/ratelimit"
+)
+
+// A Limit describes a token bucket rate limit. Rate is the
+// sustained number of requests per second, and Burst is
+// the number of requests that may be made at once. A Limit
+// with a Rate of zero does not limit anything.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) bucket() *ratelimit.Bucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+	return ratelimit.NewBucket(l.Rate, l.Burst)
+}
+
+// RateLimits restrict the rate of incoming requests. Requests
+// exceeding a limit are rejected with a 429 status code. In the
+// config JSON,
+//
+// 	"rateLimit": {
+// 		"global": {"rate": 100, "burst": 200},
+// 		"client": {"rate": 10, "burst": 20},
+// 		"prefix": {
+// 			"staging": {"rate": 5, "burst": 10}
+// 		},
+// 		"outbound": {
+// 			"production": {"rate": 20, "burst": 5}
+// 		}
+// 	}
+//
+// Outbound limits are different: they smooth out bursts of
+// requests to a backend by delaying requests over the limit,
+// instead of rejecting them. A delayed request waits until its
+// turn comes or the client goes away.
+type RateLimits struct {
+	// Applies to all requests.
+	Global Limit
+	// Applies to each client IP address separately.
+	Client Limit
+	// Applies to requests for each metrics prefix.
+	Prefix map[string]Limit
+	// Applies to requests sent to the backend for each
+	// metrics prefix.
+	Outbound map[string]Limit
+}
+
+func (c *Config) setupRateLimits() error {
+	c.globalLimit = c.RateLimit.Global.bucket()
+	if l := c.RateLimit.Client; l.Rate > 0 {
+		c.clientLimit = ratelimit.NewSet(l.Rate, l.Burst)
+	}
+	for pfx, l := range c.RateLimit.Prefix {
+		b, ok := c.proxy[pfx]
+		if !ok {
+			return fmt.Errorf("rate limit for unknown prefix %q", pfx)
+		}
+		b.limit = l.bucket()
+		c.proxy[pfx] = b
+	}
+	for pfx, l := range c.RateLimit.Outbound {
+		b, ok := c.proxy[pfx]
+		if !ok {
+			return fmt.Errorf("outbound rate limit for unknown prefix %q", pfx)
+		}
+		b.outbound = l.bucket()
+		c.proxy[pfx] = b
+	}
+	return nil
+}
+
+// wait delays a request to b until it is allowed by the outbound
+// rate limit. It returns an error if ctx is done first.
+func (b backend) wait(ctx context.Context) error {
+	if b.outbound == nil {
+		return nil
+	}
+	start := time.Now()
+	err := b.outbound.Wait(ctx)
+	backendDelay.Observe(time.Since(start).Seconds(), b.prefix)
+	return err
+}
+
+// allow checks a request against the global and per-client
+// rate limits. If the request is not allowed, a 429 response
+// is written to w.
+func (c *Config) allow(w http.ResponseWriter, r *http.Request) bool {
+	if c.globalLimit != nil {
+		if ok, wait := c.globalLimit.Take(); !ok {
+			tooManyRequests(w, wait)
+			return false
+		}
+	}
+	if c.clientLimit != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ok, wait := c.clientLimit.Take(host); !ok {
+			tooManyRequests(w, wait)
+			return false
+		}
+	}
+	return true
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	httperror(w, http.StatusTooManyRequests)
+}
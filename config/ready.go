@@ -0,0 +1,124 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// How long Ready waits for the health checks it sends.
+	readyCheckWait = 500 * time.Millisecond
+	// The time limit of a health check.
+	healthCheckTimeout = 10 * time.Second
+)
+
+func validReadiness(quorum float64, backends int) error {
+	if quorum < 0 || quorum > 1 {
+		return fmt.Errorf("readyQuorum %v out of range [0,1]", quorum)
+	}
+	if backends < 0 {
+		return fmt.Errorf("readyBackends %d is negative", backends)
+	}
+	return nil
+}
+
+// Ready reports whether enough backends are healthy to serve
+// traffic, according to ReadyQuorum and ReadyBackends. If not,
+// the reason is returned.
+//
+// A backend counts as healthy once a request to it has succeeded.
+// Ready sends a health check, a render request for a metric that
+// does not exist, to the backends no request has succeeded to
+// yet, and to unhealthy backends, at most once per probe
+// interval, so that a backend that is down is noticed before
+// traffic is sent to it, and one that recovers is noticed while
+// no traffic is sent to the instance because it is not ready. It
+// waits a short while for their results.
+func (c *Config) Ready() (bool, string) {
+	c.askPeers()
+	c.mu.RLock()
+	backends := make([]backend, 0, len(c.proxy))
+	for _, b := range c.proxy {
+		backends = append(backends, b)
+	}
+	c.mu.RUnlock()
+
+	checks := make(chan struct{}, len(backends))
+	var n int
+	for _, b := range backends {
+		if b.state.needsCheck() {
+			n++
+			go func(b backend) {
+				b.checkHealth()
+				checks <- struct{}{}
+			}(b)
+		}
+	}
+	timeout := time.NewTimer(readyCheckWait)
+	defer timeout.Stop()
+wait:
+	for ; n > 0; n-- {
+		select {
+		case <-checks:
+		case <-timeout.C:
+			break wait
+		}
+	}
+
+	var healthy int
+	for _, b := range backends {
+		if b.state.known() {
+			healthy++
+		}
+	}
+	need := 1
+	if c.ReadyQuorum > 0 {
+		need = int(math.Ceil(c.ReadyQuorum * float64(len(backends))))
+	}
+	if c.ReadyBackends > need {
+		need = c.ReadyBackends
+	}
+	if need > len(backends) {
+		need = len(backends)
+	}
+	if healthy < need {
+		return false, fmt.Sprintf("%d of %d backends healthy, need %d", healthy, len(backends), need)
+	}
+	return true, ""
+}
+
+// checkHealth sends a health check to b, and records its outcome.
+func (b backend) checkHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	req, err := probeRequest(ctx, b.pick())
+	if err != nil {
+		return
+	}
+	rsp, err := b.client.Do(req)
+	if err == nil {
+		io.Copy(ioutil.Discard, rsp.Body)
+		rsp.Body.Close()
+	}
+	b.state.observe(context.Background(), rsp, err)
+}
+
+// Readiness returns an http.Handler for a readiness check, such
+// as a Kubernetes readiness probe. It answers with a 200 when the
+// instance is ready, and a 503 otherwise.
+func (c *Config) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if ok, reason := c.Ready(); !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, reason+"\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// Relay configures the carbon relay, which receives metrics in
+// the carbon plaintext protocol and forwards each one to the
+// carbon server of the backend its prefix is mapped to, given
+// by the Carbon setting of the mapping. Prefixes are stripped,
+// and rewrites applied, as for render requests. In the config
+// JSON,
+//
+// 	"relay": {
+// 		"address": ":2003",
+// 		"pickleAddress": ":2004",
+// 		"batchSize": 500,
+// 		"flushInterval": "1s",
+// 		"queueSize": 100000,
+// 		"spoolDir": "/var/spool/metaphite"
+// 	}
+//
+// Only the mappings can be changed by reloading the config.
+type Relay struct {
+	// The TCP and UDP address to receive metrics on. If
+	// empty, plaintext metrics are not received.
+	Address string
+	// The TCP address to receive metrics on in the carbon
+	// pickle protocol, as sent by carbon-relay. Batches are
+	// split between the backends' carbon servers, which are
+	// sent plaintext.
+	PickleAddress string
+	// Most lines to send to a carbon server in one write.
+	BatchSize int
+	// Lines are sent at least this often.
+	FlushInterval Duration
+	// Most lines to queue for a carbon server while it cannot
+	// be reached. Further lines are dropped, unless SpoolDir
+	// is set.
+	QueueSize int
+	// Directory to spool lines to when a carbon server's queue
+	// is full. They are sent when it has been emptied, even
+	// after a restart.
+	SpoolDir string
+	// Most megabytes to spool for each carbon server. The
+	// default is 100.
+	SpoolSize int
+}
+
+func validRelay(r Relay) error {
+	for _, addr := range []string{r.Address, r.PickleAddress} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("relay: %v", err)
+		}
+	}
+	if r.BatchSize < 0 || r.QueueSize < 0 || r.FlushInterval.Duration < 0 || r.SpoolSize < 0 {
+		return fmt.Errorf("relay: negative batchSize, queueSize, flushInterval or spoolSize")
+	}
+	return nil
+}
+
+// CarbonRoute returns the carbon server that the metric name
+// is relayed to, and the name it is sent under.
+func (c *Config) CarbonRoute(name string) (addr, newName string, ok bool) {
+	m := query.Metric(name)
+	c.rewrite(&m)
+	pfx, rest := m.Split()
+	b, ok := c.backend(string(pfx))
+	if !ok || b.carbon == "" && b.ring == nil || rest == "" {
+		return "", "", false
+	}
+	if b.stripPrefix {
+		m = rest
+	}
+	if b.ring != nil {
+		return b.ring.carbon[b.ring.node(string(m))], string(m), true
+	}
+	return b.carbon, string(m), true
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var configReloads = metrics.NewCounter("metaphite_config_reloads_total",
+	"Attempts to reload the config file, by result.", "result")
+
+// A Reloader serves requests with the Config loaded from a file,
+// and replaces it when the file is reloaded. Each request is
+// handled by the Config that was current when it arrived, so a
+// reload does not interrupt requests in flight. A reload that
+// fails leaves the current Config in place.
+//
+// A reloaded Config starts afresh, as it would after a restart:
+// backend health is only carried over through the StateFile, and
+// mappings changed through the admin API are lost unless
+// PersistMappings is set. Mappings from etcd, and hooks, are kept.
+type Reloader struct {
+	path    string
+	mu      sync.Mutex         // serializes reloads
+	current atomic.Value       // *loaded
+	dynamic map[string]Mapping // from etcd
+	hooks   []Hook
+}
+
+type loaded struct {
+	cfg          *Config
+	admin, ready http.Handler
+}
+
+// NewReloader loads the config file at path.
+func NewReloader(path string) (*Reloader, error) {
+	rl := &Reloader{path: path}
+	if err := rl.Reload(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Reload parses the config file again, and replaces the current
+// Config if successful.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	cfg, err := ParseFile(rl.path)
+	if err != nil {
+		configReloads.Inc("error")
+		return err
+	}
+	for pfx, m := range rl.dynamic {
+		if err := cfg.putDynamic(pfx, m); err != nil {
+			slog.Warn("invalid mapping from etcd", "prefix", pfx, "err", err)
+		}
+	}
+	for _, h := range rl.hooks {
+		cfg.AddHook(h)
+	}
+	// the audit log is kept open, and quota usage is kept
+	if prev, ok := rl.current.Load().(*loaded); ok {
+		if cfg.audit != nil {
+			cfg.audit.close()
+		}
+		cfg.audit = prev.cfg.audit
+		if cfg.quotas != nil && prev.cfg.quotas != nil {
+			cfg.quotas = prev.cfg.quotas.carry(cfg.quotas)
+		}
+	}
+	rl.current.Store(&loaded{
+		cfg:   cfg,
+		admin: cfg.Admin(),
+		ready: cfg.Readiness(),
+	})
+	configReloads.Inc("ok")
+	return nil
+}
+
+func (rl *Reloader) load() *loaded {
+	return rl.current.Load().(*loaded)
+}
+
+// Config returns the current Config.
+func (rl *Reloader) Config() *Config {
+	return rl.load().cfg
+}
+
+// ServeHTTP handles render requests with the current Config.
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.load().cfg.ServeHTTP(w, r)
+}
+
+// Admin returns the admin API of the current Config. See
+// Config.Admin.
+func (rl *Reloader) Admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.load().admin.ServeHTTP(w, r)
+	})
+}
+
+// AutoComplete returns the tag autocompletion endpoints of the
+// current Config. See Config.AutoComplete.
+func (rl *Reloader) AutoComplete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.Config().AutoComplete().ServeHTTP(w, r)
+	})
+}
+
+// CarbonRoute routes a metric with the current Config. See
+// Config.CarbonRoute.
+func (rl *Reloader) CarbonRoute(name string) (addr, newName string, ok bool) {
+	return rl.Config().CarbonRoute(name)
+}
+
+// Readiness returns the readiness check of the current Config.
+// See Config.Readiness.
+func (rl *Reloader) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.load().ready.ServeHTTP(w, r)
+	})
+}
+
+// RequireAuth wraps h so that requests to it must carry the
+// credentials required by the current Config. See
+// Config.RequireAuth.
+func (rl *Reloader) RequireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.Config().authenticate(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// RestrictAccess wraps h so that it only serves the clients
+// permitted by the current Config. See Config.RestrictAccess.
+func (rl *Reloader) RestrictAccess(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.Config().permitted(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// ServeEnabled wraps h so that requests for the paths disabled
+// in the current Config are answered with a 404. See
+// Config.ServeEnabled.
+func (rl *Reloader) ServeEnabled(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.Config().ServeEnabled(h).ServeHTTP(w, r)
+	})
+}
+
+// ServerTLSConfig returns the TLS configuration for the listener,
+// or nil if the current Config does not enable TLS. The returned
+// configuration follows reloads, so that certificates can be
+// replaced without a restart; TLS cannot be turned on or off
+// that way.
+func (rl *Reloader) ServerTLSConfig() *tls.Config {
+	if rl.Config().ServerTLSConfig() == nil {
+		return nil
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if conf := rl.Config().ServerTLSConfig(); conf != nil {
+				return conf, nil
+			}
+			return nil, errors.New("TLS is disabled in the reloaded config")
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dev := newFakeGraphite(testData["dev"])
+	defer dev.Close()
+	prod := newFakeGraphite(testData["prod"])
+	defer prod.Close()
+
+	dir, err := ioutil.TempDir("", "metaphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	write := func(js string) {
+		if err := ioutil.WriteFile(path, []byte(js), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"mappings": {"dev": "` + dev.URL + `/"}}`)
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rl)
+	defer srv.Close()
+	c := &cluster{Server: srv}
+
+	if code, body := c.get(t, "/render?format=json&target=prod.cpu.load"); code == 200 {
+		t.Fatalf("prod is served before it is mapped: %s", body)
+	}
+	write(`{"mappings": {"dev": "` + dev.URL + `/", "prod": "` + prod.URL + `/"}}`)
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := c.get(t, "/render?format=json&target=prod.cpu.load"); code != 200 {
+		t.Fatalf("prod not served after reload: %d %s", code, body)
+	}
+	write(`{"mappings": `)
+	if err := rl.Reload(); err == nil {
+		t.Fatal("reload of an invalid config succeeded")
+	}
+	if code, body := c.get(t, "/render?format=json&target=prod.cpu.load"); code != 200 {
+		t.Fatalf("failed reload replaced the config: %d %s", code, body)
+	}
+}
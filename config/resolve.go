@@ -0,0 +1,64 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// setupDialer prepares the dialer used for connections to
+// backends, which resolves backend host names with c.Resolver
+// and c.Hosts, if they are set. In the config JSON,
+//
+// 	"resolver": "10.0.0.2:53",
+// 	"hosts": {
+// 		"graphite.example.net": "10.1.2.3"
+// 	}
+//
+// Names in hosts are not looked up at all. Other names are
+// looked up through the DNS server at resolver, or the system's
+// resolver if none is given.
+func (c *Config) setupDialer() error {
+	for host, ip := range c.Hosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("hosts: invalid IP address %q for %s", ip, host)
+		}
+	}
+	c.dialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if c.Resolver != "" {
+		server := c.Resolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		var d net.Dialer
+		c.dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return nil
+}
+
+func (c *Config) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip, ok := c.Hosts[host]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+	}
+	return c.dialer.DialContext(ctx, network, addr)
+}
+
+// transport creates an http.Transport for requests to backends.
+func (c *Config) transport() *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: c.tlsconfig,
+		DialContext:     c.dialContext,
+	}
+}
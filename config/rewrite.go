@@ -0,0 +1,77 @@
+package config
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// A Rewrite rule replaces metric names that match a regular
+// expression before a query is routed. Rewrite rules can be used
+// to transparently map old metric names to new ones. Replacement
+// may refer to submatches of Pattern, as in regexp.Expand.
+// In the config JSON, rewrite rules are listed in the "rewrites"
+// array:
+//
+// 	"rewrites": [
+// 		{"pattern": "^stage\\.(.*)", "replacement": "staging.$1"}
+// 	]
+type Rewrite struct {
+	Pattern     string
+	Replacement string
+
+	re *regexp.Regexp
+}
+
+func (rw *Rewrite) compile() (err error) {
+	rw.re, err = regexp.Compile(rw.Pattern)
+	return err
+}
+
+// rewrite applies all rewrite rules, in order, to a metric.
+// The result of one rule is the input of the next. rewrite
+// returns the rules that were applied.
+func (c *Config) rewrite(m *query.Metric) []appliedRewrite {
+	var applied []appliedRewrite
+	for _, rw := range c.Rewrites {
+		s := string(*m)
+		if !rw.re.MatchString(s) {
+			continue
+		}
+		*m = query.Metric(rw.re.ReplaceAllString(s, rw.Replacement))
+		applied = append(applied, appliedRewrite{rw.Pattern, s, string(*m)})
+		if c.Debug {
+			slog.Info("rewrite", "from", s, "to", string(*m))
+		}
+	}
+	return applied
+}
+
+type appliedRewrite struct {
+	Rule, From, To string
+}
+
+// A routeTrace records how a target was transformed on its
+// way to a backend. When debugging is enabled, traces are
+// returned to the client in X-Metaphite-Trace headers, one
+// JSON object per target, or, for a request that is evaluated,
+// per part of a target sent to a backend.
+type routeTrace struct {
+	Target   string
+	Rewrites []appliedRewrite `json:",omitempty"`
+	Backend  string
+	Final    string
+}
+
+func (c *Config) writeTraces(w http.ResponseWriter, traces []routeTrace) {
+	for _, t := range traces {
+		data, err := json.Marshal(t)
+		if err != nil {
+			continue
+		}
+		w.Header().Add("X-Metaphite-Trace", string(data))
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/droyo/metaphite/certs"
+)
+
+// ServerTLS configures HTTPS on the listener, and optionally
+// the authentication of clients by their certificates. In the
+// config JSON,
+//
+// 	"tls": {
+// 		"cert": "/etc/metaphite/server.pem",
+// 		"key": "/etc/metaphite/server.key",
+// 		"clientCA": "/etc/metaphite/clients-ca.pem",
+// 		"allowedClients": ["grafana.example.net"]
+// 	}
+type ServerTLS struct {
+	// Files with the server's certificate and key.
+	Cert, Key string
+	// File with the CA certs that client certificates must be
+	// signed by. If empty, clients are not asked for one.
+	ClientCA string
+	// "require" (the default) to reject clients without a
+	// valid certificate, or "optional" to accept clients
+	// without one.
+	ClientAuth string
+	// If not empty, a client certificate must have one of
+	// these as its common name or a DNS or email SAN.
+	AllowedClients []string
+}
+
+func (s ServerTLS) enabled() bool {
+	return s.Cert != "" || s.Key != "" || s.ClientCA != "" ||
+		s.ClientAuth != "" || len(s.AllowedClients) > 0
+}
+
+// setupServerTLS loads the files named in c.TLS.
+func (c *Config) setupServerTLS() error {
+	s := c.TLS
+	if !s.enabled() {
+		return nil
+	}
+	if s.Cert == "" || s.Key == "" {
+		return errors.New("tls: cert and key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if s.ClientCA == "" {
+		if s.ClientAuth != "" || len(s.AllowedClients) > 0 {
+			return errors.New("tls: clientAuth and allowedClients require a clientCA")
+		}
+		c.serverTLS = conf
+		return nil
+	}
+	pool := certs.FromFile(s.ClientCA)
+	if len(pool) == 0 {
+		return fmt.Errorf("tls: no certificates in %s", s.ClientCA)
+	}
+	conf.ClientCAs = pool.CertPool()
+	switch s.ClientAuth {
+	case "", "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("tls: invalid clientAuth %q", s.ClientAuth)
+	}
+	if len(s.AllowedClients) > 0 {
+		allowed := make(map[string]bool, len(s.AllowedClients))
+		for _, name := range s.AllowedClients {
+			allowed[name] = true
+		}
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("client certificate required")
+			}
+			return allowedClient(cs.PeerCertificates[0], allowed)
+		}
+	}
+	c.serverTLS = conf
+	return nil
+}
+
+func allowedClient(cert *x509.Certificate, allowed map[string]bool) error {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		if allowed[name] {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate for %q is not allowed", cert.Subject.CommonName)
+}
+
+// ServerTLSConfig returns the TLS configuration for the listener,
+// or nil if the config does not enable TLS.
+func (c *Config) ServerTLSConfig() *tls.Config {
+	return c.serverTLS
+}
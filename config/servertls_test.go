@@ -0,0 +1,141 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new certificate and key for name to dir, as
+// name.pem and name.key, signed by parent, or self-signed if parent
+// is nil.
+func writeCert(t *testing.T, dir, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+func TestServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metaphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "server", ca)
+	grafana := writeCert(t, dir, "grafana", ca)
+	other := writeCert(t, dir, "other", ca)
+	stranger := writeCert(t, dir, "stranger", writeCert(t, dir, "otherca", nil))
+
+	g := newFakeGraphite(testData["dev"])
+	defer g.Close()
+	file := func(name string) string { return strconv.Quote(filepath.Join(dir, name)) }
+	cfg, err := Parse(strings.NewReader(`{
+		"mappings": {"dev": "` + g.URL + `/"},
+		"tls": {
+			"cert": ` + file("server.pem") + `,
+			"key": ` + file("server.key") + `,
+			"clientCA": ` + file("ca.pem") + `,
+			"allowedClients": ["grafana"]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(cfg)
+	srv.TLS = cfg.ServerTLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	tests := []struct {
+		name string
+		cert *tls.Certificate
+		ok   bool
+	}{
+		{"allowed", grafana, true},
+		{"not allowed", other, false},
+		{"unknown CA", stranger, false},
+		{"no certificate", nil, false},
+	}
+	for _, tt := range tests {
+		conf := &tls.Config{RootCAs: roots}
+		if tt.cert != nil {
+			conf.Certificates = []tls.Certificate{*tt.cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+		rsp, err := client.Get(srv.URL + "/render?format=json&target=dev.cpu.load")
+		if err == nil {
+			rsp.Body.Close()
+			if rsp.StatusCode != 200 {
+				err = errors.New(rsp.Status)
+			}
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader(`{"tls": {"clientCA": ` + file("ca.pem") + `}}`)); err == nil {
+		t.Error("accepted a clientCA without a server certificate")
+	}
+}
@@ -0,0 +1,281 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/droyo/metaphite/metrics"
+	"github.com/droyo/metaphite/multi"
+	"github.com/droyo/metaphite/timespec"
+)
+
+var renderStitched = metrics.NewCounter("metaphite_render_stitched_total",
+	"Render requests answered by combining responses from several time shards.", "backend")
+
+// A TimeShard is a backend that holds the data for a prefix
+// over a period of time. From and Until are in any format
+// accepted by the render API's from and until parameters, such
+// as "-90d", and may be left empty for an open-ended period.
+// In the config JSON, time shards are listed for a prefix
+// that must also have a mapping:
+//
+// 	"timeShards": {
+// 		"prod": [
+// 			{"url": "http://old-graphite/", "until": "-90d"},
+// 			{"url": "http://new-graphite/", "from": "-90d"}
+// 		]
+// 	}
+//
+// A render request for a prefix with time shards is sent to the
+// shards that hold data for its time range. If there are several,
+// the response is stitched together from their responses; this is
+// only possible for the json format. For other formats, the request
+// is sent to the shard with the most recent data. If the time range
+// cannot be parsed, or no shard covers it, the request is sent to
+// the prefix's mapping.
+type TimeShard struct {
+	URL         string
+	From, Until string
+}
+
+type shard struct {
+	backend
+	from, until string
+}
+
+// A shardWindow is a shard and the part of a request's time range
+// that it will answer for.
+type shardWindow struct {
+	shard
+	from, until time.Time
+}
+
+func (c *Config) setupShards() error {
+	c.shards = make(map[string][]shard)
+	for pfx, list := range c.TimeShards {
+		if _, ok := c.proxy[pfx]; !ok {
+			return fmt.Errorf("time shards for unknown prefix %q", pfx)
+		}
+		now := time.Now()
+		for _, ts := range list {
+			for _, s := range []string{ts.From, ts.Until} {
+				if s == "" {
+					continue
+				}
+				if _, err := timespec.Parse(s, now); err != nil {
+					return fmt.Errorf("time shard %s: %v", ts.URL, err)
+				}
+			}
+			if isSRV(ts.URL) {
+				return fmt.Errorf("time shard %s: SRV URLs are not supported", ts.URL)
+			}
+			b, err := c.newBackend(pfx, Mapping{URL: ts.URL})
+			if err != nil {
+				return err
+			}
+			b.outbound = c.RateLimit.Outbound[pfx].bucket()
+			c.shards[pfx] = append(c.shards[pfx], shard{
+				backend: b,
+				from:    ts.From,
+				until:   ts.Until,
+			})
+		}
+	}
+	return nil
+}
+
+// pickShards selects the shards for prefix that hold data for
+// the time range in a render request, ordered from oldest to
+// newest.
+func (c *Config) pickShards(prefix string, form url.Values) []shardWindow {
+	shards := c.shards[prefix]
+	if len(shards) == 0 {
+		return nil
+	}
+	now := time.Now()
+	from, until := form.Get("from"), form.Get("until")
+	if from == "" {
+		from = "-24h" // graphite's default
+	}
+	start, err1 := timespec.Parse(from, now)
+	end, err2 := timespec.Parse(until, now)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+
+	var result []shardWindow
+	for _, s := range shards {
+		w := shardWindow{shard: s, from: start, until: end}
+		if s.from != "" {
+			if t, _ := timespec.Parse(s.from, now); t.After(w.from) {
+				w.from = t
+			}
+		}
+		if s.until != "" {
+			if t, _ := timespec.Parse(s.until, now); t.Before(w.until) {
+				w.until = t
+			}
+		}
+		if w.from.Before(w.until) {
+			result = append(result, w)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].from.Before(result[j].from)
+	})
+	return result
+}
+
+// stitch answers a json render request by sending it to several
+// time shards and joining the series they return along the time
+// axis.
+func (c *Config) stitch(w http.ResponseWriter, r *http.Request, form url.Values, windows []shardWindow) {
+	req, err := http.NewRequest("GET", "/render", nil)
+	if err != nil {
+		slog.Error("stitch", "err", err)
+		httperror(w, 500)
+		return
+	}
+	req = req.WithContext(r.Context())
+
+	targets := make([]multi.Target, len(windows))
+	index := make(map[*url.URL]int, len(windows))
+	for i, sw := range windows {
+		if ok, reason := sw.state.admit(c.SlowStart.Duration); !ok {
+			renderRejected.Inc(reason)
+			w.Header().Set("Retry-After", "1")
+			unavailable(w)
+			return
+		}
+		if err := sw.wait(r.Context()); err != nil {
+			renderRejected.Inc("canceled")
+			return
+		}
+		q := make(url.Values, len(form))
+		for k, v := range form {
+			q[k] = v
+		}
+		q.Set("from", strconv.FormatInt(sw.from.Unix(), 10))
+		q.Set("until", strconv.FormatInt(sw.until.Unix(), 10))
+
+		// each part gets its own URL, to identify its response
+		u := *sw.pick()
+		targets[i] = multi.Target{URL: &u, Query: q, Client: sw.client}
+		index[&u] = i
+		sw.state.begin()
+		defer sw.state.end()
+	}
+
+	results := make([][]renderJSON, len(windows))
+	merged := make([]MergeResult, len(windows))
+	cacheControl := make([]string, len(windows))
+	// each shard has its own client, with its own settings
+	for rsp := range multi.ProxyContext(r.Context(), nil, req, targets) {
+		i := index[rsp.Target.URL]
+		sw := windows[i]
+		sw.state.observe(r.Context(), rsp.Response, rsp.Err)
+		err := rsp.Err
+		if err == nil {
+			cacheControl[i] = rsp.Header.Get("Cache-Control")
+			err = multi.DecodeArray(rsp, func(elem json.RawMessage) error {
+				var s renderJSON
+				if err := json.Unmarshal(elem, &s); err != nil {
+					return err
+				}
+				results[i] = append(results[i], s)
+				return nil
+			})
+		}
+		if err != nil {
+			slog.Warn("time shard error", "backend", sw.prefix, "url", sw.url.String(), "err", err)
+		}
+		merged[i] = MergeResult{Backend: sw.prefix, Err: err}
+	}
+	keep, err := merge(c.mergeRender, merged)
+	if err != nil {
+		slog.Warn("stitch", "err", err)
+		httperror(w, http.StatusBadGateway)
+		return
+	}
+	var kept []string
+	for i := range windows {
+		if keep[i] {
+			kept = append(kept, cacheControl[i])
+		} else {
+			results[i] = nil
+		}
+	}
+	cacheControl = kept
+	renderStitched.Inc(windows[0].prefix)
+	series := stitchSeries(results)
+	c.reformat(series)
+	body, err := json.Marshal(series)
+	if err != nil {
+		slog.Error("stitch", "err", err)
+		httperror(w, 500)
+		return
+	}
+	c.setCacheControl(w, cacheControl)
+	writeTagged(w, r, "application/json", append(body, '\n'))
+}
+
+// renderJSON is a series in the json output of the render API.
+// Values are kept in their original form, so that they are
+// reproduced exactly.
+type renderJSON struct {
+	Target     json.RawMessage     `json:"target"`
+	Tags       json.RawMessage     `json:"tags,omitempty"`
+	Datapoints [][]json.RawMessage `json:"datapoints"`
+}
+
+func timestamp(point []json.RawMessage) float64 {
+	if len(point) < 2 {
+		return 0
+	}
+	ts, _ := strconv.ParseFloat(string(point[1]), 64)
+	return ts
+}
+
+// stitchSeries joins series with the same name from several
+// responses, ordered from oldest to newest. Where the responses
+// overlap, datapoints from the newer response are kept.
+func stitchSeries(results [][]renderJSON) []renderJSON {
+	var (
+		order  []string
+		series = make(map[string]*renderJSON)
+	)
+	for _, list := range results {
+		for _, s := range list {
+			name := string(s.Target)
+			prev, ok := series[name]
+			if !ok {
+				cp := s
+				series[name] = &cp
+				order = append(order, name)
+				continue
+			}
+			if len(s.Datapoints) > 0 {
+				first := timestamp(s.Datapoints[0])
+				keep := len(prev.Datapoints)
+				for keep > 0 && timestamp(prev.Datapoints[keep-1]) >= first {
+					keep--
+				}
+				prev.Datapoints = append(prev.Datapoints[:keep], s.Datapoints...)
+			}
+			if s.Tags != nil {
+				prev.Tags = s.Tags
+			}
+		}
+	}
+	result := make([]renderJSON, 0, len(order))
+	for _, name := range order {
+		result = append(result, *series[name])
+	}
+	return result
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupSRV looks up the SRV records of name. It is a variable so
+// that tests can replace it.
+var lookupSRV = func(ctx context.Context, r *net.Resolver, name string) ([]*net.SRV, error) {
+	_, addrs, err := r.LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// isSRV reports whether s is the URL of a DNS SRV name, rather
+// than of a server.
+func isSRV(s string) bool {
+	return strings.HasPrefix(s, "srv://") || strings.HasPrefix(s, "srv+https://")
+}
+
+// srvDiscovery parses an srv:// or srv+https:// URL, whose
+// servers are reached over http or https respectively, with the
+// URL's path.
+func (c *Config) srvDiscovery(s string, refresh time.Duration) (*discovery, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Port() != "" {
+		return nil, fmt.Errorf("invalid SRV URL %q", s)
+	}
+	scheme := "http"
+	if u.Scheme == "srv+https" {
+		scheme = "https"
+	}
+	resolver := c.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	d := newDiscovery(u, scheme, u.Path, refresh)
+	d.lookup = func(ctx context.Context, _ bool) ([]*url.URL, error) {
+		return lookupSRVServers(ctx, d, resolver, u.Hostname())
+	}
+	return d, nil
+}
+
+// lookupSRVServers finds the servers of an SRV name. Of the
+// records, only those with the lowest priority are used; the
+// others are for failover, which the health of the backend does
+// not track per server.
+func lookupSRVServers(ctx context.Context, d *discovery, r *net.Resolver, name string) ([]*url.URL, error) {
+	addrs, err := lookupSRV(ctx, r, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", name)
+	}
+	var urls []*url.URL
+	for _, a := range addrs {
+		if a.Priority != addrs[0].Priority {
+			continue
+		}
+		host := strings.TrimSuffix(a.Target, ".")
+		urls = append(urls, d.server(net.JoinHostPort(host, strconv.Itoa(int(a.Port)))))
+	}
+	return urls, nil
+}
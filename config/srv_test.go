@@ -0,0 +1,102 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSRV(t *testing.T) {
+	a, b := newFakeGraphite(nil), newFakeGraphite(nil)
+	defer a.Close()
+	defer b.Close()
+	record := func(g *fakeGraphite) *net.SRV {
+		u, _ := url.Parse(g.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return &net.SRV{Target: u.Hostname() + ".", Port: uint16(port), Priority: 10, Weight: 1}
+	}
+	var mu sync.Mutex
+	records := []*net.SRV{record(a), record(b), {Target: "backup.", Port: 80, Priority: 20}}
+	var lookupErr error
+	defer func(f func(context.Context, *net.Resolver, string) ([]*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	lookupSRV = func(ctx context.Context, r *net.Resolver, name string) ([]*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if name != "_graphite._tcp.example.net" {
+			return nil, fmt.Errorf("unexpected lookup of %s", name)
+		}
+		return records, lookupErr
+	}
+	parse := func() (*Config, *httptest.Server) {
+		cfg, err := Parse(strings.NewReader(`{"mappings": {
+			"scaled": {"url": "srv://_graphite._tcp.example.net/", "refresh": "1ms"}
+		}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg, httptest.NewServer(cfg)
+	}
+	render := func(srv *httptest.Server) int {
+		rsp, err := http.Get(srv.URL + "/render?format=json&target=scaled.cpu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	cfg, srv := parse()
+	defer srv.Close()
+	for i := 0; i < 4; i++ {
+		if code := render(srv); code != 200 {
+			t.Fatalf("got status %d", code)
+		}
+	}
+	stats := cfg.Stats()["scaled"]
+	if stats[a.URL].Requests != 2 || stats[b.URL].Requests != 2 || len(stats) != 2 {
+		t.Errorf("requests were not shared by the servers of the lowest priority: %v", stats)
+	}
+
+	servers := func() []string {
+		be, _ := cfg.backend("scaled")
+		return urlStrings(be.targets())
+	}
+	mu.Lock()
+	records = records[1:2]
+	mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(servers()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("servers not updated: %q", servers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := servers(); got[0] != b.URL+"/" {
+		t.Errorf("got servers %q, expected %s", got, b.URL)
+	}
+
+	mu.Lock()
+	lookupErr = errors.New("SERVFAIL")
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	servers()
+	time.Sleep(10 * time.Millisecond)
+	if got := servers(); len(got) != 1 || render(srv) != 200 {
+		t.Errorf("servers %q were not kept after a failed lookup", got)
+	}
+
+	_, empty := parse()
+	defer empty.Close()
+	if code := render(empty); code != http.StatusBadGateway {
+		t.Errorf("got status %d without servers, expected 502", code)
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedState is the health of a backend, as written to the
+// StateFile.
+type savedState struct {
+	URL       string
+	Failures  int
+	LastError string `json:",omitempty"`
+	LastFail  time.Time
+	Recovered time.Time
+}
+
+func (s *backendState) save() savedState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return savedState{
+		Failures:  s.failures,
+		LastError: s.lastError,
+		LastFail:  s.lastFail,
+		Recovered: s.recovered,
+	}
+}
+
+func (s *backendState) restore(v savedState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.succeeded = v.Failures < maxFailures
+	s.failures = v.Failures
+	s.lastError = v.LastError
+	s.lastFail = v.LastFail
+	s.recovered = v.Recovered
+	// wait a full interval before probing a backend that
+	// was down when we last looked.
+	s.lastProbe = time.Now()
+}
+
+// loadState restores backend health from the StateFile. State
+// for backends whose prefix or URL has changed is discarded.
+func (c *Config) loadState() error {
+	data, err := ioutil.ReadFile(c.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved map[string]savedState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for pfx, v := range saved {
+		if b, ok := c.proxy[pfx]; ok && b.url.String() == v.URL {
+			b.state.restore(v)
+		}
+	}
+	return nil
+}
+
+// healthState returns the health of all backends, by prefix.
+func (c *Config) healthState() map[string]savedState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	saved := make(map[string]savedState, len(c.proxy))
+	for pfx, b := range c.proxy {
+		v := b.state.save()
+		v.URL = b.url.String()
+		saved[pfx] = v
+	}
+	return saved
+}
+
+// saveState writes the health of all backends to the StateFile.
+// It is called whenever a backend becomes healthy or unhealthy.
+// The health is read once the previous write is done, so the file
+// always ends up with the latest state.
+func (c *Config) saveState() {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	data, err := json.MarshalIndent(c.healthState(), "", "\t")
+	if err != nil {
+		slog.Error("save state", "err", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.StateFile), ".metaphite")
+	if err != nil {
+		slog.Error("save state", "file", c.StateFile, "err", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.StateFile)
+	}
+	if err != nil {
+		slog.Error("save state", "file", c.StateFile, "err", err)
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	c := newCluster(t, testData, `"stateFile": "`+file+`"`)
+	defer c.Close()
+	c.backends["prod"].fail = true
+	for i := 0; i < maxFailures; i++ {
+		c.get(t, "/render?format=json&target=prod.cpu.load")
+	}
+	c.get(t, "/render?format=json&target=dev.cpu.load")
+	// the state is saved in the background
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(file)
+		if bytes.Contains(data, []byte(`"Failures": 3`)) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("state file not written: %s", data)
+		}
+	}
+
+	cfg := c.parse(t, `"stateFile": "`+file+`"`)
+	prod, dev := cfg.proxy["prod"].state.status(0), cfg.proxy["dev"].state.status(0)
+	if prod.Healthy || !strings.Contains(prod.LastError, "502") || prod.LastFail == nil {
+		t.Errorf("prod: restored %+v, expected unhealthy", prod)
+	}
+	if !dev.Healthy || !cfg.proxy["dev"].state.known() {
+		t.Errorf("dev: restored %+v, expected healthy", dev)
+	}
+	if ok, _ := cfg.proxy["prod"].state.admit(0); ok {
+		t.Error("restored unhealthy backend was probed at once")
+	}
+
+	// state of a backend whose URL has changed is discarded
+	c.backends["prod"].Close()
+	c.backends["prod"] = newFakeGraphite(testData["prod"])
+	cfg = c.parse(t, `"stateFile": "`+file+`"`)
+	if !cfg.proxy["prod"].state.healthy() {
+		t.Error("kept the state of a backend whose URL changed")
+	}
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the latency buckets in
+// ServerStats.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// backendStats counts the requests made to each server of a
+// backend, since the config was loaded. Unlike the package's
+// metrics, they are kept per server, and can be read through
+// Config.Stats without any particular metrics system.
+type backendStats struct {
+	mu      sync.Mutex
+	servers map[string]*ServerStats // by scheme://host
+}
+
+// ServerStats are the statistics kept for one server.
+type ServerStats struct {
+	Requests int64
+	// Requests that failed, or got a 5xx response.
+	Errors int64
+	// Bytes of request and response bodies.
+	BytesSent, BytesReceived int64
+	// Time until response headers were received.
+	Latency Histogram
+}
+
+// A Histogram counts observations in buckets. Counts[i] is the
+// number of observations no greater than Buckets[i], and greater
+// than Buckets[i-1]. The last count, which has no bucket, is of
+// the observations greater than all of them.
+type Histogram struct {
+	Buckets []float64
+	Counts  []int64
+	Sum     float64
+}
+
+func (h *Histogram) observe(v float64) {
+	if h.Counts == nil {
+		h.Buckets = latencyBuckets
+		h.Counts = make([]int64, len(latencyBuckets)+1)
+	}
+	h.Counts[sort.SearchFloat64s(h.Buckets, v)]++
+	h.Sum += v
+}
+
+func newBackendStats() *backendStats {
+	return &backendStats{servers: make(map[string]*ServerStats)}
+}
+
+func (s *backendStats) server(u string) *ServerStats {
+	st, ok := s.servers[u]
+	if !ok {
+		st = new(ServerStats)
+		s.servers[u] = st
+	}
+	return st
+}
+
+// record records a request to r.URL that took d to answer.
+func (s *backendStats) record(r *http.Request, rsp *http.Response, err error, d time.Duration) {
+	u := r.URL.Scheme + "://" + r.URL.Host
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.server(u)
+	st.Requests++
+	if r.ContentLength > 0 {
+		st.BytesSent += r.ContentLength
+	}
+	if err != nil || rsp.StatusCode >= 500 {
+		st.Errors++
+	}
+	st.Latency.observe(d.Seconds())
+}
+
+func (s *backendStats) received(u string, n int64) {
+	s.mu.Lock()
+	s.server(u).BytesReceived += n
+	s.mu.Unlock()
+}
+
+func (s *backendStats) snapshot() map[string]ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]ServerStats, len(s.servers))
+	for u, st := range s.servers {
+		cp := *st
+		cp.Latency.Counts = append([]int64(nil), st.Latency.Counts...)
+		result[u] = cp
+	}
+	return result
+}
+
+// A countingBody counts the bytes of a response body as they
+// are read.
+type countingBody struct {
+	io.ReadCloser
+	url   string
+	stats *backendStats
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.stats.received(b.url, int64(n))
+	}
+	return n, err
+}
+
+// Stats reports the statistics of each server of each backend,
+// by prefix and then by server, as "scheme://host". Servers that
+// have not been sent any requests are left out. The statistics
+// start over when the config is reloaded.
+func (c *Config) Stats() map[string]map[string]ServerStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string]map[string]ServerStats, len(c.proxy))
+	for pfx, b := range c.proxy {
+		result[pfx] = b.stats.snapshot()
+		if b.ring != nil {
+			// the nodes of a hash ring are distinct servers
+			for _, n := range b.ring.nodes {
+				for u, st := range n.stats.snapshot() {
+					result[pfx][u] = st
+				}
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"github.com/droyo/metaphite/query"
+)
+
+// Some graphite functions take metric names, or parts of them,
+// in string arguments. metricArgs lists the positions of those
+// arguments for each such function; a negative position n means
+// every argument from -n on. Prefixes are stripped from these
+// arguments like they are from metrics, so that
+//
+// 	useSeriesAbove(prod.reqs.*, 10, "prod.reqs", "prod.time")
+//
+// is sent to the prod backend as
+//
+// 	useSeriesAbove(reqs.*, 10, "reqs", "time")
+var metricArgs = map[string][]int{
+	"useSeriesAbove": {2, 3}, // search, replace
+	"template":       {-1},   // substitutions
+}
+
+// isMetricArg returns true if the i'th argument of the named
+// function is metric-like.
+func isMetricArg(name string, i int) bool {
+	for _, n := range metricArgs[name] {
+		if n == i || (n < 0 && i >= -n) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteStringArgs applies rewrite rules to the metric-like
+// string arguments in e, and strips prefix from them.
+func (c *Config) rewriteStringArgs(e query.Expr, prefix string) []appliedRewrite {
+	var applied []appliedRewrite
+	query.Walk(e, func(e query.Expr) bool {
+		f, ok := e.(*query.Func)
+		if !ok {
+			return true
+		}
+		for i, arg := range f.Args {
+			if v, ok := arg.(*query.Value); ok && isMetricArg(f.Name, i) {
+				applied = append(applied, c.rewriteValue(v, prefix)...)
+			}
+		}
+		return true
+	})
+	return applied
+}
+
+func (c *Config) rewriteValue(v *query.Value, prefix string) []appliedRewrite {
+	s := string(*v)
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return nil // not a string
+	}
+	quote := s[:1]
+	m := query.Metric(s[1 : len(s)-1])
+	applied := c.rewrite(&m)
+	m = m.ReplacePrefix(prefix, "")
+	*v = query.Value(quote + string(m) + quote)
+	return applied
+}
@@ -0,0 +1,20 @@
+package config
+
+import (
+	"github.com/droyo/metaphite/query"
+)
+
+// tagBackend returns the backend selected by the c.RouteTag
+// filter in a seriesByTag query, and the index of the filter.
+func (c *Config) tagBackend(t *query.SeriesByTag) (backend, int, bool) {
+	if c.RouteTag == "" {
+		return backend{}, 0, false
+	}
+	for i, f := range t.Filters {
+		if f.Tag == c.RouteTag && f.Op == query.TagEqual {
+			b, ok := c.backend(f.Value)
+			return b, i, ok
+		}
+	}
+	return backend{}, 0, false
+}
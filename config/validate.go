@@ -0,0 +1,249 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// configErrors collects the problems found in a config file,
+// so that they can all be reported at once.
+type configErrors []error
+
+func (e *configErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msg := make([]string, len(e))
+	for i, err := range e {
+		msg[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems:\n\t%s", len(e), strings.Join(msg, "\n\t"))
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// jsonPosition adds the line number to JSON syntax and type
+// errors, which only carry a byte offset.
+func jsonPosition(data []byte, err error) error {
+	var offset int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	return fmt.Errorf("line %d: %v", line, err)
+}
+
+var (
+	mappingType   = reflect.TypeOf(Mapping{})
+	unmarshalType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// unknownKeys returns an error for each key in v, the result of
+// decoding JSON into an interface{}, that does not correspond
+// to a field of the type t. Like encoding/json, it matches keys
+// to field names without regard to case.
+func unknownKeys(path string, v interface{}, t reflect.Type) []error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != mappingType && reflect.PtrTo(t).Implements(unmarshalType) {
+		return nil
+	}
+	var errs []error
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f, ok := structField(t, k)
+			if !ok {
+				msg := fmt.Sprintf("unknown key %q", keyPath(path, k))
+				if s := suggest(t, k); s != "" {
+					msg += fmt.Sprintf("; did you mean %q?", s)
+				}
+				errs = append(errs, errors.New(msg))
+				continue
+			}
+			errs = append(errs, unknownKeys(keyPath(path, k), obj[k], f.Type)...)
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			errs = append(errs, unknownKeys(keyPath(path, k), obj[k], t.Elem())...)
+		}
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, elem := range list {
+			errs = append(errs, unknownKeys(fmt.Sprintf("%s[%d]", path, i), elem, t.Elem())...)
+		}
+	}
+	return errs
+}
+
+func keyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func structField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggest returns the key for the field of t whose name is
+// closest to key, if it is close enough to be a likely typo.
+func suggest(t reflect.Type, key string) string {
+	best, bestDist := "", len(key)/3+1
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		d := editDistance(strings.ToLower(key), strings.ToLower(f.Name))
+		if d < bestDist {
+			best, bestDist = jsonKey(f.Name), d
+		}
+	}
+	return best
+}
+
+// jsonKey returns the camelCase key used for a field in the
+// documentation, such as "caCert" for CACert.
+func jsonKey(name string) string {
+	r := []rune(name)
+	n := 0
+	for n < len(r) && unicode.IsUpper(r[n]) {
+		n++
+	}
+	if n > 1 && n < len(r) && string(r[n:]) != "s" {
+		n-- // the last capital starts the next word
+	}
+	for i := 0; i < n; i++ {
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// validPrefixes checks the prefixes of the mappings in c. Only
+// the first segment of a metric is used to pick its backend, so
+// a prefix with a dot in it is never matched. If its first
+// segment is mapped on its own, this is likely an attempt at a
+// more specific mapping, and a warning is recorded; otherwise it
+// is an error.
+func (c *Config) validPrefixes() []error {
+	var errs []error
+	for pfx := range c.Mappings {
+		if err := validPrefix(pfx); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dot := strings.Index(pfx, ".")
+		if dot < 0 {
+			continue
+		}
+		if _, ok := c.Mappings[pfx[:dot]]; ok {
+			c.warnings = append(c.warnings, fmt.Sprintf(
+				"mapping for %q overlaps %q and is never used", pfx, pfx[:dot]))
+		} else {
+			errs = append(errs, fmt.Errorf("prefix %q contains a dot; only the first segment of a metric is matched", pfx))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	sort.Strings(c.warnings)
+	return errs
+}
+
+func validPrefix(pfx string) error {
+	if pfx == "" || strings.ContainsAny(pfx, "*?[]{},()") {
+		return fmt.Errorf("invalid prefix %q", pfx)
+	}
+	return nil
+}
+
+// Warnings returns problems found in the config that do not
+// prevent it from being used, such as mappings that can never
+// match.
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
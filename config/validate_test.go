@@ -0,0 +1,54 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidation(t *testing.T) {
+	_, err := Parse(strings.NewReader(`{
+		"mapings": {},
+		"mappings": {
+			"prod": {"url": "http://graphite/", "timout": "5s"},
+			"dev": "graphite-dev:8080",
+			"a*": "http://graphite/"
+		},
+		"listeners": [{"adress": ":8080"}],
+		"readyQuorum": 2
+	}`))
+	if err == nil {
+		t.Fatal("accepted config with errors")
+	}
+	for _, want := range []string{
+		`7 problems`,
+		`unknown key "mapings"; did you mean "mappings"?`,
+		`unknown key "mappings.prod.timout"; did you mean "timeout"?`,
+		`unknown key "listeners[0].adress"; did you mean "address"?`,
+		`readyQuorum`,
+		`invalid prefix "a*"`,
+		`mapping for "dev": invalid backend URL "graphite-dev:8080"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+
+	_, err = Parse(strings.NewReader("{\n\"mappings\": {},\n\"readyQuorum\": \"all\"}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("got %v, want an error on line 3", err)
+	}
+
+	cfg, err := Parse(strings.NewReader(`{"mappings": {
+		"prod": "http://graphite/",
+		"prod.web": "http://graphite-web/"
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := cfg.Warnings(); len(w) != 1 || !strings.Contains(w[0], `"prod.web" overlaps "prod"`) {
+		t.Errorf("got warnings %q", w)
+	}
+	if _, err := Parse(strings.NewReader(`{"mappings": {"prod.web": "http://graphite/"}}`)); err == nil {
+		t.Error("accepted a prefix that can never match")
+	}
+}
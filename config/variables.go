@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// Values for Config.TemplateVariables
+const (
+	variablesReject  = "reject"
+	variablesDefault = "default"
+)
+
+func (c *Config) validTemplateVariables() error {
+	switch c.TemplateVariables {
+	case "", variablesReject:
+		return nil
+	case variablesDefault:
+		if c.DefaultBackend == "" {
+			return fmt.Errorf("templateVariables %q requires a defaultBackend", variablesDefault)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid templateVariables %q, must be %q or %q",
+		c.TemplateVariables, variablesReject, variablesDefault)
+}
+
+// parse parses a target. Unexpanded Grafana template variables,
+// which dashboards sometimes send by mistake, are accepted if
+// c.TemplateVariables is set. If c.ValidateFunctions is set,
+// function calls are checked against graphite's catalog. Queries
+// costing more than c.MaxQueryCost are rejected.
+func (c *Config) parse(target string) (*query.Query, error) {
+	var mode query.Mode
+	if c.TemplateVariables != "" {
+		mode = query.AllowVariables
+	}
+	q, err := query.ParseMode(target, mode)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxQueryCost > 0 {
+		if cost := q.Cost(); cost > c.MaxQueryCost {
+			return nil, fmt.Errorf("query too expensive (cost %d, limit %d)", cost, c.MaxQueryCost)
+		}
+	}
+	if c.ValidateFunctions {
+		if err := query.Validate(q); err != nil {
+			return nil, err
+		}
+	}
+	if c.TemplateVariables == variablesReject {
+		for _, m := range q.Metrics() {
+			if m.HasVariables() {
+				return nil, fmt.Errorf("unexpanded template variable in %q", *m)
+			}
+		}
+	}
+	return q, nil
+}
+
+// prefixBackend returns the backend for a metrics prefix. With
+// c.TemplateVariables set to "default", a prefix that is a
+// template variable selects the default backend.
+func (c *Config) prefixBackend(pfx query.Metric) (backend, bool) {
+	if c.TemplateVariables == variablesDefault && pfx.HasVariables() {
+		return c.backend(c.DefaultBackend)
+	}
+	return c.backend(string(pfx))
+}
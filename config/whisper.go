@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/droyo/metaphite/whisper"
+)
+
+// whisperBackend returns the URL and transport of a backend that
+// serves the whisper files in dir itself.
+func whisperBackend(dir string) (*url.URL, http.RoundTripper, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("whisper: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, nil, fmt.Errorf("whisper: %s is not a directory", dir)
+	}
+	u := &url.URL{Scheme: "whisper", Host: "localhost", Path: "/"}
+	return u, handlerTransport{whisper.Store{Dir: dir}}, nil
+}
+
+// A handlerTransport answers requests with a Handler, in the
+// same process, instead of sending them over the network.
+type handlerTransport struct {
+	http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the outgoing request of a proxy may keep the form of the
+	// incoming one
+	r := req.Clone(req.Context())
+	r.Form, r.PostForm = nil, nil
+	if isJSON(r) {
+		if err := parseJSONForm(r); err != nil {
+			return nil, err
+		}
+	}
+	w := &resultWriter{header: make(http.Header)}
+	t.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.buf),
+		ContentLength: int64(w.buf.Len()),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeWhisper writes a whisper file with a single archive of a
+// day of points, one every minute, at path.
+func writeWhisper(t *testing.T, path string, points [][2]float64) {
+	const step, slots = 60, 1440
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 28+12*slots)
+	binary.BigEndian.PutUint32(b[0:], 1)
+	binary.BigEndian.PutUint32(b[4:], step*slots)
+	binary.BigEndian.PutUint32(b[12:], 1)
+	binary.BigEndian.PutUint32(b[16:], 28)
+	binary.BigEndian.PutUint32(b[20:], step)
+	binary.BigEndian.PutUint32(b[24:], slots)
+	for _, p := range points {
+		slot := (int64(p[1]) - int64(points[0][1])) / step % slots
+		binary.BigEndian.PutUint32(b[28+12*slot:], uint32(p[1]))
+		binary.BigEndian.PutUint64(b[28+12*slot+4:], math.Float64bits(p[0]))
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWhisper(t *testing.T) {
+	now := time.Now().Unix()
+	t0 := float64(now - now%60 - 120)
+	dir := t.TempDir()
+	writeWhisper(t, filepath.Join(dir, "cpu", "load.wsp"), [][2]float64{{1, t0}, {2, t0 + 60}})
+	g := newFakeGraphite(map[string][][2]float64{"cpu.load": {{10, t0}, {20, t0 + 60}}})
+	defer g.Close()
+	js := `{"mappings": {"local": {"whisper": "` + dir + `"}, "dev": "` + g.URL + `/"}}`
+	cfg, err := Parse(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(cfg)
+	defer srv.Close()
+	c := &cluster{config: cfg, Server: srv}
+
+	window := fmt.Sprintf("&from=%d&until=%d", int64(t0)-1, int64(t0)+60)
+	points := func(a, b int) string {
+		return fmt.Sprintf(`"datapoints":[[%d,%d],[%d,%d]]`, a, int64(t0), b, int64(t0)+60)
+	}
+	tests := []struct {
+		target string
+		body   string
+	}{
+		{"local.cpu.load", `[{"target":"cpu.load",` + points(1, 2) + "}]\n"},
+		{"local.cpu.*", `[{"target":"cpu.load",` + points(1, 2) + "}]\n"},
+		{"local.mem.*", "[]\n"},
+		// across backends
+		{"sumSeries(local.cpu.load, dev.cpu.load)", `[{"target":"sumSeries(local.cpu.load,dev.cpu.load)",` + points(11, 22) + "}]\n"},
+		// evaluated by metaphite
+		{"scale(local.cpu.load, 10)", `[{"target":"scale(cpu.load,10)",` + points(10, 20) + "}]\n"},
+	}
+	for _, tt := range tests {
+		code, body := c.get(t, "/render?format=json&target="+url.QueryEscape(tt.target)+window)
+		if code != 200 || body != tt.body {
+			t.Errorf("%s: got %d %q, expected %q", tt.target, code, body, tt.body)
+		}
+	}
+	code, body := c.get(t, "/render?format=csv&target=local.cpu.load"+window)
+	if code != 200 || strings.Count(body, "cpu.load,") != 2 {
+		t.Errorf("render csv: %d %q", code, body)
+	}
+
+	js = `{"mappings": {"local": {"whisper": "` + filepath.Join(dir, "missing") + `"}}}`
+	if _, err := Parse(strings.NewReader(js)); err == nil {
+		t.Error("missing whisper directory was accepted")
+	}
+}
@@ -0,0 +1,330 @@
+// Package eval evaluates a subset of graphite's render functions
+// on series fetched from one or more graphite servers.
+package eval
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// A Point is a single datapoint of a Series. A nil Value
+// represents a missing datapoint.
+type Point struct {
+	Value *float64
+	Time  int64
+}
+
+// MarshalJSON encodes a Point as graphite does, as a
+// [value, timestamp] pair, in the DefaultFormat.
+func (p Point) MarshalJSON() ([]byte, error) {
+	return DefaultFormat.appendPoint(nil, p), nil
+}
+
+// A Format is how the values of series are written in json
+// render output.
+type Format struct {
+	// Digits after the decimal point. If negative, as many
+	// as are needed to represent each value exactly.
+	Precision int
+	// Remove zeros at the end of the digits after the decimal
+	// point, and the point if no digits are left.
+	TrimZeros bool
+	// Written for missing values, and for values that are not
+	// finite, which JSON cannot represent. If empty, null.
+	Null string
+}
+
+// DefaultFormat writes values as graphite does. Values are
+// never written in exponent notation.
+var DefaultFormat = Format{Precision: -1}
+
+// AppendValue appends v, or f.Null if v is nil or not finite,
+// to b.
+func (f Format) AppendValue(b []byte, v *float64) []byte {
+	if v == nil || math.IsInf(*v, 0) || math.IsNaN(*v) {
+		if f.Null == "" {
+			return append(b, "null"...)
+		}
+		return append(b, f.Null...)
+	}
+	start := len(b)
+	b = strconv.AppendFloat(b, *v, 'f', f.Precision, 64)
+	if f.TrimZeros && bytes.IndexByte(b[start:], '.') >= 0 {
+		b = bytes.TrimRight(b, "0")
+		b = bytes.TrimSuffix(b, []byte("."))
+	}
+	return b
+}
+
+func (f Format) appendPoint(b []byte, p Point) []byte {
+	b = append(b, '[')
+	b = f.AppendValue(b, p.Value)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, p.Time, 10)
+	return append(b, ']')
+}
+
+// formatted is a Point written in a Format.
+type formatted struct {
+	Point
+	f *Format
+}
+
+func (p formatted) MarshalJSON() ([]byte, error) {
+	return p.f.appendPoint(nil, p.Point), nil
+}
+
+// Marshal encodes list as json render output, with its values
+// written in f.
+func (f Format) Marshal(list []Series) ([]byte, error) {
+	type series struct {
+		Target     string      `json:"target"`
+		Datapoints []formatted `json:"datapoints"`
+	}
+	out := make([]series, len(list))
+	for i, s := range list {
+		out[i].Target = s.Target
+		if s.Datapoints != nil {
+			out[i].Datapoints = make([]formatted, len(s.Datapoints))
+		}
+		for j, p := range s.Datapoints {
+			out[i].Datapoints[j] = formatted{p, &f}
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a [value, timestamp] pair.
+func (p *Point) UnmarshalJSON(data []byte) error {
+	var pair [2]*json.Number
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if pair[1] == nil {
+		return fmt.Errorf("datapoint %s has no timestamp", data)
+	}
+	ts, err := pair[1].Float64()
+	if err != nil {
+		return err
+	}
+	p.Time = int64(ts)
+	p.Value = nil
+	if pair[0] != nil {
+		v, err := pair[0].Float64()
+		if err != nil {
+			return err
+		}
+		p.Value = &v
+	}
+	return nil
+}
+
+// A Series is a named list of datapoints, in the format of
+// graphite's json render output.
+type Series struct {
+	Target     string  `json:"target"`
+	Datapoints []Point `json:"datapoints"`
+}
+
+// An Arg is an argument to a function: either a list of series,
+// or a literal value.
+type Arg struct {
+	Series []Series
+	Value  *query.Value
+}
+
+// A Func computes a list of series from its arguments. The
+// name of the function call, as it appeared in the query,
+// is passed to the function for naming its output.
+type Func func(name string, args []Arg) ([]Series, error)
+
+var funcs = map[string]Func{
+	"sumSeries":     aggregate(sum),
+	"sum":           aggregate(sum),
+	"averageSeries": aggregate(average),
+	"avg":           aggregate(average),
+	"maxSeries":     aggregate(max),
+	"minSeries":     aggregate(min),
+
+	"scale":                 each("scale(%s,%g)", 1, nil, scale),
+	"offset":                each("offset(%s,%g)", 1, nil, offset),
+	"absolute":              each("absolute(%s)", 0, nil, absolute),
+	"transformNull":         each("transformNull(%s,%g)", 0, []float64{0}, transformNull),
+	"integral":              each("integral(%s)", 0, nil, integral),
+	"derivative":            each("derivative(%s)", 0, nil, derivative),
+	"nonNegativeDerivative": each("nonNegativeDerivative(%s)", 0, []float64{math.NaN()}, nonNegativeDerivative),
+	"perSecond":             each("perSecond(%s)", 0, []float64{math.NaN()}, perSecond),
+	"keepLastValue":         each("keepLastValue(%s)", 0, []float64{math.Inf(1)}, keepLastValue),
+	"alias":                 alias,
+	"aliasByNode":           aliasByNode,
+}
+
+// Supported returns true if the named function can be
+// evaluated locally.
+func Supported(name string) bool {
+	_, ok := funcs[name]
+	return ok
+}
+
+// An Evaluator evaluates query expressions. Some parts of an
+// expression are evaluated locally, while the rest must be
+// fetched from a graphite server.
+type Evaluator struct {
+	// Local reports whether a function call should be
+	// evaluated locally.
+	Local func(*query.Func) bool
+}
+
+// Leaves returns the largest subexpressions of e that must be
+// fetched from a graphite server before e can be evaluated.
+func (ev Evaluator) Leaves(e query.Expr) []query.Expr {
+	var leaves []query.Expr
+	var visit func(query.Expr, int)
+	visit = func(e query.Expr, depth int) {
+		const maxDepth = 200
+		if depth > maxDepth {
+			return
+		}
+		switch e := e.(type) {
+		case *query.Query:
+			visit(e.Expr, depth+1)
+		case *query.Value:
+		case *query.Func:
+			if ev.Local(e) {
+				for _, arg := range e.Args {
+					visit(arg, depth+1)
+				}
+				return
+			}
+			leaves = append(leaves, e)
+		default:
+			leaves = append(leaves, e)
+		}
+	}
+	visit(e, 0)
+	return leaves
+}
+
+// Eval evaluates e. The series for each of the leaves of e, as
+// returned by Leaves, are retrieved with fetch.
+func (ev Evaluator) Eval(e query.Expr, fetch func(query.Expr) ([]Series, error)) ([]Series, error) {
+	return ev.eval(e, fetch, 0)
+}
+
+func (ev Evaluator) eval(e query.Expr, fetch func(query.Expr) ([]Series, error), depth int) ([]Series, error) {
+	const maxDepth = 200
+	if depth > maxDepth {
+		return nil, fmt.Errorf("expression too deep")
+	}
+	switch v := e.(type) {
+	case *query.Query:
+		return ev.eval(v.Expr, fetch, depth+1)
+	case *query.Value:
+		return nil, fmt.Errorf("unexpected value %s", v)
+	case *query.Func:
+		if !ev.Local(v) {
+			break
+		}
+		fn, ok := funcs[v.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: function cannot be evaluated by metaphite", v.Name)
+		}
+		args := make([]Arg, 0, len(v.Args))
+		for _, a := range v.Args {
+			if val, ok := a.(*query.Value); ok {
+				args = append(args, Arg{Value: val})
+				continue
+			}
+			s, err := ev.eval(a, fetch, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, Arg{Series: s})
+		}
+		return fn(callName(v), args)
+	}
+	return fetch(e)
+}
+
+// callName produces the name graphite gives to the output
+// of a function call, which is the call itself.
+func callName(f *query.Func) string {
+	s := (&query.Query{Expr: f}).String()
+	return strings.Replace(s, ", ", ",", -1)
+}
+
+// aggregate creates a Func that combines all datapoints with
+// the same timestamp, across all series in its arguments, into
+// a single series.
+func aggregate(combine func([]float64) float64) Func {
+	return func(name string, args []Arg) ([]Series, error) {
+		byTime := make(map[int64][]float64)
+		for _, a := range args {
+			if a.Value != nil {
+				return nil, fmt.Errorf("%s: unexpected argument %s", name, a.Value)
+			}
+			for _, s := range a.Series {
+				for _, p := range s.Datapoints {
+					vals := byTime[p.Time]
+					if p.Value != nil {
+						vals = append(vals, *p.Value)
+					}
+					byTime[p.Time] = vals
+				}
+			}
+		}
+		times := make([]int64, 0, len(byTime))
+		for t := range byTime {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		result := Series{Target: name, Datapoints: make([]Point, 0, len(times))}
+		for _, t := range times {
+			p := Point{Time: t}
+			if vals := byTime[t]; len(vals) > 0 {
+				v := combine(vals)
+				p.Value = &v
+			}
+			result.Datapoints = append(result.Datapoints, p)
+		}
+		return []Series{result}, nil
+	}
+}
+
+func sum(v []float64) float64 {
+	var total float64
+	for _, x := range v {
+		total += x
+	}
+	return total
+}
+
+func average(v []float64) float64 { return sum(v) / float64(len(v)) }
+
+func max(v []float64) float64 {
+	m := v[0]
+	for _, x := range v[1:] {
+		if x > m {
+			m = x
+		}
+	}
+	return m
+}
+
+func min(v []float64) float64 {
+	m := v[0]
+	for _, x := range v[1:] {
+		if x < m {
+			m = x
+		}
+	}
+	return m
+}
@@ -0,0 +1,139 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// testSeries are fetched by metric name, with datapoints in
+// graphite's json format.
+var testSeries = map[string]string{
+	"s.a":       `[[1,0],[3,60],[null,120],[6,180],[2,240]]`,
+	"s.b":       `[[10,0],[20,60],[30,120]]`,
+	"s.gaps":    `[[null,0],[null,60],[5,120],[null,180],[null,240],[null,300],[8,360]]`,
+	"s.nulls":   `[[null,0],[null,300]]`,
+	"s.neg":     `[[-1.5,0],[2,60],[null,120]]`,
+	"s.counter": `[[250,0],[254,60],[3,120],[7,180],[null,240],[12,300]]`,
+	"s.big":     `[[1,0],[300,60],[5,120],[9,180]]`,
+}
+
+func fetchTest(e query.Expr) ([]Series, error) {
+	m, ok := e.(*query.Metric)
+	if !ok {
+		return nil, fmt.Errorf("cannot fetch %v", e)
+	}
+	data, ok := testSeries[string(*m)]
+	if !ok {
+		return nil, nil
+	}
+	var points []Point
+	if err := json.Unmarshal([]byte(data), &points); err != nil {
+		return nil, err
+	}
+	return []Series{{Target: string(*m), Datapoints: points}}, nil
+}
+
+func evalTest(target string) (string, error) {
+	q, err := query.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	ev := Evaluator{Local: func(*query.Func) bool { return true }}
+	series, err := ev.Eval(q, fetchTest)
+	if err != nil {
+		return "", err
+	}
+	out, err := DefaultFormat.Marshal(series)
+	return string(out), err
+}
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		target, want string
+	}{
+		{"derivative(s.a)", `[{"target":"derivative(s.a)","datapoints":[[null,0],[2,60],[null,120],[null,180],[-4,240]]}]`},
+		{"nonNegativeDerivative(s.a)", `[{"target":"nonNegativeDerivative(s.a)","datapoints":[[null,0],[2,60],[null,120],[null,180],[null,240]]}]`},
+		// without maxValue, a decrease is a reset
+		{"nonNegativeDerivative(s.counter)", `[{"target":"nonNegativeDerivative(s.counter)","datapoints":[[null,0],[4,60],[null,120],[4,180],[null,240],[null,300]]}]`},
+		// with it, the counter wrapped after 255
+		{"nonNegativeDerivative(s.counter,255)", `[{"target":"nonNegativeDerivative(s.counter)","datapoints":[[null,0],[4,60],[5,120],[4,180],[null,240],[null,300]]}]`},
+		// values above maxValue are dropped, as is the next delta
+		{"nonNegativeDerivative(s.big,255)", `[{"target":"nonNegativeDerivative(s.big)","datapoints":[[null,0],[null,60],[null,120],[4,180]]}]`},
+		// rounded to 6 digits
+		{"perSecond(s.counter)", `[{"target":"perSecond(s.counter)","datapoints":[[null,0],[0.066667,60],[null,120],[0.066667,180],[null,240],[null,300]]}]`},
+		{"perSecond(s.counter,255)", `[{"target":"perSecond(s.counter)","datapoints":[[null,0],[0.066667,60],[0.083333,120],[0.066667,180],[null,240],[null,300]]}]`},
+		{"perSecond(s.nulls)", `[{"target":"perSecond(s.nulls)","datapoints":[[null,0],[null,300]]}]`},
+		{"integral(s.a)", `[{"target":"integral(s.a)","datapoints":[[1,0],[4,60],[null,120],[10,180],[12,240]]}]`},
+		{"keepLastValue(s.gaps)", `[{"target":"keepLastValue(s.gaps)","datapoints":[[null,0],[null,60],[5,120],[5,180],[5,240],[5,300],[8,360]]}]`},
+		// runs longer than the limit are left alone
+		{"keepLastValue(s.gaps,2)", `[{"target":"keepLastValue(s.gaps)","datapoints":[[null,0],[null,60],[5,120],[null,180],[null,240],[null,300],[8,360]]}]`},
+		{"keepLastValue(s.gaps,3)", `[{"target":"keepLastValue(s.gaps)","datapoints":[[null,0],[null,60],[5,120],[5,180],[5,240],[5,300],[8,360]]}]`},
+		{"keepLastValue(s.a,1)", `[{"target":"keepLastValue(s.a)","datapoints":[[1,0],[3,60],[3,120],[6,180],[2,240]]}]`},
+		{"transformNull(s.a)", `[{"target":"transformNull(s.a,0)","datapoints":[[1,0],[3,60],[0,120],[6,180],[2,240]]}]`},
+		{"transformNull(s.a,-1)", `[{"target":"transformNull(s.a,-1)","datapoints":[[1,0],[3,60],[-1,120],[6,180],[2,240]]}]`},
+		{"offset(s.neg,2)", `[{"target":"offset(s.neg,2)","datapoints":[[0.5,0],[4,60],[null,120]]}]`},
+		{"absolute(s.neg)", `[{"target":"absolute(s.neg)","datapoints":[[1.5,0],[2,60],[null,120]]}]`},
+		{"scale(s.neg,2)", `[{"target":"scale(s.neg,2)","datapoints":[[-3,0],[4,60],[null,120]]}]`},
+		{"scale(s.missing,2)", `[]`},
+	}
+	for _, tt := range tests {
+		got, err := evalTest(tt.target)
+		if err != nil {
+			t.Errorf("%s: %v", tt.target, err)
+		} else if got != tt.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+// The series aggregated have different lengths and gaps. A time
+// at which every series is missing is null.
+func TestAggregates(t *testing.T) {
+	tests := []struct {
+		target, want string
+	}{
+		{"sumSeries(s.a,s.b)", `[{"target":"sumSeries(s.a,s.b)","datapoints":[[11,0],[23,60],[30,120],[6,180],[2,240]]}]`},
+		{"sum(s.a,s.b)", `[{"target":"sum(s.a,s.b)","datapoints":[[11,0],[23,60],[30,120],[6,180],[2,240]]}]`},
+		{"averageSeries(s.a,s.b)", `[{"target":"averageSeries(s.a,s.b)","datapoints":[[5.5,0],[11.5,60],[30,120],[6,180],[2,240]]}]`},
+		{"avg(s.a,s.b)", `[{"target":"avg(s.a,s.b)","datapoints":[[5.5,0],[11.5,60],[30,120],[6,180],[2,240]]}]`},
+		{"maxSeries(s.a,s.b)", `[{"target":"maxSeries(s.a,s.b)","datapoints":[[10,0],[20,60],[30,120],[6,180],[2,240]]}]`},
+		{"minSeries(s.a,s.b)", `[{"target":"minSeries(s.a,s.b)","datapoints":[[1,0],[3,60],[30,120],[6,180],[2,240]]}]`},
+		{"sumSeries(s.a,s.nulls)", `[{"target":"sumSeries(s.a,s.nulls)","datapoints":[[1,0],[3,60],[null,120],[6,180],[2,240],[null,300]]}]`},
+		{"maxSeries(s.nulls)", `[{"target":"maxSeries(s.nulls)","datapoints":[[null,0],[null,300]]}]`},
+		{"sumSeries(s.missing)", `[{"target":"sumSeries(s.missing)","datapoints":[]}]`},
+	}
+	for _, tt := range tests {
+		got, err := evalTest(tt.target)
+		if err != nil {
+			t.Errorf("%s: %v", tt.target, err)
+		} else if got != tt.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		target, err string
+	}{
+		{"scale(s.a)", "wrong number of arguments"},
+		{"derivative(s.a,1)", "wrong number of arguments"},
+		{"keepLastValue(s.a,1,2)", "wrong number of arguments"},
+		{"scale(s.a,s.b)", "unexpected series argument"},
+		{"scale(s.a,'x')", "is not a number"},
+		{"scale(1,2)", "first argument must be a series list"},
+		{"sumSeries(s.a,1)", "unexpected argument"},
+		{"alias(s.a)", "expected a series list and a name"},
+		{"aliasByNode(s.a,3)", "has no node 3"},
+	}
+	for _, tt := range tests {
+		got, err := evalTest(tt.target)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %s, %v; expected an error containing %q", tt.target, got, err, tt.err)
+		}
+	}
+}
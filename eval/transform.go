@@ -0,0 +1,266 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A transform computes the datapoints of a series from those of
+// one of its arguments. The name of the output series, given the
+// name of the input, is made by the caller.
+type transform func(points []Point, values []float64) ([]Point, error)
+
+// each creates a Func that applies t to each series in its first
+// argument, whose other arguments are numbers. The first required
+// numbers must be given; the rest are optional, and take the
+// values in defaults. The output series are named by format, from
+// the input series name and as many of the numbers as it has %g
+// verbs, as graphite names them.
+func each(format string, required int, defaults []float64, t transform) Func {
+	named := strings.Count(format, "%g")
+	return func(name string, args []Arg) ([]Series, error) {
+		if len(args) < required+1 || len(args) > len(defaults)+required+1 {
+			return nil, fmt.Errorf("%s: wrong number of arguments", name)
+		}
+		if args[0].Value != nil {
+			return nil, fmt.Errorf("%s: first argument must be a series list", name)
+		}
+		values := make([]float64, 0, len(defaults)+required)
+		for _, a := range args[1:] {
+			v, err := number(name, a)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		values = append(values, defaults[len(values)-required:]...)
+		result := make([]Series, 0, len(args[0].Series))
+		for _, s := range args[0].Series {
+			points, err := t(s.Datapoints, values)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			fa := []interface{}{s.Target}
+			for _, v := range values[:named] {
+				fa = append(fa, v)
+			}
+			result = append(result, Series{Target: fmt.Sprintf(format, fa...), Datapoints: points})
+		}
+		return result, nil
+	}
+}
+
+func number(name string, a Arg) (float64, error) {
+	if a.Value == nil {
+		return 0, fmt.Errorf("%s: unexpected series argument", name)
+	}
+	v, err := strconv.ParseFloat(string(*a.Value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s is not a number", name, *a.Value)
+	}
+	return v, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// mapValues creates a transform that computes each value with fn,
+// from the value, or nil, and the first argument.
+func mapValues(fn func(v *float64, arg float64) *float64) transform {
+	return func(points []Point, values []float64) ([]Point, error) {
+		arg := 0.0
+		if len(values) > 0 {
+			arg = values[0]
+		}
+		out := make([]Point, len(points))
+		for i, p := range points {
+			out[i] = Point{Value: fn(p.Value, arg), Time: p.Time}
+		}
+		return out, nil
+	}
+}
+
+func float(v float64) *float64 { return &v }
+
+var (
+	scale = mapValues(func(v *float64, factor float64) *float64 {
+		if v == nil {
+			return nil
+		}
+		return float(*v * factor)
+	})
+	offset = mapValues(func(v *float64, n float64) *float64 {
+		if v == nil {
+			return nil
+		}
+		return float(*v + n)
+	})
+	absolute = mapValues(func(v *float64, _ float64) *float64 {
+		if v == nil {
+			return nil
+		}
+		return float(math.Abs(*v))
+	})
+	transformNull = mapValues(func(v *float64, def float64) *float64 {
+		if v == nil {
+			return float(def)
+		}
+		return v
+	})
+)
+
+func integral(points []Point, _ []float64) ([]Point, error) {
+	out := make([]Point, len(points))
+	var total float64
+	for i, p := range points {
+		out[i].Time = p.Time
+		if p.Value != nil {
+			total += *p.Value
+			out[i].Value = float(total)
+		}
+	}
+	return out, nil
+}
+
+func derivative(points []Point, _ []float64) ([]Point, error) {
+	out := make([]Point, len(points))
+	var prev *float64
+	for i, p := range points {
+		out[i].Time = p.Time
+		if prev != nil && p.Value != nil {
+			out[i].Value = float(*p.Value - *prev)
+		}
+		prev = p.Value
+	}
+	return out, nil
+}
+
+// nonNegativeDelta is the increase of a counter from prev to v,
+// which wraps after maxValue, if it is not NaN.
+func nonNegativeDelta(v, prev *float64, maxValue float64) *float64 {
+	switch {
+	case v == nil || prev == nil:
+		return nil
+	case *v >= *prev:
+		return float(*v - *prev)
+	case !math.IsNaN(maxValue):
+		return float(maxValue + 1 + *v - *prev)
+	}
+	return nil
+}
+
+func nonNegativeDerivative(points []Point, values []float64) ([]Point, error) {
+	maxValue := values[0]
+	out := make([]Point, len(points))
+	var prev *float64
+	for i, p := range points {
+		out[i].Time = p.Time
+		if p.Value != nil && !math.IsNaN(maxValue) && *p.Value > maxValue {
+			prev = nil
+			continue
+		}
+		out[i].Value = nonNegativeDelta(p.Value, prev, maxValue)
+		prev = p.Value
+	}
+	return out, nil
+}
+
+func perSecond(points []Point, values []float64) ([]Point, error) {
+	out, _ := nonNegativeDerivative(points, values)
+	if len(points) < 2 {
+		return out, nil
+	}
+	step := float64(points[1].Time - points[0].Time)
+	for i := range out {
+		if out[i].Value != nil {
+			out[i].Value = float(math.Round(*out[i].Value/step*1e6) / 1e6)
+		}
+	}
+	return out, nil
+}
+
+// keepLastValue fills runs of up to limit missing values with the
+// last value before them.
+func keepLastValue(points []Point, values []float64) ([]Point, error) {
+	limit := values[0]
+	out := make([]Point, len(points))
+	copy(out, points)
+	var last *float64
+	run := 0
+	fill := func(end int) {
+		if last != nil && run > 0 && float64(run) <= limit {
+			for j := end - run; j < end; j++ {
+				out[j].Value = last
+			}
+		}
+	}
+	for i, p := range points {
+		if p.Value == nil {
+			run++
+			continue
+		}
+		fill(i)
+		last, run = p.Value, 0
+	}
+	fill(len(points))
+	return out, nil
+}
+
+// alias renames the series in its first argument.
+func alias(name string, args []Arg) ([]Series, error) {
+	if len(args) != 2 || args[0].Value != nil || args[1].Value == nil {
+		return nil, fmt.Errorf("%s: expected a series list and a name", name)
+	}
+	newName := unquote(string(*args[1].Value))
+	result := make([]Series, len(args[0].Series))
+	for i, s := range args[0].Series {
+		result[i] = Series{Target: newName, Datapoints: s.Datapoints}
+	}
+	return result, nil
+}
+
+// metricName finds the metric name in the name of a series,
+// which may be wrapped in function calls, as graphite does.
+var metricName = regexp.MustCompile(`^(?:.*\()?([-\w*.:#+]+)(?:,|\)?.*)?`)
+
+// aliasByNode names each series in its first argument by the
+// nodes of its metric name given by the other arguments.
+func aliasByNode(name string, args []Arg) ([]Series, error) {
+	if len(args) < 2 || args[0].Value != nil {
+		return nil, fmt.Errorf("%s: expected a series list and nodes", name)
+	}
+	var nodes []int
+	for _, a := range args[1:] {
+		n, err := number(name, a)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, int(n))
+	}
+	result := make([]Series, len(args[0].Series))
+	for i, s := range args[0].Series {
+		var pieces []string
+		if m := metricName.FindStringSubmatch(s.Target); m != nil {
+			pieces = strings.Split(m[1], ".")
+		}
+		var parts []string
+		for _, n := range nodes {
+			if n < 0 {
+				n += len(pieces)
+			}
+			if n < 0 || n >= len(pieces) {
+				return nil, fmt.Errorf("%s: %s has no node %d", name, s.Target, n)
+			}
+			parts = append(parts, pieces[n])
+		}
+		result[i] = Series{Target: strings.Join(parts, "."), Datapoints: s.Datapoints}
+	}
+	return result, nil
+}
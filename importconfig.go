@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/droyo/metaphite/config"
+)
+
+// importConfig implements the import-config subcommand, which
+// generates a metaphite config from carbon-relay rules or a
+// carbonapi config, and writes it to standard output. Parts of
+// the configs that metaphite cannot do the same with are
+// reported, and nothing is written, unless -partial is given.
+func importConfig(args []string) {
+	fs := flag.NewFlagSet("import-config", flag.ExitOnError)
+	relayRules := fs.String("relay-rules", "", "carbon-relay relay-rules.conf to import")
+	carbonapi := fs.String("carbonapi", "", "carbonapi YAML config to import")
+	prefixes := fs.String("prefixes", "", "comma-separated first components of the metric names held by the carbonapi backends")
+	webPort := fs.Int("web-port", 80, "graphite-web port on carbon-relay destination hosts")
+	partial := fs.Bool("partial", false, "write the mappings that can be imported, even if others cannot")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: metaphite import-config [-relay-rules file] [-carbonapi file -prefixes list] [-partial]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *relayRules == "" && *carbonapi == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	mappings := make(map[string]config.Mapping)
+	var errs []error
+	load := func(path string, parse func(io.Reader) (map[string]config.Mapping, []error)) {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("import %s: %s", path, err)
+		}
+		m, list := parse(file)
+		file.Close()
+		for _, err := range list {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+		}
+		for pfx, mapping := range m {
+			if _, ok := mappings[pfx]; ok {
+				errs = append(errs, fmt.Errorf("%s: prefix %q is already mapped by %s", path, pfx, *relayRules))
+				continue
+			}
+			mappings[pfx] = mapping
+		}
+	}
+	if *relayRules != "" {
+		load(*relayRules, func(r io.Reader) (map[string]config.Mapping, []error) {
+			return importRelayRules(r, *webPort)
+		})
+	}
+	if *carbonapi != "" {
+		var names []string
+		for _, s := range strings.Split(*prefixes, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				names = append(names, s)
+			}
+		}
+		load(*carbonapi, func(r io.Reader) (map[string]config.Mapping, []error) {
+			return importCarbonapi(r, names)
+		})
+	}
+	for _, err := range errs {
+		log.Print(err)
+	}
+	if len(errs) > 0 && !*partial {
+		log.Fatal("not everything can be imported; use -partial to write the mappings that can be")
+	}
+
+	out := struct {
+		Mappings map[string]config.Mapping `json:"mappings"`
+	}{mappings}
+	data, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// fullNames returns a Mapping to the backends at urls, which hold
+// metrics under their full names, prefix included.
+func fullNames(urls []string) config.Mapping {
+	keep := false
+	m := config.Mapping{StripPrefix: &keep}
+	if len(urls) == 1 {
+		m.URL = urls[0]
+	} else {
+		m.URLs = urls
+	}
+	return m
+}
+
+type relayRule struct {
+	name, pattern string
+	prefixes      []string // nil if pattern does not select whole prefixes
+	hosts         []string
+	isDefault     bool
+	continues     bool
+}
+
+// matches patterns such as ^prod\. or ^(prod|stage)\..* that
+// select whole prefixes
+var plainPrefix = regexp.MustCompile(`^\^(?:([A-Za-z0-9_-]+)|\(([A-Za-z0-9_|-]+)\))\\\.(?:\.\*)?$`)
+
+// importRelayRules returns the mappings of the carbon-relay
+// rules in r, to the graphite-web listening on webPort on each of
+// their destinations. A relay rule sends every metric it matches
+// to all of its destinations, so each of them is a replica that
+// can answer for the rule's prefixes. The errors are for the
+// rules that cannot be imported: the default rule, which sends
+// metrics with any other name to its destinations, and rules
+// whose pattern does not select whole prefixes.
+func importRelayRules(r io.Reader, webPort int) (map[string]config.Mapping, []error) {
+	rules, err := parseRelayRules(r)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var (
+		errs  []error
+		hosts = make(map[string][]string)
+		done  = make(map[string]bool) // by a rule that does not continue
+	)
+	for _, r := range rules {
+		switch {
+		case r.isDefault:
+			errs = append(errs, fmt.Errorf("[%s]: the default rule cannot be imported; metaphite only routes metrics by prefix", r.name))
+			continue
+		case r.prefixes == nil:
+			errs = append(errs, fmt.Errorf("[%s]: pattern %q does not select whole prefixes", r.name, r.pattern))
+			continue
+		case len(r.hosts) == 0:
+			errs = append(errs, fmt.Errorf("[%s]: no destinations", r.name))
+			continue
+		}
+		for _, pfx := range r.prefixes {
+			if done[pfx] {
+				// an earlier rule matches every metric
+				// under pfx
+				log.Printf("[%s]: prefix %q is matched by an earlier rule, ignoring", r.name, pfx)
+				continue
+			}
+			for _, h := range r.hosts {
+				if !contains(hosts[pfx], h) {
+					hosts[pfx] = append(hosts[pfx], h)
+				}
+			}
+			done[pfx] = !r.continues
+		}
+	}
+	mappings := make(map[string]config.Mapping)
+	for pfx, list := range hosts {
+		var urls []string
+		for _, h := range list {
+			if webPort != 80 {
+				h = net.JoinHostPort(h, strconv.Itoa(webPort))
+			} else if strings.Contains(h, ":") {
+				h = "[" + h + "]"
+			}
+			urls = append(urls, "http://"+h+"/")
+		}
+		mappings[pfx] = fullNames(urls)
+	}
+	return mappings, errs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRelayRules parses the INI-style rules file used by
+// carbon-relay in rules mode:
+//
+// 	[prod]
+// 	pattern = ^prod\.
+// 	destinations = 10.1.0.1:2004:a, 10.1.0.2:2004:b
+//
+// 	[default]
+// 	default = true
+// 	destinations = 10.1.0.9:2004
+func parseRelayRules(r io.Reader) ([]relayRule, error) {
+	var (
+		rules []relayRule
+		cur   *relayRule
+		line  int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' || s[0] == ';' {
+			continue
+		}
+		if s[0] == '[' && s[len(s)-1] == ']' {
+			rules = append(rules, relayRule{name: s[1 : len(s)-1]})
+			cur = &rules[len(rules)-1]
+			continue
+		}
+		eq := strings.IndexAny(s, "=:")
+		if eq < 0 || cur == nil {
+			return nil, fmt.Errorf("line %d: syntax error", line)
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		val := strings.TrimSpace(s[eq+1:])
+		switch key {
+		case "pattern":
+			cur.pattern = val
+			if m := plainPrefix.FindStringSubmatch(val); m != nil {
+				if m[1] != "" {
+					cur.prefixes = []string{m[1]}
+				} else {
+					cur.prefixes = strings.Split(m[2], "|")
+				}
+			}
+		case "default":
+			cur.isDefault = strings.EqualFold(val, "true")
+		case "continue":
+			cur.continues = strings.EqualFold(val, "true")
+		case "destinations":
+			for _, d := range strings.Split(val, ",") {
+				// host:port[:instance], with brackets
+				// around an IPv6 host
+				d = strings.TrimSpace(d)
+				var host string
+				if strings.HasPrefix(d, "[") {
+					if end := strings.Index(d, "]"); end > 0 {
+						host = d[1:end]
+					}
+				} else {
+					host = strings.SplitN(d, ":", 2)[0]
+				}
+				if host != "" && !contains(cur.hosts, host) {
+					cur.hosts = append(cur.hosts, host)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var result []relayRule
+	for _, r := range rules {
+		if r.pattern != "" || r.isDefault {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+type backendGroup struct {
+	name     string
+	lbMethod string
+	servers  []string
+}
+
+// importCarbonapi returns the mappings of the backends of the
+// carbonapi config in r. carbonapi does not route by prefix: it
+// sends every request to all of its backends, so they are
+// mapped under each of the given prefixes, the first components
+// of the names of the metrics they hold. That is only possible
+// if there is a single backend, or a single group whose servers
+// are replicas, with an lbMethod of "rr" or "any"; the errors are
+// for any other config, whose responses carbonapi merges.
+func importCarbonapi(r io.Reader, prefixes []string) (map[string]config.Mapping, []error) {
+	groups, err := parseCarbonapi(r)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var errs []error
+	var used []backendGroup
+	for _, g := range groups {
+		if len(g.servers) > 0 {
+			used = append(used, g)
+		}
+	}
+	if len(used) == 0 {
+		return nil, []error{fmt.Errorf("no backends")}
+	}
+	if len(used) > 1 {
+		var names []string
+		for _, g := range used {
+			names = append(names, strconv.Quote(g.name))
+		}
+		errs = append(errs, fmt.Errorf("carbonapi merges the responses of the groups %s, which metaphite cannot do for one prefix", strings.Join(names, ", ")))
+	}
+	g := used[0]
+	switch g.lbMethod {
+	case "rr", "roundrobin", "any":
+	default:
+		if len(g.servers) > 1 {
+			errs = append(errs, fmt.Errorf("group %q: carbonapi merges the responses of the servers %s, which metaphite cannot do for one prefix; if they are replicas, set lbMethod to \"rr\"",
+				g.name, strings.Join(g.servers, ", ")))
+		}
+	}
+	if len(prefixes) == 0 {
+		errs = append(errs, fmt.Errorf("carbonapi does not route metrics by prefix; list the first components of the metric names its backends hold with -prefixes"))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	mappings := make(map[string]config.Mapping)
+	for _, pfx := range prefixes {
+		mappings[pfx] = fullNames(g.servers)
+	}
+	return mappings, nil
+}
+
+// parseCarbonapi extracts backend lists from a carbonapi YAML
+// config. Only the parts of the file describing backends are
+// understood: the "backends" lists of old configs, and the
+// "groupName", "lbMethod" and "servers" keys of backendsv2
+// groups. This is a line-oriented scan, not a YAML parser.
+func parseCarbonapi(r io.Reader) ([]backendGroup, error) {
+	var (
+		groups     []backendGroup
+		inList     bool
+		listIndent int
+	)
+	group := func() *backendGroup {
+		if len(groups) == 0 {
+			groups = append(groups, backendGroup{})
+		}
+		return &groups[len(groups)-1]
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := scanner.Text()
+		s := strings.TrimSpace(text)
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " \t"))
+		if inList {
+			item := strings.TrimPrefix(s, "- ")
+			isScalar := !strings.Contains(item, ": ") && !strings.HasSuffix(item, ":")
+			if item != s && isScalar && indent >= listIndent {
+				g := group()
+				g.servers = append(g.servers, unquoteYAML(item))
+				continue
+			}
+			inList = false
+		}
+		s = strings.TrimPrefix(s, "- ")
+		colon := strings.Index(s, ":")
+		if colon < 0 {
+			continue
+		}
+		key, val := strings.TrimSpace(s[:colon]), unquoteYAML(s[colon+1:])
+		switch key {
+		case "groupName":
+			groups = append(groups, backendGroup{name: val})
+		case "lbMethod":
+			group().lbMethod = val
+		case "backends", "servers":
+			if val == "" {
+				inList, listIndent = true, indent
+			}
+		}
+	}
+	return groups, scanner.Err()
+}
+
+func unquoteYAML(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
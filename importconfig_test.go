@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportRelayRules(t *testing.T) {
+	tests := []struct {
+		name, conf string
+		webPort    int
+		want       string // JSON of the mappings
+		errs       []string
+	}{
+		{
+			name: "replicas",
+			conf: `
+# relay-rules.conf
+[prod]
+pattern = ^prod\.
+destinations = 10.1.0.1:2004:a, 10.1.0.1:2104:b, 10.1.0.2:2004:a
+
+[stage]
+pattern = ^(stage|qa)\..*
+destinations = 10.2.0.1:2004
+`,
+			webPort: 80,
+			want: `{
+				"prod": {"urls": ["http://10.1.0.1/", "http://10.1.0.2/"], "stripPrefix": false},
+				"qa": {"url": "http://10.2.0.1/", "stripPrefix": false},
+				"stage": {"url": "http://10.2.0.1/", "stripPrefix": false}
+			}`,
+		},
+		{
+			name: "default and regexp rules",
+			conf: `
+[collectd]
+pattern = ^collectd\.[a-z]+\.cpu
+destinations = 10.3.0.1:2004
+
+[prod]
+pattern = ^prod\.
+destinations = [2001:db8::1]:2004
+
+[default]
+default = true
+destinations = 10.9.0.1:2004:a
+`,
+			webPort: 8080,
+			want:    `{"prod": {"url": "http://[2001:db8::1]:8080/", "stripPrefix": false}}`,
+			errs:    []string{"[collectd]: pattern", "[default]: the default rule"},
+		},
+		{
+			name: "continue",
+			conf: `
+[mirror]
+pattern = ^prod\.
+destinations = 10.1.0.1:2004
+continue = true
+
+[prod]
+pattern = ^prod\.
+destinations = 10.1.0.2:2004
+
+[shadowed]
+pattern = ^prod\.
+destinations = 10.1.0.3:2004
+`,
+			webPort: 80,
+			want:    `{"prod": {"urls": ["http://10.1.0.1/", "http://10.1.0.2/"], "stripPrefix": false}}`,
+		},
+		{
+			name:    "syntax",
+			conf:    "pattern = ^prod\\.\n",
+			webPort: 80,
+			want:    `null`,
+			errs:    []string{"line 1: syntax error"},
+		},
+	}
+	for _, tt := range tests {
+		m, errs := importRelayRules(strings.NewReader(tt.conf), tt.webPort)
+		checkImport(t, tt.name, m, errs, tt.want, tt.errs)
+	}
+}
+
+func TestImportCarbonapi(t *testing.T) {
+	tests := []struct {
+		name, conf string
+		prefixes   []string
+		want       string
+		errs       []string
+	}{
+		{
+			name: "backendsv2 replicas",
+			conf: `
+listen: "localhost:8081"
+upstreams:
+  backendsv2:
+    backends:
+      - groupName: "go-carbon"
+        protocol: "carbonapi_v3_pb"
+        lbMethod: "rr"
+        maxTries: 3
+        servers:
+          - "http://go-carbon-1:8080"
+          - "http://go-carbon-2:8080"
+`,
+			prefixes: []string{"prod", "stage"},
+			want: `{
+				"prod": {"urls": ["http://go-carbon-1:8080", "http://go-carbon-2:8080"], "stripPrefix": false},
+				"stage": {"urls": ["http://go-carbon-1:8080", "http://go-carbon-2:8080"], "stripPrefix": false}
+			}`,
+		},
+		{
+			name: "old backends list",
+			conf: `
+concurency: 20
+backends:
+  - "http://graphite1:8080" # the only one
+`,
+			prefixes: []string{"servers"},
+			want:     `{"servers": {"url": "http://graphite1:8080", "stripPrefix": false}}`,
+		},
+		{
+			name: "broadcast",
+			conf: `
+backends:
+  - "http://graphite1:8080"
+  - "http://graphite2:8080"
+`,
+			prefixes: []string{"servers"},
+			want:     `null`,
+			errs:     []string{"merges the responses of the servers"},
+		},
+		{
+			name: "groups",
+			conf: `
+upstreams:
+  backendsv2:
+    backends:
+      - groupName: "new"
+        lbMethod: "any"
+        servers:
+          - "http://new:8080"
+      - groupName: "old"
+        servers:
+          - "http://old:8080"
+`,
+			want: `null`,
+			errs: []string{`groups "new", "old"`, "-prefixes"},
+		},
+		{
+			name:     "no backends",
+			conf:     "listen: \":8081\"\n",
+			prefixes: []string{"prod"},
+			want:     `null`,
+			errs:     []string{"no backends"},
+		},
+	}
+	for _, tt := range tests {
+		m, errs := importCarbonapi(strings.NewReader(tt.conf), tt.prefixes)
+		checkImport(t, tt.name, m, errs, tt.want, tt.errs)
+	}
+}
+
+func checkImport(t *testing.T, name string, m interface{}, errs []error, want string, wantErrs []string) {
+	t.Helper()
+	got, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b interface{}
+	json.Unmarshal(got, &a)
+	if err := json.Unmarshal([]byte(want), &b); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%s: got mappings %s, expected %s", name, got, want)
+	}
+	if len(errs) != len(wantErrs) {
+		t.Errorf("%s: got errors %v, expected %d", name, errs, len(wantErrs))
+		return
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), wantErrs[i]) {
+			t.Errorf("%s: got error %q, expected one containing %q", name, err, wantErrs[i])
+		}
+	}
+}
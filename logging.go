@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/droyo/metaphite/accesslog"
+	"github.com/droyo/metaphite/config"
+)
+
+var (
+	logLevel = new(slog.LevelVar)
+	logJSON  bool
+)
+
+// An accessLog is where, and how, requests are logged.
+type accessLog struct {
+	dest accesslog.Logger
+	opts accesslog.Options
+}
+
+// wrap logs the requests to h, which is registered with the
+// given ServeMux pattern.
+func (a accessLog) wrap(pattern string, h http.Handler) http.Handler {
+	opts := a.opts
+	opts.Route = pattern
+	return accesslog.New(h, a.dest, opts)
+}
+
+// setupLogging configures the default logger for the given
+// format, which the config has validated. In the "json" format,
+// log messages, including those written with the log package,
+// are written to standard error as JSON objects, and so are
+// access log entries, unless accessFormat is "common". If
+// accessFormat is "json", access log entries are JSON objects
+// whatever the format of log messages. Access log entries are
+// written regardless of the log level, to the destination in
+// cfg, and may be sampled.
+func setupLogging(format, accessFormat string, cfg *config.Config) (accessLog, error) {
+	if accessFormat == "" && format == "json" {
+		accessFormat = "json"
+	}
+	if format == "json" {
+		logJSON = true
+		opts := &slog.HandlerOptions{Level: logLevel}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	}
+	access := accessLog{opts: accesslog.Options{
+		Format:         accessFormat,
+		Sample:         cfg.AccessLogSample,
+		SlowRequest:    cfg.AccessLogSlowRequest.Duration,
+		TrustedProxies: cfg.TrustedNets(),
+		LogPort:        cfg.AccessLogPort,
+	}}
+	var err error
+	switch cfg.AccessLog {
+	case "", "stderr":
+		// not the log package, which may be redirected to slog
+		access.dest = log.New(os.Stderr, "", 0)
+	case "syslog":
+		access.dest, err = syslogLogger()
+	default:
+		access.dest, err = accesslog.OpenFile(cfg.AccessLog,
+			int64(cfg.AccessLogMaxSize)<<20, cfg.AccessLogMaxAge.Duration)
+	}
+	return access, err
+}
+
+// setLogLevel sets the least severe level of the log messages
+// that are written. The level has been validated; if it is
+// empty, the level is "info".
+func setLogLevel(level string) {
+	var l slog.Level
+	if level != "" {
+		l.UnmarshalText([]byte(level))
+	}
+	logLevel.Set(l)
+	if !logJSON {
+		// messages go through the log package
+		slog.SetLogLoggerLevel(l)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	defer setLogLevel("")
+	ctx := context.Background()
+	tests := []struct {
+		level    string
+		enabled  slog.Level
+		disabled slog.Level
+	}{
+		{"debug", slog.LevelDebug, slog.LevelDebug - 1},
+		{"", slog.LevelInfo, slog.LevelDebug},
+		{"info", slog.LevelInfo, slog.LevelDebug},
+		{"warn", slog.LevelWarn, slog.LevelInfo},
+		{"error", slog.LevelError, slog.LevelWarn},
+	}
+	for _, tt := range tests {
+		setLogLevel(tt.level)
+		log := slog.Default()
+		if !log.Enabled(ctx, tt.enabled) || log.Enabled(ctx, tt.disabled) {
+			t.Errorf("level %q: %s enabled %v, %s enabled %v", tt.level,
+				tt.enabled, log.Enabled(ctx, tt.enabled), tt.disabled, log.Enabled(ctx, tt.disabled))
+		}
+		if logLevel.Level() != tt.enabled {
+			t.Errorf("level %q: JSON handler level is %s, expected %s", tt.level, logLevel.Level(), tt.enabled)
+		}
+	}
+}
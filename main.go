@@ -1,42 +1,148 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/droyo/metaphite/accesslog"
 	"github.com/droyo/metaphite/config"
+	"github.com/droyo/metaphite/version"
 )
 
 var (
 	addr = flag.String("http", "", "address to listen on")
 	file = flag.String("c", "", "configuration file")
+	vers = flag.Bool("version", false, "print the version and exit")
+	logf = flag.String("log-format", "", "log format, text or json; overrides the config")
+	accf = flag.String("access-log-format", "", "access log format, common or json; overrides the config")
+	logl = flag.String("log-level", "", "least severe messages to log: debug, info, warn or error; overrides the config")
 )
 
 func main() {
 	log.SetFlags(0)
+	if len(os.Args) > 1 && os.Args[1] == "import-config" {
+		importConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		checkConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "route" {
+		routeTargets(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPassword(os.Args[2:])
+		return
+	}
 	flag.Parse()
+	if *vers {
+		fmt.Println(version.Get())
+		return
+	}
 	if *file == "" {
 		log.Print("config file (-c) is required")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	if cfg, err := config.ParseFile(*file); err != nil {
+	if *logf != "" && *logf != "text" && *logf != "json" {
+		log.Fatalf("invalid -log-format %q", *logf)
+	}
+	if *accf != "" && *accf != "common" && *accf != "json" {
+		log.Fatalf("invalid -access-log-format %q", *accf)
+	}
+	switch *logl {
+	case "", "debug", "info", "warn", "error":
+	default:
+		log.Fatalf("invalid -log-level %q", *logl)
+	}
+	cfg, err := config.NewReloader(*file)
+	if err != nil {
 		log.Fatalf("parse %s failed: %s", *file, err)
-	} else {
-		http.Handle("/render", accesslog.Handler(cfg, nil))
+	}
+	if *logf == "" {
+		*logf = cfg.Config().LogFormat
+	}
+	if *accf == "" {
+		*accf = cfg.Config().AccessLogFormat
+	}
+	access, err := setupLogging(*logf, *accf, cfg.Config())
+	if err != nil {
+		log.Fatalf("access log: %v", err)
+	}
+	applyLogLevel(cfg.Config())
+	warn(cfg.Config())
+	go reload(cfg)
+	if c := cfg.Config().Carbon; c.Address != "" {
+		go pushMetrics(c)
+	}
+	if r := cfg.Config().Relay; r.Address != "" || r.PickleAddress != "" {
+		go runRelay(cfg)
+	}
+	if len(cfg.Config().Etcd.Endpoints) > 0 {
+		go cfg.WatchEtcd(context.Background())
+	}
+
+	listeners := cfg.Config().Listeners
+	if len(listeners) == 0 || *addr != "" {
 		if *addr == "" {
-			*addr = cfg.Address
+			*addr = cfg.Config().Address
 		}
+		listeners = []config.Listener{{
+			Address:    *addr,
+			SocketMode: cfg.Config().SocketMode,
+			TLS:        cfg.ServerTLSConfig() != nil,
+		}}
+	}
+	if a := cfg.Config().DebugAddress; a != "" {
+		listeners = append(listeners, config.Listener{
+			Address: a,
+			Serve:   []string{config.EndpointDebug},
+		})
+	}
+	err = serve(cfg, listeners, access)
+	if err := cfg.Config().CloseAudit(); err != nil {
+		slog.Warn("close audit log", "err", err)
 	}
-	status := make(chan error)
-	go func() {
-		status <- http.ListenAndServe(*addr, nil)
-	}()
-	log.Printf("listening on %s", *addr)
-	if err := <-status; err != nil {
+	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// reload reloads the config file each time the process
+// receives a SIGHUP.
+func reload(cfg *config.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := cfg.Reload(); err != nil {
+			slog.Error("reload failed", "file", *file, "err", err)
+		} else {
+			slog.Info("reloaded", "file", *file)
+			applyLogLevel(cfg.Config())
+			warn(cfg.Config())
+		}
+	}
+}
+
+func warn(cfg *config.Config) {
+	for _, w := range cfg.Warnings() {
+		slog.Warn(w, "file", *file)
+	}
+}
+
+// applyLogLevel sets the log level from the -log-level flag, or
+// else the config.
+func applyLogLevel(cfg *config.Config) {
+	if *logl != "" {
+		setLogLevel(*logl)
+	} else {
+		setLogLevel(cfg.LogLevel)
+	}
+}
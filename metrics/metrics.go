@@ -0,0 +1,417 @@
+// Package metrics collects counters and histograms about a running
+// program, and exposes them in the Prometheus text format, or
+// writes them in the graphite plaintext protocol.
+//
+// Metrics are created with the New* functions, which register
+// them with the Default registry. Each metric may have zero or
+// more labels; values for all labels must be provided, in order,
+// when updating a metric.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets used when none are
+// given. They are suitable for latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type metric interface {
+	describe() (name, help, typ string)
+	write(w io.Writer)
+	writeGraphite(w io.Writer, prefix string, ts int64)
+}
+
+// A Registry is a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// Default is the registry used by the New* functions.
+var Default = NewRegistry()
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(m metric) {
+	name, _, _ := m.describe()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.metrics[name] = m
+}
+
+// WriteTo writes all metrics in r to w in the Prometheus text
+// exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for k := range r.metrics {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	list := make([]metric, 0, len(names))
+	for _, k := range names {
+		list = append(list, r.metrics[k])
+	}
+	r.mu.Unlock()
+
+	cw := countWriter{w: bufio.NewWriter(w)}
+	for _, m := range list {
+		name, help, typ := m.describe()
+		fmt.Fprintf(&cw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(&cw, "# TYPE %s %s\n", name, typ)
+		m.write(&cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// WriteGraphite writes all metrics in r to w in the graphite
+// plaintext protocol, with the timestamp t. Each series is named
+// by prefix, the metric's name, and its label values, in order,
+// separated by dots:
+//
+// 	metaphite.metaphite_http_requests_total._render.200 1543 1700000000
+//
+// Histograms are written as their count and sum, with ".count"
+// and ".sum" appended to their names. Characters other than
+// letters, digits, '-' and '_' in label values are replaced
+// with '_'.
+func (r *Registry) WriteGraphite(w io.Writer, prefix string, t time.Time) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for k := range r.metrics {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	list := make([]metric, 0, len(names))
+	for _, k := range names {
+		list = append(list, r.metrics[k])
+	}
+	r.mu.Unlock()
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	cw := countWriter{w: bufio.NewWriter(w)}
+	for _, m := range list {
+		m.writeGraphite(&cw, prefix, t.Unix())
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP writes the contents of the registry.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// Handler returns an http.Handler that serves the Default registry.
+func Handler() http.Handler { return Default }
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// series holds the label names common to all values of a metric,
+// and the label values of each series within it.
+type series struct {
+	name, help string
+	labels     []string
+}
+
+func (s *series) describe(typ string) (string, string, string) {
+	return s.name, s.help, typ
+}
+
+// key returns the key of the series with the given label values,
+// which identifies it among the others of the metric. Each value
+// is preceded by its length, so that no value can be mistaken
+// for several.
+func (s *series) key(values []string) string {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d",
+			s.name, len(s.labels), len(values)))
+	}
+	var b strings.Builder
+	for _, v := range values {
+		b.WriteString(strconv.Itoa(len(v)))
+		b.WriteByte(':')
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// format produces the label set for the series with the given
+// label values, plus any extra name/value pairs.
+func (s *series) format(values []string, extra ...string) string {
+	if len(s.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, v := range values {
+		pairs = append(pairs, s.labels[i]+`="`+escapeLabel(v)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// path produces the graphite name of the series with the given
+// label values, after prefix.
+func (s *series) path(prefix string, values []string, suffix ...string) string {
+	parts := []string{prefix + s.name}
+	for _, v := range values {
+		parts = append(parts, graphiteNode(v))
+	}
+	return strings.Join(append(parts, suffix...), ".")
+}
+
+func graphiteNode(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// sortKeys sorts the keys of a metric's series by their label
+// values.
+func sortKeys(keys []string, labels func(key string) []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := labels(keys[i]), labels(keys[j])
+		for n := range a {
+			if a[n] != b[n] {
+				return a[n] < b[n]
+			}
+		}
+		return false
+	})
+}
+
+// A Counter is a value that only increases, such as a number of
+// requests.
+type Counter struct {
+	series
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+// NewCounter creates a Counter and registers it with the Default
+// registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		series: series{name: name, help: help, labels: labels},
+		values: make(map[string]*counterValue),
+	}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+// Add increments the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64, labels ...string) {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: append([]string(nil), labels...)}
+		c.values[key] = v
+	}
+	v.v += delta
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value(labels ...string) float64 {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.values[key]; ok {
+		return v.v
+	}
+	return 0
+}
+
+func (c *Counter) describe() (string, string, string) { return c.series.describe("counter") }
+
+func (c *Counter) sortedKeys() []string {
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sortKeys(keys, func(k string) []string { return c.values[k].labels })
+	return keys
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range c.sortedKeys() {
+		v := c.values[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(v.labels), formatFloat(v.v))
+	}
+}
+
+func (c *Counter) writeGraphite(w io.Writer, prefix string, ts int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range c.sortedKeys() {
+		v := c.values[k]
+		fmt.Fprintf(w, "%s %s %d\n", c.path(prefix, v.labels), formatFloat(v.v), ts)
+	}
+}
+
+// A Histogram counts observations, such as request durations,
+// in configurable buckets.
+type Histogram struct {
+	series
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histValue
+}
+
+type histValue struct {
+	labels []string
+	counts []uint64 // one per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a Histogram with the given upper bucket
+// bounds, which must be sorted, and registers it with the Default
+// registry. If buckets is nil, DefaultBuckets is used.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{
+		series:  series{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histValue),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(x float64, labels ...string) {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histValue{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	if i := sort.SearchFloat64s(h.buckets, x); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.count++
+	v.sum += x
+}
+
+func (h *Histogram) describe() (string, string, string) { return h.series.describe("histogram") }
+
+func (h *Histogram) sortedKeys() []string {
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sortKeys(keys, func(k string) []string { return h.values[k].labels })
+	return keys
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range h.sortedKeys() {
+		v := h.values[k]
+		var total uint64
+		for i, le := range h.buckets {
+			total += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(v.labels, "le", formatFloat(le)), total)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(v.labels, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(v.labels), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(v.labels), v.count)
+	}
+}
+
+func (h *Histogram) writeGraphite(w io.Writer, prefix string, ts int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range h.sortedKeys() {
+		v := h.values[k]
+		fmt.Fprintf(w, "%s %d %d\n", h.path(prefix, v.labels, "count"), v.count, ts)
+		fmt.Fprintf(w, "%s %s %d\n", h.path(prefix, v.labels, "sum"), formatFloat(v.sum), ts)
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+// escapeLabel escapes a label value for the text format, which
+// must be valid UTF-8. Invalid bytes are replaced with U+FFFD.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(strings.ToValidUTF8(s, "\uFFFD"))
+}
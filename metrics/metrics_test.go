@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExposition(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests\nserved.", "code")
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc(`5"0"0`)
+
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	if _, err := Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`# HELP test_requests_total Requests\nserved.`,
+		`# TYPE test_requests_total counter`,
+		`test_requests_total{code="200"} 3`,
+		`test_requests_total{code="5\"0\"0"} 1`,
+		`# TYPE test_duration_seconds histogram`,
+		`test_duration_seconds_bucket{le="0.1"} 1`,
+		`test_duration_seconds_bucket{le="1"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 3`,
+		`test_duration_seconds_sum 3.55`,
+		`test_duration_seconds_count 3`,
+	}
+	out := buf.String()
+	for _, line := range want {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output missing %q", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("output:\n%s", out)
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	r := NewRegistry()
+	c := &Counter{series: series{name: "hits_total", labels: []string{"path", "code"}}, values: make(map[string]*counterValue)}
+	r.register(c)
+	c.Add(4, "/render", "200")
+	h := &Histogram{series: series{name: "latency_seconds"}, buckets: DefaultBuckets, values: make(map[string]*histValue)}
+	r.register(h)
+	h.Observe(0.25)
+	h.Observe(0.5)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteGraphite(&buf, "metaphite", time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	want := "metaphite.hits_total._render.200 4 1700000000\n" +
+		"metaphite.latency_seconds.count 2 1700000000\n" +
+		"metaphite.latency_seconds.sum 0.75 1700000000\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	r := NewRegistry()
+	c := &Counter{series: series{name: "hits_total", labels: []string{"path", "code"}}, values: make(map[string]*counterValue)}
+	r.register(c)
+	c.Inc("/admin/\xff", "200")
+	c.Inc("a\xffb", "c")
+	c.Inc("a", "b\xffc")
+	c.Inc("line\nbreak", `quo"te\`)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "# HELP hits_total \n# TYPE hits_total counter\n" +
+		`hits_total{path="/admin/\uFFFD",code="200"} 1` + "\n" +
+		`hits_total{path="a",code="b\uFFFDc"} 1` + "\n" +
+		`hits_total{path="a\uFFFDb",code="c"} 1` + "\n" +
+		`hits_total{path="line\nbreak",code="quo\"te\\"} 1` + "\n"
+	want = strings.Replace(want, `\uFFFD`, "\uFFFD", -1)
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
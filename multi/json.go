@@ -0,0 +1,47 @@
+package multi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// DecodeArray decodes the JSON array in the body of rsp, one
+// element at a time, and calls fn with each, so that the array is
+// never held in memory whole. It closes the body. It returns an
+// error if the request failed, the status is not 200 OK, the body
+// is not an array, or fn returns one. A null body is an empty
+// array.
+func DecodeArray(rsp Response, fn func(json.RawMessage) error) error {
+	if rsp.Err != nil {
+		return rsp.Err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("%s: %.200s", rsp.Status, body)
+	}
+	dec := json.NewDecoder(rsp.Body)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("expected a JSON array, found %v", tok)
+	}
+	for dec.More() {
+		var elem json.RawMessage
+		if err := dec.Decode(&elem); err != nil {
+			return err
+		}
+		if err := fn(elem); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
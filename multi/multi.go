@@ -0,0 +1,394 @@
+// Package multi sends copies of an HTTP request to several
+// servers at once.
+package multi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A Target is a server that receives a copy of a request.
+type Target struct {
+	// The scheme and host of the server, and optionally a
+	// path that is prepended to the request path.
+	URL *url.URL
+	// If not nil, Query replaces the query string of
+	// the request.
+	Query url.Values
+	// If not nil, the request is sent with Client, instead of
+	// the client passed to ProxyContext, so that targets may
+	// have their own TLS settings, timeouts or proxies.
+	Client *http.Client
+	// If not nil, GetBody returns the body of the target's
+	// request, instead of a copy of the original request's.
+	GetBody func() (io.ReadCloser, error)
+}
+
+// CopyRequest creates a copy of r to be sent to t. The copy
+// has the given body, which may be nil.
+func (t Target) CopyRequest(r *http.Request, body []byte) *http.Request {
+	cp := t.copyRequest(r)
+	if body != nil {
+		cp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		cp.ContentLength = int64(len(body))
+	}
+	return cp
+}
+
+// copyRequest creates a copy of r, without a body, to be sent
+// to t.
+func (t Target) copyRequest(r *http.Request) *http.Request {
+	cp := r.WithContext(r.Context())
+	u := *r.URL
+	cp.URL = &u
+	cp.URL.Scheme = t.URL.Scheme
+	cp.URL.Host = t.URL.Host
+	cp.URL.Path = joinPath(t.URL.Path, r.URL.Path)
+	cp.URL.RawPath = ""
+	if t.Query != nil {
+		cp.URL.RawQuery = t.Query.Encode()
+	}
+	cp.Host = t.URL.Host
+	cp.RequestURI = ""
+	cp.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		cp.Header[k] = append([]string(nil), v...)
+	}
+	cp.Body, cp.GetBody, cp.ContentLength = nil, nil, 0
+	return cp
+}
+
+func joinPath(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// A Response is the result of sending a request to a Target.
+// If the request failed, such as when the target could not be
+// reached, Err is the error, and there is no http.Response; the
+// Response is delivered all the same, so that a target that is
+// down can be told apart from one that has no data. If Err is
+// nil, the caller must close the response body.
+type Response struct {
+	Target Target
+	*http.Response
+	Err error
+}
+
+// A MergeStrategy decides which of the responses to a request
+// sent to several targets are delivered, and when the requests
+// still waiting for a response are given up on. A response is
+// successful if the request did not fail, and its status is
+// below 500.
+type MergeStrategy struct {
+	quorum int // 0 is every target
+}
+
+var (
+	// WaitAll delivers every response as it arrives. It is the
+	// default.
+	WaitAll = MergeStrategy{}
+	// FirstSuccess delivers only the first successful response,
+	// for targets that are identical replicas.
+	FirstSuccess = Quorum(1)
+)
+
+// Quorum holds the responses back until n of them are successful,
+// and then delivers those n, for callers that merge them. If so
+// many fail that n cannot succeed, the failures are delivered
+// instead. Either way, the remaining requests are canceled, and
+// their responses discarded. n is at most the number of targets.
+func Quorum(n int) MergeStrategy {
+	if n < 1 {
+		n = 1
+	}
+	return MergeStrategy{quorum: n}
+}
+
+// DefaultMaxBody is the default for Options.MaxBody.
+const DefaultMaxBody = 10 << 20
+
+// ErrBodyTooLarge is the error of the responses to a request whose
+// body is larger than Options.MaxBody, and must be buffered.
+var ErrBodyTooLarge = errors.New("multi: request body too large")
+
+// Options change how a request is sent to several targets.
+type Options struct {
+	Strategy MergeStrategy
+	// Limit on the size of a request body that is read into
+	// memory to be sent to several targets. Bodies are not read
+	// into memory if the request has a GetBody function, or
+	// there is only one target. Zero is DefaultMaxBody.
+	MaxBody int64
+	// If above zero, the most requests that are waiting for a
+	// response at once. The others are sent, in the order of
+	// the targets, as responses arrive.
+	MaxConcurrent int
+	// If true, the responses are delivered in the order of the
+	// targets, instead of as they arrive, so that callers merge
+	// them in the same order every time.
+	Ordered bool
+}
+
+// Proxy sends a copy of r to each target using client, as
+// ProxyContext does with r's context.
+//
+// Deprecated: a caller that stops reading the channel early
+// cannot cancel the requests unless it cancels r's context; use
+// ProxyContext.
+func Proxy(client *http.Client, r *http.Request, targets []Target) <-chan Response {
+	return ProxyContext(r.Context(), client, r, targets)
+}
+
+// ProxyContext sends a copy of r to each target using client, or
+// the target's own Client, and delivers each response, as it
+// arrives, on the returned channel. The channel is closed once
+// every target has responded. If client is nil, it is
+// http.DefaultClient. The requests are made with ctx instead of
+// r's context, and are cancelled when it is done; a caller that
+// stops reading the channel should cancel ctx.
+func ProxyContext(ctx context.Context, client *http.Client, r *http.Request, targets []Target) <-chan Response {
+	return ProxyOptions(ctx, client, r, targets, Options{})
+}
+
+// ProxyOptions sends a copy of r to each target using client, as
+// ProxyContext does, and delivers the responses chosen by the
+// options' Strategy. The channel is closed once they have been
+// delivered.
+func ProxyOptions(parent context.Context, client *http.Client, r *http.Request, targets []Target, opts Options) <-chan Response {
+	ch := make(chan Response, len(targets))
+	var shared int // targets that are sent r's body
+	for _, t := range targets {
+		if t.GetBody == nil {
+			shared++
+		}
+	}
+	maxBody := opts.MaxBody
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBody
+	}
+	body, err := bodyOf(r, shared, maxBody)
+	if err != nil {
+		for _, t := range targets {
+			ch <- Response{Target: t, Err: err}
+		}
+		close(ch)
+		return ch
+	}
+	// each request has its own context, so that the slower ones
+	// can be canceled
+	results := make(chan result, len(targets))
+	cancels := make([]context.CancelFunc, len(targets))
+	ctxs := make([]context.Context, len(targets))
+	for i := range targets {
+		ctxs[i], cancels[i] = context.WithCancel(parent)
+	}
+	send := func(i int, t Target, sem chan struct{}) {
+		ctx, cancel := ctxs[i], cancels[i]
+		c := client
+		if t.Client != nil {
+			c = t.Client
+		} else if c == nil {
+			c = http.DefaultClient
+		}
+		cp := t.copyRequest(r.WithContext(ctx))
+		var rsp *http.Response
+		err := body.set(cp, t.GetBody)
+		if err == nil {
+			rsp, err = c.Do(cp)
+		}
+		if sem != nil {
+			<-sem
+		}
+		if err == nil {
+			rsp.Body = cancelBody{rsp.Body, cancel}
+		} else {
+			cancel()
+		}
+		results <- result{i, Response{Target: t, Response: rsp, Err: err}}
+	}
+	if opts.MaxConcurrent > 0 {
+		go func() {
+			sem := make(chan struct{}, opts.MaxConcurrent)
+			for i, t := range targets {
+				select {
+				case sem <- struct{}{}:
+					go send(i, t, sem)
+				case <-ctxs[i].Done():
+					results <- result{i, Response{Target: t, Err: ctxs[i].Err()}}
+				}
+			}
+		}()
+	} else {
+		for i, t := range targets {
+			go send(i, t, nil)
+		}
+	}
+	go opts.Strategy.deliver(ch, results, cancels, opts.Ordered)
+	return ch
+}
+
+// A result is the response for the i'th target.
+type result struct {
+	i int
+	Response
+}
+
+func (rsp Response) succeeded() bool {
+	return rsp.Err == nil && rsp.StatusCode < 500
+}
+
+func (rsp Response) discard() {
+	if rsp.Err == nil {
+		rsp.Body.Close()
+	}
+}
+
+// deliver sends the responses in results, one for each of
+// cancels, to ch, as s decides, and closes ch. If ordered, they
+// are sent in the order of the targets.
+func (s MergeStrategy) deliver(ch chan<- Response, results <-chan result, cancels []context.CancelFunc, ordered bool) {
+	if s.quorum == 0 {
+		arrived := make([]*Response, len(cancels))
+		next := 0
+		for range cancels {
+			res := <-results
+			if !ordered {
+				ch <- res.Response
+				continue
+			}
+			arrived[res.i] = &res.Response
+			for ; next < len(arrived) && arrived[next] != nil; next++ {
+				ch <- *arrived[next]
+			}
+		}
+		close(ch)
+		return
+	}
+	n := s.quorum
+	if n > len(cancels) {
+		n = len(cancels)
+	}
+	var held, failed []result
+	done := false
+	for range cancels {
+		res := <-results
+		switch {
+		case done:
+			res.discard()
+			continue
+		case res.succeeded():
+			held = append(held, res)
+		default:
+			failed = append(failed, res)
+		}
+		deliver := held
+		if len(held) == n {
+			for _, f := range failed {
+				f.discard()
+			}
+		} else if len(failed) > len(cancels)-n {
+			for _, h := range held {
+				h.discard()
+			}
+			deliver = failed
+		} else {
+			continue
+		}
+		if ordered {
+			sort.Slice(deliver, func(i, j int) bool { return deliver[i].i < deliver[j].i })
+		}
+		delivered := make(map[int]bool)
+		for _, res := range deliver {
+			delivered[res.i] = true
+			ch <- res.Response
+		}
+		close(ch)
+		for i, cancel := range cancels {
+			if !delivered[i] {
+				cancel()
+			}
+		}
+		done = true
+	}
+	if !done {
+		close(ch)
+	}
+}
+
+// A cancelBody releases the context of a request when the body
+// of its response is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// A body is the body of the request sent to the targets.
+type body struct {
+	get      func() (io.ReadCloser, error) // nil if there is none
+	length   int64
+	reusable bool // get may be called more than once
+}
+
+// bodyOf returns the body of r, to be sent to n targets. It is
+// read into memory, up to max bytes, only if it must be.
+func bodyOf(r *http.Request, n int, max int64) (body, error) {
+	switch {
+	case n == 0 || r.Body == nil || r.Body == http.NoBody:
+		return body{}, nil
+	case r.GetBody != nil:
+		return body{r.GetBody, r.ContentLength, true}, nil
+	case n == 1:
+		rc := r.Body
+		return body{func() (io.ReadCloser, error) { return rc, nil }, r.ContentLength, false}, nil
+	}
+	defer r.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return body{}, err
+	}
+	if int64(len(buf)) > max {
+		return body{}, ErrBodyTooLarge
+	}
+	get := func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(buf)), nil }
+	return body{get, int64(len(buf)), true}, nil
+}
+
+// set sets the body of the request r, from get if it is not nil.
+func (b body) set(r *http.Request, get func() (io.ReadCloser, error)) error {
+	length, reusable := b.length, b.reusable
+	if get != nil {
+		length, reusable = 0, true
+	} else if get = b.get; get == nil {
+		return nil
+	}
+	rc, err := get()
+	if err != nil {
+		return err
+	}
+	r.Body, r.ContentLength = rc, length
+	if reusable {
+		r.GetBody = get
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package multi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// servers starts a server for each of the given handlers, and
+// returns them as targets.
+func servers(t *testing.T, handlers ...http.HandlerFunc) []Target {
+	var targets []Target
+	for _, h := range handlers {
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		u, _ := url.Parse(srv.URL)
+		targets = append(targets, Target{URL: u})
+	}
+	return targets
+}
+
+func reply(body string, status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+// slow answers after a while, unless the request is canceled,
+// which it reports on canceled.
+func slow(canceled chan<- bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	}
+}
+
+// collect reads the responses on ch, as "status body", or "error".
+func collect(t *testing.T, ch <-chan Response) []string {
+	var got []string
+	for rsp := range ch {
+		if rsp.Err != nil {
+			got = append(got, "error")
+			continue
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		got = append(got, rsp.Status[:3]+" "+string(body))
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestStrategies(t *testing.T) {
+	canceled := make(chan bool, 10)
+	down := Target{URL: &url.URL{Scheme: "http", Host: "127.0.0.1:1"}}
+	tests := []struct {
+		name     string
+		strategy MergeStrategy
+		targets  []Target
+		want     []string
+		canceled int
+	}{
+		{"all", WaitAll,
+			append(servers(t, reply("a", 200), reply("b", 500)), down),
+			[]string{"200 a", "500 b", "error"}, 0},
+		{"first success", FirstSuccess,
+			append(servers(t, reply("b", 500), slow(canceled), reply("a", 200)), down),
+			[]string{"200 a"}, 1},
+		{"quorum", Quorum(2),
+			servers(t, reply("a", 200), reply("b", 503), slow(canceled), reply("c", 200)),
+			[]string{"200 a", "200 c"}, 1},
+		{"no quorum", Quorum(2),
+			append(servers(t, reply("a", 200), reply("b", 502)), down),
+			[]string{"502 b", "error"}, 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/render", nil)
+		start := time.Now()
+		got := collect(t, ProxyOptions(req.Context(), http.DefaultClient, req, tt.targets, Options{Strategy: tt.strategy}))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.want)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: waited %s for a slow target", tt.name, d)
+		}
+		for i := 0; i < tt.canceled; i++ {
+			select {
+			case <-canceled:
+			case <-time.After(time.Second):
+				t.Errorf("%s: request to a slow target was not canceled", tt.name)
+			}
+		}
+	}
+}
+
+func TestProxyContext(t *testing.T) {
+	canceled := make(chan bool, 1)
+	targets := servers(t, slow(canceled), reply("a", 200))
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ProxyContext(ctx, http.DefaultClient, httptest.NewRequest("GET", "/render", nil), targets)
+	rsp := <-ch
+	if rsp.Err != nil || rsp.StatusCode != 200 {
+		t.Fatalf("first response: %v", rsp.Err)
+	}
+	rsp.Body.Close()
+	// the caller stops reading
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("request to a slow target was not canceled")
+	}
+	if rsp := <-ch; rsp.Err == nil {
+		t.Error("canceled request did not fail")
+	}
+}
+
+// A headerTransport adds a header to each request.
+type headerTransport struct {
+	key, value string
+}
+
+func (t headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(t.key, t.value)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestTargetClient(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client")))
+	}
+	targets := servers(t, echo, echo)
+	targets[1].Client = &http.Client{Transport: headerTransport{"X-Client", "own"}}
+	shared := &http.Client{Transport: headerTransport{"X-Client", "shared"}}
+	got := collect(t, ProxyContext(context.Background(), shared, httptest.NewRequest("GET", "/", nil), targets))
+	if want := []string{"200 own", "200 shared"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+}
+
+func TestBody(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}
+	post := func(body string, getBody bool) *http.Request {
+		r := httptest.NewRequest("POST", "/render", strings.NewReader(body))
+		if getBody {
+			r.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(body)), nil
+			}
+			// the body is not read
+			r.Body = ioutil.NopCloser(iotest.ErrReader(errors.New("read the body")))
+		}
+		return r
+	}
+	own := servers(t, echo, echo)
+	own[1].GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("own")), nil
+	}
+	tests := []struct {
+		name    string
+		r       *http.Request
+		targets []Target
+		max     int64
+		want    []string
+	}{
+		{"buffered", post("target=a", false), servers(t, echo, echo), 0,
+			[]string{"200 target=a", "200 target=a"}},
+		{"GetBody", post("target=a", true), servers(t, echo, echo), 1,
+			[]string{"200 target=a", "200 target=a"}},
+		{"one target", post("target=a", false), servers(t, echo), 1,
+			[]string{"200 target=a"}},
+		{"target body", post("target=a", false), own, 0,
+			[]string{"200 own", "200 target=a"}},
+		{"too large", post("target=a", false), servers(t, echo, echo), 4,
+			[]string{"error", "error"}},
+	}
+	for _, tt := range tests {
+		ch := ProxyOptions(context.Background(), http.DefaultClient, tt.r, tt.targets, Options{MaxBody: tt.max})
+		if got := collect(t, ch); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, most int
+	busy := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if inFlight++; inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Write([]byte("a"))
+	}
+	targets := servers(t, busy, busy, busy, busy, busy)
+	req := httptest.NewRequest("GET", "/render", nil)
+	got := collect(t, ProxyOptions(req.Context(), http.DefaultClient, req, targets, Options{MaxConcurrent: 2}))
+	if len(got) != len(targets) {
+		t.Errorf("got %q, expected a response from each target", got)
+	}
+	if most > 2 {
+		t.Errorf("%d requests at once, expected at most 2", most)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	after := func(d time.Duration, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			w.Write([]byte(body))
+		}
+	}
+	targets := servers(t, after(60*time.Millisecond, "a"), after(30*time.Millisecond, "b"), after(0, "c"))
+	for _, strategy := range []MergeStrategy{WaitAll, Quorum(3)} {
+		req := httptest.NewRequest("GET", "/render", nil)
+		var got []string
+		for rsp := range ProxyOptions(req.Context(), http.DefaultClient, req, targets, Options{Strategy: strategy, Ordered: true}) {
+			if rsp.Err != nil {
+				t.Fatal(rsp.Err)
+			}
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			got = append(got, string(body))
+		}
+		if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("quorum %d: got %q, expected %q", strategy.quorum, got, want)
+		}
+	}
+}
+
+func TestDecodeArray(t *testing.T) {
+	targets := servers(t, reply(`[{"target":"a"},{"target":"b"}]`, 200), reply(`null`, 200),
+		reply(`{"target":"c"}`, 200), reply(`[{"target":"d"}]`, 500), reply(`[{"target":"e"},`, 200))
+	tests := []struct {
+		list string
+		err  bool
+	}{
+		{`[{"target":"a"},{"target":"b"}]`, false},
+		{`null`, false},
+		{`null`, true},
+		{`null`, true},
+		// the elements read before the error are kept
+		{`[{"target":"e"}]`, true},
+	}
+	req := httptest.NewRequest("GET", "/render", nil)
+	i := 0
+	for rsp := range ProxyOptions(req.Context(), http.DefaultClient, req, targets, Options{Ordered: true}) {
+		var list []json.RawMessage
+		err := DecodeArray(rsp, func(elem json.RawMessage) error {
+			list = append(list, elem)
+			return nil
+		})
+		if got, _ := json.Marshal(list); string(got) != tests[i].list || (err != nil) != tests[i].err {
+			t.Errorf("response %d: got %s, %v; expected %s, error %v", i, got, err, tests[i].list, tests[i].err)
+		}
+		i++
+	}
+	if i != len(targets) {
+		t.Errorf("got %d responses, expected %d", i, len(targets))
+	}
+}
+
+func TestCopyRequest(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.RequestURI() + " " + r.Header.Get("X-Target")))
+	}
+	targets := servers(t, echo, echo, echo, echo)
+	var want []string
+	for i := range targets {
+		targets[i].URL.Path = "/" + strconv.Itoa(i)
+		targets[i].Query = url.Values{"n": {strconv.Itoa(i)}}
+		targets[i].Client = &http.Client{Transport: headerTransport{"X-Target", strconv.Itoa(i)}}
+		want = append(want, fmt.Sprintf("200 %s/%d/render?n=%d %d", targets[i].URL.Host, i, i, i))
+	}
+	sort.Strings(want)
+	req := httptest.NewRequest("GET", "http://example.com/render?target=a", nil)
+	req.Header.Set("X-Original", "1")
+	got := collect(t, ProxyContext(req.Context(), nil, req, targets))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	if u := req.URL.String(); u != "http://example.com/render?target=a" {
+		t.Errorf("original URL changed to %s", u)
+	}
+	if len(req.Header) != 1 || req.Header.Get("X-Original") != "1" {
+		t.Errorf("original header changed to %v", req.Header)
+	}
+}
@@ -0,0 +1,120 @@
+package query_test
+
+import (
+	"testing"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// The declarations below fail to compile if the public API of
+// the query package changes in a way that breaks its users. See
+// the package documentation for the compatibility policy.
+var (
+	_ func(string) (*query.Query, error)                           = query.Parse
+	_ func(*query.Query) string                                    = (*query.Query).String
+	_ func(*query.Query) []*query.Metric                           = (*query.Query).Metrics
+	_ func(query.Metric) (query.Metric, query.Metric)              = query.Metric.Split
+	_ func(query.Metric) []query.Metric                            = query.Metric.Expand
+	_ func(query.Metric, string) bool                              = query.Metric.Match
+	_ func(query.Metric) bool                                      = query.Metric.HasVariables
+	_ func(string, query.Mode) (*query.Query, error)               = query.ParseMode
+	_ func(*query.Query) []*query.SeriesByTag                      = (*query.Query).TagQueries
+	_ func(string) (query.TagFilter, error)                        = query.ParseTagFilter
+	_ func(query.TagFilter) string                                 = query.TagFilter.String
+	_ func(query.Expr, func(query.Expr) bool)                      = query.Walk
+	_ func(*query.Query, func(query.Expr) query.Expr) *query.Query = query.Rewrite
+	_ func(*query.Query) error                                     = query.Validate
+	_ func(*query.Query) int                                       = (*query.Query).Cost
+
+	_ func(string) ([]query.Token, error)             = query.Tokens
+	_ func(string, query.Mode) ([]query.Token, error) = query.TokensMode
+
+	_ func(string, query.Mode, query.Limits) (*query.Query, error) = query.ParseLimits
+	_ func(string) *query.Query                                    = query.MustParse
+	_ func([]string) ([]*query.Query, error)                       = query.ParseTargets
+	_ error                                                        = (*query.TargetError)(nil)
+
+	_ func(...string) query.Metric                    = query.Join
+	_ func(query.Metric) []string                     = query.Metric.Segments
+	_ func(query.Metric) bool                         = query.Metric.HasGlob
+	_ func(query.Metric, string, string) query.Metric = query.Metric.ReplacePrefix
+
+	_ query.Mode = query.AllowVariables
+	_            = query.Token{Kind: query.TokenMetric, Text: "", Pos: 0}
+
+	_ query.Expr = (*query.Query)(nil)
+	_ query.Expr = (*query.Func)(nil)
+	_ query.Expr = (*query.Metric)(nil)
+	_ query.Expr = (*query.Value)(nil)
+	_ query.Expr = (*query.SeriesByTag)(nil)
+
+	_ = query.Query{Expr: nil}
+	_ = query.Limits{MaxLength: 0, MaxDepth: 0}
+	_ = query.Func{Name: "", Args: []query.Expr(nil)}
+	_ = query.SeriesByTag{Filters: []query.TagFilter(nil)}
+	_ = query.TagFilter{Tag: "", Op: query.TagEqual, Value: ""}
+)
+
+// TestContract checks the shape of the trees that Parse produces,
+// which external tools rely on.
+func TestContract(t *testing.T) {
+	tests := []struct {
+		in, out string
+		check   func(*query.Query) bool
+	}{
+		{
+			"a.b.c", "a.b.c",
+			func(q *query.Query) bool {
+				m, ok := q.Expr.(*query.Metric)
+				return ok && *m == "a.b.c"
+			},
+		},
+		{
+			`alias(a.b, "x")`, `alias(a.b, "x")`,
+			func(q *query.Query) bool {
+				f, ok := q.Expr.(*query.Func)
+				if !ok || f.Name != "alias" || len(f.Args) != 2 {
+					return false
+				}
+				v, ok := f.Args[1].(*query.Value)
+				return ok && *v == `"x"` // quotes are kept
+			},
+		},
+		{
+			"scale(a.b,0.5)", "scale(a.b, 0.5)",
+			func(q *query.Query) bool {
+				f, ok := q.Expr.(*query.Func)
+				if !ok || len(f.Args) != 2 {
+					return false
+				}
+				v, ok := f.Args[1].(*query.Value)
+				return ok && *v == "0.5"
+			},
+		},
+		{
+			"sum(avg(a.b))", "sum(avg(a.b))",
+			func(q *query.Query) bool {
+				f, ok := q.Expr.(*query.Func)
+				if !ok || len(f.Args) != 1 {
+					return false
+				}
+				// nested calls are not wrapped in a Query
+				_, ok = f.Args[0].(*query.Func)
+				return ok
+			},
+		},
+	}
+	for _, tt := range tests {
+		q, err := query.Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if s := q.String(); s != tt.out {
+			t.Errorf("Parse(%q).String() = %q, expected %q", tt.in, s, tt.out)
+		}
+		if !tt.check(q) {
+			t.Errorf("Parse(%q) produced an unexpected tree: %#v", tt.in, q.Expr)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// catalog lists graphite's render functions and their arguments.
+// Each argument is written as a kind, optionally followed by a
+// modifier: ? for an optional argument, * for zero or more, and
+// + for one or more. The kinds are
+//
+// 	S  a series list: a metric, or a function call
+// 	N  a number
+// 	Q  a quoted string
+// 	A  anything
+//
+// Boolean and keyword arguments cannot be parsed, and are not
+// listed.
+var catalog = map[string]string{
+	"absolute":                    "S",
+	"aggregate":                   "S Q A?",
+	"aggregateLine":               "S Q?",
+	"aggregateWithWildcards":      "S Q N*",
+	"alias":                       "S Q",
+	"aliasByMetric":               "S",
+	"aliasByNode":                 "S A+",
+	"aliasByTags":                 "S A+",
+	"aliasQuery":                  "S Q Q Q",
+	"aliasSub":                    "S Q Q",
+	"alpha":                       "S N",
+	"applyByNode":                 "S N Q Q?",
+	"areaBetween":                 "S",
+	"asPercent":                   "S A? N*",
+	"averageAbove":                "S N",
+	"averageBelow":                "S N",
+	"averageOutsidePercentile":    "S N",
+	"averageSeries":               "S+",
+	"averageSeriesWithWildcards":  "S N*",
+	"avg":                         "S+",
+	"cactiStyle":                  "S Q? Q?",
+	"changed":                     "S",
+	"color":                       "S Q",
+	"consolidateBy":               "S Q",
+	"constantLine":                "N",
+	"countSeries":                 "S*",
+	"cumulative":                  "S",
+	"currentAbove":                "S N",
+	"currentBelow":                "S N",
+	"dashed":                      "S N?",
+	"delay":                       "S N",
+	"derivative":                  "S",
+	"diffSeries":                  "S+",
+	"divideSeries":                "S S",
+	"divideSeriesLists":           "S S",
+	"drawAsInfinite":              "S",
+	"events":                      "Q*",
+	"exclude":                     "S Q",
+	"exponentialMovingAverage":    "S A",
+	"fallbackSeries":              "S S",
+	"filterSeries":                "S Q Q N",
+	"grep":                        "S Q",
+	"group":                       "S*",
+	"groupByNode":                 "S N Q?",
+	"groupByNodes":                "S Q N*",
+	"groupByTags":                 "S Q Q+",
+	"highest":                     "S N? Q?",
+	"highestAverage":              "S N",
+	"highestCurrent":              "S N",
+	"highestMax":                  "S N",
+	"hitcount":                    "S Q",
+	"holtWintersAberration":       "S N? Q? Q?",
+	"holtWintersConfidenceArea":   "S N? Q? Q?",
+	"holtWintersConfidenceBands":  "S N? Q? Q?",
+	"holtWintersForecast":         "S Q? Q?",
+	"identity":                    "Q",
+	"integral":                    "S",
+	"integralByInterval":          "S Q",
+	"interpolate":                 "S N?",
+	"invert":                      "S",
+	"isNonNull":                   "S",
+	"keepLastValue":               "S N?",
+	"legendValue":                 "S Q*",
+	"limit":                       "S N",
+	"lineWidth":                   "S N",
+	"linearRegression":            "S Q? Q?",
+	"log":                         "S N?",
+	"logarithm":                   "S N?",
+	"lowest":                      "S N? Q?",
+	"lowestAverage":               "S N",
+	"lowestCurrent":               "S N",
+	"mapSeries":                   "S N+",
+	"maxSeries":                   "S+",
+	"maximumAbove":                "S N",
+	"maximumBelow":                "S N",
+	"minMax":                      "S",
+	"minSeries":                   "S+",
+	"minimumAbove":                "S N",
+	"minimumBelow":                "S N",
+	"mostDeviant":                 "S N",
+	"movingAverage":               "S A Q?",
+	"movingMax":                   "S A Q?",
+	"movingMedian":                "S A Q?",
+	"movingMin":                   "S A Q?",
+	"movingSum":                   "S A Q?",
+	"movingWindow":                "S A Q? Q?",
+	"multiplySeries":              "S+",
+	"multiplySeriesWithWildcards": "S N*",
+	"nPercentile":                 "S N",
+	"nonNegativeDerivative":       "S N? N?",
+	"offset":                      "S N",
+	"offsetToZero":                "S",
+	"pct":                         "S A? N*",
+	"perSecond":                   "S N? N?",
+	"percentileOfSeries":          "S N",
+	"pow":                         "S N",
+	"powSeries":                   "S+",
+	"randomWalk":                  "Q N?",
+	"randomWalkFunction":          "Q N?",
+	"range":                       "S+",
+	"rangeOfSeries":               "S+",
+	"reduceSeries":                "S Q N Q*",
+	"removeAbovePercentile":       "S N",
+	"removeAboveValue":            "S N",
+	"removeBelowPercentile":       "S N",
+	"removeBelowValue":            "S N",
+	"removeBetweenPercentile":     "S N",
+	"removeEmptySeries":           "S N?",
+	"scale":                       "S N",
+	"scaleToSeconds":              "S N",
+	"secondYAxis":                 "S",
+	"seriesByTag":                 "Q+",
+	"setXFilesFactor":             "S N",
+	"sin":                         "Q N? N?",
+	"sinFunction":                 "Q N? N?",
+	"smartSummarize":              "S Q Q? Q?",
+	"sortBy":                      "S Q",
+	"sortByMaxima":                "S",
+	"sortByMinima":                "S",
+	"sortByName":                  "S",
+	"sortByTotal":                 "S",
+	"squareRoot":                  "S",
+	"stacked":                     "S Q?",
+	"stddevSeries":                "S+",
+	"stdev":                       "S N A?",
+	"substr":                      "S N? N?",
+	"sum":                         "S+",
+	"sumSeries":                   "S+",
+	"sumSeriesWithWildcards":      "S N*",
+	"summarize":                   "S Q Q?",
+	"template":                    "S A*",
+	"threshold":                   "N Q? Q?",
+	"time":                        "Q N?",
+	"timeFunction":                "Q N?",
+	"timeShift":                   "S Q",
+	"timeSlice":                   "S Q Q?",
+	"timeStack":                   "S Q? N? N?",
+	"transformNull":               "S N? S?",
+	"unique":                      "S*",
+	"useSeriesAbove":              "S N Q Q",
+	"verticalLine":                "Q Q? Q?",
+	"weightedAverage":             "S S N*",
+	"xFilesFactor":                "S N",
+}
+
+// Validate checks that every function called in q is a known
+// graphite function, and that it is given the right number and
+// kinds of arguments. It returns an error describing the first
+// problem found.
+func Validate(q *Query) error {
+	var err error
+	Walk(q, func(e Expr) bool {
+		if f, ok := e.(*Func); ok && err == nil {
+			err = validateFunc(f)
+		}
+		return err == nil
+	})
+	return err
+}
+
+func validateFunc(f *Func) error {
+	spec, ok := catalog[f.Name]
+	if !ok {
+		if s := suggest(f.Name); s != "" {
+			return fmt.Errorf("%s: unknown function, did you mean %s?", f.Name, s)
+		}
+		return fmt.Errorf("%s: unknown function", f.Name)
+	}
+	params := strings.Fields(spec)
+	min, max := 0, 0
+	for _, p := range params {
+		switch p[len(p)-1] {
+		case '*':
+			max = -1
+		case '+':
+			min++
+			max = -1
+		case '?':
+			if max >= 0 {
+				max++
+			}
+		default:
+			min++
+			if max >= 0 {
+				max++
+			}
+		}
+	}
+	switch n := len(f.Args); {
+	case n < min:
+		return fmt.Errorf("%s: expected at least %d arguments, got %d", f.Name, min, n)
+	case max >= 0 && n > max:
+		return fmt.Errorf("%s: expected at most %d arguments, got %d", f.Name, max, n)
+	}
+	for i, arg := range f.Args {
+		p := params[len(params)-1]
+		if i < len(params) {
+			p = params[i]
+		}
+		if err := checkArg(p[0], arg); err != nil {
+			return fmt.Errorf("%s: argument %d %v", f.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+func checkArg(kind byte, e Expr) error {
+	v, isValue := e.(*Value)
+	switch kind {
+	case 'S':
+		if isValue {
+			return fmt.Errorf("must be a series list, got %s", *v)
+		}
+	case 'N':
+		if !isValue || isQuoted(string(*v)) {
+			return fmt.Errorf("must be a number, got %s", exprString(e))
+		}
+	case 'Q':
+		if !isValue || !isQuoted(string(*v)) {
+			return fmt.Errorf("must be a string, got %s", exprString(e))
+		}
+	}
+	return nil
+}
+
+func isQuoted(s string) bool {
+	return len(s) > 0 && (s[0] == '"' || s[0] == '\'')
+}
+
+func exprString(e Expr) string {
+	return (&Query{Expr: e}).String()
+}
+
+// suggest returns the name of the known function that is closest
+// to name, if there is one that is close enough.
+func suggest(name string) string {
+	var names []string
+	for fn := range catalog {
+		names = append(names, fn)
+	}
+	sort.Strings(names)
+	best, bestDist := "", len(name)/3+1
+	for _, fn := range names {
+		if strings.EqualFold(fn, name) {
+			return fn
+		}
+		if d := editDistance(strings.ToLower(fn), strings.ToLower(name)); d < bestDist {
+			best, bestDist = fn, d
+		}
+	}
+	return best
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(v ...int) int {
+	m := v[0]
+	for _, x := range v[1:] {
+		if x < m {
+			m = x
+		}
+	}
+	return m
+}
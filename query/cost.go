@@ -0,0 +1,65 @@
+package query
+
+// Constants for Cost.
+const (
+	// Each wildcard segment in a metric is assumed to match
+	// this many nodes.
+	wildcardFanout = 4
+	// Cost saturates at this value.
+	maxCost = 1 << 30
+)
+
+// Cost estimates how expensive q is to evaluate, as a rough
+// count of the series a graphite server must find and process.
+// Each metric pattern costs 1, multiplied by 4 for each segment
+// containing a wildcard; brace expansions count once per
+// alternative. Each function call adds 1, as does each level of
+// nesting. Cost is meant for admission control, to compare
+// queries with each other and with a limit; it is not a
+// prediction of the number of series a query will return.
+func (q *Query) Cost() int {
+	var cost, depth, deepest int
+	Walk(q.Expr, func(e Expr) bool {
+		switch e := e.(type) {
+		case nil:
+			depth--
+			return true
+		case *Func, *SeriesByTag:
+			cost++
+		case *Metric:
+			cost += e.cost()
+		}
+		depth++
+		if depth > deepest {
+			deepest = depth
+		}
+		return true
+	})
+	cost += deepest
+	if cost > maxCost || cost < 0 {
+		return maxCost
+	}
+	return cost
+}
+
+func (m Metric) cost() int {
+	pats := m.Expand()
+	if len(pats) == 0 {
+		// too many expansions to count
+		return maxCost
+	}
+	var cost int
+	for _, pat := range pats {
+		c := 1
+		for _, seg := range pat.Segments() {
+			if Metric(seg).HasGlob() && c < maxCost {
+				c *= wildcardFanout
+			}
+		}
+		cost += c
+		if cost > maxCost {
+			return maxCost
+		}
+	}
+	return cost
+}
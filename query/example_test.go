@@ -0,0 +1,102 @@
+package query_test
+
+import (
+	"fmt"
+
+	"github.com/droyo/metaphite/query"
+)
+
+func ExampleParse() {
+	q, err := query.Parse("aliasByNode(servers.web*.cpu.load, 1)")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fn := q.Expr.(*query.Func)
+	fmt.Println(fn.Name, len(fn.Args))
+	// Output: aliasByNode 2
+}
+
+func ExampleQuery_Metrics() {
+	q, err := query.Parse("sumSeries(dev.cpu.load, dev.cpu.user)")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, m := range q.Metrics() {
+		_, rest := m.Split()
+		*m = rest
+	}
+	fmt.Println(q)
+	// Output: sumSeries(cpu.load, cpu.user)
+}
+
+func ExampleMetric_Expand() {
+	m := query.Metric("servers.{web,db}.cpu")
+	fmt.Println(m.Expand())
+	// Output: [servers.web.cpu servers.db.cpu]
+}
+
+func ExampleMetric_Match() {
+	m := query.Metric("servers.*.cpu")
+	fmt.Println(m.Match("servers.web1.cpu"), m.Match("servers.web1.mem"))
+	// Output: true false
+}
+
+func ExampleWalk() {
+	q, err := query.Parse("sumSeries(a.b, scale(c.d, 2), e.f)")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// print the metrics outside of calls to scale
+	query.Walk(q, func(e query.Expr) bool {
+		switch e := e.(type) {
+		case *query.Func:
+			return e.Name != "scale"
+		case *query.Metric:
+			fmt.Println(*e)
+		}
+		return true
+	})
+	// Output:
+	// a.b
+	// e.f
+}
+
+func ExampleRewrite() {
+	q, err := query.Parse("sumSeries(servers.*.requests, servers.*.errors)")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	gaps := query.Rewrite(q, func(e query.Expr) query.Expr {
+		if m, ok := e.(*query.Metric); ok && m.Match("servers.x.errors") {
+			return &query.Func{Name: "keepLastValue", Args: []query.Expr{m}}
+		}
+		return e
+	})
+	fmt.Println(gaps)
+	fmt.Println(q)
+	// Output:
+	// sumSeries(servers.*.requests, keepLastValue(servers.*.errors))
+	// sumSeries(servers.*.requests, servers.*.errors)
+}
+
+func ExampleTokens() {
+	tokens, err := query.Tokens("alias(a.b, 'x')")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, t := range tokens {
+		fmt.Println(t.Pos, t.Kind, t.Text)
+	}
+	// Output:
+	// 0 word alias
+	// 5 '(' (
+	// 6 metric a.b
+	// 9 ',' ,
+	// 11 string 'x'
+	// 14 ')' )
+}
@@ -42,22 +42,30 @@ type item struct {
 type stateFn func(*lexer) stateFn
 
 type lexer struct {
-	input      string    // the input string
-	start, pos int       // start, end+1 of current item
-	width      int       // length of previous utf8 codepoint
-	items      chan item // scanned lexemes go here
-	err        []string  // errors from yacc
-	last       string    // last token emitted
-	result     *Query    // yacc puts our result here
+	input      string   // the input string
+	start, pos int      // start, end+1 of current item
+	width      int      // length of previous utf8 codepoint
+	items      []item   // scanned lexemes not yet returned
+	offsets    []int    // byte offsets of items in input
+	state      stateFn  // next state; nil once done
+	err        []string // errors from yacc
+	last       string   // last token emitted
+	result     *Query   // yacc puts our result here
+	mode       Mode
+	depth      int // nesting of parentheses
+	maxDepth   int // if non-zero, limit on depth
 }
 
 func lex(input string) *lexer {
-	l := lexer{
+	return lexMode(input, 0)
+}
+
+func lexMode(input string, mode Mode) *lexer {
+	return &lexer{
 		input: input,
-		items: make(chan item),
+		mode:  mode,
+		state: lexClear,
 	}
-	go l.run()
-	return &l
 }
 
 // implement the yyLex interface
@@ -67,7 +75,7 @@ func (l *lexer) Error(e string) {
 }
 
 func (l *lexer) Lex(lval *yySymType) int {
-	tok, ok := <-l.items
+	tok, ok := l.nextItem()
 	if !ok {
 		// eof reached
 		return 0
@@ -93,27 +101,38 @@ func (l *lexer) backup()      { l.pos -= l.width }
 func (l *lexer) peek() int    { defer l.backup(); return l.next() }
 func (l *lexer) emit(t int) {
 	l.last = l.dot()
-	l.items <- item{t, l.dot()}
+	l.items = append(l.items, item{t, l.dot()})
+	l.offsets = append(l.offsets, l.start)
 	l.start = l.pos
 }
 
 func (l *lexer) errorf(format string, v ...interface{}) stateFn {
-	l.items <- item{pERROR, fmt.Sprintf(format, v...)}
+	l.items = append(l.items, item{pERROR, fmt.Sprintf(format, v...)})
+	l.offsets = append(l.offsets, l.pos)
 	return nil
 }
 
-func (l *lexer) run() {
-	for state := lexClear; state != nil; state = state(l) {
-	}
-	close(l.items)
+// nextItem runs the state machine until it produces the next
+// lexeme. It returns false once the input is exhausted. The
+// lexer is driven by the parser this way, rather than running
+// in a goroutine of its own, to keep parsing cheap.
+func (l *lexer) nextItem() (item, bool) {
+	it, _, ok := l.nextToken()
+	return it, ok
 }
 
-// Any call to lex() should be paired with a deferred
-// call to l.drain(). This ensures that the lexing goroutine
-// finishes.
-func (l *lexer) drain() {
-	for range l.items {
+// nextToken is like nextItem, but also returns the offset of
+// the lexeme in the input.
+func (l *lexer) nextToken() (item, int, bool) {
+	for len(l.items) == 0 {
+		if l.state == nil {
+			return item{}, 0, false
+		}
+		l.state = l.state(l)
 	}
+	it, off := l.items[0], l.offsets[0]
+	l.items, l.offsets = l.items[1:], l.offsets[1:]
+	return it, off, true
 }
 
 // consumes the next character in the input
@@ -169,7 +188,19 @@ func lexClear(l *lexer) stateFn {
 		case is(r, charGlob):
 			l.backup()
 			return lexMetric
+		case r == '$' && l.mode&AllowVariables != 0:
+			l.backup()
+			return lexMetric
 		case is(r, charDelim):
+			switch r {
+			case '(':
+				l.depth++
+			case ')':
+				l.depth--
+			}
+			if l.maxDepth > 0 && l.depth > l.maxDepth {
+				return l.errorf("query nested more than %d deep", l.maxDepth)
+			}
 			l.emit(r)
 			return lexClear
 		case is(r, charQuote):
@@ -182,10 +213,9 @@ func lexClear(l *lexer) stateFn {
 		case r == eof:
 			return nil
 		default:
-			return l.errorf("unexpected character '%c' (%d)", r)
+			return l.errorf("unexpected character '%c' (%d)", r, r)
 		}
 	}
-	panic("not reached")
 }
 
 // read a (possibly negative, possibly) number.
@@ -222,7 +252,7 @@ func lexName(l *lexer) stateFn {
 		l.emit(pWORD)
 		return lexClear
 	}
-	if l.accept(charGlob, charDot) {
+	if l.accept(charGlob, charDot) || (l.mode&AllowVariables != 0 && l.accept("$")) {
 		l.backup()
 		return lexMetric
 	}
@@ -239,6 +269,13 @@ func lexName(l *lexer) stateFn {
 // are balanced.
 func lexMetric(l *lexer) stateFn {
 	l.acceptRun(charIdentifier, "*.")
+	if l.mode&AllowVariables != 0 {
+		if strings.HasPrefix(l.rest(), "[[") {
+			return lexVariable
+		} else if l.accept("$") {
+			return lexVariable
+		}
+	}
 	if l.accept("{") {
 		return lexCurlyBrace
 	} else if l.accept("[") {
@@ -254,6 +291,31 @@ func lexMetric(l *lexer) stateFn {
 	return l.errorf("unexpected character '%c' in metric", l.peek())
 }
 
+// consume a Grafana template variable, of the form $name,
+// ${name}, ${name:format}, [[name]] or [[name:format]]. Any
+// leading '$' is already consumed.
+func lexVariable(l *lexer) stateFn {
+	end := "}"
+	switch {
+	case strings.HasPrefix(l.rest(), "[["):
+		l.pos += 2
+		end = "]]"
+	case l.accept("{"):
+	default:
+		if !l.accept(charIdentifier) {
+			return l.errorf("invalid template variable")
+		}
+		l.acceptRun(charIdentifier)
+		return lexMetric
+	}
+	i := strings.Index(l.rest(), end)
+	if i < 0 {
+		return l.errorf("unterminated template variable")
+	}
+	l.pos += i + len(end)
+	return lexMetric
+}
+
 // consume a glob expression of the form {x,y,z} (do not emit it)
 // The opening '{' is already consumed. '}' characters may be
 // escaped with a backslash.
@@ -1,5 +1,21 @@
 // Package query parses Graphite queries into an
 // abstract syntax tree.
+//
+// A parsed query is a tree of expressions, rooted at a Query.
+// The tree can be traversed with Walk, or with a type switch
+// over the Expr types:
+//
+// 	*Query        the root of a tree
+// 	*Func         a function call, such as sumSeries(a.b, c.d)
+// 	*SeriesByTag  a call to seriesByTag, with its tag filters
+// 	*Metric       a metric name or pattern, such as a.*.b
+// 	*Value        a number or quoted string literal
+//
+// The exported API of this package is stable: the names, types
+// and signatures checked in api_test.go, and the shape of the
+// trees produced by Parse, are not changed incompatibly. An API
+// that must go is first marked "Deprecated:" in its doc comment,
+// and is kept for at least one release after that.
 package query
 
 import (
@@ -20,8 +36,99 @@ import (
 // in a query can be accessed and modified through the methods
 // on the returned Query value.
 func Parse(query string) (*Query, error) {
-	l := lex(query)
-	defer l.drain()
+	return ParseMode(query, 0)
+}
+
+// MustParse is like Parse, but panics if query cannot be
+// parsed. It is meant for queries that are known to be valid,
+// such as those in tests.
+func MustParse(query string) *Query {
+	q, err := Parse(query)
+	if err != nil {
+		panic(fmt.Sprintf("query.MustParse(%q): %v", query, err))
+	}
+	return q
+}
+
+// A TargetError records a failure to parse one of several
+// targets.
+type TargetError struct {
+	Index  int    // position of the target in the list
+	Target string // the target that could not be parsed
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("target %d %q: %v", e.Index, e.Target, e.Err)
+}
+
+// ParseTargets parses a list of targets, such as the target
+// parameters of a render request. If a target cannot be
+// parsed, ParseTargets returns a *TargetError for the first
+// such target.
+func ParseTargets(targets []string) ([]*Query, error) {
+	result := make([]*Query, 0, len(targets))
+	for i, t := range targets {
+		q, err := Parse(t)
+		if err != nil {
+			return nil, &TargetError{Index: i, Target: t, Err: err}
+		}
+		result = append(result, q)
+	}
+	return result, nil
+}
+
+// A Mode changes how queries are parsed.
+type Mode uint
+
+const (
+	// AllowVariables accepts unexpanded Grafana template
+	// variables, such as $env, ${env} or [[env]], in metric
+	// names. Use Metric.HasVariables to find them.
+	AllowVariables Mode = 1 << iota
+)
+
+// Limits bound the work done to parse a query, so that hostile
+// input cannot exhaust memory or the stack. A zero field uses the
+// default.
+type Limits struct {
+	// Maximum length of a query, in bytes. The default is
+	// not to limit length.
+	MaxLength int
+	// Maximum nesting of function calls. The default, and the
+	// most that is allowed, is 100.
+	MaxDepth int
+}
+
+const (
+	// Bounds recursion over the expression tree.
+	maxDepth = 200
+	// Bounds the number of metrics a brace expansion
+	// produces.
+	maxExpansions = 4096
+	// Bounds nesting of function calls in parsed queries.
+	// It is well under maxDepth, so that every parsed query
+	// can be marshalled and walked in full.
+	maxNesting = 100
+)
+
+// ParseMode is like Parse, but changes its behavior
+// according to mode.
+func ParseMode(query string, mode Mode) (*Query, error) {
+	return ParseLimits(query, mode, Limits{})
+}
+
+// ParseLimits is like ParseMode, but rejects queries that exceed
+// limits.
+func ParseLimits(query string, mode Mode, limits Limits) (*Query, error) {
+	if limits.MaxLength > 0 && len(query) > limits.MaxLength {
+		return nil, fmt.Errorf("query too long (%d bytes, limit %d)", len(query), limits.MaxLength)
+	}
+	l := lexMode(query, mode)
+	l.maxDepth = maxNesting
+	if limits.MaxDepth > 0 && limits.MaxDepth < maxNesting {
+		l.maxDepth = limits.MaxDepth
+	}
 
 	result := yyParse(l)
 	if err := l.Err(); err != nil {
@@ -32,6 +139,7 @@ func Parse(query string) (*Query, error) {
 		return nil, errors.New("parse error")
 	}
 
+	convertTags(l.result, 0)
 	return l.result, nil
 }
 
@@ -44,7 +152,6 @@ func (q *Query) String() string {
 }
 
 func marshalExpr(w io.Writer, e Expr, depth int) {
-	const maxDepth = 200
 	if depth > maxDepth {
 		return
 	}
@@ -66,6 +173,8 @@ func marshalExpr(w io.Writer, e Expr, depth int) {
 		fmt.Fprint(w, *e)
 	case *Metric:
 		fmt.Fprint(w, *e)
+	case *SeriesByTag:
+		e.marshal(w)
 	}
 }
 
@@ -89,27 +198,41 @@ func (x *Query) equal(y Expr) bool {
 // walk calls fn on each expression in a Query in
 // depth-first order
 func (q *Query) walk(fn func(Expr)) {
-	walk(q.Expr, fn, 0)
+	Walk(q.Expr, func(e Expr) bool {
+		if e != nil {
+			fn(e)
+		}
+		return true
+	})
 }
 
-func walk(e Expr, fn func(Expr), depth int) {
-	const maxDepth = 200
-	if depth > maxDepth {
+// Walk traverses the expression e in depth-first order. It
+// calls fn(e) before visiting the children of e; if fn returns
+// false, the children are skipped. Otherwise, once the children
+// have been visited, Walk calls fn(nil), so that fn can undo any
+// state it set up for them. Only Query and Func expressions have
+// children. Very deeply nested expressions are not traversed
+// past a fixed depth.
+func Walk(e Expr, fn func(Expr) bool) {
+	walk(e, fn, 0)
+}
+
+func walk(e Expr, fn func(Expr) bool, depth int) {
+	if depth > maxDepth || e == nil {
+		return
+	}
+	if !fn(e) {
 		return
 	}
 	switch v := e.(type) {
 	case *Func:
-		fn(v)
 		for _, vv := range v.Args {
 			walk(vv, fn, depth+1)
 		}
 	case *Query:
 		walk(v.Expr, fn, depth+1)
-	case *Value:
-		fn(v)
-	case *Metric:
-		fn(v)
 	}
+	fn(nil)
 }
 
 // Metrics returns a slice of pointers to all metric names
@@ -126,7 +249,9 @@ func (q *Query) Metrics() []*Metric {
 	return result
 }
 
-// An Expr represents a graphite query subexpression.
+// An Expr represents a graphite query subexpression. Its
+// dynamic type is one of *Query, *Func, *SeriesByTag, *Metric
+// or *Value; no other implementations are possible.
 type Expr interface {
 	equal(e Expr) bool
 }
@@ -182,16 +307,73 @@ func (m Metric) Split() (first, rest Metric) {
 	return first, rest
 }
 
+// Join joins segments with dots to form a Metric.
+func Join(segs ...string) Metric {
+	return Metric(strings.Join(segs, "."))
+}
+
+// Segments splits m into the words separated by its dots. Dots
+// that are escaped, or inside a character class or brace list,
+// do not separate segments.
+func (m Metric) Segments() []string {
+	return m.segments()
+}
+
+// HasGlob returns true if m contains a wildcard or brace list,
+// and may match more than one metric.
+func (m Metric) HasGlob() bool {
+	escape := false
+	for _, c := range m {
+		switch {
+		case escape:
+			escape = false
+		case c == '\\':
+			escape = true
+		case strings.ContainsRune("*?[{", c):
+			return true
+		}
+	}
+	return false
+}
+
+// ReplacePrefix replaces the leading segments of m with new, if
+// they are equal to old. If new is empty, the dot following the
+// prefix is removed as well. If m does not begin with old, or is
+// equal to it, m is returned unchanged.
+func (m Metric) ReplacePrefix(old, new string) Metric {
+	if old == "" || !strings.HasPrefix(string(m), old+".") {
+		return m
+	}
+	rest := m[len(old)+1:]
+	if new == "" {
+		return rest
+	}
+	return Metric(new) + "." + rest
+}
+
+// HasVariables returns true if m contains unexpanded Grafana
+// template variables. See AllowVariables.
+func (m Metric) HasVariables() bool {
+	return strings.Contains(string(m), "$") || strings.Contains(string(m), "[[")
+}
+
 // If a Metric contains any brace expansions,
 // Expand expands them and returns a slice
 // of Metrics for each expansion. Otherwise,
 // Expand returns a single-element slice containing
-// the original Metric.
+// the original Metric. If the braces are unbalanced,
+// or there would be more than 4096 expansions, Expand
+// returns nil.
 func (m Metric) Expand() []Metric {
 	return m.braceExpand(0, nil)
 }
 
-// Match returns true if the metric is equal to or matches name
+// Match returns true if the metric is equal to or matches name,
+// as graphite would match it. Wildcards (*, ? and [...]) match
+// within a single segment of name, never across the dots that
+// separate segments, so a pattern and the names it matches have
+// the same number of segments. Brace lists ({a,b}) may span
+// segments.
 func (m Metric) Match(name string) bool {
 	for _, pat := range m.Expand() {
 		if pat.match(name) {
@@ -201,13 +383,51 @@ func (m Metric) Match(name string) bool {
 	return false
 }
 
-// match returns true if the Metric pat matches s.
+// match returns true if the Metric pat, which has no brace
+// lists, matches s.
 func (pat Metric) match(s string) bool {
-	ok, err := path.Match(string(pat), s)
-	if err != nil {
+	patSegs := pat.segments()
+	nameSegs := strings.Split(s, ".")
+	if len(patSegs) != len(nameSegs) {
 		return false
 	}
-	return ok
+	for i, seg := range patSegs {
+		ok, err := path.Match(seg, nameSegs[i])
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// segments splits pat at the dots that are not inside a
+// character class or brace list, or escaped.
+func (pat Metric) segments() []string {
+	var (
+		segs                     []string
+		start                    int
+		escape, inclass, inbrace bool
+	)
+	for i, c := range pat {
+		switch {
+		case escape:
+			escape = false
+		case c == '\\':
+			escape = true
+		case c == '[':
+			inclass = true
+		case c == ']':
+			inclass = false
+		case c == '{':
+			inbrace = true
+		case c == '}':
+			inbrace = false
+		case c == '.' && !inclass && !inbrace:
+			segs = append(segs, string(pat[start:i]))
+			start = i + 1
+		}
+	}
+	return append(segs, string(pat[start:]))
 }
 
 // braceExpand expands all brace-delimited lists in a Metric
@@ -272,6 +492,9 @@ done:
 		}
 		return addto
 	}
+	if len(segments)*len(addto) > maxExpansions {
+		return nil
+	}
 	result := make([]Metric, 0, len(segments)*len(addto))
 	for _, pfx := range addto {
 		for _, seg := range segments {
@@ -2,6 +2,8 @@ package query
 
 import (
 	"errors"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -120,7 +122,11 @@ func tokenize(s string) ([]item, error) {
 		acc []item
 		lex = lex(s)
 	)
-	for v := range lex.items {
+	for {
+		v, ok := lex.nextItem()
+		if !ok {
+			break
+		}
 		if v.typ == pERROR {
 			return acc, errors.New(v.val)
 		}
@@ -210,12 +216,26 @@ var ttMatch = []struct {
 	{"servers.host[1-3]", "servers.host2", true},
 	{"servers.h*st3", "servers.hoooost3", true},
 	{"servers.{h,m,k}ost3", "servers.host3", true},
+	// wildcards do not cross segments
+	{"prod.*", "prod.cpu", true},
+	{"prod.*", "prod.cpu.load", false},
+	{"*", "prod", true},
+	{"*", "prod.cpu", false},
+	{"*.cpu.load", "prod.cpu.load", true},
+	{"prod.cpu*", "prod.cpu.0", false},
+	{"prod.*.*", "prod.cpu", false},
+	{"prod.cpu-[0-3]", "prod.cpu-4", false},
+	{"prod.cpu-?", "prod.cpu-4", true},
+	{"prod.[.x]", "prod..", false},
+	// brace lists may
+	{"prod.{cpu.user,mem}", "prod.cpu.user", true},
+	{"prod.{cpu.user,mem}", "prod.cpu", false},
 }
 
 func TestMatch(t *testing.T) {
 	for _, tt := range ttMatch {
 		if ok := tt.pat.Match(tt.val); ok != tt.ok {
-			t.Error("match(%q,%q) = %v, expected %v", tt.pat, tt.val, ok, tt.ok)
+			t.Errorf("match(%q,%q) = %v, expected %v", tt.pat, tt.val, ok, tt.ok)
 		} else {
 			t.Logf("match(%q,%q) = %v", tt.pat, tt.val, tt.ok)
 		}
@@ -287,3 +307,341 @@ func TestString(t *testing.T) {
 		}
 	}
 }
+
+func TestVariables(t *testing.T) {
+	tests := []struct {
+		in     string
+		metric Metric
+	}{
+		{"$env.cpu.load", "$env.cpu.load"},
+		{"servers.${host}.cpu", "servers.${host}.cpu"},
+		{"servers.[[host:csv]].cpu", "servers.[[host:csv]].cpu"},
+		{"sumSeries(prod.web$n.cpu)", "prod.web$n.cpu"},
+		{"alias(prod.[[host]]-[0-9].cpu, 'x')", "prod.[[host]]-[0-9].cpu"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.in); err == nil {
+			t.Errorf("Parse(%q) accepted template variables", tt.in)
+		}
+		q, err := ParseMode(tt.in, AllowVariables)
+		if err != nil {
+			t.Errorf("ParseMode(%q): %v", tt.in, err)
+			continue
+		}
+		m := q.Metrics()
+		if len(m) != 1 || *m[0] != tt.metric || !m[0].HasVariables() {
+			t.Errorf("ParseMode(%q) metrics = %q, expected %q", tt.in, m, tt.metric)
+		}
+		if q.String() != tt.in {
+			t.Errorf("ParseMode(%q).String() = %q", tt.in, q.String())
+		}
+	}
+	for _, in := range []string{"prod.${env", "prod.[[env", "prod.$.cpu"} {
+		if _, err := ParseMode(in, AllowVariables); err == nil {
+			t.Errorf("ParseMode(%q) succeeded", in)
+		}
+	}
+}
+
+func TestSeriesByTag(t *testing.T) {
+	tests := []struct {
+		in      string
+		filters []TagFilter
+		out     string
+	}{
+		{
+			`seriesByTag('name=cpu.load', "dc!=east", 'host=~web.*', 'env!=~dev|qa')`,
+			[]TagFilter{
+				{Tag: "name", Op: TagEqual, Value: "cpu.load"},
+				{Tag: "dc", Op: TagNotEqual, Value: "east"},
+				{Tag: "host", Op: TagMatch, Value: "web.*"},
+				{Tag: "env", Op: TagNotMatch, Value: "dev|qa"},
+			},
+			`seriesByTag('name=cpu.load', "dc!=east", 'host=~web.*', 'env!=~dev|qa')`,
+		},
+		{
+			`aliasByTags(seriesByTag('name=x'), 'dc')`,
+			[]TagFilter{{Tag: "name", Op: TagEqual, Value: "x"}},
+			`aliasByTags(seriesByTag('name=x'), 'dc')`,
+		},
+		{`seriesByTag('novalue')`, nil, `seriesByTag('novalue')`},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		tq := q.TagQueries()
+		switch {
+		case tt.filters == nil && len(tq) != 0:
+			t.Errorf("Parse(%q) produced a SeriesByTag", tt.in)
+		case tt.filters != nil && (len(tq) != 1 || !tq[0].equal(&SeriesByTag{Filters: tt.filters})):
+			t.Errorf("Parse(%q) tag queries = %+v, expected %+v", tt.in, tq, tt.filters)
+		}
+		if s := q.String(); s != tt.out {
+			t.Errorf("Parse(%q).String() = %q, expected %q", tt.in, s, tt.out)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	q, err := Parse("a(b(x.y, 1), c(z.w))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var depth, max int
+	var names []string
+	Walk(q, func(e Expr) bool {
+		if e == nil {
+			depth--
+			return true
+		}
+		depth++
+		if depth > max {
+			max = depth
+		}
+		if f, ok := e.(*Func); ok {
+			names = append(names, f.Name)
+		}
+		return true
+	})
+	if depth != 0 {
+		t.Errorf("unbalanced pre and post calls, depth %d after walk", depth)
+	}
+	if max != 4 {
+		t.Errorf("max depth %d, expected 4", max)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("visited functions %s, expected a,b,c", got)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	q, err := Parse("alias(scale(a.b, 2), 'x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	r := Rewrite(q, func(e Expr) Expr {
+		switch e := e.(type) {
+		case *Func:
+			order = append(order, e.Name)
+			if e.Name == "scale" {
+				e.Name = "offset"
+			}
+		case *Value:
+			order = append(order, string(*e))
+		}
+		return e
+	})
+	if got, want := r.String(), "alias(offset(a.b, 2), 'x')"; got != want {
+		t.Errorf("rewritten query %q, expected %q", got, want)
+	}
+	if got, want := q.String(), "alias(scale(a.b, 2), 'x')"; got != want {
+		t.Errorf("original query modified to %q", got)
+	}
+	if got, want := strings.Join(order, " "), "2 scale 'x' alias"; got != want {
+		t.Errorf("rewrite order %q, expected %q", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		in, err string
+	}{
+		{"aliasByNode(a.b.c, 1, 2)", ""},
+		{"sumSeries(a.b, scale(c.d, 0.5), seriesByTag('name=x'))", ""},
+		{"alias(movingAverage(a.b, '5min'), 'avg')", ""},
+		{"aliasByNod(a.b.c, 1)", "aliasByNod: unknown function, did you mean aliasByNode?"},
+		{"sumseries(a.b)", "sumseries: unknown function, did you mean sumSeries?"},
+		{"frobnicate(a.b)", "frobnicate: unknown function"},
+		{"sum(scale(a.b))", "scale: expected at least 2 arguments, got 1"},
+		{"alias(a.b, 'x', 'y')", "alias: expected at most 2 arguments, got 3"},
+		{"scale(a.b, 'two')", "scale: argument 2 must be a number, got 'two'"},
+		{"alias(a.b, c.d)", "alias: argument 2 must be a string, got c.d"},
+		{"absolute(1)", "absolute: argument 1 must be a series list, got 1"},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		err = Validate(q)
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("Validate(%q) = %v, expected %q", tt.in, err, tt.err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	const target = "aliasByNode(sumSeriesWithWildcards(servers.{web,db}[0-9].cpu-*.value, 2), 1)"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(target); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCost(t *testing.T) {
+	tests := []struct {
+		in   string
+		cost int
+	}{
+		{"a.b.c", 1 + 1},
+		{"a.*.c", 4 + 1},
+		{"a.*.*", 16 + 1},
+		{"a.{b,c,d}.e", 3 + 1},
+		{"a.{b,c}.*", 8 + 1},
+		{"sumSeries(a.b, a.c)", 1 + 1 + 1 + 2},
+		{"alias(scale(a.*, 2), 'x')", 2 + 4 + 3},
+		{strings.Repeat("{a,b}.", 13) + "c", maxCost},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if c := q.Cost(); c != tt.cost {
+			t.Errorf("Parse(%q).Cost() = %d, expected %d", tt.in, c, tt.cost)
+		}
+	}
+}
+
+func TestTokensError(t *testing.T) {
+	tokens, err := Tokens("sum(a.b, \"unterminated)")
+	if err == nil {
+		t.Fatal("no error for unterminated string")
+	}
+	if len(tokens) != 4 {
+		t.Errorf("got %d tokens before the error, expected 4: %v", len(tokens), tokens)
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	qs, err := ParseTargets([]string{"a.b", "sum(c.d)"})
+	if err != nil || len(qs) != 2 || qs[1].String() != "sum(c.d)" {
+		t.Errorf("ParseTargets = %v, %v", qs, err)
+	}
+	_, err = ParseTargets([]string{"a.b", "sum(c.d", "e.f"})
+	te, ok := err.(*TargetError)
+	if !ok {
+		t.Fatalf("ParseTargets error %v is not a *TargetError", err)
+	}
+	if te.Index != 1 || te.Target != "sum(c.d" || te.Err == nil {
+		t.Errorf("ParseTargets error = %+v", te)
+	}
+}
+
+func TestMustParse(t *testing.T) {
+	if q := MustParse("a.b"); q.String() != "a.b" {
+		t.Errorf("MustParse(%q) = %q", "a.b", q)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("MustParse did not panic on an invalid query")
+		}
+	}()
+	MustParse("a.b)")
+}
+
+func TestMetricHelpers(t *testing.T) {
+	segs := Metric(`a.b[.]c.{d.e,f}.g\.h`).Segments()
+	want := []string{"a", "b[.]c", "{d.e,f}", `g\.h`}
+	if !reflect.DeepEqual(segs, want) {
+		t.Errorf("Segments = %q, expected %q", segs, want)
+	}
+	if m := Join("a", "b", "c"); m != "a.b.c" {
+		t.Errorf("Join = %q", m)
+	}
+	for m, glob := range map[Metric]bool{
+		"a.b.c": false, "a.*.c": true, "a.b?": true, "a.[bc]": true,
+		"a.{b,c}": true, `a.b\*`: false,
+	} {
+		if m.HasGlob() != glob {
+			t.Errorf("%q.HasGlob() = %v", m, !glob)
+		}
+	}
+	for _, tt := range []struct{ m, old, new, out Metric }{
+		{"prod.cpu.load", "prod", "", "cpu.load"},
+		{"prod.cpu.load", "prod", "dev", "dev.cpu.load"},
+		{"prod.cpu.load", "prod.cpu", "x.y", "x.y.load"},
+		{"production.cpu", "prod", "dev", "production.cpu"},
+		{"prod", "prod", "", "prod"},
+	} {
+		if out := tt.m.ReplacePrefix(string(tt.old), string(tt.new)); out != tt.out {
+			t.Errorf("%q.ReplacePrefix(%q, %q) = %q, expected %q",
+				tt.m, tt.old, tt.new, out, tt.out)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	nest := func(n int) string {
+		return strings.Repeat("f(", n) + "a.b" + strings.Repeat(")", n)
+	}
+	tests := []struct {
+		in     string
+		limits Limits
+		ok     bool
+	}{
+		{"a.b", Limits{MaxLength: 3}, true},
+		{"a.bc", Limits{MaxLength: 3}, false},
+		{nest(3), Limits{MaxDepth: 3}, true},
+		{nest(4), Limits{MaxDepth: 3}, false},
+		{nest(100), Limits{}, true},
+		{nest(101), Limits{}, false},
+		{nest(101), Limits{MaxDepth: 1000}, false},
+	}
+	for _, tt := range tests {
+		q, err := ParseLimits(tt.in, 0, tt.limits)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseLimits(%.20q, %+v) error = %v", tt.in, tt.limits, err)
+		}
+		if err == nil && q.String() != tt.in {
+			t.Errorf("ParseLimits(%.20q).String() = %.20q", tt.in, q)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, tt := range ttPositive {
+		f.Add(tt.in)
+	}
+	f.Add(`seriesByTag('name=a', 'env=~prod.*')`)
+	f.Add(strings.Repeat("f(", 300))
+	f.Fuzz(func(t *testing.T, in string) {
+		q, err := ParseLimits(in, AllowVariables, Limits{MaxLength: 4096})
+		if err != nil {
+			return
+		}
+		// a parsed query must survive a round trip
+		s := q.String()
+		q2, err := ParseMode(s, AllowVariables)
+		if err != nil {
+			t.Fatalf("%q parsed, but its String %q did not: %v", in, s, err)
+		}
+		if s2 := q2.String(); s2 != s {
+			t.Fatalf("%q: String %q reparsed as %q", in, s, s2)
+		}
+		q.Metrics()
+		q.Cost()
+	})
+}
+
+func FuzzTokens(f *testing.F) {
+	for _, tt := range ttPositive {
+		f.Add(tt.in)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		toks, _ := TokensMode(in, AllowVariables)
+		for _, tok := range toks {
+			if tok.Pos < 0 || tok.Pos > len(in) {
+				t.Fatalf("%q: token %+v out of range", in, tok)
+			}
+		}
+	})
+}
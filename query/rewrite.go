@@ -0,0 +1,45 @@
+package query
+
+// Rewrite returns a copy of q, rebuilt bottom-up: each
+// expression's arguments are rewritten before the expression
+// itself is passed to fn, and the expression fn returns takes
+// its place in the tree. fn may return its argument unchanged,
+// modify it, or return a new expression; the expressions it is
+// given are copies, so q is never modified. For example, to
+// wrap every metric in a call to keepLastValue:
+//
+// 	q = query.Rewrite(q, func(e query.Expr) query.Expr {
+// 		if m, ok := e.(*query.Metric); ok {
+// 			return &query.Func{Name: "keepLastValue", Args: []query.Expr{m}}
+// 		}
+// 		return e
+// 	})
+func Rewrite(q *Query, fn func(Expr) Expr) *Query {
+	return &Query{Expr: rewrite(q.Expr, fn, 0)}
+}
+
+func rewrite(e Expr, fn func(Expr) Expr, depth int) Expr {
+	if depth > maxDepth {
+		return e
+	}
+	switch v := e.(type) {
+	case *Query:
+		return &Query{Expr: rewrite(v.Expr, fn, depth+1)}
+	case *Func:
+		f := &Func{Name: v.Name, Args: make([]Expr, len(v.Args))}
+		for i, arg := range v.Args {
+			f.Args[i] = rewrite(arg, fn, depth+1)
+		}
+		return fn(f)
+	case *SeriesByTag:
+		t := &SeriesByTag{Filters: append([]TagFilter(nil), v.Filters...)}
+		return fn(t)
+	case *Metric:
+		m := *v
+		return fn(&m)
+	case *Value:
+		x := *v
+		return fn(&x)
+	}
+	return e
+}
@@ -0,0 +1,156 @@
+package query
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A SeriesByTag is a call to graphite's seriesByTag function,
+// which selects series by their tags rather than by name:
+//
+// 	seriesByTag('name=cpu.load', 'dc=east')
+//
+// Parse produces a SeriesByTag, rather than a Func, for every
+// call to seriesByTag whose arguments are all valid tag
+// expressions.
+type SeriesByTag struct {
+	Filters []TagFilter
+}
+
+// A TagFilter is a tag expression, one of the arguments to
+// seriesByTag. It selects series with tag values that are
+// equal (=), not equal (!=), matching (=~) or not matching
+// (!=~) Value.
+type TagFilter struct {
+	Tag, Op, Value string
+	quote          byte // as written in the query
+}
+
+// Tag filter operators
+const (
+	TagEqual    = "="
+	TagNotEqual = "!="
+	TagMatch    = "=~"
+	TagNotMatch = "!=~"
+)
+
+const seriesByTagFun = "seriesByTag"
+
+// ParseTagFilter parses a tag expression, such as "dc=east",
+// without the surrounding quotes.
+func ParseTagFilter(s string) (TagFilter, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return TagFilter{}, fmt.Errorf("tag expression %q has no operator", s)
+	}
+	start, end := i, i+1
+	if i > 0 && s[i-1] == '!' {
+		start--
+	}
+	if end < len(s) && s[end] == '~' {
+		end++
+	}
+	f := TagFilter{Tag: s[:start], Op: s[start:end], Value: s[end:]}
+	if f.Tag == "" {
+		return TagFilter{}, fmt.Errorf("tag expression %q has no tag", s)
+	}
+	return f, nil
+}
+
+// String produces the tag expression, without quotes.
+func (f TagFilter) String() string { return f.Tag + f.Op + f.Value }
+
+func (f TagFilter) quoted() string {
+	q := f.quote
+	if q == 0 {
+		q = '\''
+	}
+	return string(q) + f.String() + string(q)
+}
+
+func (x *SeriesByTag) equal(y Expr) bool {
+	t, ok := y.(*SeriesByTag)
+	if !ok || t == nil || len(x.Filters) != len(t.Filters) {
+		return false
+	}
+	for i, f := range x.Filters {
+		g := t.Filters[i]
+		if f.Tag != g.Tag || f.Op != g.Op || f.Value != g.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *SeriesByTag) marshal(w io.Writer) {
+	fmt.Fprint(w, seriesByTagFun, "(")
+	for i, f := range x.Filters {
+		if i > 0 {
+			fmt.Fprint(w, ", ")
+		}
+		fmt.Fprint(w, f.quoted())
+	}
+	fmt.Fprint(w, ")")
+}
+
+// tagQuery converts a call to seriesByTag into a SeriesByTag.
+// If the call's arguments are not all tag expressions, tagQuery
+// returns nil.
+func tagQuery(f *Func) *SeriesByTag {
+	if f.Name != seriesByTagFun || len(f.Args) == 0 {
+		return nil
+	}
+	t := &SeriesByTag{Filters: make([]TagFilter, 0, len(f.Args))}
+	for _, arg := range f.Args {
+		v, ok := arg.(*Value)
+		if !ok {
+			return nil
+		}
+		s := string(*v)
+		if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] ||
+			strings.Contains(s, `\`) {
+			return nil
+		}
+		filter, err := ParseTagFilter(s[1 : len(s)-1])
+		if err != nil {
+			return nil
+		}
+		filter.quote = s[0]
+		t.Filters = append(t.Filters, filter)
+	}
+	return t
+}
+
+// convertTags replaces calls to seriesByTag in e with SeriesByTag
+// values, and returns the result.
+func convertTags(e Expr, depth int) Expr {
+	if depth > maxDepth {
+		return e
+	}
+	switch v := e.(type) {
+	case *Query:
+		v.Expr = convertTags(v.Expr, depth+1)
+	case *Func:
+		if t := tagQuery(v); t != nil {
+			return t
+		}
+		for i, arg := range v.Args {
+			v.Args[i] = convertTags(arg, depth+1)
+		}
+	}
+	return e
+}
+
+// TagQueries returns a slice of pointers to all calls to
+// seriesByTag in a query. Like Metrics, the values may be
+// mutated to affect the output of the Query's String method.
+func (q *Query) TagQueries() []*SeriesByTag {
+	var result []*SeriesByTag
+	q.walk(func(expr Expr) {
+		if t, ok := expr.(*SeriesByTag); ok {
+			result = append(result, t)
+		}
+	})
+	return result
+}
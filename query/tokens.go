@@ -0,0 +1,84 @@
+package query
+
+import "fmt"
+
+// A TokenKind identifies the kind of a Token.
+type TokenKind int
+
+// Kinds of tokens
+const (
+	TokenMetric TokenKind = iota // a metric name or pattern
+	TokenWord                    // a function name
+	TokenNumber                  // a number literal
+	TokenString                  // a quoted string literal, with its quotes
+	TokenLParen                  // (
+	TokenRParen                  // )
+	TokenComma                   // ,
+)
+
+var tokenNames = [...]string{
+	TokenMetric: "metric",
+	TokenWord:   "word",
+	TokenNumber: "number",
+	TokenString: "string",
+	TokenLParen: "'('",
+	TokenRParen: "')'",
+	TokenComma:  "','",
+}
+
+func (k TokenKind) String() string {
+	if k >= 0 && int(k) < len(tokenNames) {
+		return tokenNames[k]
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
+// A Token is a lexical element of a graphite target, such as
+// a metric name or a parenthesis. Pos is the byte offset of
+// Text in the input. Whitespace between tokens is not reported.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+}
+
+// Tokens splits input into tokens, as the parser does. It
+// does not check that the tokens form a valid query; use Parse
+// for that. If input contains an invalid token, Tokens returns
+// the tokens before it, and an error.
+func Tokens(input string) ([]Token, error) {
+	return TokensMode(input, 0)
+}
+
+// TokensMode is like Tokens, but changes its behavior according
+// to mode, as ParseMode does.
+func TokensMode(input string, mode Mode) ([]Token, error) {
+	var result []Token
+	l := lexMode(input, mode)
+	for {
+		it, off, ok := l.nextToken()
+		if !ok {
+			return result, nil
+		}
+		tok := Token{Text: it.val, Pos: off}
+		switch it.typ {
+		case pERROR:
+			return result, fmt.Errorf("%s at column %d", it.val, off)
+		case pMETRIC:
+			tok.Kind = TokenMetric
+		case pWORD:
+			tok.Kind = TokenWord
+		case pNUMBER:
+			tok.Kind = TokenNumber
+		case pSTRING:
+			tok.Kind = TokenString
+		case '(':
+			tok.Kind = TokenLParen
+		case ')':
+			tok.Kind = TokenRParen
+		case ',':
+			tok.Kind = TokenComma
+		}
+		result = append(result, tok)
+	}
+}
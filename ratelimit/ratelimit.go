@@ -0,0 +1,170 @@
+// Package ratelimit implements token bucket rate limiting.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// A Bucket is a token bucket. Tokens are added to the bucket at
+// a constant rate, up to a maximum. Each event removes a token
+// from the bucket; if the bucket is empty, the event should be
+// rejected or delayed. A Bucket is safe for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64 // maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full Bucket that refills at rate tokens
+// per second and holds at most burst tokens. If burst is less
+// than 1, it is set to 1.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Take removes a token from the bucket, if one is available. If
+// the bucket is empty, Take returns false and the time until the
+// next token becomes available.
+func (b *Bucket) Take() (ok bool, wait time.Duration) {
+	return b.take(time.Now())
+}
+
+func (b *Bucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := (1 - b.tokens) / b.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Wait removes a token from the bucket, waiting for one to become
+// available if the bucket is empty. Tokens are handed out in the
+// order Wait is called, so that waiting events are spaced evenly.
+// If ctx is done first, the token is returned to the bucket and
+// Wait returns ctx.Err().
+func (b *Bucket) Wait(ctx context.Context) error {
+	delay := b.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reserve removes a token from the bucket, which may leave it
+// in debt, and returns the time until the token is available.
+func (b *Bucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	if b.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) fill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// full returns true if the bucket would be full at time now.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill(now)
+	return b.tokens >= b.burst
+}
+
+// A Set is a collection of Buckets with identical parameters,
+// one per key, such as a client address. Buckets are created on
+// demand, and discarded once they have been refilled. A Set is
+// safe for concurrent use.
+type Set struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+	swept   time.Time
+}
+
+// NewSet creates a Set whose buckets are created with
+// NewBucket(rate, burst).
+func NewSet(rate float64, burst int) *Set {
+	return &Set{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+// Take removes a token from the bucket for key. See
+// Bucket.Take for the meaning of the return values.
+func (s *Set) Take(key string) (ok bool, wait time.Duration) {
+	now := time.Now()
+	return s.bucket(key, now).take(now)
+}
+
+func (s *Set) bucket(key string, now time.Time) *Bucket {
+	const sweepInterval = time.Minute
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A full bucket is indistinguishable from a new one, so
+	// it can be dropped to keep the set from growing forever.
+	if now.Sub(s.swept) > sweepInterval {
+		for k, b := range s.buckets {
+			if b.full(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = NewBucket(s.rate, s.burst)
+		s.buckets[key] = b
+	}
+	return b
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := NewBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(start); !ok {
+			t.Fatalf("take %d from full bucket failed", i)
+		}
+	}
+	ok, wait := b.take(start)
+	if ok {
+		t.Fatal("took token from empty bucket")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, expected 500ms", wait)
+	}
+	if ok, _ := b.take(start.Add(500 * time.Millisecond)); !ok {
+		t.Error("bucket not refilled after 500ms")
+	}
+	if !b.full(start.Add(time.Hour)) {
+		t.Error("bucket not full after an hour")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := NewBucket(10, 2)
+
+	want := []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond}
+	for i, w := range want {
+		if d := b.reserve(start); d != w {
+			t.Errorf("reservation %d: wait %v, expected %v", i, d, w)
+		}
+	}
+	if d := b.reserve(start.Add(time.Second)); d != 0 {
+		t.Errorf("wait %v after debt was repaid, expected 0", d)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := NewSet(1, 1)
+	if ok, _ := s.Take("a"); !ok {
+		t.Error("first take for a failed")
+	}
+	if ok, _ := s.Take("a"); ok {
+		t.Error("second take for a succeeded")
+	}
+	if ok, _ := s.Take("b"); !ok {
+		t.Error("take for b limited by a")
+	}
+}
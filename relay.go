@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/droyo/metaphite/config"
+	"github.com/droyo/metaphite/relay"
+)
+
+// runRelay relays metrics on the configured addresses, routing
+// them with the current config. It exits the process if the
+// relay cannot listen.
+func runRelay(cfg *config.Reloader) {
+	r := cfg.Config().Relay
+	srv := &relay.Server{
+		Router:        cfg,
+		BatchSize:     r.BatchSize,
+		FlushInterval: r.FlushInterval.Duration,
+		QueueSize:     r.QueueSize,
+		SpoolDir:      r.SpoolDir,
+		SpoolSize:     int64(r.SpoolSize) << 20,
+	}
+	if r.SpoolDir != "" {
+		if err := os.MkdirAll(r.SpoolDir, 0755); err != nil {
+			log.Fatalf("relay: %v", err)
+		}
+	}
+	if r.PickleAddress != "" {
+		go func() {
+			log.Fatalf("relay: %v", srv.ListenAndServePickle(r.PickleAddress))
+		}()
+	}
+	if r.Address != "" {
+		log.Fatalf("relay: %v", srv.ListenAndServe(r.Address))
+	}
+	select {}
+}
@@ -0,0 +1,481 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Messages longer than this are rejected, as carbon does.
+const maxPickleLength = 1 << 20
+
+// ServePickle accepts connections on l that use the carbon
+// pickle protocol, and relays the metrics in each message. A
+// message is a 4-byte, big-endian length, followed by a pickled
+// list of (name, (timestamp, value)) tuples, as sent by
+// carbon-relay and carbon-c-relay.
+func (s *Server) ServePickle(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.ReadPickles(conn); err != nil {
+				slog.Debug("relay connection", "remote", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+// ListenAndServePickle relays metrics received on the TCP port
+// at addr in the pickle protocol.
+func (s *Server) ListenAndServePickle(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.ServePickle(l)
+}
+
+// ReadPickles relays the metrics in each pickle message read
+// from r, until the end of its input. Messages that cannot be
+// decoded end the connection, as the stream cannot be trusted
+// after them.
+func (s *Server) ReadPickles(r io.Reader) error {
+	br := bufio.NewReader(r)
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxPickleLength {
+			relayLines.Inc("invalid")
+			return fmt.Errorf("pickle message of %d bytes is too long", n)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return err
+		}
+		v, err := unpickle(msg)
+		if err != nil {
+			relayLines.Inc("invalid")
+			return err
+		}
+		s.handlePickled(v)
+	}
+}
+
+func (s *Server) handlePickled(v interface{}) {
+	list, ok := v.([]interface{})
+	if !ok {
+		relayLines.Inc("invalid")
+		return
+	}
+	for _, item := range list {
+		name, ts, value, ok := pickledMetric(item)
+		if !ok {
+			relayLines.Inc("invalid")
+			continue
+		}
+		s.Handle(name, value, ts)
+	}
+}
+
+// pickledMetric unpacks a (name, (timestamp, value)) tuple.
+func pickledMetric(item interface{}) (name, ts, value string, ok bool) {
+	pair, ok := item.([]interface{})
+	if !ok || len(pair) != 2 {
+		return "", "", "", false
+	}
+	name, ok = pair[0].(string)
+	point, ok2 := pair[1].([]interface{})
+	if !ok || !ok2 || len(point) != 2 || name == "" {
+		return "", "", "", false
+	}
+	if ts, ok = pickledNumber(point[0]); !ok {
+		return "", "", "", false
+	}
+	if value, ok = pickledNumber(point[1]); !ok {
+		return "", "", "", false
+	}
+	return name, ts, value, true
+}
+
+func pickledNumber(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		// protocol 0 pickles of old clients
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+var errPickle = errors.New("invalid pickle")
+
+// mark is pushed on the stack by the MARK opcode.
+type mark struct{}
+
+// unpickle decodes the subset of the pickle format, protocols 0
+// to 5, that is needed for lists of tuples of strings and
+// numbers. Strings are returned as string, integers as int64,
+// floats as float64, and lists and tuples as []interface{}.
+// Other objects are rejected; in particular, nothing is ever
+// called or imported.
+func unpickle(data []byte) (interface{}, error) {
+	var (
+		stack []interface{}
+		memo  = make(map[int]interface{})
+		pos   int
+	)
+	next := func(n int) ([]byte, error) {
+		if n < 0 || pos+n > len(data) {
+			return nil, errPickle
+		}
+		b := data[pos : pos+n]
+		pos += n
+		return b, nil
+	}
+	line := func() (string, error) {
+		for i := pos; i < len(data); i++ {
+			if data[i] == '\n' {
+				s := string(data[pos:i])
+				pos = i + 1
+				return s, nil
+			}
+		}
+		return "", errPickle
+	}
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, errPickle
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	// popMark pops the items above the topmost mark
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(mark); ok {
+				items := append([]interface{}(nil), stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, errPickle
+	}
+	top := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, errPickle
+		}
+		return stack[len(stack)-1], nil
+	}
+	put := func(i int) error {
+		v, err := top()
+		memo[i] = v
+		return err
+	}
+	get := func(i int) error {
+		v, ok := memo[i]
+		if !ok {
+			return errPickle
+		}
+		stack = append(stack, v)
+		return nil
+	}
+	// appendTo adds items to the list below them on the stack
+	appendTo := func(items []interface{}) error {
+		if len(stack) == 0 {
+			return errPickle
+		}
+		list, ok := stack[len(stack)-1].(*[]interface{})
+		if !ok {
+			return errPickle
+		}
+		*list = append(*list, items...)
+		return nil
+	}
+
+	for {
+		op, err := next(1)
+		if err != nil {
+			return nil, err
+		}
+		switch op[0] {
+		case 0x80: // PROTO
+			_, err = next(1)
+		case 0x95: // FRAME
+			_, err = next(8)
+		case '.': // STOP
+			v, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			budget := len(data)
+			return resolveLists(v, 0, &budget)
+		case '(': // MARK
+			stack = append(stack, mark{})
+		case ']': // EMPTY_LIST
+			stack = append(stack, new([]interface{}))
+		case 'l': // LIST
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				stack = append(stack, &items)
+			}
+		case ')': // EMPTY_TUPLE
+			stack = append(stack, []interface{}{})
+		case 't': // TUPLE
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				stack = append(stack, items)
+			}
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op[0]-0x85) + 1
+			if len(stack) < n {
+				return nil, errPickle
+			}
+			items := append([]interface{}(nil), stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+		case 'a': // APPEND
+			var v interface{}
+			if v, err = pop(); err == nil {
+				err = appendTo([]interface{}{v})
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				err = appendTo(items)
+			}
+		case 'N': // NONE
+			stack = append(stack, nil)
+		case 0x88, 0x89: // NEWTRUE, NEWFALSE
+			stack = append(stack, op[0] == 0x88)
+		case 'K': // BININT1
+			var b []byte
+			if b, err = next(1); err == nil {
+				stack = append(stack, int64(b[0]))
+			}
+		case 'M': // BININT2
+			var b []byte
+			if b, err = next(2); err == nil {
+				stack = append(stack, int64(binary.LittleEndian.Uint16(b)))
+			}
+		case 'J': // BININT
+			var b []byte
+			if b, err = next(4); err == nil {
+				stack = append(stack, int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case 0x8a: // LONG1
+			var b []byte
+			if b, err = next(1); err == nil {
+				if b, err = next(int(b[0])); err == nil {
+					var v int64
+					if v, err = decodeLong(b); err == nil {
+						stack = append(stack, v)
+					}
+				}
+			}
+		case 'I', 'L': // INT, LONG
+			var s string
+			if s, err = line(); err == nil {
+				var v int64
+				if v, err = parsePickledInt(s); err == nil {
+					stack = append(stack, v)
+				}
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = next(8); err == nil {
+				stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case 'F': // FLOAT
+			var s string
+			if s, err = line(); err == nil {
+				var f float64
+				if f, err = strconv.ParseFloat(s, 64); err == nil {
+					stack = append(stack, f)
+				}
+			}
+		case 0x8c, 'U': // SHORT_BINUNICODE, SHORT_BINSTRING
+			var b []byte
+			if b, err = next(1); err == nil {
+				if b, err = next(int(b[0])); err == nil {
+					stack = append(stack, string(b))
+				}
+			}
+		case 'X', 'T': // BINUNICODE, BINSTRING
+			var b []byte
+			if b, err = next(4); err == nil {
+				if b, err = next(int(binary.LittleEndian.Uint32(b))); err == nil {
+					stack = append(stack, string(b))
+				}
+			}
+		case 'V': // UNICODE, raw-unicode-escaped; metric names are ASCII
+			var s string
+			if s, err = line(); err == nil {
+				stack = append(stack, s)
+			}
+		case 'S': // STRING, a quoted python literal
+			var s string
+			if s, err = line(); err == nil {
+				if s, err = strconv.Unquote(pythonQuote(s)); err == nil {
+					stack = append(stack, s)
+				}
+			}
+		case 'p': // PUT
+			var s string
+			if s, err = line(); err == nil {
+				var i int
+				if i, err = strconv.Atoi(s); err == nil {
+					err = put(i)
+				}
+			}
+		case 'q': // BINPUT
+			var b []byte
+			if b, err = next(1); err == nil {
+				err = put(int(b[0]))
+			}
+		case 'r': // LONG_BINPUT
+			var b []byte
+			if b, err = next(4); err == nil {
+				err = put(int(binary.LittleEndian.Uint32(b)))
+			}
+		case 0x94: // MEMOIZE
+			err = put(len(memo))
+		case 'g': // GET
+			var s string
+			if s, err = line(); err == nil {
+				var i int
+				if i, err = strconv.Atoi(s); err == nil {
+					err = get(i)
+				}
+			}
+		case 'h': // BINGET
+			var b []byte
+			if b, err = next(1); err == nil {
+				err = get(int(b[0]))
+			}
+		case 'j': // LONG_BINGET
+			var b []byte
+			if b, err = next(4); err == nil {
+				err = get(int(binary.LittleEndian.Uint32(b)))
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode %#x", op[0])
+		}
+		if err != nil {
+			return nil, errPickle
+		}
+	}
+}
+
+// resolveLists replaces the list pointers used while decoding,
+// so that lists can be appended to, with the lists themselves.
+// Deep nesting, which metrics never need, is rejected, as are
+// lists that contain themselves, and results with more items
+// than the pickle has bytes, which it can only have by
+// referring to the same list many times.
+func resolveLists(v interface{}, depth int, budget *int) (interface{}, error) {
+	if depth > 8 {
+		return nil, errPickle
+	}
+	switch v := v.(type) {
+	case *[]interface{}:
+		return resolveLists(*v, depth+1, budget)
+	case []interface{}:
+		if *budget -= len(v); *budget < 0 {
+			return nil, errPickle
+		}
+		list := make([]interface{}, len(v))
+		for i := range v {
+			var err error
+			if list[i], err = resolveLists(v[i], depth+1, budget); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return v, nil
+}
+
+// decodeLong decodes a little-endian two's complement integer.
+func decodeLong(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(b) > 8 {
+		return 0, errPickle
+	}
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		// sign-extend
+		v |= math.MaxUint64 << (8 * uint(len(b)))
+	}
+	return int64(v), nil
+}
+
+func parsePickledInt(s string) (int64, error) {
+	if len(s) > 0 && s[len(s)-1] == 'L' {
+		s = s[:len(s)-1]
+	}
+	switch s {
+	case "00":
+		return 0, nil
+	case "01":
+		return 1, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// pythonQuote converts a python string literal in single quotes
+// to a Go one.
+func pythonQuote(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		inner := s[1 : len(s)-1]
+		out := make([]byte, 0, len(inner)+2)
+		out = append(out, '"')
+		for i := 0; i < len(inner); i++ {
+			switch {
+			case inner[i] == '"':
+				out = append(out, '\\', '"')
+			case inner[i] == '\\' && i+1 < len(inner) && inner[i+1] == '\'':
+				out = append(out, '\'')
+				i++
+			default:
+				out = append(out, inner[i])
+			}
+		}
+		return string(append(out, '"'))
+	}
+	return s
+}
@@ -0,0 +1,326 @@
+// Package relay receives metrics in the carbon plaintext or
+// pickle protocols and forwards each one, in the plaintext
+// protocol, to the carbon server of the backend its name is
+// routed to.
+//
+// Plaintext lines have the form
+//
+// 	name value timestamp
+//
+// Lines are batched per destination, and sent over a TCP
+// connection that is reopened when it fails. While a destination
+// is unreachable, lines are queued for it, up to a limit, and
+// then dropped, unless they can be spooled to disk. Spooled lines
+// are sent once the queue is empty again.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/droyo/metaphite/metrics"
+)
+
+var (
+	relayLines = metrics.NewCounter("metaphite_relay_lines_total",
+		"Metric lines received by the relay, by outcome.", "result")
+	relayErrors = metrics.NewCounter("metaphite_relay_errors_total",
+		"Failed connections and writes to carbon servers, by destination.", "destination")
+)
+
+// A Router decides where a metric is sent. It returns the
+// host:port of the destination's carbon listener and the name
+// to send the metric under, or false if the metric cannot be
+// routed.
+type Router interface {
+	CarbonRoute(name string) (addr, newName string, ok bool)
+}
+
+// Defaults for the zero values of Server's settings.
+const (
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = time.Second
+	DefaultQueueSize     = 100000
+)
+
+// A Server relays the metrics it receives.
+type Server struct {
+	Router Router
+	// Most lines to send to a destination in one write.
+	BatchSize int
+	// Lines are sent at least this often.
+	FlushInterval time.Duration
+	// Most lines to queue for each destination.
+	QueueSize int
+	// If set, lines that do not fit in a destination's queue are
+	// appended to a file for the destination in this directory,
+	// of up to SpoolSize bytes, and sent later. Spool files left
+	// by a previous run are sent too.
+	SpoolDir  string
+	SpoolSize int64
+
+	mu      sync.Mutex
+	dests   map[string]*forwarder
+	spooled sync.Once // started forwarders for SpoolDir
+}
+
+// ListenAndServe relays metrics received on the TCP and UDP
+// port at addr. It returns when either listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- s.Serve(l) }()
+	go func() { errc <- s.ServePacket(pc) }()
+	err = <-errc
+	l.Close()
+	pc.Close()
+	return err
+}
+
+// Serve accepts connections on l and relays the lines sent over
+// them.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	if err := s.ReadLines(conn); err != nil {
+		slog.Debug("relay connection", "remote", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// ReadLines relays each line read from r, until the end of
+// its input.
+func (s *Server) ReadLines(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		s.HandleLine(sc.Bytes())
+	}
+	return sc.Err()
+}
+
+// ServePacket relays the lines in each datagram read from pc.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				s.HandleLine(line)
+			}
+		}
+	}
+}
+
+// HandleLine relays a single line.
+func (s *Server) HandleLine(line []byte) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		relayLines.Inc("invalid")
+		return
+	}
+	value, ts := string(fields[1]), string(fields[2])
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		relayLines.Inc("invalid")
+		return
+	}
+	if _, err := strconv.ParseFloat(ts, 64); err != nil {
+		relayLines.Inc("invalid")
+		return
+	}
+	s.Handle(string(fields[0]), value, ts)
+}
+
+// Handle relays one metric, whose value and timestamp have
+// been validated.
+func (s *Server) Handle(name, value, timestamp string) {
+	s.spooled.Do(func() {
+		if s.SpoolDir != "" {
+			for _, addr := range spooledDestinations(s.SpoolDir) {
+				s.forwarder(addr)
+			}
+		}
+	})
+	addr, name, ok := s.Router.CarbonRoute(name)
+	if !ok {
+		relayLines.Inc("unrouted")
+		return
+	}
+	relayLines.Inc(s.forwarder(addr).send(name + " " + value + " " + timestamp + "\n"))
+}
+
+func (s *Server) forwarder(addr string) *forwarder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dests == nil {
+		s.dests = make(map[string]*forwarder)
+	}
+	if f, ok := s.dests[addr]; ok {
+		return f
+	}
+	f := &forwarder{
+		addr:     addr,
+		batch:    s.BatchSize,
+		interval: s.FlushInterval,
+		queue:    make(chan string, orDefault(s.QueueSize, DefaultQueueSize)),
+	}
+	if f.batch <= 0 {
+		f.batch = DefaultBatchSize
+	}
+	if f.interval <= 0 {
+		f.interval = DefaultFlushInterval
+	}
+	if s.SpoolDir != "" {
+		size := s.SpoolSize
+		if size <= 0 {
+			size = DefaultSpoolSize
+		}
+		var err error
+		if f.spool, err = openSpool(spoolPath(s.SpoolDir, addr), size); err != nil {
+			slog.Warn("relay spool", "destination", addr, "err", err)
+		}
+	}
+	s.dests[addr] = f
+	go f.run()
+	return f
+}
+
+func orDefault(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
+// A forwarder sends the lines for one destination.
+type forwarder struct {
+	addr     string
+	batch    int
+	interval time.Duration
+	queue    chan string
+	spool    *spool // nil if lines are not spooled
+
+	conn    net.Conn
+	backoff time.Duration
+}
+
+// send queues line, or spools it if the queue is full. It returns
+// what became of it.
+func (f *forwarder) send(line string) string {
+	select {
+	case f.queue <- line:
+		return "queued"
+	default:
+	}
+	if f.spool != nil && f.spool.add(line) {
+		return "spooled"
+	}
+	return "dropped"
+}
+
+func (f *forwarder) run() {
+	var buf bytes.Buffer
+	var n int
+	tick := time.NewTicker(f.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case line := <-f.queue:
+			buf.WriteString(line)
+			n++
+			if n < f.batch {
+				continue
+			}
+		case <-tick.C:
+			if n == 0 {
+				f.replay()
+				continue
+			}
+		}
+		// keep the batch until it is written
+		for !f.write(buf.Bytes()) {
+			time.Sleep(f.backoff)
+		}
+		buf.Reset()
+		n = 0
+	}
+}
+
+// replay sends the spooled lines, a batch at a time, until there
+// are none left, a write fails, or lines are queued.
+func (f *forwarder) replay() {
+	if f.spool == nil {
+		return
+	}
+	for len(f.queue) == 0 {
+		p, lines := f.spool.next(f.batch)
+		if lines == 0 || !f.write(p) {
+			return
+		}
+		f.spool.done(len(p))
+		relayLines.Add(float64(lines), "replayed")
+	}
+}
+
+// write writes p to the destination, connecting first if need
+// be. After a failure, backoff is how long to wait before trying
+// again.
+func (f *forwarder) write(p []byte) bool {
+	if f.conn == nil {
+		conn, err := net.DialTimeout("tcp", f.addr, 10*time.Second)
+		if err != nil {
+			f.fail(err)
+			return false
+		}
+		f.conn = conn
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := f.conn.Write(p); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		f.fail(err)
+		return false
+	}
+	f.backoff = 0
+	return true
+}
+
+const maxBackoff = 30 * time.Second
+
+func (f *forwarder) fail(err error) {
+	relayErrors.Inc(f.addr)
+	if f.backoff == 0 {
+		slog.Warn("relay to carbon failed", "destination", f.addr, "err", err)
+		f.backoff = 100 * time.Millisecond
+	} else if f.backoff *= 2; f.backoff > maxBackoff {
+		f.backoff = maxBackoff
+	}
+}
@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type prefixRouter map[string]string
+
+func (p prefixRouter) CarbonRoute(name string) (string, string, bool) {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	addr, ok := p[name[:i]]
+	return addr, name[i+1:], ok
+}
+
+func TestRelay(t *testing.T) {
+	carbon, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carbon.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := carbon.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			received <- sc.Text()
+		}
+	}()
+
+	s := &Server{
+		Router:        prefixRouter{"prod": carbon.Addr().String()},
+		FlushInterval: 10 * time.Millisecond,
+	}
+	s.ReadLines(strings.NewReader(
+		"prod.cpu.load 0.5 1700000000\n" +
+			"dev.cpu.load 1 1700000000\n" +
+			"prod.cpu.load not-a-number 1700000000\n" +
+			"garbage\n" +
+			"prod.mem.free 1024 1700000010\n"))
+
+	want := []string{"cpu.load 0.5 1700000000", "mem.free 1024 1700000010"}
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Errorf("got %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", w)
+		}
+	}
+	select {
+	case got := <-received:
+		t.Errorf("unexpected line %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Made by python's pickle.dumps with each protocol, of
+// [('prod.cpu.load', (1700000000, 0.5)), ('dev.x', (1700000001, 2)), ('prod.mem', (1700000002.5, -3))]
+var pickles = map[string]string{
+	"protocol 0": "286c70300a285670726f642e6370752e6c6f61640a70310a2849313730303030303030300a46302e350a7470320a7470330a6128566465762e780a70340a2849313730303030303030310a49320a7470350a7470360a61285670726f642e6d656d0a70370a2846313730303030303030322e350a492d330a7470380a7470390a612e",
+	"protocol 1": "5d71002828580d00000070726f642e6370752e6c6f61647101284a00f15365473fe00000000000007471027471032858050000006465762e787104284a01f153654b0274710574710628580800000070726f642e6d656d7107284741d954fc40a000004afdffffff747108747109652e",
+	"protocol 2": "80025d710028580d00000070726f642e6370752e6c6f616471014a00f15365473fe000000000000086710286710358050000006465762e7871044a01f153654b02867105867106580800000070726f642e6d656d71074741d954fc40a000004afdffffff867108867109652e",
+	"protocol 4": "80049557000000000000005d94288c0d70726f642e6370752e6c6f6164944a00f15365473fe0000000000000869486948c056465762e78944a01f153654b02869486948c0870726f642e6d656d944741d954fc40a000004afdffffff86948694652e",
+}
+
+type recorder struct{ lines []string }
+
+func (r *recorder) CarbonRoute(name string) (string, string, bool) {
+	r.lines = append(r.lines, name)
+	return "", "", false
+}
+
+func TestPickle(t *testing.T) {
+	for proto, h := range pickles {
+		data, err := hex.DecodeString(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := unpickle(data)
+		if err != nil {
+			t.Errorf("%s: %v", proto, err)
+			continue
+		}
+		var got []string
+		for _, item := range v.([]interface{}) {
+			name, ts, value, ok := pickledMetric(item)
+			if !ok {
+				t.Errorf("%s: cannot unpack %v", proto, item)
+			}
+			got = append(got, name+" "+value+" "+ts)
+		}
+		want := []string{
+			"prod.cpu.load 0.5 1700000000",
+			"dev.x 2 1700000001",
+			"prod.mem -3 1700000002.5",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", proto, got, want)
+		}
+	}
+}
+
+func TestReadPickles(t *testing.T) {
+	var msgs bytes.Buffer
+	for _, proto := range []string{"protocol 2", "protocol 4"} {
+		data, _ := hex.DecodeString(pickles[proto])
+		binary.Write(&msgs, binary.BigEndian, uint32(len(data)))
+		msgs.Write(data)
+	}
+	var r recorder
+	s := &Server{Router: &r}
+	if err := s.ReadPickles(&msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.lines) != 6 {
+		t.Errorf("routed %q, want 6 metrics", r.lines)
+	}
+}
+
+func TestUnpickleInvalid(t *testing.T) {
+	for _, h := range []string{
+		"",
+		"80025d",                         // no STOP
+		"8002652e",                       // APPENDS without a list
+		"80025d71006871006168710061612e", // list in itself
+		"8002635f5f6275696c74696e5f5f0a6576616c0a710058010000003171018571025271032e", // GLOBAL eval
+	} {
+		data, _ := hex.DecodeString(h)
+		if v, err := unpickle(data); err == nil {
+			t.Errorf("unpickle(%s) = %v, want an error", h, v)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	// a port with nothing listening yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dir := t.TempDir()
+	s := &Server{
+		Router:        prefixRouter{"prod": addr},
+		FlushInterval: 10 * time.Millisecond,
+		QueueSize:     1,
+		SpoolDir:      dir,
+	}
+	var want []string
+	for i := 0; i < 20; i++ {
+		line := "cpu.load " + strconv.Itoa(i) + " 1700000000"
+		want = append(want, line)
+		s.HandleLine([]byte("prod." + line))
+	}
+	if info, err := os.Stat(spoolPath(dir, addr)); err != nil || info.Size() == 0 {
+		t.Fatalf("nothing spooled while %s is down: %v", addr, err)
+	}
+
+	carbon, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	defer carbon.Close()
+	received := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := carbon.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					received <- sc.Text()
+				}
+			}()
+		}
+	}()
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case line := <-received:
+			got = append(got, line)
+		case <-timeout:
+			t.Fatalf("received %d of %d lines", len(got), len(want))
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// a spool left by a previous run is sent when the relay starts
+	dir = t.TempDir()
+	if err := os.WriteFile(spoolPath(dir, addr), []byte("mem.free 1 1700000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = &Server{Router: prefixRouter{}, FlushInterval: 10 * time.Millisecond, SpoolDir: dir}
+	s.HandleLine([]byte("unrouted.x 1 1700000000"))
+	select {
+	case line := <-received:
+		if line != "mem.free 1 1700000000" {
+			t.Errorf("replayed %q", line)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("spool of previous run not sent")
+	}
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"bytes"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Default for the zero value of Server's SpoolSize.
+const DefaultSpoolSize = 100 << 20
+
+// Most bytes read from a spool file at once.
+const spoolChunk = 1 << 20
+
+const spoolExt = ".spool"
+
+// A spool keeps the lines for a destination in a file while its
+// queue is full. Lines are appended to the end of the file, and
+// read from an offset; once all have been read, the file is
+// emptied.
+type spool struct {
+	path string
+	max  int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64 // of the file
+	off  int64 // of the first line not yet sent
+}
+
+// spoolPath returns the path of the spool file for the
+// destination addr in dir.
+func spoolPath(dir, addr string) string {
+	return filepath.Join(dir, url.PathEscape(addr)+spoolExt)
+}
+
+// spooledDestinations returns the destinations with spool files
+// in dir.
+func spooledDestinations(dir string) []string {
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	var addrs []string
+	for _, name := range names {
+		addr, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(name), spoolExt))
+		if err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// openSpool opens the spool file at path, whose lines, if it
+// has any, are sent first.
+func openSpool(path string, max int64) (*spool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spool{path: path, max: max, f: f, size: info.Size()}, nil
+}
+
+// add appends line to the spool. It returns false if the spool is
+// full, or cannot be written.
+func (s *spool) add(line string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size-s.off+int64(len(line)) > s.max {
+		return false
+	}
+	n, err := s.f.WriteAt([]byte(line), s.size)
+	s.size += int64(n)
+	if err != nil {
+		slog.Warn("relay spool", "file", s.path, "err", err)
+		return false
+	}
+	return true
+}
+
+// next returns up to max lines from the start of the spool, and
+// the number of lines. They stay in the spool until they are
+// removed with done.
+func (s *spool) next(max int) ([]byte, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.off < s.size {
+		size := s.size - s.off
+		if size > spoolChunk {
+			size = spoolChunk
+		}
+		buf := make([]byte, size)
+		n, err := s.f.ReadAt(buf, s.off)
+		if n < len(buf) {
+			slog.Warn("relay spool", "file", s.path, "err", err)
+			s.reset()
+			return nil, 0
+		}
+		var lines, end int
+		for end < len(buf) && lines < max {
+			i := bytes.IndexByte(buf[end:], '\n')
+			if i < 0 {
+				break
+			}
+			end += i + 1
+			lines++
+		}
+		if lines > 0 {
+			return buf[:end], lines
+		}
+		// a line too long to be a metric
+		if s.off += size; s.off >= s.size {
+			s.reset()
+		}
+	}
+	return nil, 0
+}
+
+// done removes the first n bytes from the spool, which were
+// returned by next.
+func (s *spool) done(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.off += int64(n); s.off >= s.size {
+		s.reset()
+	}
+}
+
+// reset empties the spool.
+func (s *spool) reset() {
+	if err := s.f.Truncate(0); err != nil {
+		slog.Warn("relay spool", "file", s.path, "err", err)
+	}
+	s.size, s.off = 0, 0
+}
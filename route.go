@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/droyo/metaphite/config"
+)
+
+// routeTargets implements the route subcommand, which shows how
+// a render request would be routed, without sending it.
+func routeTargets(args []string) {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	file := fs.String("c", "", "configuration file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: metaphite route -c config.json 'target=...&from=-1d' | target ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *file == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfg, err := config.ParseFile(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *file, err)
+		os.Exit(1)
+	}
+
+	// Arguments are either render parameters in query string
+	// form, or bare targets.
+	form := make(url.Values)
+	for _, arg := range fs.Args() {
+		if !strings.HasPrefix(arg, "target=") {
+			form.Add("target", arg)
+			continue
+		}
+		v, err := url.ParseQuery(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%q: %s\n", arg, err)
+			os.Exit(2)
+		}
+		for k, list := range v {
+			form[k] = append(form[k], list...)
+		}
+	}
+
+	routes, evaluated, err := cfg.Routes(form)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if evaluated {
+		fmt.Println("targets span several backends; metaphite evaluates them from these parts:")
+		fmt.Println()
+	}
+	for i, r := range routes {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("target:   %s\n", r.Target)
+		for _, rw := range r.Rewrites {
+			fmt.Printf("rewrite:  %s\n", rw)
+		}
+		if r.Backend == "" {
+			fmt.Println("backend:  none")
+			continue
+		}
+		fmt.Printf("backend:  %s\n", r.Backend)
+		for _, u := range r.URLs {
+			fmt.Printf("url:      %s\n", u)
+		}
+		fmt.Printf("upstream: %s\n", r.Upstream)
+	}
+}
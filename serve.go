@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/droyo/metaphite/config"
+	"github.com/droyo/metaphite/metrics"
+)
+
+// newMux returns a handler for the endpoints served on l.
+func newMux(cfg *config.Reloader, l config.Listener, access accessLog) *http.ServeMux {
+	mux := http.NewServeMux()
+	if l.Serves(config.EndpointRender) {
+		mux.Handle("/render", access.wrap("/render", cfg))
+		mux.Handle("/tags/autoComplete/", access.wrap("/tags/autoComplete/", cfg.AutoComplete()))
+	}
+	if l.Serves(config.EndpointAdmin) {
+		mux.Handle("/admin/", access.wrap("/admin/", cfg.RestrictAccess(cfg.Admin())))
+	}
+	if l.Serves(config.EndpointMetrics) {
+		mux.Handle("/debug/metrics", cfg.RestrictAccess(cfg.RequireAuth(metrics.Handler())))
+	}
+	if l.Serves(config.EndpointDebug) {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	if l.Serves(config.EndpointHealth) {
+		mux.Handle("/readyz", cfg.Readiness())
+		live := func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok\n")
+		}
+		mux.HandleFunc("/livez", live)
+		mux.HandleFunc("/healthz", live)
+	}
+	return mux
+}
+
+// serve serves requests on each of the listeners until one of
+// them fails, or the process receives a SIGTERM or SIGINT, and
+// then stops the others. After a signal, requests in flight are
+// given the config's DrainTimeout to finish; a second signal
+// ends the process at once.
+func serve(cfg *config.Reloader, listeners []config.Listener, access accessLog) error {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	var servers []*http.Server
+	status := make(chan error, len(listeners))
+	for _, l := range listeners {
+		ln, err := l.Listen()
+		if err != nil {
+			shutdown(servers, drainTimeout(cfg))
+			return err
+		}
+		srv := cfg.Config().Server(cfg.ServeEnabled(newMux(cfg, l, access)))
+		if l.TLS {
+			srv.TLSConfig = cfg.ServerTLSConfig()
+		}
+		servers = append(servers, srv)
+		go func(srv *http.Server, ln net.Listener) {
+			if srv.TLSConfig != nil {
+				status <- srv.ServeTLS(ln, "", "")
+			} else {
+				status <- srv.Serve(ln)
+			}
+		}(srv, ln)
+		slog.Info("listening", "address", l.Address)
+	}
+	select {
+	case err := <-status:
+		shutdown(servers, drainTimeout(cfg))
+		return err
+	case sig := <-stop:
+		go func() {
+			<-stop
+			log.Fatal("exiting without waiting for requests")
+		}()
+		drain := drainTimeout(cfg)
+		slog.Info("draining requests", "signal", sig.String(), "timeout", drain.String())
+		if !shutdown(servers, drain) {
+			return fmt.Errorf("requests still running after %s", drain)
+		}
+		return nil
+	}
+}
+
+// shutdown stops servers from accepting connections, and waits
+// for the requests in flight to finish, up to the given time.
+// Any connections left are then closed, and false returned.
+func shutdown(servers []*http.Server, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			if errs[i] = srv.Shutdown(ctx); errs[i] != nil {
+				srv.Close()
+			}
+		}(i, srv)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+const defaultDrainTimeout = 20 * time.Second
+
+func drainTimeout(cfg *config.Reloader) time.Duration {
+	if d := cfg.Config().DrainTimeout.Duration; d > 0 {
+		return d
+	}
+	return defaultDrainTimeout
+}
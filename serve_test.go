@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	entered, release := make(chan bool), make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer srv.Close()
+
+	type result struct {
+		body string
+		err  error
+	}
+	get := func() chan result {
+		ch := make(chan result, 1)
+		go func() {
+			rsp, err := http.Get(srv.URL)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			defer rsp.Body.Close()
+			body, err := ioutil.ReadAll(rsp.Body)
+			ch <- result{string(body), err}
+		}()
+		<-entered
+		return ch
+	}
+
+	// a request in flight is allowed to finish
+	inflight := get()
+	drained := make(chan bool)
+	go func() { drained <- shutdown([]*http.Server{srv.Config}, time.Minute) }()
+	select {
+	case <-drained:
+		t.Fatal("shutdown returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Error("new connection accepted while draining")
+	}
+	close(release)
+	if r := <-inflight; r.err != nil || r.body != "done" {
+		t.Errorf("request in flight: got %q, %v", r.body, r.err)
+	}
+	if !<-drained {
+		t.Error("shutdown reported requests left after they finished")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	entered, release := make(chan bool), make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	failed := make(chan error, 1)
+	go func() {
+		rsp, err := http.Get(srv.URL)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-entered
+	start := time.Now()
+	if shutdown([]*http.Server{srv.Config}, 50*time.Millisecond) {
+		t.Error("shutdown reported success with a request still running")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("shutdown took %s, expected about 50ms", d)
+	}
+	if err := <-failed; err == nil {
+		t.Error("connection of unfinished request not closed")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"log/syslog"
+
+	"github.com/droyo/metaphite/accesslog"
+)
+
+// syslogLogger returns a Logger that sends access log entries
+// to the local syslog daemon.
+func syslogLogger() (accesslog.Logger, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "metaphite")
+	if err != nil {
+		return nil, err
+	}
+	return log.New(w, "", 0), nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+
+	"github.com/droyo/metaphite/accesslog"
+)
+
+func syslogLogger() (accesslog.Logger, error) {
+	return nil, errors.New("syslog is not supported on this system")
+}
@@ -0,0 +1,220 @@
+// Package timespec parses the time expressions accepted by the
+// from and until parameters of graphite's render API.
+//
+// An expression is a reference time, optionally followed by an
+// offset. The reference may be "now" or empty, epoch seconds, a
+// time of day such as "noon", "16:00" or "4pm", a day such as
+// "today", "yesterday", "20240131", "01/31/24", "jan31" or
+// "monday", or a time of day followed by a day, as in
+// "noon yesterday" or "16:00_20240131". A reference time with
+// no time of day is midnight. The offset is a sign followed by
+// one or more amounts with units, such as "-1h" or "+1d12h".
+// Spaces, commas and underscores are ignored, and case does not
+// matter.
+package timespec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	months   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// Parse parses a time expression. Relative times are relative to
+// now, and times without an explicit zone are in now's location.
+func Parse(s string, now time.Time) (time.Time, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.NewReplacer(" ", "", ",", "", "_", "").Replace(s)
+	if isEpoch(s) {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad time %q", s)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	ref, offset := s, ""
+	if i := strings.IndexAny(s, "+-"); i >= 0 {
+		ref, offset = s[:i], s[i:]
+	}
+	t, err := reference(ref, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return addOffset(t, offset)
+}
+
+// isEpoch reports whether s is a number of seconds since the
+// epoch. As in graphite, eight digits that look like a date are
+// a date.
+func isEpoch(s string) bool {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return false
+	}
+	if len(s) != 8 {
+		return true
+	}
+	month, _ := strconv.Atoi(s[4:6])
+	day, _ := strconv.Atoi(s[6:])
+	return s[:4] <= "1900" || month > 12 || day > 31
+}
+
+func reference(ref string, now time.Time) (time.Time, error) {
+	if ref == "" || ref == "now" {
+		return now, nil
+	}
+	orig := ref
+	bad := func() (time.Time, error) {
+		return time.Time{}, fmt.Errorf("unknown time reference %q", orig)
+	}
+
+	// time of day
+	var hour, min int
+	if i := strings.IndexByte(ref, ':'); i > 0 && i < 3 && len(ref) >= i+3 {
+		h, err1 := strconv.Atoi(ref[:i])
+		m, err2 := strconv.Atoi(ref[i+1 : i+3])
+		if err1 != nil || err2 != nil || h > 23 || m > 59 {
+			return bad()
+		}
+		hour, min, ref = h, m, ref[i+3:]
+		if strings.HasPrefix(ref, "am") {
+			ref = ref[2:]
+		} else if strings.HasPrefix(ref, "pm") {
+			hour, ref = (hour+12)%24, ref[2:]
+		}
+	}
+	for _, suffix := range []string{"am", "pm"} {
+		if i := strings.Index(ref, suffix); i > 0 && i < 3 {
+			h, err := strconv.Atoi(ref[:i])
+			if err != nil || h > 12 {
+				return bad()
+			}
+			if suffix == "pm" {
+				h = (h + 12) % 24
+			}
+			hour, ref = h, ref[i+2:]
+		}
+	}
+	switch {
+	case strings.HasPrefix(ref, "noon"):
+		hour, min, ref = 12, 0, ref[len("noon"):]
+	case strings.HasPrefix(ref, "midnight"):
+		hour, min, ref = 0, 0, ref[len("midnight"):]
+	case strings.HasPrefix(ref, "teatime"):
+		hour, min, ref = 16, 0, ref[len("teatime"):]
+	}
+	year, month, day := now.Date()
+	t := time.Date(year, month, day, hour, min, 0, 0, now.Location())
+
+	// day
+	switch {
+	case ref == "" || ref == "today":
+		return t, nil
+	case ref == "yesterday":
+		return t.AddDate(0, 0, -1), nil
+	case ref == "tomorrow":
+		return t.AddDate(0, 0, 1), nil
+	case strings.Count(ref, "/") == 2:
+		f := strings.Split(ref, "/")
+		m, err1 := strconv.Atoi(f[0])
+		d, err2 := strconv.Atoi(f[1])
+		y, err3 := strconv.Atoi(f[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return bad()
+		}
+		if y < 1900 {
+			y += 1900
+		}
+		if y < 1970 {
+			y += 100
+		}
+		return onDay(t, y, m, d)
+	case len(ref) == 8 && strings.Trim(ref, "0123456789") == "":
+		y, _ := strconv.Atoi(ref[:4])
+		m, _ := strconv.Atoi(ref[4:6])
+		d, _ := strconv.Atoi(ref[6:])
+		return onDay(t, y, m, d)
+	case len(ref) >= 3 && index(months, ref[:3]) >= 0:
+		digits := strings.TrimLeft(ref, "abcdefghijklmnopqrstuvwxyz")
+		d, err := strconv.Atoi(digits)
+		if err != nil || len(digits) > 2 {
+			return bad()
+		}
+		return onDay(t, t.Year(), index(months, ref[:3])+1, d)
+	case len(ref) >= 3 && index(weekdays, ref[:3]) >= 0:
+		ago := int(t.Weekday()) - index(weekdays, ref[:3])
+		if ago < 0 {
+			ago += 7
+		}
+		return t.AddDate(0, 0, -ago), nil
+	}
+	return bad()
+}
+
+// onDay moves t to another day, keeping its time of day.
+func onDay(t time.Time, year, month, day int) (time.Time, error) {
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, fmt.Errorf("bad date %d/%d/%d", month, day, year)
+	}
+	return time.Date(year, time.Month(month), day, t.Hour(), t.Minute(), 0, 0, t.Location()), nil
+}
+
+func index(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// addOffset adds an offset such as "-1d12h" to t.
+func addOffset(t time.Time, s string) (time.Time, error) {
+	if s == "" {
+		return t, nil
+	}
+	orig := s
+	sign := 1
+	switch s[0] {
+	case '-':
+		sign, s = -1, s[1:]
+	case '+':
+		s = s[1:]
+	}
+	if s == "" {
+		return time.Time{}, fmt.Errorf("bad time offset %q", orig)
+	}
+	for s != "" {
+		rest := strings.TrimLeft(s, "0123456789")
+		n, err := strconv.Atoi(s[:len(s)-len(rest)])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad time offset %q", orig)
+		}
+		s = strings.TrimLeft(rest, "abcdefghijklmnopqrstuvwxyz")
+		unit := rest[:len(rest)-len(s)]
+		n *= sign
+		switch {
+		case unit == "s" || strings.HasPrefix(unit, "sec"):
+			t = t.Add(time.Duration(n) * time.Second)
+		case unit == "min" || strings.HasPrefix(unit, "minute"):
+			t = t.Add(time.Duration(n) * time.Minute)
+		case unit == "h" || strings.HasPrefix(unit, "hour"):
+			t = t.Add(time.Duration(n) * time.Hour)
+		case unit == "d" || strings.HasPrefix(unit, "day"):
+			t = t.AddDate(0, 0, n)
+		case unit == "w" || strings.HasPrefix(unit, "week"):
+			t = t.AddDate(0, 0, 7*n)
+		case unit == "mon" || strings.HasPrefix(unit, "month"):
+			t = t.AddDate(0, n, 0)
+		case unit == "y" || strings.HasPrefix(unit, "year"):
+			t = t.AddDate(n, 0, 0)
+		default:
+			return time.Time{}, fmt.Errorf("bad time unit in %q", orig)
+		}
+	}
+	return t, nil
+}
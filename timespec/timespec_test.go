@@ -0,0 +1,50 @@
+package timespec
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2024, 1, 31, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		in  string
+		out time.Time
+	}{
+		{"", now},
+		{"now", now},
+		{"-1h", now.Add(-time.Hour)},
+		{"now-7d", now.AddDate(0, 0, -7)},
+		{"+1d12h", now.Add(36 * time.Hour)},
+		{"-2weeks", now.AddDate(0, 0, -14)},
+		{"-1mon", now.AddDate(0, -1, 0)},
+		{"1706659200", time.Unix(1706659200, 0)},
+		{"today", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"noon yesterday", time.Date(2024, 1, 30, 12, 0, 0, 0, time.UTC)},
+		{"midnight tomorrow", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"teatime", time.Date(2024, 1, 31, 16, 0, 0, 0, time.UTC)},
+		{"4pm", time.Date(2024, 1, 31, 16, 0, 0, 0, time.UTC)},
+		{"16:20_20240115", time.Date(2024, 1, 15, 16, 20, 0, 0, time.UTC)},
+		{"8:15pm 20240115", time.Date(2024, 1, 15, 20, 15, 0, 0, time.UTC)},
+		{"20231225", time.Date(2023, 12, 25, 0, 0, 0, 0, time.UTC)},
+		{"12/25/23", time.Date(2023, 12, 25, 0, 0, 0, 0, time.UTC)},
+		{"January 8", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{"monday", time.Date(2024, 1, 29, 0, 0, 0, 0, time.UTC)},
+		{"wednesday", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"noon yesterday-1h", time.Date(2024, 1, 30, 11, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		out, err := Parse(tt.in, now)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+		} else if !out.Equal(tt.out) {
+			t.Errorf("Parse(%q) = %v, expected %v", tt.in, out, tt.out)
+		}
+	}
+	for _, in := range []string{"-", "-1fortnight", "soon", "13/45/20", "25:00", "jan"} {
+		if out, err := Parse(in, now); err == nil {
+			t.Errorf("Parse(%q) = %v, expected an error", in, out)
+		}
+	}
+}
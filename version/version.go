@@ -0,0 +1,72 @@
+// Package version describes the build of metaphite that is
+// running. The version, commit and build date are set with
+// linker flags:
+//
+// 	go build -ldflags "\
+// 		-X github.com/droyo/metaphite/version.Version=v1.4.0 \
+// 		-X github.com/droyo/metaphite/version.Commit=$(git rev-parse HEAD) \
+// 		-X github.com/droyo/metaphite/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// If they are not set, the commit and date recorded by the go
+// command, if any, are used instead.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time.
+var (
+	Version = "devel"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes a build.
+type Info struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+// Get returns the Info for the running program.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// String formats info on one line, such as
+//
+// 	metaphite v1.4.0 (commit 5c3c75d, built 2024-05-01T12:00:00Z, go1.22.2)
+func (info Info) String() string {
+	s := "metaphite " + info.Version + " ("
+	if info.Commit != "" {
+		commit := info.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += "commit " + commit + ", "
+	}
+	if info.Date != "" {
+		s += "built " + info.Date + ", "
+	}
+	return fmt.Sprintf("%s%s)", s, info.GoVersion)
+}
@@ -0,0 +1,29 @@
+package version
+
+import "testing"
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		info Info
+		want string
+	}{
+		{Info{Version: "devel", GoVersion: "go1.22.2"}, "metaphite devel (go1.22.2)"},
+		{
+			Info{"v1.4.0", "5c3c75d0a1b2c3d4e5f6", "2024-05-01T12:00:00Z", "go1.22.2"},
+			"metaphite v1.4.0 (commit 5c3c75d0a1b2, built 2024-05-01T12:00:00Z, go1.22.2)",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	Commit = "abc123"
+	defer func() { Commit = "" }()
+	if info := Get(); info.Commit != "abc123" || info.Version != Version {
+		t.Errorf("Get() = %+v", info)
+	}
+}
@@ -0,0 +1,255 @@
+package whisper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/droyo/metaphite/eval"
+	"github.com/droyo/metaphite/query"
+	"github.com/droyo/metaphite/timespec"
+)
+
+const ext = ".wsp"
+
+// A Store is a directory tree of whisper files, laid out as carbon
+// writes them: the metric a.b.c is in the file a/b/c.wsp.
+//
+// A Store answers graphite's /render requests for metric names and
+// patterns, in the json and csv formats, and /metrics/find
+// requests, in the treejson format. It does not evaluate render
+// functions, and has no tags.
+type Store struct {
+	Dir string
+}
+
+// A Node is a metric in a Store, or a directory of them.
+type Node struct {
+	Path string // the metric name, or the name of the directory
+	Leaf bool   // a metric
+}
+
+// Find returns the nodes in s matched by pattern, sorted by path.
+func (s Store) Find(pattern query.Metric) []Node {
+	seen := make(map[Node]bool)
+	for _, pat := range pattern.Expand() {
+		s.find(s.Dir, "", pat.Segments(), seen)
+	}
+	nodes := make([]Node, 0, len(seen))
+	for n := range seen {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Path != nodes[j].Path {
+			return nodes[i].Path < nodes[j].Path
+		}
+		return nodes[i].Leaf
+	})
+	return nodes
+}
+
+// find adds the nodes under dir, whose metric names start with
+// prefix, that are matched by segs.
+func (s Store) find(dir, prefix string, segs []string, seen map[Node]bool) {
+	seg := segs[0]
+	if seg == "" || seg == "." || seg == ".." || strings.Contains(seg, "/") {
+		return
+	}
+	var names []string
+	if query.Metric(seg).HasGlob() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			name := strings.TrimSuffix(e.Name(), ext)
+			if ok, _ := path.Match(seg, name); ok && !strings.HasPrefix(name, ".") {
+				names = append(names, e.Name())
+			}
+		}
+	} else {
+		names = []string{seg, seg + ext}
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		metric := prefix + strings.TrimSuffix(name, ext)
+		switch {
+		case info.IsDir() && len(segs) > 1:
+			s.find(filepath.Join(dir, name), metric+".", segs[1:], seen)
+		case info.IsDir():
+			seen[Node{Path: metric}] = true
+		case len(segs) == 1 && strings.HasSuffix(name, ext):
+			seen[Node{Path: metric, Leaf: true}] = true
+		}
+	}
+}
+
+// file returns the path of the whisper file for metric.
+func (s Store) file(metric string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(strings.Replace(metric, ".", "/", -1))+ext)
+}
+
+// ServeHTTP answers a graphite API request with the metrics in s.
+func (s Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, time.Now())
+}
+
+func (s Store) serve(w http.ResponseWriter, r *http.Request, now time.Time) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.URL.Path == "/render":
+		s.render(w, r, now)
+	case r.URL.Path == "/metrics/find":
+		s.serveFind(w, r)
+	case strings.HasPrefix(r.URL.Path, "/tags/autoComplete/"):
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, "[]")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s Store) render(w http.ResponseWriter, r *http.Request, now time.Time) {
+	loc := time.Local
+	if tz := r.Form.Get("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			http.Error(w, "invalid tz "+tz, http.StatusBadRequest)
+			return
+		}
+		loc = l
+	}
+	from, err := parseTime(r.Form.Get("from"), "-24h", now.In(loc))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTime(r.Form.Get("until"), "now", now.In(loc))
+	if err != nil {
+		http.Error(w, "invalid until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.Form.Get("format")
+	if format != "json" && format != "csv" {
+		http.Error(w, "unsupported format "+strconv.Quote(format), http.StatusBadRequest)
+		return
+	}
+
+	result := []eval.Series{}
+	for _, target := range r.Form["target"] {
+		q, err := query.Parse(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m, ok := q.Expr.(*query.Metric)
+		if !ok {
+			http.Error(w, "cannot evaluate "+strconv.Quote(target)+": only metric names are supported", http.StatusBadRequest)
+			return
+		}
+		for _, n := range s.Find(*m) {
+			if !n.Leaf {
+				continue
+			}
+			series, err := s.fetch(n.Path, from, until, now.Unix())
+			if err != nil {
+				slog.Warn("whisper", "metric", n.Path, "err", err)
+				continue
+			}
+			result = append(result, series)
+		}
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		for _, series := range result {
+			for _, p := range series.Datapoints {
+				v := ""
+				if p.Value != nil {
+					v = strconv.FormatFloat(*p.Value, 'f', -1, 64)
+				}
+				ts := time.Unix(p.Time, 0).In(loc).Format("2006-01-02 15:04:05")
+				fmt.Fprintf(w, "%s,%s,%s\n", series.Target, ts, v)
+			}
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func parseTime(s, def string, now time.Time) (int64, error) {
+	if s == "" {
+		s = def
+	}
+	t, err := timespec.Parse(s, now)
+	return t.Unix(), err
+}
+
+// fetch reads the datapoints of metric between from and until.
+func (s Store) fetch(metric string, from, until, now int64) (eval.Series, error) {
+	series := eval.Series{Target: metric, Datapoints: []eval.Point{}}
+	f, err := Open(s.file(metric))
+	if err != nil {
+		return series, err
+	}
+	defer f.Close()
+	data, err := f.fetch(from, until, now)
+	if err == errFuture {
+		return series, nil
+	} else if err != nil {
+		return series, err
+	}
+	for i, v := range data.Values {
+		series.Datapoints = append(series.Datapoints, eval.Point{Value: v, Time: data.Start + int64(i)*data.Step})
+	}
+	return series, nil
+}
+
+// A treeNode is a node in graphite's treejson format.
+type treeNode struct {
+	AllowChildren int               `json:"allowChildren"`
+	Expandable    int               `json:"expandable"`
+	Leaf          int               `json:"leaf"`
+	ID            string            `json:"id"`
+	Text          string            `json:"text"`
+	Context       map[string]string `json:"context"`
+}
+
+func (s Store) serveFind(w http.ResponseWriter, r *http.Request) {
+	pattern := r.Form.Get("query")
+	if pattern == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	if f := r.Form.Get("format"); f != "" && f != "treejson" {
+		http.Error(w, "unsupported format "+strconv.Quote(f), http.StatusBadRequest)
+		return
+	}
+	nodes := []treeNode{}
+	for _, n := range s.Find(query.Metric(pattern)) {
+		t := treeNode{ID: n.Path, Text: n.Path[strings.LastIndex(n.Path, ".")+1:], Context: map[string]string{}}
+		if n.Leaf {
+			t.Leaf = 1
+		} else {
+			t.AllowChildren, t.Expandable = 1, 1
+		}
+		nodes = append(nodes, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
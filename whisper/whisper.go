@@ -0,0 +1,184 @@
+// Package whisper reads the whisper files written by carbon, and
+// serves the metrics in a directory of them over graphite's render
+// API, so that a small deployment needs no graphite-web.
+package whisper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Sizes of the parts of a whisper file.
+const (
+	metadataSize    = 16
+	archiveInfoSize = 12
+	pointSize       = 12
+)
+
+// An Archive is one of the resolutions at which a whisper file
+// keeps a metric: a ring of Points datapoints, one every
+// SecondsPerPoint.
+type Archive struct {
+	Offset          uint32 // of the first point, in the file
+	SecondsPerPoint uint32
+	Points          uint32
+}
+
+// Retention is how far back the archive goes, in seconds.
+func (a Archive) Retention() int64 {
+	return int64(a.SecondsPerPoint) * int64(a.Points)
+}
+
+// A File is an open whisper file. Its archives are ordered from
+// the highest resolution to the lowest.
+type File struct {
+	f            *os.File
+	MaxRetention int64
+	Archives     []Archive
+}
+
+// Open opens the whisper file at path for reading, and reads its
+// header.
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &File{f: f}
+	if err := w.readHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return w, nil
+}
+
+func (w *File) readHeader() error {
+	var meta [metadataSize]byte
+	if _, err := io.ReadFull(w.f, meta[:]); err != nil {
+		return err
+	}
+	w.MaxRetention = int64(binary.BigEndian.Uint32(meta[4:]))
+	count := binary.BigEndian.Uint32(meta[12:])
+	if count == 0 || count > 64 {
+		return fmt.Errorf("invalid number of archives %d", count)
+	}
+	info := make([]byte, archiveInfoSize*count)
+	if _, err := io.ReadFull(w.f, info); err != nil {
+		return err
+	}
+	for i := 0; i < int(count); i++ {
+		b := info[i*archiveInfoSize:]
+		a := Archive{
+			Offset:          binary.BigEndian.Uint32(b),
+			SecondsPerPoint: binary.BigEndian.Uint32(b[4:]),
+			Points:          binary.BigEndian.Uint32(b[8:]),
+		}
+		if a.SecondsPerPoint == 0 || a.Points == 0 {
+			return fmt.Errorf("invalid archive %d", i)
+		}
+		w.Archives = append(w.Archives, a)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (w *File) Close() error {
+	return w.f.Close()
+}
+
+// A Series is the datapoints fetched from a whisper file: one
+// every Step seconds, starting at Start. Missing datapoints are
+// nil.
+type Series struct {
+	Start, Step int64
+	Values      []*float64
+}
+
+// Fetch reads the datapoints between from and until, in epoch
+// seconds, from the highest resolution archive that goes back as
+// far as from, as carbon does. If the file goes back less far than
+// from, the datapoints start as early as they can.
+func (w *File) Fetch(from, until int64) (Series, error) {
+	return w.fetch(from, until, time.Now().Unix())
+}
+
+var errFuture = errors.New("whisper: from is in the future")
+
+func (w *File) fetch(from, until, now int64) (Series, error) {
+	if from > now {
+		return Series{}, errFuture
+	}
+	if from > until {
+		return Series{}, fmt.Errorf("whisper: from %d is after until %d", from, until)
+	}
+	if oldest := now - w.MaxRetention; from < oldest {
+		from = oldest
+	}
+	if until > now || until < from {
+		until = now
+	}
+	a := w.Archives[len(w.Archives)-1]
+	for _, arc := range w.Archives {
+		if arc.Retention() >= now-from {
+			a = arc
+			break
+		}
+	}
+	step := int64(a.SecondsPerPoint)
+	fromInterval := from - from%step + step
+	untilInterval := until - until%step + step
+	if fromInterval == untilInterval {
+		untilInterval += step
+	}
+	s := Series{Start: fromInterval, Step: step, Values: make([]*float64, (untilInterval-fromInterval)/step)}
+
+	points, err := w.read(a, fromInterval, len(s.Values))
+	if err != nil || points == nil {
+		return s, err
+	}
+	for i := 0; i < len(points)/pointSize; i++ {
+		p := points[i*pointSize:]
+		interval := int64(binary.BigEndian.Uint32(p))
+		if interval == fromInterval+int64(i)*step {
+			v := math.Float64frombits(binary.BigEndian.Uint64(p[4:]))
+			s.Values[i] = &v
+		}
+	}
+	return s, nil
+}
+
+// read returns n points of a, starting at the slot for the time
+// interval, wrapping around the end of the archive. The points
+// are nil if the archive is empty.
+func (w *File) read(a Archive, interval int64, n int) ([]byte, error) {
+	var first [pointSize]byte
+	if _, err := w.f.ReadAt(first[:], int64(a.Offset)); err != nil {
+		return nil, err
+	}
+	base := int64(binary.BigEndian.Uint32(first[:]))
+	if base == 0 {
+		return nil, nil
+	}
+	slots := int64(a.Points)
+	if int64(n) > slots {
+		n = int(slots)
+	}
+	slot := ((interval-base)/int64(a.SecondsPerPoint)%slots + slots) % slots
+	buf := make([]byte, n*pointSize)
+	head := buf
+	if end := slot + int64(n); end > slots {
+		head = buf[:(slots-slot)*pointSize]
+		if _, err := w.f.ReadAt(buf[len(head):], int64(a.Offset)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := w.f.ReadAt(head, int64(a.Offset)+slot*pointSize); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
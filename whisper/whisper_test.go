@@ -0,0 +1,168 @@
+package whisper
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/droyo/metaphite/query"
+)
+
+// An archive is the resolution and points of an archive to
+// write to a whisper file.
+type archive struct {
+	secondsPerPoint, points uint32
+	data                    [][2]float64 // [interval, value], in the order written
+}
+
+// writeFile writes a whisper file with archives. Each point is
+// stored in the slot carbon would use, overwriting older ones.
+func writeFile(t *testing.T, path string, archives ...archive) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var maxRetention uint32
+	for _, a := range archives {
+		if r := a.secondsPerPoint * a.points; r > maxRetention {
+			maxRetention = r
+		}
+	}
+	header := make([]byte, metadataSize+archiveInfoSize*len(archives))
+	binary.BigEndian.PutUint32(header[0:], 1) // average
+	binary.BigEndian.PutUint32(header[4:], maxRetention)
+	binary.BigEndian.PutUint32(header[8:], math.Float32bits(0.5))
+	binary.BigEndian.PutUint32(header[12:], uint32(len(archives)))
+	offset := uint32(len(header))
+	var data []byte
+	for i, a := range archives {
+		info := header[metadataSize+i*archiveInfoSize:]
+		binary.BigEndian.PutUint32(info, offset)
+		binary.BigEndian.PutUint32(info[4:], a.secondsPerPoint)
+		binary.BigEndian.PutUint32(info[8:], a.points)
+		offset += a.points * pointSize
+
+		slots := make([]byte, a.points*pointSize)
+		var base int64
+		for _, p := range a.data {
+			interval := int64(p[0])
+			if base == 0 {
+				base = interval
+			}
+			n := int64(a.points)
+			slot := ((interval-base)/int64(a.secondsPerPoint)%n + n) % n
+			b := slots[slot*pointSize:]
+			binary.BigEndian.PutUint32(b, uint32(interval))
+			binary.BigEndian.PutUint64(b[4:], math.Float64bits(p[1]))
+		}
+		data = append(data, slots...)
+	}
+	if err := os.WriteFile(path, append(header, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func values(s Series) []interface{} {
+	var list []interface{}
+	for _, v := range s.Values {
+		if v == nil {
+			list = append(list, nil)
+		} else {
+			list = append(list, *v)
+		}
+	}
+	return list
+}
+
+func TestFetch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.wsp")
+	writeFile(t, path,
+		archive{10, 5, [][2]float64{{960, 1}, {970, 2}, {990, 4}, {1000, 5}, {1010, 6}, {1020, 7}}},
+		archive{60, 10, [][2]float64{{600, 100}, {660, 110}, {720, 120}}},
+	)
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.MaxRetention != 600 || len(f.Archives) != 2 {
+		t.Fatalf("header: retention %d, archives %v", f.MaxRetention, f.Archives)
+	}
+
+	tests := []struct {
+		from, until int64
+		start, step int64
+		values      []interface{}
+	}{
+		// the 10s archive, which has wrapped around
+		{985, 1025, 990, 10, []interface{}{4.0, 5.0, 6.0, 7.0}},
+		// a slot that was never written is missing
+		{975, 995, 980, 10, []interface{}{nil, 4.0}},
+		// the 60s archive, as the 10s one does not go back far enough
+		{590, 780, 600, 60, []interface{}{100.0, 110.0, 120.0, nil}},
+	}
+	for _, tt := range tests {
+		s, err := f.fetch(tt.from, tt.until, 1025)
+		if err != nil {
+			t.Errorf("fetch %d-%d: %v", tt.from, tt.until, err)
+			continue
+		}
+		if s.Start != tt.start || s.Step != tt.step || !reflect.DeepEqual(values(s), tt.values) {
+			t.Errorf("fetch %d-%d: got %d+%d %v, expected %d+%d %v",
+				tt.from, tt.until, s.Start, s.Step, values(s), tt.start, tt.step, tt.values)
+		}
+	}
+	if _, err := f.fetch(2000, 3000, 1025); err != errFuture {
+		t.Errorf("fetch from the future: %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "cpu", "load.wsp"), archive{60, 1440, [][2]float64{{60, 1}, {120, 2}}})
+	writeFile(t, filepath.Join(dir, "cpu", "user.wsp"), archive{60, 1440, [][2]float64{{60, 3}}})
+	writeFile(t, filepath.Join(dir, "mem", "total.wsp"), archive{60, 1440, nil})
+	os.MkdirAll(filepath.Join(dir, "disk", "sda"), 0755)
+	s := Store{Dir: dir}
+
+	find := func(pattern string) []Node { return s.Find(query.Metric(pattern)) }
+	if got, want := find("cpu.*"), []Node{{"cpu.load", true}, {"cpu.user", true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find cpu.*: %v", got)
+	}
+	if got, want := find("*"), []Node{{"cpu", false}, {"disk", false}, {"mem", false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find *: %v", got)
+	}
+	if got, want := find("{mem,disk}.*"), []Node{{"disk.sda", false}, {"mem.total", true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find {mem,disk}.*: %v", got)
+	}
+	if got := find("..cpu.load"); len(got) != 0 {
+		t.Errorf("find ..cpu.load: %v", got)
+	}
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.serve(rec, httptest.NewRequest("GET", path, nil), time.Unix(200, 0))
+		return rec.Code, rec.Body.String()
+	}
+	code, body := get("/render?format=json&target=cpu.l*&from=60&until=180")
+	if want := `[{"target":"cpu.load","datapoints":[[2,120],[null,180]]}]` + "\n"; code != 200 || body != want {
+		t.Errorf("render: %d %s", code, body)
+	}
+	code, body = get("/render?format=csv&target=cpu.user&from=0&until=60&tz=UTC")
+	if want := "cpu.user,1970-01-01 00:01:00,3\n"; code != 200 || body != want {
+		t.Errorf("render csv: %d %q", code, body)
+	}
+	code, body = get("/render?format=json&target=sumSeries(cpu.*)")
+	if code != 400 || !strings.Contains(body, "only metric names") {
+		t.Errorf("render function: %d %s", code, body)
+	}
+	code, body = get("/metrics/find?query=cpu.*")
+	if !strings.Contains(body, `"id":"cpu.load","text":"load"`) {
+		t.Errorf("find: %d %s", code, body)
+	}
+}